@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/binary"
 	"flag"
 
@@ -15,26 +16,18 @@ func init() {
 	flag.IntVar(&mod, "mod", 1, "passes messages that are multiples of mod")
 }
 
+func filter(ctx context.Context, data []byte) ([][]byte, error) {
+	number := binary.BigEndian.Uint32(data)
+	if int(number)%mod != 0 {
+		return nil, nil
+	}
+	return [][]byte{data}, nil
+}
+
 func main() {
 	flag.Parse()
 
-	for {
-		data, err := actionlib.ReadMessage()
-		if err != nil {
-			actionlib.WriteError(err)
-			continue
-		}
-
-		number := binary.BigEndian.Uint32(data)
-		if int(number)%mod != 0 {
-			actionlib.AckMessage()
-			continue
-		}
-
-		if err := actionlib.WriteMessage(data); err != nil {
-			actionlib.WriteError(err)
-			continue
-		}
+	if err := actionlib.Run(context.Background(), actionlib.HandlerFunc(filter)); err != nil {
+		actionlib.WriteFatal(err)
 	}
-
 }
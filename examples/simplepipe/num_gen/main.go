@@ -1,9 +1,9 @@
 package main
 
 import (
+	"context"
 	"encoding/binary"
 	"flag"
-	"fmt"
 	"time"
 
 	"github.com/GDVFox/gostreaming/lib/go-actionlib"
@@ -20,15 +20,24 @@ func init() {
 func main() {
 	flag.Parse()
 
-	for i := 1; ; i++ {
+	ticker := time.NewTicker(time.Duration(int64(time.Millisecond) * freq))
+	defer ticker.Stop()
+
+	i := uint32(0)
+	emitter := actionlib.EmitterFunc(func(ctx context.Context) ([][]byte, error) {
+		i++
 		data := make([]byte, 4)
-		binary.BigEndian.PutUint32(data, uint32(i))
+		binary.BigEndian.PutUint32(data, i)
 
-		if err := actionlib.WriteMessage(data); err != nil {
-			actionlib.WriteError(fmt.Errorf("write size error: %w", err))
-			continue
+		select {
+		case <-ctx.Done():
+			return nil, nil
+		case <-ticker.C:
+			return [][]byte{data}, nil
 		}
+	})
 
-		time.Sleep(time.Duration(int64(time.Millisecond) * freq))
+	if err := actionlib.RunSource(context.Background(), emitter); err != nil {
+		actionlib.WriteFatal(err)
 	}
 }
@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"time"
 
 	"github.com/GDVFox/gostreaming/examples/stocks/util"
 	"github.com/GDVFox/gostreaming/lib/go-actionlib"
@@ -37,6 +38,9 @@ func main() {
 		actionlib.WriteFatal(err)
 	}
 
+	insertLatency := actionlib.NewHistogram("insert_latency_seconds")
+	insertErrors := actionlib.NewCounter("insert_errors")
+
 	for {
 		stockBin, err := actionlib.ReadMessage()
 		if err != nil {
@@ -52,8 +56,12 @@ func main() {
 		}
 
 		ticker := stocksFIGI[stock.FIGI].Ticker
-		if err := insertPriceChange(db, stock, ticker); err != nil {
+		insertStart := time.Now()
+		err = insertPriceChange(db, stock, ticker)
+		insertLatency.Observe(time.Since(insertStart).Seconds())
+		if err != nil {
 			actionlib.WriteError(err)
+			insertErrors.Inc()
 
 			actionlib.AckMessage()
 			continue
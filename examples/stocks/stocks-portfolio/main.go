@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 
 	"github.com/GDVFox/gostreaming/examples/stocks/util"
 
@@ -24,6 +25,17 @@ func main() {
 
 	client := sdk.NewSandboxRestClient(conf.TCSToken)
 	positions := newPositions(client)
+
+	// Состояние включается в описании узла, без него позиции хранятся только в памяти.
+	state, err := actionlib.OpenState()
+	if err != nil && !errors.Is(err, actionlib.ErrStateDisabled) {
+		actionlib.WriteFatal(err)
+	}
+	if state != nil {
+		if err := positions.load(state); err != nil {
+			actionlib.WriteFatal(err)
+		}
+	}
 	currency, err := newCurrencyWatcher(conf.TCSToken)
 	if err != nil {
 		actionlib.WriteFatal(err)
@@ -43,6 +55,14 @@ func main() {
 			continue
 		}
 
+		// Позиции сохраняются при обработке сообщения, поэтому будут зафиксированы
+		// вместе с его подтверждением.
+		if state != nil {
+			if err := positions.save(state); err != nil {
+				actionlib.WriteError(err)
+			}
+		}
+
 		stock := &util.StockMessage{}
 		if err := json.Unmarshal(stockBin, stock); err != nil {
 			actionlib.WriteError(err)
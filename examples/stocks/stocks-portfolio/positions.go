@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"sync"
 	"time"
 
@@ -14,8 +16,15 @@ type positions struct {
 
 	posMutex sync.RWMutex
 	pos      map[string]sdk.PositionBalance
+	// version увеличивается при каждом обновлении позиций.
+	version uint64
+	// savedVersion версия, сохраненная в состоянии.
+	savedVersion uint64
 }
 
+// positionsKey ключ, по которому позиции хранятся в состоянии.
+var positionsKey = []byte("positions")
+
 func newPositions(client *sdk.SandboxRestClient) *positions {
 	return &positions{
 		client: client,
@@ -40,6 +49,7 @@ func (p *positions) updateLoop() {
 
 		p.posMutex.Lock()
 		p.pos = postions
+		p.version++
 		p.posMutex.Unlock()
 	}
 }
@@ -51,3 +61,47 @@ func (p *positions) getPosition(figi string) (sdk.PositionBalance, bool) {
 	position, ok := p.pos[figi]
 	return position, ok
 }
+
+// load загружает позиции, сохраненные до перезапуска действия,
+// чтобы не пропускать сообщения до первого обновления.
+func (p *positions) load(state *actionlib.State) error {
+	data, err := state.Get(positionsKey)
+	if errors.Is(err, actionlib.ErrStateKeyNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	pos := make(map[string]sdk.PositionBalance)
+	if err := json.Unmarshal(data, &pos); err != nil {
+		return err
+	}
+
+	p.posMutex.Lock()
+	defer p.posMutex.Unlock()
+
+	p.pos = pos
+	return nil
+}
+
+// save сохраняет позиции в состояние, если они изменились.
+func (p *positions) save(state *actionlib.State) error {
+	p.posMutex.RLock()
+	if p.version == p.savedVersion {
+		p.posMutex.RUnlock()
+		return nil
+	}
+	version := p.version
+	data, err := json.Marshal(p.pos)
+	p.posMutex.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	if err := state.Put(positionsKey, data); err != nil {
+		return err
+	}
+	p.savedVersion = version
+	return nil
+}
@@ -17,6 +17,7 @@ require (
 require (
 	github.com/GDVFox/ctxio v0.0.0-20210518102935-c4e9c3452111
 	github.com/TinkoffCreditSystems/invest-openapi-go-sdk v0.6.1
+	github.com/coreos/go-iptables v0.6.0
 	github.com/goccy/go-graphviz v0.0.9
 	github.com/gorilla/websocket v1.5.0
 	github.com/jmoiron/sqlx v1.3.5
@@ -32,7 +33,6 @@ require (
 	atomicgo.dev/cursor v0.1.1 // indirect
 	atomicgo.dev/keyboard v0.2.8 // indirect
 	github.com/containerd/console v1.0.3 // indirect
-	github.com/coreos/go-iptables v0.6.0 // indirect
 	github.com/coreos/go-semver v0.3.0 // indirect
 	github.com/coreos/go-systemd/v22 v22.3.2 // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
@@ -20,6 +20,8 @@ func HandleHelp() {
 		{"", "rm", "Removes specified scheme"},
 		{"", "run", "Runs specified scheme using saved description"},
 		{"", "stop", "Stops specified scheme"},
+		{"", "dead-letters", "Returns messages rejected by nodes of specified scheme"},
+		{"", "replay", "Sends rejected message to its node again or drops it"},
 		{"actions", "", "Managing a list of actions"},
 		{"", "list", "Returns list of available actions"},
 		{"", "get", "Returns binary file of specified action"},
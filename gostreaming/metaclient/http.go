@@ -13,6 +13,7 @@ import (
 	"github.com/GDVFox/gostreaming/meta_node/api/schemas"
 	"github.com/GDVFox/gostreaming/meta_node/planner"
 	"github.com/GDVFox/gostreaming/util/httplib"
+	"github.com/GDVFox/gostreaming/util/message"
 )
 
 var (
@@ -23,6 +24,9 @@ var (
 	deleteSchemePath = "/v1/schemas/"
 	runSchemePath    = "/v1/schemas/%s/run"
 	stopSchemePath   = "/v1/schemas/%s/stop"
+	deadLettersPath  = "/v1/schemas/%s/dead_letters"
+	deadLetterPath   = "/v1/schemas/%s/dead_letters/%s"
+	replayLetterPath = "/v1/schemas/%s/dead_letters/%s/replay"
 	actionsListPath  = "/v1/actions"
 	getActionPath    = "/v1/actions/"
 	createActionPath = "/v1/actions"
@@ -137,6 +141,58 @@ func (c *MetaNodeClient) StopScheme(schemeName string) error {
 	return c.put(metaURL.String())
 }
 
+// GetDeadLetters возвращает очередь недоставленных сообщений схемы.
+func (c *MetaNodeClient) GetDeadLetters(schemeName string) (*schemas.DeadLetterList, error) {
+	metaURL := url.URL{
+		Scheme: metaScheme,
+		Host:   c.cfg.Address,
+		Path:   fmt.Sprintf(deadLettersPath, schemeName),
+	}
+
+	letters := &schemas.DeadLetterList{}
+	if err := c.get(metaURL.String(), letters); err != nil {
+		return nil, err
+	}
+	return letters, nil
+}
+
+// GetDeadLetter возвращает недоставленное сообщение схемы.
+func (c *MetaNodeClient) GetDeadLetter(schemeName, id string) (*message.DeadLetter, error) {
+	metaURL := url.URL{
+		Scheme: metaScheme,
+		Host:   c.cfg.Address,
+		Path:   fmt.Sprintf(deadLetterPath, schemeName, id),
+	}
+
+	letter := &message.DeadLetter{}
+	if err := c.get(metaURL.String(), letter); err != nil {
+		return nil, err
+	}
+	return letter, nil
+}
+
+// ReplayDeadLetter повторно передает недоставленное сообщение узлу схемы.
+func (c *MetaNodeClient) ReplayDeadLetter(schemeName, id string) error {
+	metaURL := url.URL{
+		Scheme: metaScheme,
+		Host:   c.cfg.Address,
+		Path:   fmt.Sprintf(replayLetterPath, schemeName, id),
+	}
+
+	return c.put(metaURL.String())
+}
+
+// DeleteDeadLetter удаляет недоставленное сообщение схемы.
+func (c *MetaNodeClient) DeleteDeadLetter(schemeName, id string) error {
+	metaURL := url.URL{
+		Scheme: metaScheme,
+		Host:   c.cfg.Address,
+		Path:   fmt.Sprintf(deadLetterPath, schemeName, id),
+	}
+
+	return c.delete(metaURL.String())
+}
+
 // GetActionsList возвращает список загруженных действий.
 func (c *MetaNodeClient) GetActionsList() (*actions.ActionList, error) {
 	metaURL := url.URL{
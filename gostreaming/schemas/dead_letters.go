@@ -0,0 +1,109 @@
+package schemas
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/GDVFox/gostreaming/gostreaming/metaclient"
+	"github.com/pterm/pterm"
+	flag "github.com/spf13/pflag"
+)
+
+// LettersCommandHelper получение недоставленных сообщений схемы.
+type LettersCommandHelper struct {
+	fs *flag.FlagSet
+
+	help bool
+	name string
+	id   string
+}
+
+// NewLettersCommandHelper создает новый LettersCommandHelper
+func NewLettersCommandHelper() *LettersCommandHelper {
+	c := &LettersCommandHelper{
+		fs: flag.NewFlagSet("dead-letters", flag.ContinueOnError),
+	}
+
+	c.fs.StringVarP(&c.name, "name", "n", "", "Name of the scheme")
+	c.fs.StringVarP(&c.id, "id", "i", "", "ID of the message to print with data, by default all messages are listed")
+	c.fs.BoolVarP(&c.help, "help", "h", false, "Prints help message")
+
+	return c
+}
+
+// PrintHelp печатает сообщение с помощью по команде
+func (c *LettersCommandHelper) PrintHelp() {
+	pterm.DefaultBasicText.Printfln("Command 'gostreaming %s schemas dead-letters' returns messages rejected by nodes of specified scheme.", metaclient.MetaNodeAddress)
+	pterm.Println()
+	pterm.DefaultBasicText.Println("Flags:")
+	c.fs.PrintDefaults()
+}
+
+// Init инициализирует состояние команды.
+func (c *LettersCommandHelper) Init(args []string) error {
+	if err := c.fs.Parse(args); err != nil {
+		return err
+	}
+	if c.help {
+		return nil
+	}
+
+	if c.name == "" {
+		return errors.New("name can not be empty")
+	}
+	return nil
+}
+
+// Run запускает команду
+func (c *LettersCommandHelper) Run() {
+	if c.help {
+		c.PrintHelp()
+		return
+	}
+
+	if c.id != "" {
+		c.printLetter()
+		return
+	}
+
+	loadSpinner, _ := pterm.DefaultSpinner.Start("Loading dead letters...")
+	letters, err := metaclient.MetaNode.GetDeadLetters(c.name)
+	if err != nil {
+		loadSpinner.Fail("Can not load dead letters: ", err)
+		return
+	}
+	loadSpinner.Success("Dead letters loaded:")
+	pterm.Println()
+
+	tableData := pterm.TableData{{"ID", "NODE", "CRASHES", "CREATED", "REASON"}}
+	for _, letter := range letters.DeadLetters {
+		crashes := "-"
+		if letter.Crashes > 0 {
+			crashes = pterm.Sprint(letter.Crashes)
+		}
+		tableData = append(tableData, []string{
+			letter.ID, letter.ActionName, crashes, letter.CreatedAt.Format("2006-01-02 15:04:05"), letter.Reason,
+		})
+	}
+	if err := pterm.DefaultTable.WithHasHeader().WithData(tableData).Render(); err != nil {
+		pterm.Error.Printfln("Can not render dead letters: %s", err)
+	}
+}
+
+func (c *LettersCommandHelper) printLetter() {
+	loadSpinner, _ := pterm.DefaultSpinner.Start("Loading dead letter...")
+	letter, err := metaclient.MetaNode.GetDeadLetter(c.name, c.id)
+	if err != nil {
+		loadSpinner.Fail("Can not load dead letter: ", err)
+		return
+	}
+	loadSpinner.Success("Dead letter loaded!")
+
+	letterData, err := json.MarshalIndent(letter, "", "\t")
+	if err != nil {
+		pterm.Error.Printfln("Can not marshal dead letter: %s", err)
+		return
+	}
+	pterm.Println()
+	pterm.DefaultBasicText.Println(string(letterData))
+}
@@ -0,0 +1,85 @@
+package schemas
+
+import (
+	"errors"
+
+	"github.com/GDVFox/gostreaming/gostreaming/metaclient"
+	"github.com/pterm/pterm"
+	flag "github.com/spf13/pflag"
+)
+
+// ReplayCommandHelper повторная передача недоставленного сообщения.
+type ReplayCommandHelper struct {
+	fs *flag.FlagSet
+
+	help bool
+	name string
+	id   string
+	drop bool
+}
+
+// NewReplayCommandHelper создает новый ReplayCommandHelper
+func NewReplayCommandHelper() *ReplayCommandHelper {
+	c := &ReplayCommandHelper{
+		fs: flag.NewFlagSet("replay", flag.ContinueOnError),
+	}
+
+	c.fs.StringVarP(&c.name, "name", "n", "", "Name of the scheme")
+	c.fs.StringVarP(&c.id, "id", "i", "", "ID of the message to replay")
+	c.fs.BoolVarP(&c.drop, "drop", "d", false, "Removes message from dead letters without replay")
+	c.fs.BoolVarP(&c.help, "help", "h", false, "Prints help message")
+
+	return c
+}
+
+// PrintHelp печатает сообщение с помощью по команде
+func (c *ReplayCommandHelper) PrintHelp() {
+	pterm.DefaultBasicText.Printfln("Command 'gostreaming %s schemas replay' sends rejected message to the node of running scheme again.", metaclient.MetaNodeAddress)
+	pterm.DefaultBasicText.Println("Message is removed from dead letters after replay.")
+	pterm.Println()
+	pterm.DefaultBasicText.Println("Flags:")
+	c.fs.PrintDefaults()
+}
+
+// Init инициализирует состояние команды.
+func (c *ReplayCommandHelper) Init(args []string) error {
+	if err := c.fs.Parse(args); err != nil {
+		return err
+	}
+	if c.help {
+		return nil
+	}
+
+	if c.name == "" {
+		return errors.New("name can not be empty")
+	}
+	if c.id == "" {
+		return errors.New("id can not be empty")
+	}
+	return nil
+}
+
+// Run запускает команду
+func (c *ReplayCommandHelper) Run() {
+	if c.help {
+		c.PrintHelp()
+		return
+	}
+
+	if c.drop {
+		loadSpinner, _ := pterm.DefaultSpinner.Start("Removing dead letter...")
+		if err := metaclient.MetaNode.DeleteDeadLetter(c.name, c.id); err != nil {
+			loadSpinner.Fail("Can not remove dead letter: ", err)
+			return
+		}
+		loadSpinner.Success("Dead letter removed!")
+		return
+	}
+
+	loadSpinner, _ := pterm.DefaultSpinner.Start("Replaying dead letter...")
+	if err := metaclient.MetaNode.ReplayDeadLetter(c.name, c.id); err != nil {
+		loadSpinner.Fail("Can not replay dead letter: ", err)
+		return
+	}
+	loadSpinner.Success("Dead letter replayed!")
+}
@@ -30,12 +30,14 @@ const (
 
 // Список возможных команд.
 const (
-	ListCommand   common.Command = "list"
-	GetCommand    common.Command = "get"
-	CreateCommand common.Command = "new"
-	DeleteCommand common.Command = "rm"
-	RunCommand    common.Command = "run"
-	StopCommand   common.Command = "stop"
+	ListCommand    common.Command = "list"
+	GetCommand     common.Command = "get"
+	CreateCommand  common.Command = "new"
+	DeleteCommand  common.Command = "rm"
+	RunCommand     common.Command = "run"
+	StopCommand    common.Command = "stop"
+	LettersCommand common.Command = "dead-letters"
+	ReplayCommand  common.Command = "replay"
 )
 
 // HandleSchemas обрабатывает вызов schemas.
@@ -60,6 +62,10 @@ func HandleSchemas(rawArgs []string) {
 		commandHelper = NewRunCommandHelper()
 	case StopCommand:
 		commandHelper = NewStopCommandHelper()
+	case LettersCommand:
+		commandHelper = NewLettersCommandHelper()
+	case ReplayCommand:
+		commandHelper = NewReplayCommandHelper()
 	default:
 		pterm.Error.Printfln("Unknown command '%s', run 'gostreaming %s help' for more information", args[0], metaclient.MetaNodeAddress)
 		return
@@ -0,0 +1,278 @@
+// Package actiontest runs actions the way runtime does, without a cluster.
+//
+// An action is started either as a binary (RunBinary) or in-process from
+// an actionlib.Handler or actionlib.Emitter (RunHandler, RunEmitter).
+// Scripted input messages are written to the action with the same framing
+// runtime uses, outputs and acknowledgements are collected and matched
+// with the inputs, STDERR is split into log records, metric samples and raw errors.
+package actiontest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	actionlib "github.com/GDVFox/gostreaming/lib/go-actionlib"
+)
+
+// DefaultTimeout limits a run if Config.Timeout is not set.
+const DefaultTimeout = 10 * time.Second
+
+// Possible run errors.
+var (
+	ErrUnanswered       = errors.New("input messages are not answered")
+	ErrUnexpectedOutput = errors.New("output without input message")
+	ErrIncompleteAnswer = errors.New("output is not finished")
+	ErrKilled           = errors.New("action is killed")
+)
+
+// StopMode defines how the action is stopped after the inputs.
+type StopMode int
+
+const (
+	// StopEOF closes STDIN of the action after all inputs are written.
+	// Sources are expected to stop by themselves.
+	StopEOF StopMode = iota
+	// StopSignal sends SIGTERM to the action after all inputs are answered,
+	// or, for sources, after Config.Outputs outputs are received.
+	// In-process actions are stopped by cancelling their context.
+	StopSignal
+)
+
+// Config describes a single run of an action.
+type Config struct {
+	// Inputs are written to the action in order.
+	Inputs []*actionlib.Envelope
+	// Metadata passes metadata of inputs to the action,
+	// as runtime does for nodes with enabled metadata.
+	Metadata bool
+	// Stop defines how the action is stopped.
+	Stop StopMode
+	// Outputs is the number of outputs to wait from a source before StopSignal.
+	Outputs int
+	// Timeout limits the run, the action is killed after it. DefaultTimeout is used if not set.
+	Timeout time.Duration
+	// Env is added to the environment of a binary action.
+	Env []string
+}
+
+// Messages returns inputs with the given data and without metadata.
+func Messages(data ...string) []*actionlib.Envelope {
+	inputs := make([]*actionlib.Envelope, 0, len(data))
+	for _, d := range data {
+		inputs = append(inputs, &actionlib.Envelope{Data: []byte(d)})
+	}
+	return inputs
+}
+
+// Answer is the reaction of the action to an input message.
+type Answer struct {
+	// Outputs are messages produced from the input, empty if the input was acknowledged.
+	Outputs []*actionlib.Envelope
+	// Rejected is true if the input was rejected with actionlib.Reject.
+	Rejected bool
+	// RejectReason is the reason of the rejection.
+	RejectReason string
+}
+
+// Acked returns true if the input was acknowledged without outputs.
+func (a *Answer) Acked() bool {
+	return len(a.Outputs) == 0 && !a.Rejected
+}
+
+// Data returns data of outputs as strings.
+func (a *Answer) Data() []string {
+	return envelopesData(a.Outputs)
+}
+
+// Report is the result of a run.
+type Report struct {
+	// Inputs is the number of input messages written to the action.
+	Inputs int
+	// Answers are answers to inputs in order of inputs.
+	Answers []*Answer
+	// Outputs are all output messages in order of receipt.
+	Outputs []*actionlib.Envelope
+	// Incomplete is true if the action wrote message parts without finishing them.
+	Incomplete bool
+	// Logs are log records written by the action.
+	Logs []*actionlib.LogRecord
+	// Metrics are metric samples written by the action.
+	Metrics []*actionlib.MetricSample
+	// Errors is raw STDERR output, which runtime logs as errors.
+	Errors string
+	// ExitErr is the error the action finished with.
+	ExitErr error
+}
+
+// OutputsData returns data of all outputs as strings.
+func (r *Report) OutputsData() []string {
+	return envelopesData(r.Outputs)
+}
+
+// CheckAnswered returns an error if some input was not answered with outputs or an acknowledgement,
+// or the action wrote outputs which do not belong to any input.
+func (r *Report) CheckAnswered() error {
+	if r.Incomplete {
+		return ErrIncompleteAnswer
+	}
+	if len(r.Answers) < r.Inputs {
+		return fmt.Errorf("%d of %d: %w", r.Inputs-len(r.Answers), r.Inputs, ErrUnanswered)
+	}
+	if len(r.Answers) > r.Inputs {
+		return fmt.Errorf("%d answers for %d inputs: %w", len(r.Answers), r.Inputs, ErrUnexpectedOutput)
+	}
+	return nil
+}
+
+func envelopesData(envelopes []*actionlib.Envelope) []string {
+	data := make([]string, 0, len(envelopes))
+	for _, e := range envelopes {
+		data = append(data, string(e.Data))
+	}
+	return data
+}
+
+// action is a started action with connected streams.
+type action struct {
+	stdin  io.WriteCloser
+	stdout io.Reader
+	stderr io.Reader
+
+	// stop asks the action to stop gracefully.
+	stop func() error
+	// kill stops the action immediately.
+	kill func()
+	// wait waits for the action to finish, it is called after STDOUT and STDERR are read.
+	wait func() error
+}
+
+type frameResult struct {
+	envelope *actionlib.Envelope
+	more     bool
+	rejected *string
+	err      error
+}
+
+// drive feeds inputs to a and collects its outputs until a finishes.
+// Inputs are written concurrently with reading outputs, as runtime does,
+// and outputs are matched with inputs in order.
+func drive(ctx context.Context, a *action, cfg *Config, isSource bool) (*Report, error) {
+	timeout := cfg.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var killOnce sync.Once
+	kill := func() { killOnce.Do(a.kill) }
+
+	stderrDone := make(chan []byte, 1)
+	go func() {
+		data, _ := io.ReadAll(a.stderr)
+		stderrDone <- data
+	}()
+
+	go func() {
+		for _, in := range cfg.Inputs {
+			if err := writeInput(a.stdin, in, cfg.Metadata); err != nil {
+				// The action has exited, unanswered inputs are shown in the report.
+				return
+			}
+		}
+		if cfg.Stop == StopEOF {
+			a.stdin.Close()
+		}
+	}()
+
+	frames := make(chan frameResult)
+	go func() {
+		defer close(frames)
+		for {
+			e, more, rejected, err := readOutput(a.stdout)
+			select {
+			case frames <- frameResult{envelope: e, more: more, rejected: rejected, err: err}:
+			case <-ctx.Done():
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	report := &Report{Inputs: len(cfg.Inputs)}
+	if isSource {
+		report.Inputs = 0
+	}
+
+	stopped := false
+	stopIfDone := func() {
+		if stopped || cfg.Stop != StopSignal {
+			return
+		}
+		if (isSource && len(report.Outputs) >= cfg.Outputs) || (!isSource && len(report.Answers) >= len(cfg.Inputs)) {
+			stopped = true
+			a.stop()
+		}
+	}
+	stopIfDone()
+
+	var current *Answer
+	var runErr error
+loop:
+	for {
+		select {
+		case <-ctx.Done():
+			kill()
+			runErr = fmt.Errorf("action is not finished: %w", ctx.Err())
+			break loop
+		case res, ok := <-frames:
+			if !ok {
+				break loop
+			}
+			if res.err != nil {
+				if !errors.Is(res.err, io.EOF) {
+					kill()
+					runErr = fmt.Errorf("read output error: %w", res.err)
+				}
+				break loop
+			}
+
+			if current == nil {
+				current = &Answer{}
+			}
+			if len(res.envelope.Data) != 0 {
+				current.Outputs = append(current.Outputs, res.envelope)
+				report.Outputs = append(report.Outputs, res.envelope)
+			}
+			if res.rejected != nil {
+				current.Rejected, current.RejectReason = true, *res.rejected
+			}
+			if !res.more {
+				if !isSource {
+					report.Answers = append(report.Answers, current)
+				}
+				current = nil
+			}
+			stopIfDone()
+		}
+	}
+	report.Incomplete = current != nil
+	a.stdin.Close()
+
+	select {
+	case data := <-stderrDone:
+		parseStderr(data, report)
+	case <-ctx.Done():
+		kill()
+		parseStderr(<-stderrDone, report)
+	}
+	report.ExitErr = a.wait()
+
+	return report, runErr
+}
@@ -0,0 +1,231 @@
+package actiontest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	actionlib "github.com/GDVFox/gostreaming/lib/go-actionlib"
+	"github.com/stretchr/testify/assert"
+)
+
+const helperEnv = "ACTIONTEST_HELPER"
+
+// TestMain runs the test binary as an action if helperEnv is set.
+func TestMain(m *testing.M) {
+	switch os.Getenv(helperEnv) {
+	case "":
+		os.Exit(m.Run())
+	case "repeat":
+		logger := actionlib.NewLogger()
+		counter := actionlib.NewCounter("repeated")
+		err := actionlib.Run(context.Background(), repeatHandler(func(n int) {
+			logger.Info("repeat", "n", n)
+			counter.Add(float64(n))
+		}))
+		if err != nil {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	case "crash":
+		actionlib.Run(context.Background(), actionlib.HandlerFunc(func(ctx context.Context, message []byte) ([][]byte, error) {
+			if string(message) == "crash" {
+				os.Exit(2)
+			}
+			return [][]byte{message}, nil
+		}))
+		os.Exit(0)
+	}
+}
+
+// repeatHandler answers input n with messages 1..n-1, input 1 is acknowledged.
+func repeatHandler(onMessage func(n int)) actionlib.Handler {
+	return actionlib.HandlerFunc(func(ctx context.Context, message []byte) ([][]byte, error) {
+		n, err := strconv.Atoi(string(message))
+		if err != nil {
+			return nil, err
+		}
+		onMessage(n)
+
+		outputs := make([][]byte, 0, n)
+		for i := 1; i < n; i++ {
+			outputs = append(outputs, []byte(strconv.Itoa(i)))
+		}
+		return outputs, nil
+	})
+}
+
+func TestRunHandler(t *testing.T) {
+	cfg := &Config{Inputs: Messages("1", "2", "3", "bad")}
+	report, err := RunHandler(context.Background(), cfg, repeatHandler(func(int) {}))
+	assert.NoError(t, err)
+	assert.NoError(t, report.ExitErr)
+	assert.NoError(t, report.CheckAnswered())
+
+	assert.Len(t, report.Answers, 4)
+	assert.True(t, report.Answers[0].Acked())
+	assert.Equal(t, []string{"1"}, report.Answers[1].Data())
+	assert.Equal(t, []string{"1", "2"}, report.Answers[2].Data())
+	assert.True(t, report.Answers[3].Acked())
+	assert.Equal(t, []string{"1", "1", "2"}, report.OutputsData())
+	assert.Contains(t, report.Errors, "invalid syntax")
+}
+
+func TestRunHandlerSignal(t *testing.T) {
+	cfg := &Config{Inputs: Messages("2", "3"), Stop: StopSignal}
+	report, err := RunHandler(context.Background(), cfg, repeatHandler(func(int) {}))
+	assert.NoError(t, err)
+	assert.NoError(t, report.ExitErr)
+	assert.NoError(t, report.CheckAnswered())
+	assert.Equal(t, []string{"1", "1", "2"}, report.OutputsData())
+}
+
+func TestRunHandlerUnanswered(t *testing.T) {
+	cfg := &Config{Inputs: Messages("2", "bad", "3")}
+	report, err := RunHandler(context.Background(), cfg, repeatHandler(func(int) {}),
+		actionlib.WithErrorPolicy(actionlib.FatalPolicy()))
+	assert.NoError(t, err)
+	assert.Error(t, report.ExitErr)
+	assert.ErrorIs(t, report.CheckAnswered(), ErrUnanswered)
+	assert.Len(t, report.Answers, 1)
+}
+
+func TestRunHandlerDeadLetter(t *testing.T) {
+	cfg := &Config{Inputs: Messages("2", "bad", "1")}
+	report, err := RunHandler(context.Background(), cfg, repeatHandler(func(int) {}),
+		actionlib.WithErrorPolicy(actionlib.DeadLetterPolicy()))
+	assert.NoError(t, err)
+	assert.NoError(t, report.ExitErr)
+	assert.NoError(t, report.CheckAnswered())
+
+	assert.Len(t, report.Answers, 3)
+	assert.False(t, report.Answers[1].Acked())
+	assert.True(t, report.Answers[1].Rejected)
+	assert.Contains(t, report.Answers[1].RejectReason, "invalid syntax")
+	assert.True(t, report.Answers[2].Acked())
+	assert.Empty(t, report.Errors)
+}
+
+func TestRunHandlerTimeout(t *testing.T) {
+	cfg := &Config{Inputs: Messages("1"), Stop: StopSignal, Timeout: 50 * time.Millisecond}
+	block := make(chan struct{})
+	defer close(block)
+
+	report, err := RunHandler(context.Background(), cfg, actionlib.HandlerFunc(func(ctx context.Context, message []byte) ([][]byte, error) {
+		// Context is not respected, so the action has to be abandoned.
+		<-block
+		return nil, nil
+	}))
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.ErrorIs(t, report.ExitErr, ErrKilled)
+	assert.ErrorIs(t, report.CheckAnswered(), ErrUnanswered)
+}
+
+func TestRunEmitter(t *testing.T) {
+	n := 0
+	emitter := actionlib.EmitterFunc(func(ctx context.Context) ([][]byte, error) {
+		n++
+		return [][]byte{[]byte(strconv.Itoa(n))}, nil
+	})
+
+	cfg := &Config{Stop: StopSignal, Outputs: 3}
+	report, err := RunEmitter(context.Background(), cfg, emitter)
+	assert.NoError(t, err)
+	assert.NoError(t, report.ExitErr)
+	assert.NoError(t, report.CheckAnswered())
+	assert.GreaterOrEqual(t, len(report.Outputs), 3)
+	assert.Equal(t, []string{"1", "2", "3"}, report.OutputsData()[:3])
+}
+
+func TestRunEmitterEOF(t *testing.T) {
+	n := 0
+	emitter := actionlib.EmitterFunc(func(ctx context.Context) ([][]byte, error) {
+		n++
+		if n > 2 {
+			return nil, io.EOF
+		}
+		return [][]byte{[]byte(strconv.Itoa(n))}, nil
+	})
+
+	report, err := RunEmitter(context.Background(), &Config{}, emitter)
+	assert.NoError(t, err)
+	assert.NoError(t, report.ExitErr)
+	assert.Equal(t, []string{"1", "2"}, report.OutputsData())
+}
+
+func TestRunBinary(t *testing.T) {
+	for _, stop := range []StopMode{StopEOF, StopSignal} {
+		cfg := &Config{
+			Inputs: Messages("1", "3", "bad"),
+			Stop:   stop,
+			Env:    []string{helperEnv + "=repeat"},
+		}
+		report, err := RunBinary(context.Background(), cfg, os.Args[0])
+		assert.NoError(t, err)
+		assert.NoError(t, report.ExitErr)
+		assert.NoError(t, report.CheckAnswered())
+		assert.Equal(t, []string{"1", "2"}, report.OutputsData())
+
+		assert.Equal(t, []*actionlib.LogRecord{
+			{Level: actionlib.LevelInfo, Message: "repeat", Fields: map[string]interface{}{"n": float64(1)}},
+			{Level: actionlib.LevelInfo, Message: "repeat", Fields: map[string]interface{}{"n": float64(3)}},
+		}, report.Logs)
+		assert.Equal(t, []*actionlib.MetricSample{
+			{Name: "repeated", Type: actionlib.MetricCounter, Value: 1},
+			{Name: "repeated", Type: actionlib.MetricCounter, Value: 3},
+		}, report.Metrics)
+		assert.Contains(t, report.Errors, "invalid syntax")
+	}
+}
+
+func TestRunBinaryCrash(t *testing.T) {
+	cfg := &Config{
+		Inputs: Messages("a", "crash", "b"),
+		Env:    []string{helperEnv + "=crash"},
+	}
+	report, err := RunBinary(context.Background(), cfg, os.Args[0])
+	assert.NoError(t, err)
+
+	var exitErr interface{ ExitCode() int }
+	if assert.True(t, errors.As(report.ExitErr, &exitErr)) {
+		assert.Equal(t, 2, exitErr.ExitCode())
+	}
+	assert.ErrorIs(t, report.CheckAnswered(), ErrUnanswered)
+	assert.Equal(t, []string{"a"}, report.OutputsData())
+}
+
+func TestFrames(t *testing.T) {
+	in := &actionlib.Envelope{
+		Key:       []byte("key"),
+		Timestamp: time.Unix(0, 42),
+		Headers:   map[string]string{"a": "b"},
+		Data:      []byte("data"),
+	}
+
+	var buff bytes.Buffer
+	assert.NoError(t, writeInput(&buff, in, false))
+	e, more, rejected, err := readOutput(&buff)
+	assert.NoError(t, err)
+	assert.False(t, more)
+	assert.Nil(t, rejected)
+	assert.Equal(t, &actionlib.Envelope{Data: in.Data}, e)
+
+	assert.NoError(t, writeInput(&buff, in, true))
+	e, _, _, err = readOutput(&buff)
+	assert.NoError(t, err)
+	assert.Equal(t, in, e)
+}
+
+func TestParseStderr(t *testing.T) {
+	data := []byte("raw\x1elog {\"level\":\"warn\",\"msg\":\"m\"}\n\x1eunknown {}\nerror")
+
+	report := &Report{}
+	parseStderr(data, report)
+	assert.Equal(t, []*actionlib.LogRecord{{Level: actionlib.LevelWarn, Message: "m"}}, report.Logs)
+	assert.Equal(t, "raw\x1eunknown {}error", report.Errors)
+}
@@ -0,0 +1,161 @@
+package actiontest
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	actionlib "github.com/GDVFox/gostreaming/lib/go-actionlib"
+)
+
+const lengthMask = actionlib.MetadataFlag - 1
+
+// controlHeader is the length prefix of a control frame, see actionlib.Reject.
+const controlHeader = actionlib.MoreMessagesFlag | actionlib.MetadataFlag
+
+// controlReject is the type of the control frame written by actionlib.Reject.
+const controlReject uint8 = 8
+
+// ErrUnknownControl is returned for control frames other than rejections.
+var ErrUnknownControl = errors.New("unknown control frame")
+
+// writeInput writes in to w as runtime does: metadata is sent only if withMetadata is set.
+func writeInput(w io.Writer, in *actionlib.Envelope, withMetadata bool) error {
+	if len(in.Data) > actionlib.MaxMessageLength {
+		return actionlib.ErrMessageTooLong
+	}
+
+	var buff bytes.Buffer
+	header := uint32(len(in.Data))
+	if withMetadata && in.HasMetadata() {
+		metadata, err := actionlib.EncodeMetadata(in)
+		if err != nil {
+			return fmt.Errorf("encode metadata error: %w", err)
+		}
+		binary.Write(&buff, binary.BigEndian, header|actionlib.MetadataFlag)
+		binary.Write(&buff, binary.BigEndian, uint32(len(metadata)))
+		buff.Write(metadata)
+	} else {
+		binary.Write(&buff, binary.BigEndian, header)
+	}
+	buff.Write(in.Data)
+
+	if _, err := w.Write(buff.Bytes()); err != nil {
+		return fmt.Errorf("write input error: %w", err)
+	}
+	return nil
+}
+
+// readOutput reads a single output frame from r.
+// more is true if more frames for the same input message follow.
+// A rejection is returned as an empty envelope with the reason in rejected.
+func readOutput(r io.Reader) (e *actionlib.Envelope, more bool, rejected *string, err error) {
+	header := uint32(0)
+	if err := binary.Read(r, binary.BigEndian, &header); err != nil {
+		return nil, false, nil, err
+	}
+	if header == controlHeader {
+		reason, err := readReject(r)
+		if err != nil {
+			return nil, false, nil, err
+		}
+		return &actionlib.Envelope{}, false, &reason, nil
+	}
+
+	e = &actionlib.Envelope{}
+	if header&actionlib.MetadataFlag != 0 {
+		metadataLength := uint32(0)
+		if err := binary.Read(r, binary.BigEndian, &metadataLength); err != nil {
+			return nil, false, nil, fmt.Errorf("read metadata header error: %w", err)
+		}
+		if metadataLength > actionlib.MaxMetadataLength {
+			return nil, false, nil, actionlib.ErrMetadataTooLong
+		}
+
+		metadata := make([]byte, metadataLength)
+		if _, err := io.ReadFull(r, metadata); err != nil {
+			return nil, false, nil, fmt.Errorf("read metadata error: %w", err)
+		}
+		if err := actionlib.DecodeMetadata(metadata, e); err != nil {
+			return nil, false, nil, fmt.Errorf("decode metadata error: %w", err)
+		}
+	}
+
+	e.Data = make([]byte, header&lengthMask)
+	if _, err := io.ReadFull(r, e.Data); err != nil {
+		return nil, false, nil, fmt.Errorf("read message data error: %w", err)
+	}
+	return e, header&actionlib.MoreMessagesFlag != 0, nil, nil
+}
+
+// readReject reads the rest of a control frame, which must be a rejection.
+func readReject(r io.Reader) (string, error) {
+	length := uint32(0)
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return "", fmt.Errorf("read control header error: %w", err)
+	}
+	if length == 0 || length > actionlib.MaxRejectReasonLength+1 {
+		return "", ErrUnknownControl
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return "", fmt.Errorf("read control frame error: %w", err)
+	}
+	if payload[0] != controlReject {
+		return "", fmt.Errorf("%d: %w", payload[0], ErrUnknownControl)
+	}
+	return string(payload[1:]), nil
+}
+
+// parseStderr splits STDERR output to framed records and raw error output.
+func parseStderr(data []byte, report *Report) {
+	var raw bytes.Buffer
+	for len(data) != 0 {
+		if data[0] != actionlib.RecordSeparator {
+			end := bytes.IndexByte(data, actionlib.RecordSeparator)
+			if end < 0 {
+				end = len(data)
+			}
+			raw.Write(data[:end])
+			data = data[end:]
+			continue
+		}
+
+		record, rest, _ := bytes.Cut(data, []byte{'\n'})
+		if !parseRecord(record[1:], report) {
+			raw.Write(record)
+		}
+		data = rest
+	}
+	report.Errors = raw.String()
+}
+
+// parseRecord adds record to report, it returns false if the record is malformed.
+func parseRecord(record []byte, report *Report) bool {
+	kind, payload, ok := bytes.Cut(record, []byte{' '})
+	if !ok {
+		return false
+	}
+
+	switch string(kind) {
+	case actionlib.LogRecordKind:
+		r := &actionlib.LogRecord{}
+		if err := json.Unmarshal(payload, r); err != nil {
+			return false
+		}
+		report.Logs = append(report.Logs, r)
+	case actionlib.MetricRecordKind:
+		s := &actionlib.MetricSample{}
+		if err := json.Unmarshal(payload, s); err != nil {
+			return false
+		}
+		report.Metrics = append(report.Metrics, s)
+	default:
+		return false
+	}
+	return true
+}
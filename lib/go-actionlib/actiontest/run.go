@@ -0,0 +1,128 @@
+package actiontest
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"syscall"
+
+	actionlib "github.com/GDVFox/gostreaming/lib/go-actionlib"
+)
+
+// RunBinary starts the action binary at path with args and runs cfg against it.
+// Transformation and sink actions are expected to answer every input,
+// the answers are checked with Report.CheckAnswered.
+func RunBinary(ctx context.Context, cfg *Config, path string, args ...string) (*Report, error) {
+	return runBinary(ctx, cfg, false, path, args...)
+}
+
+// RunSourceBinary starts the source action binary at path with args and collects its outputs.
+func RunSourceBinary(ctx context.Context, cfg *Config, path string, args ...string) (*Report, error) {
+	return runBinary(ctx, cfg, true, path, args...)
+}
+
+func runBinary(ctx context.Context, cfg *Config, isSource bool, path string, args ...string) (*Report, error) {
+	cmd := exec.Command(path, args...)
+	cmd.Env = append(os.Environ(), cfg.Env...)
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("can not create stdin pipe: %w", err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("can not create stdout pipe: %w", err)
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, fmt.Errorf("can not create stderr pipe: %w", err)
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("can not start action: %w", err)
+	}
+
+	a := &action{
+		stdin:  stdin,
+		stdout: stdout,
+		stderr: stderr,
+		stop:   func() error { return cmd.Process.Signal(syscall.SIGTERM) },
+		kill:   func() { cmd.Process.Kill() },
+		wait:   cmd.Wait,
+	}
+	return drive(ctx, a, cfg, isSource)
+}
+
+// RunHandler runs h in-process with actionlib.Run and runs cfg against it.
+// Logger records and metrics written by h go to STDERR of the test and are not collected.
+func RunHandler(ctx context.Context, cfg *Config, h actionlib.Handler, opts ...actionlib.Option) (*Report, error) {
+	return runInProcess(ctx, cfg, false, func(ctx context.Context, opts ...actionlib.Option) error {
+		return actionlib.Run(ctx, h, opts...)
+	}, opts)
+}
+
+// RunEmitter runs e in-process with actionlib.RunSource and collects its outputs.
+func RunEmitter(ctx context.Context, cfg *Config, e actionlib.Emitter, opts ...actionlib.Option) (*Report, error) {
+	return runInProcess(ctx, cfg, true, func(ctx context.Context, opts ...actionlib.Option) error {
+		return actionlib.RunSource(ctx, e, opts...)
+	}, opts)
+}
+
+func runInProcess(ctx context.Context, cfg *Config, isSource bool,
+	run func(ctx context.Context, opts ...actionlib.Option) error, opts []actionlib.Option) (*Report, error) {
+	inR, inW := io.Pipe()
+	outR, outW := io.Pipe()
+	errR, errW := io.Pipe()
+
+	// Signals are not used in-process, the action is stopped by cancelling its context.
+	opts = append(opts, actionlib.WithStreams(inR, outW, errW), actionlib.WithSignals())
+
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		var err error
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("action panic: %v", r)
+			}
+			// Unblock writer of inputs and readers of outputs, as if the process exited.
+			inR.CloseWithError(io.ErrClosedPipe)
+			outW.Close()
+			errW.Close()
+			done <- err
+		}()
+		err = run(runCtx, opts...)
+	}()
+
+	killed := make(chan struct{})
+	a := &action{
+		stdin:  inW,
+		stdout: outR,
+		stderr: errR,
+		stop: func() error {
+			cancel()
+			return nil
+		},
+		kill: func() {
+			// A goroutine can not be killed, so the action is abandoned
+			// if it does not respect its context.
+			cancel()
+			outR.CloseWithError(ErrKilled)
+			errR.CloseWithError(ErrKilled)
+			close(killed)
+		},
+		wait: func() error {
+			select {
+			case err := <-done:
+				return err
+			case <-killed:
+				return ErrKilled
+			}
+		},
+	}
+	return drive(ctx, a, cfg, isSource)
+}
@@ -0,0 +1,307 @@
+package actionlib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+)
+
+// BatchEnv is the environment variable with the maximum number of input messages in a batch,
+// which runtime sets if it supports batch frames for the node.
+const BatchEnv = "GOSTREAMING_BATCH"
+
+// MaxBatchLength is the maximum length of a batch frame,
+// larger batches are split into several frames.
+const MaxBatchLength = 16 << 20
+
+// controlHeader is the length prefix of a control frame. The more flag with zero length
+// is never used for data messages, so control frames can be mixed with them.
+// The prefix is followed by a uint32 length of the payload and the payload,
+// which starts with the control type.
+const controlHeader = MoreMessagesFlag | MetadataFlag
+
+// Control frame types.
+const (
+	// controlBatch carries a uint32 number of frames and the frames.
+	controlBatch uint8 = 1
+	// controlBatchOptIn tells runtime that the action reads batch frames.
+	controlBatchOptIn uint8 = 2
+)
+
+// Possible batch errors.
+var (
+	ErrBatchingDisabled = errors.New("batching is not enabled by runtime")
+	ErrBadControlFrame  = errors.New("bad control frame")
+	ErrControlTooLong   = errors.New("control frame is too long")
+	ErrUnknownControl   = errors.New("unknown control frame")
+)
+
+// EnableBatching tells runtime that the action reads batch frames, after that runtime
+// sends several input messages in one frame. It returns the maximum number of messages in a batch.
+// ReadMessage and ReadEnvelope keep working with batches, ReadBatch returns the whole batch.
+// ErrBatchingDisabled is returned if runtime does not support batches for the node.
+func EnableBatching() (int, error) {
+	size, err := batchSize()
+	if err != nil {
+		return 0, err
+	}
+	if err := writeControl(stdout, controlBatchOptIn, nil); err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+func batchSize() (int, error) {
+	rawSize := os.Getenv(BatchEnv)
+	if rawSize == "" {
+		return 0, ErrBatchingDisabled
+	}
+	size, err := strconv.Atoi(rawSize)
+	if err != nil {
+		return 0, fmt.Errorf("can not parse batch size %q: %w", rawSize, err)
+	}
+	return size, nil
+}
+
+// pendingInputs are messages of the last batch not yet returned by ReadMessage or ReadEnvelope.
+var pendingInputs []*Envelope
+
+func readNextEnvelope() (*Envelope, error) {
+	if len(pendingInputs) == 0 {
+		envelopes, err := readStdinInputs()
+		if err != nil {
+			return nil, err
+		}
+		pendingInputs = envelopes
+	}
+
+	e := pendingInputs[0]
+	pendingInputs[0] = nil
+	pendingInputs = pendingInputs[1:]
+	return e, nil
+}
+
+// ReadBatch reads the next batch of messages from input dataflow. If runtime sent
+// a single message, the batch consists of it. Metadata of messages is skipped.
+func ReadBatch() ([][]byte, error) {
+	envelopes, err := ReadEnvelopeBatch()
+	if err != nil {
+		return nil, err
+	}
+
+	messages := make([][]byte, 0, len(envelopes))
+	for _, e := range envelopes {
+		messages = append(messages, e.Data)
+	}
+	return messages, nil
+}
+
+// ReadEnvelopeBatch reads the next batch of messages with their metadata from input dataflow.
+func ReadEnvelopeBatch() ([]*Envelope, error) {
+	envelopes := pendingInputs
+	pendingInputs = nil
+	if len(envelopes) == 0 {
+		var err error
+		if envelopes, err = readStdinInputs(); err != nil {
+			return nil, err
+		}
+	}
+
+	for range envelopes {
+		nextInput()
+	}
+	return envelopes, nil
+}
+
+// WriteBatch writes outputs for a batch of input messages: results[i] are outputs
+// of the i-th message, empty results[i] acknowledges it. If runtime supports batches,
+// all outputs are written in as few frames as possible, otherwise they are written one by one.
+func WriteBatch(results [][][]byte) error {
+	all := make([][]byte, 0, len(results))
+	for _, outputs := range results {
+		all = append(all, outputs...)
+	}
+	if err := acquireOutput(all...); err != nil {
+		return err
+	}
+
+	if _, err := batchSize(); err != nil {
+		for i, outputs := range results {
+			if err := writeMessages(stdout, outputs); err != nil {
+				return fmt.Errorf("write result #%d error: %w", i, err)
+			}
+		}
+		return nil
+	}
+	return writeBatch(stdout, results)
+}
+
+// writeBatch writes results to w in batch frames.
+func writeBatch(w io.Writer, results [][][]byte) error {
+	var batch, frame bytes.Buffer
+	count := uint32(0)
+	flush := func() error {
+		if count == 0 {
+			return nil
+		}
+		payload := make([]byte, 4, 4+batch.Len())
+		binary.BigEndian.PutUint32(payload, count)
+		payload = append(payload, batch.Bytes()...)
+		batch.Reset()
+		count = 0
+		return writeControl(w, controlBatch, payload)
+	}
+	add := func(message []byte, flags uint32) error {
+		frame.Reset()
+		if err := writeFrame(&frame, nil, message, flags); err != nil {
+			return err
+		}
+		if batch.Len()+frame.Len() > MaxBatchLength {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		if frame.Len() > MaxBatchLength {
+			_, err := w.Write(frame.Bytes())
+			return err
+		}
+		batch.Write(frame.Bytes())
+		count++
+		return nil
+	}
+
+	for i, outputs := range results {
+		if len(outputs) == 0 {
+			outputs = [][]byte{nil}
+		}
+		for j, output := range outputs {
+			flags := uint32(0)
+			if j != len(outputs)-1 {
+				if len(output) == 0 {
+					return fmt.Errorf("write result #%d error: %w", i, ErrEmptyMessage)
+				}
+				flags = MoreMessagesFlag
+			}
+			if err := add(output, flags); err != nil {
+				return fmt.Errorf("write result #%d error: %w", i, err)
+			}
+		}
+	}
+	return flush()
+}
+
+func writeControl(w io.Writer, controlType uint8, payload []byte) error {
+	frame := make([]byte, 9, 9+len(payload))
+	binary.BigEndian.PutUint32(frame[0:], controlHeader)
+	binary.BigEndian.PutUint32(frame[4:], uint32(1+len(payload)))
+	frame[8] = controlType
+	frame = append(frame, payload...)
+	if _, err := w.Write(frame); err != nil {
+		return fmt.Errorf("write control frame error: %w", err)
+	}
+	return nil
+}
+
+// readStdinInputs reads the next input messages from STDIN.
+// Events are acknowledged without outputs, as the caller does not handle them.
+func readStdinInputs() ([]*Envelope, error) {
+	for {
+		envelopes, event, err := readFrames(stdin, replyProbe(stdout))
+		if err != nil {
+			return nil, err
+		}
+		if event == nil {
+			return envelopes, nil
+		}
+		if err := ackMessage(stdout); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// readFrames reads the next frame from r. A batch frame gives all its messages,
+// a data frame gives a single message and an event frame gives the event.
+// Health probes are passed to onProbe.
+func readFrames(r io.Reader, onProbe func(payload []byte) error) ([]*Envelope, *Event, error) {
+	for {
+		header := uint32(0)
+		if err := binary.Read(r, binary.BigEndian, &header); err != nil {
+			return nil, nil, fmt.Errorf("read message header error: %w", err)
+		}
+		if header != controlHeader {
+			e, err := readEnvelopeBody(r, header)
+			if err != nil {
+				return nil, nil, err
+			}
+			return []*Envelope{e}, nil, nil
+		}
+
+		controlType, payload, err := readControl(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		switch controlType {
+		case controlBatch:
+		case controlProbe:
+			if err := onProbe(payload); err != nil {
+				return nil, nil, err
+			}
+			continue
+		case controlTick, controlShutdown:
+			event, err := decodeEvent(controlType, payload)
+			return nil, event, err
+		default:
+			return nil, nil, fmt.Errorf("%d: %w", controlType, ErrUnknownControl)
+		}
+
+		envelopes, err := decodeBatch(payload)
+		if err != nil {
+			return nil, nil, err
+		}
+		// An empty batch is valid, but the caller expects messages.
+		if len(envelopes) != 0 {
+			return envelopes, nil, nil
+		}
+	}
+}
+
+func readControl(r io.Reader) (uint8, []byte, error) {
+	length := uint32(0)
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return 0, nil, fmt.Errorf("read control header error: %w", err)
+	}
+	if length == 0 {
+		return 0, nil, ErrBadControlFrame
+	}
+	if length > MaxBatchLength+5 {
+		return 0, nil, ErrControlTooLong
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, fmt.Errorf("read control frame error: %w", err)
+	}
+	return payload[0], payload[1:], nil
+}
+
+func decodeBatch(payload []byte) ([]*Envelope, error) {
+	if len(payload) < 4 {
+		return nil, ErrBadControlFrame
+	}
+	count := binary.BigEndian.Uint32(payload)
+	r := bytes.NewReader(payload[4:])
+
+	envelopes := make([]*Envelope, 0, count)
+	for i := uint32(0); i < count; i++ {
+		e, err := readEnvelope(r)
+		if err != nil {
+			return nil, fmt.Errorf("read batch message #%d error: %w", i, err)
+		}
+		envelopes = append(envelopes, e)
+	}
+	return envelopes, nil
+}
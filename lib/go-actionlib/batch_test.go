@@ -0,0 +1,217 @@
+package actionlib
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeInputBatch(t *testing.T, w io.Writer, messages ...string) {
+	results := make([][][]byte, 0, len(messages))
+	for _, msg := range messages {
+		results = append(results, [][]byte{[]byte(msg)})
+	}
+	assert.NoError(t, writeBatch(w, results))
+}
+
+func readControlFrame(t *testing.T, r io.Reader) (uint8, []byte) {
+	header := uint32(0)
+	assert.NoError(t, binary.Read(r, binary.BigEndian, &header))
+	assert.Equal(t, uint32(controlHeader), header)
+
+	controlType, payload, err := readControl(r)
+	assert.NoError(t, err)
+	return controlType, payload
+}
+
+func readBatchOutput(t *testing.T, r io.Reader) []string {
+	controlType, payload := readControlFrame(t, r)
+	assert.Equal(t, controlBatch, controlType)
+	return readOutput(t, bytes.NewReader(payload[4:]))
+}
+
+func TestReadBatch(t *testing.T) {
+	var buff bytes.Buffer
+	stdin = &buff
+
+	writeInput(t, &buff, "a")
+	writeInputBatch(t, &buff, "b", "c")
+	writeInput(t, &buff, "d")
+	writeInputBatch(t, &buff)
+	writeInputBatch(t, &buff, "e", "f", "g")
+
+	batch, err := ReadBatch()
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("a")}, batch)
+
+	batch, err = ReadBatch()
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("b"), []byte("c")}, batch)
+
+	message, err := ReadMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("d"), message)
+
+	// The empty batch is skipped, the rest of a batch is returned after ReadMessage.
+	message, err = ReadMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("e"), message)
+
+	batch, err = ReadBatch()
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("f"), []byte("g")}, batch)
+
+	_, err = ReadBatch()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestReadBatchUnknownControl(t *testing.T) {
+	var buff bytes.Buffer
+	assert.NoError(t, writeControl(&buff, 100, nil))
+
+	_, _, err := readFrames(&buff, nil)
+	assert.ErrorIs(t, err, ErrUnknownControl)
+}
+
+func TestWriteBatch(t *testing.T) {
+	var out bytes.Buffer
+	stdout = &out
+
+	results := [][][]byte{
+		{[]byte("1")},
+		nil,
+		{[]byte("2"), []byte("3")},
+	}
+
+	assert.NoError(t, WriteBatch(results))
+	assert.Equal(t, []string{"1", "", "2+", "3"}, readOutput(t, &out))
+
+	t.Setenv(BatchEnv, "10")
+	assert.NoError(t, WriteBatch(results))
+	assert.Equal(t, []string{"1", "", "2+", "3"}, readBatchOutput(t, &out))
+	assert.Zero(t, out.Len())
+
+	assert.ErrorIs(t, WriteBatch([][][]byte{{nil, []byte("1")}}), ErrEmptyMessage)
+}
+
+func TestWriteBatchSplit(t *testing.T) {
+	var out bytes.Buffer
+
+	large := bytes.Repeat([]byte{'x'}, MaxBatchLength/2)
+	assert.NoError(t, writeBatch(&out, [][][]byte{{large}, {large}, {[]byte("1")}}))
+
+	assert.Equal(t, []string{string(large)}, readBatchOutput(t, &out))
+	assert.Equal(t, []string{string(large), "1"}, readBatchOutput(t, &out))
+	assert.Zero(t, out.Len())
+}
+
+func TestRunBatching(t *testing.T) {
+	t.Setenv(BatchEnv, "10")
+
+	var in, out, errOut bytes.Buffer
+	writeInputBatch(t, &in, "1", "bad", "2")
+	writeInput(t, &in, "3")
+
+	handler := HandlerFunc(func(ctx context.Context, message []byte) ([][]byte, error) {
+		n, err := strconv.Atoi(string(message))
+		if err != nil {
+			return nil, err
+		}
+		return [][]byte{[]byte(strconv.Itoa(n * 10))}, nil
+	})
+	assert.NoError(t, Run(context.Background(), handler, WithStreams(&in, &out, &errOut), WithSignals(), WithBatching()))
+
+	controlType, payload := readControlFrame(t, &out)
+	assert.Equal(t, controlBatchOptIn, controlType)
+	assert.Empty(t, payload)
+
+	assert.Equal(t, []string{"10", "", "20"}, readBatchOutput(t, &out))
+	assert.Equal(t, []string{"30"}, readBatchOutput(t, &out))
+	assert.NotEmpty(t, errOut.String())
+}
+
+const benchmarkBatchSize = 100
+
+// benchmarkFrames measures a round trip of b.N messages through pipes:
+// inputs are read by the action, outputs are written back.
+func benchmarkFrames(b *testing.B, batched bool) {
+	inR, inW, err := os.Pipe()
+	if err != nil {
+		b.Fatal(err)
+	}
+	outR, outW, err := os.Pipe()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer inR.Close()
+	defer outR.Close()
+
+	message := bytes.Repeat([]byte{'x'}, 64)
+	go func() {
+		defer inW.Close()
+
+		batch := make([][][]byte, 0, benchmarkBatchSize)
+		for i := 0; i < b.N; i++ {
+			if !batched {
+				if err := writeMessages(inW, [][]byte{message}); err != nil {
+					return
+				}
+				continue
+			}
+			batch = append(batch, [][]byte{message})
+			if len(batch) == benchmarkBatchSize || i == b.N-1 {
+				if err := writeBatch(inW, batch); err != nil {
+					return
+				}
+				batch = batch[:0]
+			}
+		}
+	}()
+	go func() {
+		defer outW.Close()
+
+		for {
+			envelopes, _, err := readFrames(inR, nil)
+			if err != nil {
+				return
+			}
+			if !batched {
+				if err := writeMessages(outW, [][]byte{envelopes[0].Data}); err != nil {
+					return
+				}
+				continue
+			}
+			results := make([][][]byte, 0, len(envelopes))
+			for _, e := range envelopes {
+				results = append(results, [][]byte{e.Data})
+			}
+			if err := writeBatch(outW, results); err != nil {
+				return
+			}
+		}
+	}()
+
+	b.SetBytes(int64(len(message)))
+	b.ResetTimer()
+	for received := 0; received < b.N; {
+		envelopes, _, err := readFrames(outR, nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		received += len(envelopes)
+	}
+}
+
+func BenchmarkSingleFrames(b *testing.B) {
+	benchmarkFrames(b, false)
+}
+
+func BenchmarkBatchFrames(b *testing.B) {
+	benchmarkFrames(b, true)
+}
@@ -0,0 +1,247 @@
+package actionlib
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// CodecEnv is the environment variable with the name of the codec,
+// which runtime passes to action from node description.
+const CodecEnv = "GOSTREAMING_CODEC"
+
+// Codec names.
+const (
+	CodecJSON = "json"
+	CodecGob  = "gob"
+	CodecCSV  = "csv"
+	CodecLine = "line"
+)
+
+// Possible codec errors.
+var (
+	ErrUnknownCodec    = errors.New("unknown codec")
+	ErrUnsupportedType = errors.New("type is not supported by codec")
+)
+
+// Codec encodes values to messages and decodes them back.
+type Codec interface {
+	// Name returns the name of codec.
+	Name() string
+	// Marshal encodes v to message.
+	Marshal(v interface{}) ([]byte, error)
+	// Unmarshal decodes message to value pointed by v.
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// CodecByName returns codec with the given name.
+func CodecByName(name string) (Codec, error) {
+	switch name {
+	case CodecJSON:
+		return JSONCodec{}, nil
+	case CodecGob:
+		return GobCodec{}, nil
+	case CodecCSV:
+		return CSVCodec{}, nil
+	case CodecLine:
+		return LineCodec{}, nil
+	default:
+		return nil, fmt.Errorf("%q: %w", name, ErrUnknownCodec)
+	}
+}
+
+// EnvCodec returns codec set by runtime. If codec is not set, JSONCodec is returned.
+func EnvCodec() (Codec, error) {
+	name := os.Getenv(CodecEnv)
+	if name == "" {
+		return JSONCodec{}, nil
+	}
+	return CodecByName(name)
+}
+
+// JSONCodec encodes values as JSON documents.
+type JSONCodec struct{}
+
+// Name returns the name of codec.
+func (JSONCodec) Name() string { return CodecJSON }
+
+// Marshal encodes v to message.
+func (JSONCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// Unmarshal decodes message to value pointed by v.
+func (JSONCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// GobCodec encodes values with encoding/gob.
+// Every message is self-contained and carries type information.
+type GobCodec struct{}
+
+// Name returns the name of codec.
+func (GobCodec) Name() string { return CodecGob }
+
+// Marshal encodes v to message.
+func (GobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buff bytes.Buffer
+	if err := gob.NewEncoder(&buff).Encode(v); err != nil {
+		return nil, err
+	}
+	return buff.Bytes(), nil
+}
+
+// Unmarshal decodes message to value pointed by v.
+func (GobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// CSVCodec encodes a single CSV record per message.
+// Supported types are []string for Marshal and *[]string for Unmarshal.
+type CSVCodec struct{}
+
+// Name returns the name of codec.
+func (CSVCodec) Name() string { return CodecCSV }
+
+// Marshal encodes v to message.
+func (CSVCodec) Marshal(v interface{}) ([]byte, error) {
+	var record []string
+	switch r := v.(type) {
+	case []string:
+		record = r
+	case *[]string:
+		record = *r
+	default:
+		return nil, fmt.Errorf("csv: %T: %w", v, ErrUnsupportedType)
+	}
+
+	var buff bytes.Buffer
+	w := csv.NewWriter(&buff)
+	if err := w.Write(record); err != nil {
+		return nil, err
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buff.Bytes(), []byte{'\n'}), nil
+}
+
+// Unmarshal decodes message to value pointed by v.
+func (CSVCodec) Unmarshal(data []byte, v interface{}) error {
+	record, ok := v.(*[]string)
+	if !ok {
+		return fmt.Errorf("csv: %T: %w", v, ErrUnsupportedType)
+	}
+
+	r := csv.NewReader(bytes.NewReader(data))
+	fields, err := r.Read()
+	if err != nil {
+		return err
+	}
+	*record = fields
+	return nil
+}
+
+// LineCodec passes a single text line per message.
+// Supported types are string and []byte for Marshal and *string and *[]byte for Unmarshal.
+type LineCodec struct{}
+
+// Name returns the name of codec.
+func (LineCodec) Name() string { return CodecLine }
+
+// Marshal encodes v to message.
+func (LineCodec) Marshal(v interface{}) ([]byte, error) {
+	switch l := v.(type) {
+	case string:
+		return []byte(strings.TrimSuffix(l, "\n")), nil
+	case *string:
+		return []byte(strings.TrimSuffix(*l, "\n")), nil
+	case []byte:
+		return bytes.TrimSuffix(l, []byte{'\n'}), nil
+	default:
+		return nil, fmt.Errorf("line: %T: %w", v, ErrUnsupportedType)
+	}
+}
+
+// Unmarshal decodes message to value pointed by v.
+func (LineCodec) Unmarshal(data []byte, v interface{}) error {
+	switch l := v.(type) {
+	case *string:
+		*l = string(data)
+	case *[]byte:
+		*l = append((*l)[:0], data...)
+	default:
+		return fmt.Errorf("line: %T: %w", v, ErrUnsupportedType)
+	}
+	return nil
+}
+
+// Decode decodes message to value of type T.
+func Decode[T any](c Codec, data []byte) (T, error) {
+	var v T
+	if err := c.Unmarshal(data, &v); err != nil {
+		return v, fmt.Errorf("decode %s message error: %w", c.Name(), err)
+	}
+	return v, nil
+}
+
+// Encode encodes value of type T to message.
+func Encode[T any](c Codec, v T) ([]byte, error) {
+	data, err := c.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("encode %s message error: %w", c.Name(), err)
+	}
+	return data, nil
+}
+
+// ReadTyped reads message from input dataflow and decodes it to value of type T.
+func ReadTyped[T any](c Codec) (T, error) {
+	data, err := ReadMessage()
+	if err != nil {
+		var v T
+		return v, err
+	}
+	return Decode[T](c, data)
+}
+
+// WriteTyped encodes v and writes it to output dataflow.
+func WriteTyped[T any](c Codec, v T) error {
+	data, err := Encode(c, v)
+	if err != nil {
+		return err
+	}
+	return WriteMessage(data)
+}
+
+// TypedHandler returns Handler which decodes input messages to In
+// and encodes outputs of f from Out.
+func TypedHandler[In, Out any](c Codec, f func(ctx context.Context, in In) ([]Out, error)) Handler {
+	return HandlerFunc(func(ctx context.Context, message []byte) ([][]byte, error) {
+		in, err := Decode[In](c, message)
+		if err != nil {
+			return nil, err
+		}
+
+		outs, err := f(ctx, in)
+		if err != nil {
+			return nil, err
+		}
+
+		outputs := make([][]byte, 0, len(outs))
+		for _, out := range outs {
+			data, err := Encode(c, out)
+			if err != nil {
+				return nil, err
+			}
+			outputs = append(outputs, data)
+		}
+		return outputs, nil
+	})
+}
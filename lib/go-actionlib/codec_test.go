@@ -0,0 +1,102 @@
+package actionlib
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testStock struct {
+	FIGI  string
+	Price float64
+}
+
+func TestCodecByName(t *testing.T) {
+	for _, name := range []string{CodecJSON, CodecGob, CodecCSV, CodecLine} {
+		c, err := CodecByName(name)
+		assert.NoError(t, err)
+		assert.Equal(t, name, c.Name())
+	}
+
+	_, err := CodecByName("xml")
+	assert.ErrorIs(t, err, ErrUnknownCodec)
+}
+
+func TestEnvCodec(t *testing.T) {
+	t.Setenv(CodecEnv, "")
+	c, err := EnvCodec()
+	assert.NoError(t, err)
+	assert.Equal(t, CodecJSON, c.Name())
+
+	t.Setenv(CodecEnv, CodecGob)
+	c, err = EnvCodec()
+	assert.NoError(t, err)
+	assert.Equal(t, CodecGob, c.Name())
+}
+
+func TestStructCodecs(t *testing.T) {
+	stock := testStock{FIGI: "BBG000B9XRY4", Price: 133.7}
+	for _, c := range []Codec{JSONCodec{}, GobCodec{}} {
+		data, err := Encode(c, stock)
+		assert.NoError(t, err)
+
+		decoded, err := Decode[testStock](c, data)
+		assert.NoError(t, err)
+		assert.Equalf(t, stock, decoded, "Failed codec %s:", c.Name())
+	}
+}
+
+func TestCSVCodec(t *testing.T) {
+	record := []string{"a", "b,c", "d\"e"}
+	data, err := Encode(CSVCodec{}, record)
+	assert.NoError(t, err)
+	assert.Equal(t, `a,"b,c","d""e"`, string(data))
+
+	decoded, err := Decode[[]string](CSVCodec{}, data)
+	assert.NoError(t, err)
+	assert.Equal(t, record, decoded)
+
+	_, err = Encode(CSVCodec{}, 42)
+	assert.ErrorIs(t, err, ErrUnsupportedType)
+}
+
+func TestLineCodec(t *testing.T) {
+	data, err := Encode(LineCodec{}, "hello\n")
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(data))
+
+	decoded, err := Decode[string](LineCodec{}, data)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", decoded)
+
+	_, err = Decode[int](LineCodec{}, data)
+	assert.ErrorIs(t, err, ErrUnsupportedType)
+}
+
+func TestReadWriteTyped(t *testing.T) {
+	var buff bytes.Buffer
+	stdin, stdout = &buff, &buff
+
+	stock := testStock{FIGI: "BBG000B9XRY4", Price: 133.7}
+	assert.NoError(t, WriteTyped(JSONCodec{}, stock))
+
+	decoded, err := ReadTyped[testStock](JSONCodec{})
+	assert.NoError(t, err)
+	assert.Equal(t, stock, decoded)
+}
+
+func TestTypedHandler(t *testing.T) {
+	h := TypedHandler(JSONCodec{}, func(ctx context.Context, in testStock) ([]testStock, error) {
+		in.Price *= 2
+		return []testStock{in}, nil
+	})
+
+	outputs, err := h.Handle(context.Background(), []byte(`{"FIGI":"A","Price":1.5}`))
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte(`{"FIGI":"A","Price":3}`)}, outputs)
+
+	_, err = h.Handle(context.Background(), []byte(`not json`))
+	assert.Error(t, err)
+}
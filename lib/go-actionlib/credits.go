@@ -0,0 +1,150 @@
+package actionlib
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// CreditsEnv is the environment variable, which runtime sets for sources
+// with limited unacknowledged output. In this case runtime grants credits
+// to the source through STDIN: a credit frame is a uint32 number of messages
+// and a uint32 number of bytes, which the source may additionally write.
+const CreditsEnv = "GOSTREAMING_CREDITS"
+
+// Possible flow control errors.
+var (
+	ErrWouldBlock = errors.New("output limit is reached, write would block")
+)
+
+var nonBlocking uint32
+
+// SetNonBlocking sets the mode of writing messages in sources with limited output.
+// In non-blocking mode the Write functions return ErrWouldBlock instead of waiting
+// for downstreams to acknowledge earlier messages. The mode does not affect RunSource.
+func SetNonBlocking(enabled bool) {
+	value := uint32(0)
+	if enabled {
+		value = 1
+	}
+	atomic.StoreUint32(&nonBlocking, value)
+}
+
+// creditWindow counts messages and bytes the source may write.
+// Credits are taken while both counters are positive, so a message larger
+// than the rest of bytes is still written and the counter becomes negative.
+type creditWindow struct {
+	lock     sync.Mutex
+	messages int64
+	bytes    int64
+	// changed is closed and replaced when credits are granted.
+	changed chan struct{}
+	err     error
+}
+
+func newCreditWindow(r io.Reader) *creditWindow {
+	c := &creditWindow{changed: make(chan struct{})}
+	go c.readGrants(r)
+	return c
+}
+
+var (
+	stdoutCredits     *creditWindow
+	stdoutCreditsOnce sync.Once
+)
+
+// outputCredits returns the window for STDOUT or nil if output is not limited.
+func outputCredits() *creditWindow {
+	stdoutCreditsOnce.Do(func() {
+		if os.Getenv(CreditsEnv) != "" {
+			stdoutCredits = newCreditWindow(stdin)
+		}
+	})
+	return stdoutCredits
+}
+
+func (c *creditWindow) readGrants(r io.Reader) {
+	for {
+		grant := struct {
+			Messages uint32
+			Bytes    uint32
+		}{}
+		err := binary.Read(r, binary.BigEndian, &grant)
+
+		c.lock.Lock()
+		if err != nil {
+			c.err = fmt.Errorf("read credits error: %w", err)
+		} else {
+			c.messages += int64(grant.Messages)
+			c.bytes += int64(grant.Bytes)
+		}
+		close(c.changed)
+		c.changed = make(chan struct{})
+		c.lock.Unlock()
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// acquire takes credits for messages with total length bytes.
+// If credits are not available, acquire waits for them or returns ErrWouldBlock if block is false.
+func (c *creditWindow) acquire(ctx context.Context, messages int, bytes int, block bool) error {
+	if messages == 0 {
+		return nil
+	}
+	for {
+		c.lock.Lock()
+		if c.messages > 0 && c.bytes > 0 {
+			c.messages -= int64(messages)
+			c.bytes -= int64(bytes)
+			c.lock.Unlock()
+			return nil
+		}
+		if c.err != nil {
+			err := c.err
+			c.lock.Unlock()
+			return err
+		}
+		if !block {
+			c.lock.Unlock()
+			return ErrWouldBlock
+		}
+		changed := c.changed
+		c.lock.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// acquireOutput takes credits for messages written to STDOUT, empty messages are free.
+func acquireOutput(messages ...[]byte) error {
+	credits := outputCredits()
+	if credits == nil {
+		return nil
+	}
+
+	count, bytes := outputSize(messages)
+	return credits.acquire(context.Background(), count, bytes, atomic.LoadUint32(&nonBlocking) == 0)
+}
+
+// outputSize returns the number and the total length of non-empty messages.
+func outputSize(messages [][]byte) (count int, bytes int) {
+	for _, message := range messages {
+		if len(message) != 0 {
+			count++
+			bytes += len(message)
+		}
+	}
+	return count, bytes
+}
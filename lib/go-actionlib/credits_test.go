@@ -0,0 +1,70 @@
+package actionlib
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeGrant(t *testing.T, w io.Writer, messages, bytes uint32) {
+	assert.NoError(t, binary.Write(w, binary.BigEndian, []uint32{messages, bytes}))
+}
+
+func TestCreditWindow(t *testing.T) {
+	r, w := io.Pipe()
+	credits := newCreditWindow(r)
+	ctx := context.Background()
+
+	writeGrant(t, w, 2, 10)
+	assert.NoError(t, credits.acquire(ctx, 1, 4, true))
+	assert.NoError(t, credits.acquire(ctx, 1, 4, false))
+	assert.ErrorIs(t, credits.acquire(ctx, 1, 4, false), ErrWouldBlock)
+	assert.NoError(t, credits.acquire(ctx, 0, 0, false))
+
+	writeGrant(t, w, 1, 1)
+	// Bytes are still positive, so a large message takes them all.
+	assert.NoError(t, credits.acquire(ctx, 1, 100, true))
+	writeGrant(t, w, 1, 10)
+	assert.ErrorIs(t, credits.acquire(ctx, 1, 1, false), ErrWouldBlock)
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	assert.ErrorIs(t, credits.acquire(canceled, 1, 1, true), context.Canceled)
+
+	w.Close()
+	assert.ErrorIs(t, credits.acquire(ctx, 1, 1, true), io.EOF)
+}
+
+func TestRunSourceCredits(t *testing.T) {
+	t.Setenv(CreditsEnv, "1")
+
+	in, grants := io.Pipe()
+	var out, errOut bytes.Buffer
+
+	n := 0
+	blocked := make(chan struct{})
+	emitter := EmitterFunc(func(ctx context.Context) ([][]byte, error) {
+		n++
+		if n == 3 {
+			close(blocked)
+		}
+		return [][]byte{[]byte(strconv.Itoa(n))}, nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- RunSource(ctx, emitter, WithStreams(in, &out, &errOut))
+	}()
+
+	writeGrant(t, grants, 2, 100)
+	<-blocked
+	cancel()
+	assert.NoError(t, <-done)
+	assert.Equal(t, []string{"1", "2"}, readOutput(t, &out))
+}
@@ -0,0 +1,36 @@
+package actionlib
+
+import "io"
+
+// controlReject finishes processing of the current input message without outputs
+// and asks runtime to move the message to the dead-letter queue of the node.
+// The payload is the reason of rejection.
+const controlReject uint8 = 8
+
+// MaxRejectReasonLength is the maximum length of a rejection reason, longer reasons are truncated.
+const MaxRejectReasonLength = 4096
+
+// Reject finishes processing of the current input message and tells runtime that
+// the action can not process it. Runtime moves the message with the reason to the
+// dead-letter node configured for the node or to the dead-letter queue of the scheme,
+// where it can be inspected and replayed. Outputs already written with
+// WriteMessagePart are forwarded as usual.
+func Reject(reason string) error {
+	return rejectMessage(stdout, reason)
+}
+
+func rejectMessage(w io.Writer, reason string) error {
+	if len(reason) > MaxRejectReasonLength {
+		reason = reason[:MaxRejectReasonLength]
+	}
+	return writeControl(w, controlReject, []byte(reason))
+}
+
+// rejection is returned by handle when the policy decides to reject the message.
+type rejection struct {
+	err error
+}
+
+func (r *rejection) Error() string {
+	return r.err.Error()
+}
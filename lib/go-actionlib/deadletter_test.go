@@ -0,0 +1,70 @@
+package actionlib
+
+import (
+	"bytes"
+	"context"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func readReject(t *testing.T, r *bytes.Buffer) string {
+	controlType, payload := readControlFrame(t, r)
+	assert.Equal(t, controlReject, controlType)
+	return string(payload)
+}
+
+func TestReject(t *testing.T) {
+	var out bytes.Buffer
+	stdout = &out
+
+	assert.NoError(t, Reject("bad message"))
+	assert.Equal(t, "bad message", readReject(t, &out))
+
+	assert.NoError(t, Reject(strings.Repeat("x", MaxRejectReasonLength+1)))
+	assert.Len(t, readReject(t, &out), MaxRejectReasonLength)
+	assert.Zero(t, out.Len())
+}
+
+func atoiHandler() Handler {
+	return HandlerFunc(func(ctx context.Context, message []byte) ([][]byte, error) {
+		n, err := strconv.Atoi(string(message))
+		if err != nil {
+			return nil, err
+		}
+		return [][]byte{[]byte(strconv.Itoa(n * 10))}, nil
+	})
+}
+
+func TestRunDeadLetterPolicy(t *testing.T) {
+	var in, out, errOut bytes.Buffer
+	writeInput(t, &in, "1", "bad", "2")
+
+	policy := RetryPolicy(1, DeadLetterPolicy())
+	assert.NoError(t, Run(context.Background(), atoiHandler(), WithStreams(&in, &out, &errOut), WithSignals(), WithErrorPolicy(policy)))
+
+	assert.Equal(t, []string{"10"}, readOutput(t, bytes.NewReader(out.Next(6))))
+	assert.Contains(t, readReject(t, &out), "bad")
+	assert.Equal(t, []string{"20"}, readOutput(t, &out))
+	assert.Empty(t, errOut.String())
+}
+
+func TestRunBatchingDeadLetter(t *testing.T) {
+	t.Setenv(BatchEnv, "10")
+
+	var in, out, errOut bytes.Buffer
+	writeInputBatch(t, &in, "1", "bad", "2")
+
+	assert.NoError(t, Run(context.Background(), atoiHandler(), WithStreams(&in, &out, &errOut), WithSignals(), WithErrorPolicy(DeadLetterPolicy()), WithBatching()))
+
+	controlType, _ := readControlFrame(t, &out)
+	assert.Equal(t, controlBatchOptIn, controlType)
+
+	// The rejection is placed between the outputs of the neighbouring messages.
+	assert.Equal(t, []string{"10"}, readBatchOutput(t, &out))
+	assert.Contains(t, readReject(t, &out), "bad")
+	assert.Equal(t, []string{"20"}, readBatchOutput(t, &out))
+	assert.Zero(t, out.Len())
+}
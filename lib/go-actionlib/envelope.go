@@ -0,0 +1,187 @@
+package actionlib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+// MetadataFlag is set in the length prefix of a frame when the message data
+// is preceded by a metadata block: uint32 length of the block and the block itself.
+const MetadataFlag uint32 = 1 << 30
+
+// MaxMetadataLength is the maximum length of an encoded metadata block.
+const MaxMetadataLength = 1 << 20
+
+const metadataVersion uint8 = 1
+
+// Possible metadata errors.
+var (
+	ErrMetadataTooLong    = errors.New("metadata is too long")
+	ErrBadMetadataVersion = errors.New("unknown metadata version")
+)
+
+// Envelope is a message with its metadata.
+type Envelope struct {
+	// Key is an optional partition key of the message.
+	Key []byte
+	// Timestamp is an optional event time of the message.
+	Timestamp time.Time
+	// Headers is an optional set of user headers.
+	Headers map[string]string
+	// Data is the payload of the message.
+	Data []byte
+}
+
+// HasMetadata returns true if any of the metadata fields is set.
+func (e *Envelope) HasMetadata() bool {
+	return len(e.Key) != 0 || !e.Timestamp.IsZero() || len(e.Headers) != 0
+}
+
+// EncodeMetadata encodes metadata of e to a metadata block.
+//
+// The block consists of a version byte, a uint16 length prefixed key,
+// an int64 timestamp in unix nanoseconds (0 if not set), a uint16 number of headers
+// and the headers as uint16 length prefixed names and values.
+func EncodeMetadata(e *Envelope) ([]byte, error) {
+	if len(e.Key) > math.MaxUint16 || len(e.Headers) > math.MaxUint16 {
+		return nil, ErrMetadataTooLong
+	}
+
+	var buff bytes.Buffer
+	buff.WriteByte(metadataVersion)
+	writeShortBytes(&buff, e.Key)
+
+	timestamp := int64(0)
+	if !e.Timestamp.IsZero() {
+		timestamp = e.Timestamp.UnixNano()
+	}
+	binary.Write(&buff, binary.BigEndian, timestamp)
+
+	binary.Write(&buff, binary.BigEndian, uint16(len(e.Headers)))
+	for name, value := range e.Headers {
+		if len(name) > math.MaxUint16 || len(value) > math.MaxUint16 {
+			return nil, ErrMetadataTooLong
+		}
+		writeShortBytes(&buff, []byte(name))
+		writeShortBytes(&buff, []byte(value))
+	}
+
+	if buff.Len() > MaxMetadataLength {
+		return nil, ErrMetadataTooLong
+	}
+	return buff.Bytes(), nil
+}
+
+// DecodeMetadata decodes metadata block to e.
+func DecodeMetadata(data []byte, e *Envelope) error {
+	r := bytes.NewReader(data)
+
+	version, err := r.ReadByte()
+	if err != nil {
+		return fmt.Errorf("read metadata version error: %w", err)
+	}
+	if version != metadataVersion {
+		return fmt.Errorf("%d: %w", version, ErrBadMetadataVersion)
+	}
+
+	if e.Key, err = readShortBytes(r); err != nil {
+		return fmt.Errorf("read key error: %w", err)
+	}
+
+	timestamp := int64(0)
+	if err := binary.Read(r, binary.BigEndian, &timestamp); err != nil {
+		return fmt.Errorf("read timestamp error: %w", err)
+	}
+	e.Timestamp = time.Time{}
+	if timestamp != 0 {
+		e.Timestamp = time.Unix(0, timestamp)
+	}
+
+	headersCount := uint16(0)
+	if err := binary.Read(r, binary.BigEndian, &headersCount); err != nil {
+		return fmt.Errorf("read headers count error: %w", err)
+	}
+	e.Headers = nil
+	if headersCount != 0 {
+		e.Headers = make(map[string]string, headersCount)
+	}
+	for i := 0; i < int(headersCount); i++ {
+		name, err := readShortBytes(r)
+		if err != nil {
+			return fmt.Errorf("read header name error: %w", err)
+		}
+		value, err := readShortBytes(r)
+		if err != nil {
+			return fmt.Errorf("read header value error: %w", err)
+		}
+		e.Headers[string(name)] = string(value)
+	}
+	return nil
+}
+
+func writeShortBytes(w io.Writer, data []byte) {
+	binary.Write(w, binary.BigEndian, uint16(len(data)))
+	w.Write(data)
+}
+
+func readShortBytes(r io.Reader) ([]byte, error) {
+	length := uint16(0)
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	if length == 0 {
+		return nil, nil
+	}
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// ReadEnvelope reads message with its metadata from input dataflow.
+// Runtime passes metadata only to nodes with enabled metadata in the scheme.
+func ReadEnvelope() (*Envelope, error) {
+	e, err := readNextEnvelope()
+	if err != nil {
+		return nil, err
+	}
+	nextInput()
+	return e, nil
+}
+
+// WriteEnvelope writes message with its metadata to output dataflow.
+// WriteEnvelope finishes processing of the current input message.
+func WriteEnvelope(e *Envelope) error {
+	return writeEnvelope(e, 0)
+}
+
+// WriteEnvelopePart writes message with its metadata to output dataflow without
+// finishing processing of the current input message, as WriteMessagePart does.
+func WriteEnvelopePart(e *Envelope) error {
+	if len(e.Data) == 0 {
+		return ErrEmptyMessage
+	}
+	return writeEnvelope(e, MoreMessagesFlag)
+}
+
+func writeEnvelope(e *Envelope, flags uint32) error {
+	if err := acquireOutput(e.Data); err != nil {
+		return err
+	}
+	if !e.HasMetadata() {
+		return writeFrame(stdout, nil, e.Data, flags)
+	}
+
+	metadata, err := EncodeMetadata(e)
+	if err != nil {
+		return fmt.Errorf("encode metadata error: %w", err)
+	}
+	return writeFrame(stdout, metadata, e.Data, flags|MetadataFlag)
+}
@@ -0,0 +1,62 @@
+package actionlib
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetadata(t *testing.T) {
+	e := &Envelope{
+		Key:       []byte("BBG000B9XRY4"),
+		Timestamp: time.Unix(1621234567, 1337),
+		Headers:   map[string]string{"source": "tcs", "trace": ""},
+	}
+	metadata, err := EncodeMetadata(e)
+	assert.NoError(t, err)
+
+	decoded := &Envelope{}
+	assert.NoError(t, DecodeMetadata(metadata, decoded))
+	assert.Equal(t, e.Key, decoded.Key)
+	assert.True(t, e.Timestamp.Equal(decoded.Timestamp))
+	assert.Equal(t, e.Headers, decoded.Headers)
+
+	assert.ErrorIs(t, DecodeMetadata([]byte{42}, decoded), ErrBadMetadataVersion)
+	assert.Error(t, DecodeMetadata(metadata[:5], decoded))
+}
+
+func TestReadWriteEnvelope(t *testing.T) {
+	var buff bytes.Buffer
+	stdin, stdout = &buff, &buff
+
+	envelopes := []*Envelope{
+		{Data: []byte("plain")},
+		{Key: []byte("key"), Data: []byte("keyed")},
+		{Timestamp: time.Unix(0, 42), Headers: map[string]string{"a": "b"}, Data: []byte("stamped")},
+	}
+	assert.NoError(t, WriteEnvelopePart(envelopes[0]))
+	assert.NoError(t, WriteEnvelopePart(envelopes[1]))
+	assert.NoError(t, WriteEnvelope(envelopes[2]))
+	assert.ErrorIs(t, WriteEnvelopePart(&Envelope{Key: []byte("key")}), ErrEmptyMessage)
+
+	for i, e := range envelopes {
+		got, err := ReadEnvelope()
+		assert.NoError(t, err)
+		assert.Equalf(t, e.Key, got.Key, "Failed key check #%d:", i)
+		assert.Truef(t, e.Timestamp.Equal(got.Timestamp), "Failed timestamp check #%d:", i)
+		assert.Equalf(t, e.Headers, got.Headers, "Failed headers check #%d:", i)
+		assert.Equalf(t, e.Data, got.Data, "Failed data check #%d:", i)
+	}
+}
+
+func TestReadMessageSkipsMetadata(t *testing.T) {
+	var buff bytes.Buffer
+	stdin, stdout = &buff, &buff
+
+	assert.NoError(t, WriteEnvelope(&Envelope{Key: []byte("key"), Data: []byte("data")}))
+	data, err := ReadMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, "data", string(data))
+}
@@ -10,7 +10,13 @@ var stderr io.Writer = os.Stderr
 
 // WriteError sends an error to runtime.
 func WriteError(err error) {
-	fmt.Fprintf(stderr, err.Error())
+	writeError(stderr, err)
+}
+
+func writeError(w io.Writer, err error) {
+	stderrMutex.Lock()
+	defer stderrMutex.Unlock()
+	fmt.Fprint(w, err.Error())
 }
 
 // WriteFatal sends an fatal error to runtime.
@@ -0,0 +1,104 @@
+package actionlib
+
+import (
+	"context"
+	"encoding/binary"
+	"time"
+)
+
+// Control frame types of events. Both carry an int64 time of the event in unix nanoseconds.
+const (
+	controlTick     uint8 = 6
+	controlShutdown uint8 = 7
+)
+
+// EventType is the type of an event read with ReadEvent.
+type EventType uint8
+
+// Possible event types.
+const (
+	// EventMessage is an input message.
+	EventMessage EventType = iota
+	// EventTick is sent by runtime periodically with the interval from the node description.
+	EventTick
+	// EventShutdown is sent by runtime before the action is stopped. It is the last chance
+	// to write buffered outputs, runtime waits for the answer within the shutdown timeout.
+	EventShutdown
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventMessage:
+		return "message"
+	case EventTick:
+		return "tick"
+	case EventShutdown:
+		return "shutdown"
+	default:
+		return "unknown"
+	}
+}
+
+// Event is an input message or a timer event delivered by runtime.
+// Every event must be answered as an input message: with outputs or AckMessage.
+type Event struct {
+	Type EventType
+	// Envelope is the input message of EventMessage.
+	Envelope *Envelope
+	// Time is the time runtime generated a tick or a shutdown notice.
+	Time time.Time
+}
+
+// EventHandler is a Handler, which also handles events. Run declares CapabilityEvents
+// for it, so runtime delivers ticks and the shutdown notice to the action.
+// Outputs of HandleEvent are not bound to any input message.
+type EventHandler interface {
+	Handler
+	HandleEvent(ctx context.Context, e *Event) ([][]byte, error)
+}
+
+// ReadEvent reads the next input message or event. The action must declare
+// CapabilityEvents with Ready, otherwise runtime sends only input messages.
+// Changes of State made while processing an event are committed immediately.
+func ReadEvent() (*Event, error) {
+	if len(pendingInputs) != 0 {
+		e, err := readNextEnvelope()
+		if err != nil {
+			return nil, err
+		}
+		nextInput()
+		return &Event{Type: EventMessage, Envelope: e}, nil
+	}
+
+	envelopes, event, err := readFrames(stdin, replyProbe(stdout))
+	if err != nil {
+		return nil, err
+	}
+	if event != nil {
+		beginEvent()
+		return event, nil
+	}
+
+	pendingInputs = envelopes
+	e, err := readNextEnvelope()
+	if err != nil {
+		return nil, err
+	}
+	nextInput()
+	return &Event{Type: EventMessage, Envelope: e}, nil
+}
+
+func decodeEvent(controlType uint8, payload []byte) (*Event, error) {
+	if len(payload) != 8 {
+		return nil, ErrBadControlFrame
+	}
+
+	event := &Event{
+		Type: EventTick,
+		Time: time.Unix(0, int64(binary.BigEndian.Uint64(payload))),
+	}
+	if controlType == controlShutdown {
+		event.Type = EventShutdown
+	}
+	return event, nil
+}
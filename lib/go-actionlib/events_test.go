@@ -0,0 +1,91 @@
+package actionlib
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeEvent(t *testing.T, w *bytes.Buffer, controlType uint8, at time.Time) {
+	payload := make([]byte, 8)
+	binary.BigEndian.PutUint64(payload, uint64(at.UnixNano()))
+	assert.NoError(t, writeControl(w, controlType, payload))
+}
+
+func TestReadEvent(t *testing.T) {
+	var in, out bytes.Buffer
+	stdin, stdout = &in, &out
+
+	at := time.Unix(100, 5)
+	writeEvent(t, &in, controlTick, at)
+	writeInputBatch(t, &in, "a", "b")
+	writeEvent(t, &in, controlShutdown, at)
+
+	event, err := ReadEvent()
+	assert.NoError(t, err)
+	assert.Equal(t, EventTick, event.Type)
+	assert.True(t, at.Equal(event.Time))
+	assert.Zero(t, currentInput())
+
+	for _, data := range []string{"a", "b"} {
+		event, err = ReadEvent()
+		assert.NoError(t, err)
+		assert.Equal(t, EventMessage, event.Type)
+		assert.Equal(t, []byte(data), event.Envelope.Data)
+		assert.NotZero(t, currentInput())
+	}
+
+	event, err = ReadEvent()
+	assert.NoError(t, err)
+	assert.Equal(t, EventShutdown, event.Type)
+	assert.Zero(t, out.Len())
+}
+
+func TestReadMessageSkipsEvents(t *testing.T) {
+	var in, out bytes.Buffer
+	stdin, stdout = &in, &out
+
+	writeEvent(t, &in, controlTick, time.Now())
+	writeInput(t, &in, "a")
+
+	message, err := ReadMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("a"), message)
+	// The tick is answered without outputs.
+	assert.Equal(t, []string{""}, readOutput(t, &out))
+}
+
+type flushingHandler struct {
+	buffered [][]byte
+}
+
+func (h *flushingHandler) Handle(ctx context.Context, message []byte) ([][]byte, error) {
+	h.buffered = append(h.buffered, message)
+	return nil, nil
+}
+
+func (h *flushingHandler) HandleEvent(ctx context.Context, e *Event) ([][]byte, error) {
+	outputs := h.buffered
+	h.buffered = nil
+	return outputs, nil
+}
+
+func TestRunEvents(t *testing.T) {
+	t.Setenv(ProtocolEnv, "1")
+
+	var in, out, errOut bytes.Buffer
+	writeInput(t, &in, "a", "b")
+	writeEvent(t, &in, controlTick, time.Now())
+	writeInput(t, &in, "c")
+	writeEvent(t, &in, controlShutdown, time.Now())
+
+	assert.NoError(t, Run(context.Background(), &flushingHandler{}, WithStreams(&in, &out, &errOut), WithSignals()))
+
+	_, capabilities := readReady(t, &out)
+	assert.Equal(t, CapabilityProbes|CapabilityEvents, capabilities)
+	assert.Equal(t, []string{"", "", "a+", "b", "", "c"}, readOutput(t, &out))
+}
@@ -0,0 +1,87 @@
+package actionlib
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+)
+
+// ProtocolEnv is the environment variable with the protocol version of runtime.
+// Runtime sets it if it supports the ready handshake and control frames.
+const ProtocolEnv = "GOSTREAMING_PROTOCOL"
+
+// ProtocolVersion is the latest protocol version supported by the library.
+const ProtocolVersion uint16 = 1
+
+// Capabilities are features the action supports, declared in the ready handshake.
+type Capabilities uint32
+
+// Possible capabilities.
+const (
+	// CapabilityProbes means the action answers health probes of runtime,
+	// which is true when it reads input with ReadMessage, ReadBatch or Run.
+	CapabilityProbes Capabilities = 1 << iota
+	// CapabilityBatch means the action reads batch frames, see EnableBatching.
+	CapabilityBatch
+	// CapabilityEvents means the action reads events with ReadEvent, see EventHandler.
+	CapabilityEvents
+)
+
+// Control frame types of the handshake and health probes.
+const (
+	// controlReady carries a uint16 protocol version and uint32 capabilities.
+	controlReady uint8 = 3
+	// controlProbe carries a uint64 probe number, which is sent back with controlProbeReply.
+	controlProbe      uint8 = 4
+	controlProbeReply uint8 = 5
+)
+
+// Possible handshake errors.
+var (
+	ErrHandshakeDisabled = errors.New("handshake is not supported by runtime")
+)
+
+// Ready tells runtime that the action is initialized and declares its capabilities.
+// If the node requires a handshake, runtime waits for Ready before considering the action running.
+// Run and RunSource call it automatically. ErrHandshakeDisabled is returned
+// if runtime does not support the handshake.
+func Ready(capabilities Capabilities) error {
+	return ready(stdout, capabilities)
+}
+
+func ready(w io.Writer, capabilities Capabilities) error {
+	version, err := runtimeProtocol()
+	if err != nil {
+		return err
+	}
+	if version > ProtocolVersion {
+		version = ProtocolVersion
+	}
+
+	payload := make([]byte, 6)
+	binary.BigEndian.PutUint16(payload, version)
+	binary.BigEndian.PutUint32(payload[2:], uint32(capabilities))
+	return writeControl(w, controlReady, payload)
+}
+
+func runtimeProtocol() (uint16, error) {
+	rawVersion := os.Getenv(ProtocolEnv)
+	if rawVersion == "" {
+		return 0, ErrHandshakeDisabled
+	}
+	version, err := strconv.ParseUint(rawVersion, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("can not parse protocol version %q: %w", rawVersion, err)
+	}
+	return uint16(version), nil
+}
+
+// replyProbe returns a probe handler, which answers probes by writing to w.
+func replyProbe(w io.Writer) func(payload []byte) error {
+	return func(payload []byte) error {
+		return writeControl(w, controlProbeReply, payload)
+	}
+}
@@ -0,0 +1,103 @@
+package actionlib
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeProbe(t *testing.T, w *bytes.Buffer, n uint64) {
+	payload := make([]byte, 8)
+	binary.BigEndian.PutUint64(payload, n)
+	assert.NoError(t, writeControl(w, controlProbe, payload))
+}
+
+func readReady(t *testing.T, r *bytes.Buffer) (uint16, Capabilities) {
+	controlType, payload := readControlFrame(t, r)
+	assert.Equal(t, controlReady, controlType)
+	if !assert.Len(t, payload, 6) {
+		return 0, 0
+	}
+	return binary.BigEndian.Uint16(payload), Capabilities(binary.BigEndian.Uint32(payload[2:]))
+}
+
+func readProbeReply(t *testing.T, r *bytes.Buffer) uint64 {
+	controlType, payload := readControlFrame(t, r)
+	assert.Equal(t, controlProbeReply, controlType)
+	if !assert.Len(t, payload, 8) {
+		return 0
+	}
+	return binary.BigEndian.Uint64(payload)
+}
+
+func TestReady(t *testing.T) {
+	var out bytes.Buffer
+	stdout = &out
+
+	assert.ErrorIs(t, Ready(CapabilityProbes), ErrHandshakeDisabled)
+	assert.Zero(t, out.Len())
+
+	t.Setenv(ProtocolEnv, "100")
+	assert.NoError(t, Ready(CapabilityProbes|CapabilityBatch))
+	version, capabilities := readReady(t, &out)
+	assert.Equal(t, ProtocolVersion, version)
+	assert.Equal(t, CapabilityProbes|CapabilityBatch, capabilities)
+
+	t.Setenv(ProtocolEnv, "bad")
+	assert.Error(t, Ready(0))
+}
+
+func TestReadMessageProbe(t *testing.T) {
+	var in, out bytes.Buffer
+	stdin, stdout = &in, &out
+
+	writeProbe(t, &in, 1)
+	writeProbe(t, &in, 2)
+	writeInput(t, &in, "a")
+
+	message, err := ReadMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("a"), message)
+	assert.Equal(t, uint64(1), readProbeReply(t, &out))
+	assert.Equal(t, uint64(2), readProbeReply(t, &out))
+	assert.Zero(t, out.Len())
+}
+
+func TestRunProbes(t *testing.T) {
+	t.Setenv(ProtocolEnv, "1")
+
+	var in, out, errOut bytes.Buffer
+	writeProbe(t, &in, 1)
+	writeInput(t, &in, "a")
+	writeProbe(t, &in, 2)
+
+	handler := HandlerFunc(func(ctx context.Context, message []byte) ([][]byte, error) {
+		return [][]byte{message}, nil
+	})
+	assert.NoError(t, Run(context.Background(), handler, WithStreams(&in, &out, &errOut), WithSignals()))
+
+	_, capabilities := readReady(t, &out)
+	assert.Equal(t, CapabilityProbes, capabilities)
+	assert.Equal(t, uint64(1), readProbeReply(t, &out))
+	assert.Equal(t, []string{"a"}, readOutput(t, bytes.NewReader(out.Next(5))))
+	assert.Equal(t, uint64(2), readProbeReply(t, &out))
+	assert.Zero(t, out.Len())
+}
+
+func TestRunSourceReady(t *testing.T) {
+	t.Setenv(ProtocolEnv, "1")
+
+	var in, out, errOut bytes.Buffer
+	emitter := EmitterFunc(func(ctx context.Context) ([][]byte, error) {
+		return nil, context.Canceled
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.NoError(t, RunSource(ctx, emitter, WithStreams(&in, &out, &errOut), WithSignals()))
+
+	_, capabilities := readReady(t, &out)
+	assert.Zero(t, capabilities)
+}
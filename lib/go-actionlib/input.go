@@ -10,16 +10,50 @@ import (
 var stdin io.Reader = os.Stdin
 
 // ReadMessage reads message from input dataflow.
+// Metadata of the message, if any, is skipped, use ReadEnvelope to get it.
 func ReadMessage() ([]byte, error) {
+	e, err := readNextEnvelope()
+	if err != nil {
+		return nil, err
+	}
+	nextInput()
+	return e.Data, nil
+}
+
+// readEnvelope reads a single data frame from r.
+func readEnvelope(r io.Reader) (*Envelope, error) {
 	messageLength := uint32(0)
-	if err := binary.Read(stdin, binary.BigEndian, &messageLength); err != nil {
+	if err := binary.Read(r, binary.BigEndian, &messageLength); err != nil {
 		return nil, fmt.Errorf("read message header error: %w", err)
 	}
+	return readEnvelopeBody(r, messageLength)
+}
+
+// readEnvelopeBody reads metadata and data of a frame with the length prefix messageLength.
+func readEnvelopeBody(r io.Reader, messageLength uint32) (*Envelope, error) {
+	e := &Envelope{}
+	if messageLength&MetadataFlag != 0 {
+		metadataLength := uint32(0)
+		if err := binary.Read(r, binary.BigEndian, &metadataLength); err != nil {
+			return nil, fmt.Errorf("read metadata header error: %w", err)
+		}
+		if metadataLength > MaxMetadataLength {
+			return nil, ErrMetadataTooLong
+		}
+
+		metadata := make([]byte, metadataLength)
+		if err := binary.Read(r, binary.BigEndian, metadata); err != nil {
+			return nil, fmt.Errorf("read metadata error: %w", err)
+		}
+		if err := DecodeMetadata(metadata, e); err != nil {
+			return nil, fmt.Errorf("decode metadata error: %w", err)
+		}
+	}
 
-	data := make([]byte, messageLength)
-	if err := binary.Read(stdin, binary.BigEndian, data); err != nil {
+	e.Data = make([]byte, messageLength&lengthMask)
+	if err := binary.Read(r, binary.BigEndian, e.Data); err != nil {
 		return nil, fmt.Errorf("read message data error: %w", err)
 	}
 
-	return data, nil
+	return e, nil
 }
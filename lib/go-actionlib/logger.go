@@ -0,0 +1,98 @@
+package actionlib
+
+import "fmt"
+
+// LogRecordKind is the kind of framed log records.
+const LogRecordKind = "log"
+
+// Level is the level of log record.
+type Level string
+
+// Log levels.
+const (
+	LevelDebug Level = "debug"
+	LevelInfo  Level = "info"
+	LevelWarn  Level = "warn"
+	LevelError Level = "error"
+)
+
+// LogRecord is a structured log record sent to runtime.
+type LogRecord struct {
+	Level   Level                  `json:"level"`
+	Message string                 `json:"msg"`
+	Fields  map[string]interface{} `json:"fields,omitempty"`
+}
+
+// Logger sends leveled structured records to runtime,
+// which writes them to its log with the same level and fields.
+type Logger struct {
+	fields map[string]interface{}
+}
+
+// NewLogger creates a new Logger without fields.
+func NewLogger() *Logger {
+	return &Logger{}
+}
+
+// With returns a Logger which adds keysAndValues to every record.
+func (l *Logger) With(keysAndValues ...interface{}) *Logger {
+	fields := make(map[string]interface{}, len(l.fields)+len(keysAndValues)/2)
+	for k, v := range l.fields {
+		fields[k] = v
+	}
+	addFields(fields, keysAndValues)
+	return &Logger{fields: fields}
+}
+
+// Debug sends a debug record with additional key-value pairs.
+func (l *Logger) Debug(msg string, keysAndValues ...interface{}) error {
+	return l.Log(LevelDebug, msg, keysAndValues...)
+}
+
+// Info sends an info record with additional key-value pairs.
+func (l *Logger) Info(msg string, keysAndValues ...interface{}) error {
+	return l.Log(LevelInfo, msg, keysAndValues...)
+}
+
+// Warn sends a warning record with additional key-value pairs.
+func (l *Logger) Warn(msg string, keysAndValues ...interface{}) error {
+	return l.Log(LevelWarn, msg, keysAndValues...)
+}
+
+// Error sends an error record with additional key-value pairs.
+func (l *Logger) Error(msg string, keysAndValues ...interface{}) error {
+	return l.Log(LevelError, msg, keysAndValues...)
+}
+
+// Log sends a record with the given level.
+func (l *Logger) Log(level Level, msg string, keysAndValues ...interface{}) error {
+	record := &LogRecord{
+		Level:   level,
+		Message: msg,
+	}
+	if len(l.fields) != 0 || len(keysAndValues) != 0 {
+		record.Fields = make(map[string]interface{}, len(l.fields)+len(keysAndValues)/2)
+		for k, v := range l.fields {
+			record.Fields[k] = v
+		}
+		addFields(record.Fields, keysAndValues)
+	}
+	return writeRecord(LogRecordKind, record)
+}
+
+func addFields(fields map[string]interface{}, keysAndValues []interface{}) {
+	for i := 0; i < len(keysAndValues); i += 2 {
+		key := fmt.Sprint(keysAndValues[i])
+		if i+1 == len(keysAndValues) {
+			fields[key] = nil
+			break
+		}
+
+		value := keysAndValues[i+1]
+		// errors are not serializable by encoding/json.
+		if err, ok := value.(error); ok {
+			value = err.Error()
+		}
+		fields[key] = value
+	}
+}
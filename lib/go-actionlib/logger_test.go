@@ -0,0 +1,51 @@
+package actionlib
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func readRecord(t *testing.T, r *bufio.Reader, kind string, payload interface{}) {
+	line, err := r.ReadBytes('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, RecordSeparator, line[0])
+
+	prefix := string(line[1:]) + " "
+	assert.Equal(t, kind+" ", prefix[:len(kind)+1])
+	assert.NoError(t, json.Unmarshal(line[len(kind)+2:], payload))
+}
+
+func TestLogger(t *testing.T) {
+	var buff bytes.Buffer
+	stderr = &buff
+
+	logger := NewLogger().With("request_id", "abc")
+	assert.NoError(t, logger.Info("multi\nline", "count", 3))
+	assert.NoError(t, logger.Error("failed", "error", errors.New("boom"), "odd"))
+	assert.NoError(t, NewLogger().Debug("plain"))
+
+	r := bufio.NewReader(&buff)
+
+	record := &LogRecord{}
+	readRecord(t, r, LogRecordKind, record)
+	assert.Equal(t, LevelInfo, record.Level)
+	assert.Equal(t, "multi\nline", record.Message)
+	assert.Equal(t, map[string]interface{}{"request_id": "abc", "count": float64(3)}, record.Fields)
+
+	record = &LogRecord{}
+	readRecord(t, r, LogRecordKind, record)
+	assert.Equal(t, LevelError, record.Level)
+	assert.Equal(t, map[string]interface{}{"request_id": "abc", "error": "boom", "odd": nil}, record.Fields)
+
+	record = &LogRecord{}
+	readRecord(t, r, LogRecordKind, record)
+	assert.Equal(t, LevelDebug, record.Level)
+	assert.Nil(t, record.Fields)
+
+	assert.Zero(t, r.Buffered())
+}
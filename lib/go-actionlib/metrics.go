@@ -0,0 +1,77 @@
+package actionlib
+
+// MetricRecordKind is the kind of framed metric records.
+const MetricRecordKind = "metric"
+
+// MetricType is the type of metric.
+type MetricType string
+
+// Metric types.
+const (
+	MetricCounter   MetricType = "counter"
+	MetricGauge     MetricType = "gauge"
+	MetricHistogram MetricType = "histogram"
+)
+
+// MetricSample is a single metric sample sent to runtime.
+// Runtime sums samples of counters, keeps the last sample of gauges
+// and keeps count, sum, min and max of histogram samples.
+type MetricSample struct {
+	Name  string     `json:"name"`
+	Type  MetricType `json:"type"`
+	Value float64    `json:"value"`
+}
+
+func writeSample(name string, t MetricType, value float64) error {
+	return writeRecord(MetricRecordKind, &MetricSample{Name: name, Type: t, Value: value})
+}
+
+// Counter is a monotonically increasing metric, e.g. number of filtered messages.
+type Counter struct {
+	name string
+}
+
+// NewCounter creates a new Counter.
+func NewCounter(name string) *Counter {
+	return &Counter{name: name}
+}
+
+// Inc increases the counter by 1.
+func (c *Counter) Inc() error {
+	return c.Add(1)
+}
+
+// Add increases the counter by delta, delta must not be negative.
+func (c *Counter) Add(delta float64) error {
+	return writeSample(c.name, MetricCounter, delta)
+}
+
+// Gauge is a metric which value can go up and down, e.g. size of a buffer.
+type Gauge struct {
+	name string
+}
+
+// NewGauge creates a new Gauge.
+func NewGauge(name string) *Gauge {
+	return &Gauge{name: name}
+}
+
+// Set sets the current value of the gauge.
+func (g *Gauge) Set(value float64) error {
+	return writeSample(g.name, MetricGauge, value)
+}
+
+// Histogram is a metric which summarizes observations, e.g. latency of DB inserts.
+type Histogram struct {
+	name string
+}
+
+// NewHistogram creates a new Histogram.
+func NewHistogram(name string) *Histogram {
+	return &Histogram{name: name}
+}
+
+// Observe adds an observation to the histogram.
+func (h *Histogram) Observe(value float64) error {
+	return writeSample(h.name, MetricHistogram, value)
+}
@@ -0,0 +1,32 @@
+package actionlib
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetrics(t *testing.T) {
+	var buff bytes.Buffer
+	stderr = &buff
+
+	assert.NoError(t, NewCounter("filtered").Inc())
+	assert.NoError(t, NewGauge("buffer_size").Set(42))
+	assert.NoError(t, NewHistogram("insert_latency").Observe(0.25))
+
+	expected := []MetricSample{
+		{Name: "filtered", Type: MetricCounter, Value: 1},
+		{Name: "buffer_size", Type: MetricGauge, Value: 42},
+		{Name: "insert_latency", Type: MetricHistogram, Value: 0.25},
+	}
+
+	r := bufio.NewReader(&buff)
+	for i, sample := range expected {
+		got := MetricSample{}
+		readRecord(t, r, MetricRecordKind, &got)
+		assert.Equalf(t, sample, got, "Failed #%d:", i)
+	}
+	assert.Zero(t, r.Buffered())
+}
@@ -2,29 +2,111 @@ package actionlib
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 )
 
+// MoreMessagesFlag is set in the length prefix of an output frame
+// when more output frames for the same input message follow.
+const MoreMessagesFlag uint32 = 1 << 31
+
+// lengthMask selects message length from the length prefix of a frame.
+const lengthMask = MetadataFlag - 1
+
+// MaxMessageLength is the maximum length of a single message.
+const MaxMessageLength = int(lengthMask)
+
+// Possible output errors.
+var (
+	ErrMessageTooLong = errors.New("message is too long")
+	ErrEmptyMessage   = errors.New("message part can not be empty")
+)
+
 var stdout io.Writer = os.Stdout
 
 // WriteMessage writes message to output dataflow.
+// WriteMessage finishes processing of the current input message.
+// In a source with limited output WriteMessage waits for credits, see CreditsEnv.
 func WriteMessage(message []byte) error {
-	messageLength := uint32(len(message))
-	if err := binary.Write(stdout, binary.BigEndian, messageLength); err != nil {
-		return fmt.Errorf("write message header error: %w", err)
+	if err := acquireOutput(message); err != nil {
+		return err
 	}
-	if err := binary.Write(stdout, binary.BigEndian, message); err != nil {
-		return fmt.Errorf("write message data error: %w", err)
+	return writeFrame(stdout, nil, message, 0)
+}
+
+// WriteMessagePart writes message to output dataflow without finishing
+// processing of the current input message. Processing must be finished
+// with WriteMessage, WriteMessages or AckMessage.
+func WriteMessagePart(message []byte) error {
+	if err := acquireOutput(message); err != nil {
+		return err
 	}
-	return nil
+	return writeMessagePart(stdout, message)
+}
+
+func writeMessagePart(w io.Writer, message []byte) error {
+	if len(message) == 0 {
+		return ErrEmptyMessage
+	}
+	return writeFrame(w, nil, message, MoreMessagesFlag)
+}
+
+// WriteMessages writes several messages produced from the current input message
+// and finishes its processing. If messages is empty, the input message is acknowledged.
+func WriteMessages(messages ...[]byte) error {
+	if err := acquireOutput(messages...); err != nil {
+		return err
+	}
+	return writeMessages(stdout, messages)
+}
+
+func writeMessages(w io.Writer, messages [][]byte) error {
+	if len(messages) == 0 {
+		return ackMessage(w)
+	}
+
+	for i, message := range messages[:len(messages)-1] {
+		if err := writeMessagePart(w, message); err != nil {
+			return fmt.Errorf("write message #%d error: %w", i, err)
+		}
+	}
+	return writeFrame(w, nil, messages[len(messages)-1], 0)
 }
 
 // AckMessage method required to acknowledge the message without sending data.
+// After WriteMessagePart it marks the end of outputs for the current input message.
 func AckMessage() error {
-	if err := binary.Write(stdout, binary.BigEndian, uint32(0)); err != nil {
+	return ackMessage(stdout)
+}
+
+func ackMessage(w io.Writer) error {
+	if err := binary.Write(w, binary.BigEndian, uint32(0)); err != nil {
 		return fmt.Errorf("write ACK error: %w", err)
 	}
 	return nil
 }
+
+func writeFrame(w io.Writer, metadata, message []byte, flags uint32) error {
+	if len(message) > MaxMessageLength {
+		return ErrMessageTooLong
+	}
+
+	messageLength := uint32(len(message)) | flags
+	if err := binary.Write(w, binary.BigEndian, messageLength); err != nil {
+		return fmt.Errorf("write message header error: %w", err)
+	}
+	if flags&MetadataFlag != 0 {
+		if err := binary.Write(w, binary.BigEndian, uint32(len(metadata))); err != nil {
+			return fmt.Errorf("write metadata header error: %w", err)
+		}
+		if err := binary.Write(w, binary.BigEndian, metadata); err != nil {
+			return fmt.Errorf("write metadata error: %w", err)
+		}
+	}
+	if err := binary.Write(w, binary.BigEndian, message); err != nil {
+		return fmt.Errorf("write message data error: %w", err)
+	}
+	return nil
+}
@@ -45,3 +45,62 @@ func TestAckMessage(t *testing.T) {
 	assert.NoError(t, binary.Read(&buff, binary.BigEndian, &ackMessage))
 	assert.EqualValues(t, 0, ackMessage)
 }
+
+func TestWriteMessages(t *testing.T) {
+	var buff bytes.Buffer
+	stdout = &buff
+
+	messages := [][]byte{
+		[]byte("Hello"),
+		[]byte("World"),
+		{0x1, 0x3, 0x3, 0x7},
+	}
+	assert.NoError(t, WriteMessages(messages...))
+
+	for i, msg := range messages {
+		msgLength := uint32(0)
+		assert.NoError(t, binary.Read(&buff, binary.BigEndian, &msgLength))
+
+		isLast := i == len(messages)-1
+		assert.EqualValuesf(t, !isLast, msgLength&MoreMessagesFlag != 0, "Failed flag check #%d:", i)
+		msgLength &^= MoreMessagesFlag
+		assert.EqualValuesf(t, len(msg), msgLength, "Failed length check #%d:", i)
+
+		data := make([]byte, msgLength)
+		assert.NoError(t, binary.Read(&buff, binary.BigEndian, data))
+		assert.EqualValuesf(t, msg, data, "Failed data check #%d:", i)
+	}
+	assert.Zero(t, buff.Len())
+}
+
+func TestWriteMessagesEmpty(t *testing.T) {
+	var buff bytes.Buffer
+	stdout = &buff
+
+	ackMessage := uint32(1337)
+	assert.NoError(t, WriteMessages())
+	assert.NoError(t, binary.Read(&buff, binary.BigEndian, &ackMessage))
+	assert.EqualValues(t, 0, ackMessage)
+}
+
+func TestWriteMessagePart(t *testing.T) {
+	var buff bytes.Buffer
+	stdout = &buff
+
+	assert.ErrorIs(t, WriteMessagePart(nil), ErrEmptyMessage)
+	assert.Zero(t, buff.Len())
+
+	assert.NoError(t, WriteMessagePart([]byte("part")))
+	assert.NoError(t, AckMessage())
+
+	msgLength := uint32(0)
+	assert.NoError(t, binary.Read(&buff, binary.BigEndian, &msgLength))
+	assert.EqualValues(t, MoreMessagesFlag|4, msgLength)
+
+	data := make([]byte, 4)
+	assert.NoError(t, binary.Read(&buff, binary.BigEndian, data))
+	assert.EqualValues(t, "part", string(data))
+
+	assert.NoError(t, binary.Read(&buff, binary.BigEndian, &msgLength))
+	assert.EqualValues(t, 0, msgLength)
+}
@@ -0,0 +1,65 @@
+package actionlib
+
+// ErrorDecision describes what to do with a message which processing failed.
+type ErrorDecision int
+
+const (
+	// DecisionSkip reports the error to runtime and acknowledges the message.
+	DecisionSkip ErrorDecision = iota
+	// DecisionRetry processes the message once again.
+	DecisionRetry
+	// DecisionFatal stops the action with the error.
+	DecisionFatal
+	// DecisionDeadLetter rejects the message with the error as the reason, see Reject.
+	// Sources have no input messages, so for them it is the same as DecisionSkip.
+	DecisionDeadLetter
+)
+
+// ErrorPolicy decides how to react to processing errors.
+type ErrorPolicy interface {
+	// Decide is called after a failed attempt; attempt starts from 1.
+	Decide(attempt int, err error) ErrorDecision
+}
+
+// ErrorPolicyFunc is an adapter to allow the use of ordinary functions as ErrorPolicy.
+type ErrorPolicyFunc func(attempt int, err error) ErrorDecision
+
+// Decide calls f(attempt, err).
+func (f ErrorPolicyFunc) Decide(attempt int, err error) ErrorDecision {
+	return f(attempt, err)
+}
+
+// SkipPolicy returns a policy that skips every failed message.
+func SkipPolicy() ErrorPolicy {
+	return ErrorPolicyFunc(func(int, error) ErrorDecision {
+		return DecisionSkip
+	})
+}
+
+// FatalPolicy returns a policy that stops the action on the first error.
+func FatalPolicy() ErrorPolicy {
+	return ErrorPolicyFunc(func(int, error) ErrorDecision {
+		return DecisionFatal
+	})
+}
+
+// DeadLetterPolicy returns a policy that rejects every failed message, see Reject.
+func DeadLetterPolicy() ErrorPolicy {
+	return ErrorPolicyFunc(func(int, error) ErrorDecision {
+		return DecisionDeadLetter
+	})
+}
+
+// RetryPolicy returns a policy that retries a failed message up to retries times
+// and then delegates the decision to fallback. A nil fallback means SkipPolicy.
+func RetryPolicy(retries int, fallback ErrorPolicy) ErrorPolicy {
+	if fallback == nil {
+		fallback = SkipPolicy()
+	}
+	return ErrorPolicyFunc(func(attempt int, err error) ErrorDecision {
+		if attempt <= retries {
+			return DecisionRetry
+		}
+		return fallback.Decide(attempt-retries, err)
+	})
+}
@@ -0,0 +1,20 @@
+package actionlib
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	someErr := errors.New("aAAaAaaAAAAAaaA")
+
+	policy := RetryPolicy(2, FatalPolicy())
+	assert.Equal(t, DecisionRetry, policy.Decide(1, someErr))
+	assert.Equal(t, DecisionRetry, policy.Decide(2, someErr))
+	assert.Equal(t, DecisionFatal, policy.Decide(3, someErr))
+
+	policy = RetryPolicy(0, nil)
+	assert.Equal(t, DecisionSkip, policy.Decide(1, someErr))
+}
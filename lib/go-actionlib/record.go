@@ -0,0 +1,36 @@
+package actionlib
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+// RecordSeparator starts a framed record in STDERR.
+// A record is a single line: separator, kind, space, JSON payload and '\n'.
+// Everything else in STDERR is treated by runtime as raw error output.
+const RecordSeparator byte = 0x1e
+
+var stderrMutex sync.Mutex
+
+func writeRecord(kind string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("encode %s record error: %w", kind, err)
+	}
+
+	record := make([]byte, 0, len(kind)+len(data)+3)
+	record = append(record, RecordSeparator)
+	record = append(record, kind...)
+	record = append(record, ' ')
+	record = append(record, data...)
+	record = append(record, '\n')
+
+	// A record is written with a single call, so concurrent records are not mixed.
+	stderrMutex.Lock()
+	defer stderrMutex.Unlock()
+	if _, err := stderr.Write(record); err != nil {
+		return fmt.Errorf("write %s record error: %w", kind, err)
+	}
+	return nil
+}
@@ -0,0 +1,398 @@
+package actionlib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+)
+
+// Handler processes input messages of an action.
+type Handler interface {
+	// Handle processes message and returns output messages.
+	// Returning no outputs acknowledges the message.
+	Handle(ctx context.Context, message []byte) ([][]byte, error)
+}
+
+// HandlerFunc is an adapter to allow the use of ordinary functions as Handler.
+type HandlerFunc func(ctx context.Context, message []byte) ([][]byte, error)
+
+// Handle calls f(ctx, message).
+func (f HandlerFunc) Handle(ctx context.Context, message []byte) ([][]byte, error) {
+	return f(ctx, message)
+}
+
+// Emitter produces messages of a source action.
+type Emitter interface {
+	// Emit returns the next batch of output messages.
+	// Returning io.EOF stops the source.
+	Emit(ctx context.Context) ([][]byte, error)
+}
+
+// EmitterFunc is an adapter to allow the use of ordinary functions as Emitter.
+type EmitterFunc func(ctx context.Context) ([][]byte, error)
+
+// Emit calls f(ctx).
+func (f EmitterFunc) Emit(ctx context.Context) ([][]byte, error) {
+	return f(ctx)
+}
+
+// Option configures Run and RunSource.
+type Option func(*runOptions)
+
+type runOptions struct {
+	policy   ErrorPolicy
+	signals  []os.Signal
+	batching bool
+
+	in     io.Reader
+	out    io.Writer
+	errOut io.Writer
+
+	// credits limit the output of a source, nil if the output is not limited.
+	credits *creditWindow
+}
+
+func newRunOptions(opts []Option) *runOptions {
+	o := &runOptions{
+		policy:  SkipPolicy(),
+		signals: []os.Signal{syscall.SIGTERM, syscall.SIGINT},
+		in:      stdin,
+		out:     stdout,
+		errOut:  stderr,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// WithErrorPolicy sets the policy for processing errors. SkipPolicy is used by default.
+func WithErrorPolicy(p ErrorPolicy) Option {
+	return func(o *runOptions) {
+		o.policy = p
+	}
+}
+
+// WithSignals sets the signals which stop the action. SIGTERM and SIGINT are used by default.
+// Without signals the action is stopped only by its context.
+func WithSignals(signals ...os.Signal) Option {
+	return func(o *runOptions) {
+		o.signals = signals
+	}
+}
+
+// WithStreams replaces STDIN, STDOUT and STDERR of the action with the given streams.
+// It allows running a handler in-process, e.g. in tests.
+// Messages written by Logger and metrics still go to STDERR.
+func WithStreams(in io.Reader, out, errOut io.Writer) Option {
+	return func(o *runOptions) {
+		o.in = in
+		o.out = out
+		o.errOut = errOut
+	}
+}
+
+// notifyContext returns a copy of ctx, which is done when one of the stop signals arrives.
+func (o *runOptions) notifyContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if len(o.signals) == 0 {
+		// signal.NotifyContext without signals is notified about all of them.
+		return context.WithCancel(ctx)
+	}
+	return signal.NotifyContext(ctx, o.signals...)
+}
+
+// WithBatching makes Run receive input messages in batches and write their outputs
+// in batch frames if runtime supports it, see BatchEnv. A stop signal stops Run
+// only after the whole batch is processed.
+func WithBatching() Option {
+	return func(o *runOptions) {
+		o.batching = true
+	}
+}
+
+type readResult struct {
+	messages []*Envelope
+	event    *Event
+	probe    []byte
+	err      error
+}
+
+// Run reads input messages and processes them with h until the input is closed,
+// ctx is done or a stop signal is received. The message being processed
+// when a signal arrives is processed to the end before Run returns, as well as
+// the messages of a frame which is being read at that moment.
+// If h implements EventHandler, runtime also delivers ticks and the shutdown notice to it.
+// Run returns an error only if the error policy decided to stop the action.
+func Run(ctx context.Context, h Handler, opts ...Option) error {
+	o := newRunOptions(opts)
+
+	stopCtx, stop := o.notifyContext(ctx)
+	defer stop()
+
+	if o.batching {
+		if _, err := batchSize(); err != nil {
+			o.batching = false
+		}
+	}
+	capabilities := CapabilityProbes
+	if o.batching {
+		capabilities |= CapabilityBatch
+	}
+	eventHandler, handlesEvents := h.(EventHandler)
+	if handlesEvents {
+		capabilities |= CapabilityEvents
+	}
+	if err := ready(o.out, capabilities); err != nil {
+		if !errors.Is(err, ErrHandshakeDisabled) {
+			return err
+		}
+		if o.batching {
+			if err := writeControl(o.out, controlBatchOptIn, nil); err != nil {
+				return err
+			}
+		}
+	}
+
+	in := &frameReader{r: o.in}
+	messages := make(chan readResult)
+	// inflight receives the frame which was being read when the stop arrived.
+	inflight := make(chan readResult, 1)
+	// Probes are answered between messages, so a stuck handler is seen by runtime as unresponsive.
+	onProbe := func(payload []byte) error {
+		in.inFrame = false
+		select {
+		case <-stopCtx.Done():
+			return errStopped
+		case messages <- readResult{probe: payload}:
+		}
+		return nil
+	}
+	go func() {
+		for {
+			batch, event, err := readFrames(in, onProbe)
+			in.inFrame = false
+			res := readResult{messages: batch, event: event, err: err}
+			select {
+			case <-stopCtx.Done():
+				inflight <- res
+				return
+			case messages <- res:
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	received := uint64(0)
+	for {
+		select {
+		case <-stopCtx.Done():
+			// A frame started before the stop is read to the end and its messages are processed.
+			if atomic.LoadUint64(&in.started) == received {
+				return nil
+			}
+			res := <-inflight
+			if res.err != nil || len(res.messages) == 0 {
+				return nil
+			}
+			return processMessages(ctx, o, h, res.messages)
+		case res := <-messages:
+			received++
+			if res.err != nil {
+				if errors.Is(res.err, io.EOF) || errors.Is(res.err, io.ErrUnexpectedEOF) {
+					return nil
+				}
+				return res.err
+			}
+			if res.probe != nil {
+				if err := writeControl(o.out, controlProbeReply, res.probe); err != nil {
+					return err
+				}
+				continue
+			}
+			if res.event != nil {
+				if !handlesEvents {
+					if err := ackMessage(o.out); err != nil {
+						return err
+					}
+					continue
+				}
+				beginEvent()
+				event := res.event
+				attempt := func() ([][]byte, error) { return eventHandler.HandleEvent(ctx, event) }
+				if err := process(ctx, o, attempt, true); err != nil {
+					return err
+				}
+				continue
+			}
+
+			if err := processMessages(ctx, o, h, res.messages); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// errStopped interrupts reading of the frames after a stop signal.
+var errStopped = errors.New("action stopped")
+
+// frameReader counts the frames whose reading has started, so Run can wait for
+// the frame which is being read when a stop signal arrives.
+type frameReader struct {
+	r io.Reader
+	// started is the number of started frames, including probes.
+	started uint64
+	// inFrame is accessed only by the reading goroutine.
+	inFrame bool
+}
+
+func (r *frameReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 && !r.inFrame {
+		r.inFrame = true
+		atomic.AddUint64(&r.started, 1)
+	}
+	return n, err
+}
+
+// processMessages processes the input messages read from one frame.
+func processMessages(ctx context.Context, o *runOptions, h Handler, batch []*Envelope) error {
+	// ctx, not stopCtx: the in-flight messages must be drained after a stop signal.
+	if o.batching {
+		return processBatch(ctx, o, h, batch)
+	}
+	for _, e := range batch {
+		nextInput()
+		message := e.Data
+		attempt := func() ([][]byte, error) { return h.Handle(ctx, message) }
+		if err := process(ctx, o, attempt, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// processBatch processes a batch of input messages and writes all outputs at once.
+// If the policy decides to stop the action, outputs of the processed messages are written anyway.
+func processBatch(ctx context.Context, o *runOptions, h Handler, batch []*Envelope) error {
+	results := make([][][]byte, 0, len(batch))
+	for _, e := range batch {
+		nextInput()
+		message := e.Data
+		outputs, err := handle(o, func() ([][]byte, error) { return h.Handle(ctx, message) }, true)
+		if err != nil {
+			if writeErr := writeBatch(o.out, results); writeErr != nil {
+				return writeErr
+			}
+			var r *rejection
+			if !errors.As(err, &r) {
+				return err
+			}
+			// Runtime matches outputs with inputs in order, so the rejection
+			// is written after the outputs of the previous messages.
+			if err := rejectMessage(o.out, r.Error()); err != nil {
+				return err
+			}
+			results = results[:0]
+			continue
+		}
+		results = append(results, outputs)
+	}
+	return writeBatch(o.out, results)
+}
+
+// RunSource calls e until it returns io.EOF, ctx is done or a stop signal is received,
+// and writes the emitted messages to output dataflow.
+// If the output is limited by runtime, RunSource waits for credits before writing, see CreditsEnv.
+// RunSource returns an error only if the error policy decided to stop the action.
+func RunSource(ctx context.Context, e Emitter, opts ...Option) error {
+	o := newRunOptions(opts)
+
+	stopCtx, stop := o.notifyContext(ctx)
+	defer stop()
+
+	if o.in == stdin {
+		o.credits = outputCredits()
+	} else if os.Getenv(CreditsEnv) != "" {
+		o.credits = newCreditWindow(o.in)
+	}
+	// Sources do not read input, so they can not answer probes.
+	if err := ready(o.out, 0); err != nil && !errors.Is(err, ErrHandshakeDisabled) {
+		return err
+	}
+
+	for stopCtx.Err() == nil {
+		attempt := func() ([][]byte, error) { return e.Emit(stopCtx) }
+		if err := process(stopCtx, o, attempt, false); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// process makes attempts until success or policy decision.
+// withAck controls if the input message must be acknowledged when there are no outputs,
+// sources have no input messages, so nothing is written for them.
+func process(ctx context.Context, o *runOptions, attempt func() ([][]byte, error), withAck bool) error {
+	outputs, err := handle(o, attempt, withAck)
+	if err != nil {
+		var r *rejection
+		if errors.As(err, &r) {
+			return rejectMessage(o.out, r.Error())
+		}
+		return err
+	}
+	if len(outputs) == 0 && !withAck {
+		return nil
+	}
+	if o.credits != nil {
+		count, bytes := outputSize(outputs)
+		if err := o.credits.acquire(ctx, count, bytes, true); err != nil {
+			if ctx.Err() != nil {
+				// The source is stopped while waiting, outputs are dropped.
+				return nil
+			}
+			return err
+		}
+	}
+	return writeMessages(o.out, outputs)
+}
+
+// handle makes attempts until success or policy decision and returns outputs to write.
+// A skipped message has no outputs, a message to reject is reported with a *rejection error.
+func handle(o *runOptions, attempt func() ([][]byte, error), withAck bool) ([][]byte, error) {
+	for i := 1; ; i++ {
+		outputs, err := attempt()
+		if err == nil {
+			return outputs, nil
+		}
+		if !withAck && errors.Is(err, io.EOF) {
+			return nil, err
+		}
+
+		switch o.policy.Decide(i, err) {
+		case DecisionRetry:
+			continue
+		case DecisionFatal:
+			return nil, fmt.Errorf("processing failed: %w", err)
+		case DecisionDeadLetter:
+			if withAck {
+				return nil, &rejection{err: err}
+			}
+			writeError(o.errOut, err)
+			return nil, nil
+		default:
+			writeError(o.errOut, err)
+			return nil, nil
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package actionlib
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeInput(t *testing.T, w io.Writer, messages ...string) {
+	for _, msg := range messages {
+		assert.NoError(t, binary.Write(w, binary.BigEndian, uint32(len(msg))))
+		assert.NoError(t, binary.Write(w, binary.BigEndian, []byte(msg)))
+	}
+}
+
+func readOutput(t *testing.T, r io.Reader) []string {
+	outputs := make([]string, 0)
+	for {
+		msgLength := uint32(0)
+		if err := binary.Read(r, binary.BigEndian, &msgLength); err != nil {
+			assert.ErrorIs(t, err, io.EOF)
+			return outputs
+		}
+
+		flag := ""
+		if msgLength&MoreMessagesFlag != 0 {
+			flag = "+"
+		}
+		data := make([]byte, msgLength&^MoreMessagesFlag)
+		assert.NoError(t, binary.Read(r, binary.BigEndian, data))
+		outputs = append(outputs, string(data)+flag)
+	}
+}
+
+func TestRun(t *testing.T) {
+	var in, out, errOut bytes.Buffer
+	stdin, stdout, stderr = &in, &out, &errOut
+
+	writeInput(t, &in, "1", "2", "3", "bad")
+	handler := HandlerFunc(func(ctx context.Context, message []byte) ([][]byte, error) {
+		n, err := strconv.Atoi(string(message))
+		if err != nil {
+			return nil, err
+		}
+
+		outputs := make([][]byte, 0, n)
+		for i := 1; i < n; i++ {
+			outputs = append(outputs, []byte(strconv.Itoa(i)))
+		}
+		return outputs, nil
+	})
+
+	assert.NoError(t, Run(context.Background(), handler))
+	assert.Equal(t, []string{"", "1", "1+", "2", ""}, readOutput(t, &out))
+	assert.NotEmpty(t, errOut.String())
+}
+
+func TestRunRetryPolicy(t *testing.T) {
+	var in, out, errOut bytes.Buffer
+	stdin, stdout, stderr = &in, &out, &errOut
+
+	writeInput(t, &in, "a", "b")
+	attempts := 0
+	handler := HandlerFunc(func(ctx context.Context, message []byte) ([][]byte, error) {
+		attempts++
+		if attempts%3 != 0 {
+			return nil, errors.New("try again")
+		}
+		return [][]byte{message}, nil
+	})
+
+	assert.NoError(t, Run(context.Background(), handler, WithErrorPolicy(RetryPolicy(2, nil))))
+	assert.Equal(t, []string{"a", "b"}, readOutput(t, &out))
+	assert.Equal(t, 6, attempts)
+	assert.Empty(t, errOut.String())
+}
+
+func TestRunFatalPolicy(t *testing.T) {
+	var in, out, errOut bytes.Buffer
+	stdin, stdout, stderr = &in, &out, &errOut
+
+	someErr := errors.New("aAAaAaaAAAAAaaA")
+	writeInput(t, &in, "a", "b")
+	handler := HandlerFunc(func(ctx context.Context, message []byte) ([][]byte, error) {
+		return nil, someErr
+	})
+
+	assert.ErrorIs(t, Run(context.Background(), handler, WithErrorPolicy(FatalPolicy())), someErr)
+	assert.Empty(t, readOutput(t, &out))
+}
+
+func TestRunSource(t *testing.T) {
+	var out, errOut bytes.Buffer
+	stdout, stderr = &out, &errOut
+
+	i := 0
+	emitter := EmitterFunc(func(ctx context.Context) ([][]byte, error) {
+		i++
+		switch i {
+		case 2:
+			return nil, nil
+		case 3:
+			return nil, errors.New("skip me")
+		case 5:
+			return nil, io.EOF
+		}
+		return [][]byte{[]byte(strconv.Itoa(i))}, nil
+	})
+
+	assert.NoError(t, RunSource(context.Background(), emitter))
+	assert.Equal(t, []string{"1", "4"}, readOutput(t, &out))
+	assert.Equal(t, "skip me", errOut.String())
+}
+
+func TestRunSourceStop(t *testing.T) {
+	var out bytes.Buffer
+	stdout = &out
+
+	ctx, cancel := context.WithCancel(context.Background())
+	emitter := EmitterFunc(func(ctx context.Context) ([][]byte, error) {
+		cancel()
+		return [][]byte{[]byte("last")}, nil
+	})
+
+	assert.NoError(t, RunSource(ctx, emitter))
+	assert.Equal(t, []string{"last"}, readOutput(t, &out))
+}
+
+func TestRunStopWhileReading(t *testing.T) {
+	in, inWriter := io.Pipe()
+	var out, errOut bytes.Buffer
+	stdin, stdout, stderr = in, &out, &errOut
+
+	ctx, cancel := context.WithCancel(context.Background())
+	handler := HandlerFunc(func(ctx context.Context, message []byte) ([][]byte, error) {
+		return [][]byte{message}, nil
+	})
+
+	done := make(chan error)
+	go func() { done <- Run(ctx, handler, WithSignals()) }()
+
+	// The pipe returns from Write only after Run has read the data.
+	message := []byte("in flight")
+	assert.NoError(t, binary.Write(inWriter, binary.BigEndian, uint32(len(message))))
+	_, err := inWriter.Write(message[:2])
+	assert.NoError(t, err)
+
+	cancel()
+	time.Sleep(50 * time.Millisecond)
+	_, err = inWriter.Write(message[2:])
+	assert.NoError(t, err)
+
+	assert.NoError(t, <-done)
+	assert.Equal(t, []string{"in flight"}, readOutput(t, &out))
+	inWriter.Close()
+}
@@ -0,0 +1,125 @@
+package actionlib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// Delivery headers, which runtime adds to input messages in exactly-once mode
+// if metadata is enabled for the node.
+const (
+	DeliveryUpstreamHeader  = "gostreaming-upstream"
+	DeliveryMessageIDHeader = "gostreaming-message-id"
+)
+
+// ErrNoDelivery is returned for a message without delivery headers.
+var ErrNoDelivery = errors.New("message has no delivery headers")
+
+// Delivery identifies an input message in exactly-once mode.
+// It does not change when the upstream sends the message again after a failure.
+type Delivery struct {
+	Upstream  string
+	MessageID uint64
+}
+
+// String returns the delivery in the "upstream/id" form.
+func (d Delivery) String() string {
+	return d.Upstream + "/" + strconv.FormatUint(d.MessageID, 10)
+}
+
+// DeliveryOf returns the delivery of e from its headers or ErrNoDelivery.
+func DeliveryOf(e *Envelope) (Delivery, error) {
+	upstream, ok := e.Headers[DeliveryUpstreamHeader]
+	if !ok {
+		return Delivery{}, ErrNoDelivery
+	}
+	rawID, ok := e.Headers[DeliveryMessageIDHeader]
+	if !ok {
+		return Delivery{}, ErrNoDelivery
+	}
+	id, err := strconv.ParseUint(rawID, 10, 64)
+	if err != nil {
+		return Delivery{}, fmt.Errorf("parse message id %q error: %w", rawID, err)
+	}
+	return Delivery{Upstream: upstream, MessageID: id}, nil
+}
+
+// SinkTx is a transaction of the external system a sink writes to.
+type SinkTx interface {
+	Commit() error
+	Rollback() error
+}
+
+// SinkStore is an external system with transactions. Deliveries are recorded
+// in the same transactions as the side effects of messages.
+type SinkStore interface {
+	// Begin starts a new transaction.
+	Begin(ctx context.Context) (SinkTx, error)
+	// Delivered reports whether d is recorded by a committed transaction.
+	Delivered(ctx context.Context, tx SinkTx, d Delivery) (bool, error)
+	// MarkDelivered records d in tx.
+	MarkDelivered(ctx context.Context, tx SinkTx, d Delivery) error
+}
+
+// SinkFunc applies the side effects of e in tx.
+type SinkFunc func(ctx context.Context, tx SinkTx, e *Envelope) error
+
+// TransactionalSink applies each input message to a SinkStore once.
+//
+// Runtime in exactly-once mode drops the messages it has already processed, but a sink
+// may fail after its transaction is committed and before runtime learns about it.
+// Such a message is delivered again, and TransactionalSink skips it because its
+// delivery is committed together with its side effects.
+type TransactionalSink struct {
+	store SinkStore
+	apply SinkFunc
+}
+
+// NewTransactionalSink creates a TransactionalSink, which applies messages to store with apply.
+func NewTransactionalSink(store SinkStore, apply SinkFunc) *TransactionalSink {
+	return &TransactionalSink{store: store, apply: apply}
+}
+
+// Write applies e in a new transaction and returns true, or returns false
+// if e was applied before. After an error Write may be retried with the same e,
+// even if the commit itself failed and its outcome is unknown.
+// ErrNoDelivery is returned if exactly-once mode or metadata is not enabled for the node.
+func (s *TransactionalSink) Write(ctx context.Context, e *Envelope) (applied bool, err error) {
+	d, err := DeliveryOf(e)
+	if err != nil {
+		return false, err
+	}
+
+	tx, err := s.store.Begin(ctx)
+	if err != nil {
+		return false, fmt.Errorf("begin transaction error: %w", err)
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			tx.Rollback()
+		}
+	}()
+
+	delivered, err := s.store.Delivered(ctx, tx, d)
+	if err != nil {
+		return false, fmt.Errorf("check delivery %s error: %w", d, err)
+	}
+	if delivered {
+		return false, nil
+	}
+
+	if err := s.apply(ctx, tx, e); err != nil {
+		return false, err
+	}
+	if err := s.store.MarkDelivered(ctx, tx, d); err != nil {
+		return false, fmt.Errorf("mark delivery %s error: %w", d, err)
+	}
+	committed = true
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("commit delivery %s error: %w", d, err)
+	}
+	return true, nil
+}
@@ -0,0 +1,166 @@
+package actionlib
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var errInjected = errors.New("injected failure")
+
+// testSinkStore is an in-memory SinkStore with failure injection.
+type testSinkStore struct {
+	rows      []string
+	delivered map[Delivery]bool
+
+	// failCommit fails the next commit, after applying it if commitApplied is set,
+	// like a connection lost while the commit is in progress.
+	failCommit    bool
+	commitApplied bool
+}
+
+type testSinkTx struct {
+	store     *testSinkStore
+	rows      []string
+	delivered []Delivery
+}
+
+func newTestSinkStore() *testSinkStore {
+	return &testSinkStore{delivered: make(map[Delivery]bool)}
+}
+
+func (s *testSinkStore) Begin(ctx context.Context) (SinkTx, error) {
+	return &testSinkTx{store: s}, nil
+}
+
+func (s *testSinkStore) Delivered(ctx context.Context, tx SinkTx, d Delivery) (bool, error) {
+	return s.delivered[d], nil
+}
+
+func (s *testSinkStore) MarkDelivered(ctx context.Context, tx SinkTx, d Delivery) error {
+	t := tx.(*testSinkTx)
+	t.delivered = append(t.delivered, d)
+	return nil
+}
+
+func (t *testSinkTx) Commit() error {
+	s := t.store
+	failed := s.failCommit
+	s.failCommit = false
+	if failed && !s.commitApplied {
+		return errInjected
+	}
+
+	s.rows = append(s.rows, t.rows...)
+	for _, d := range t.delivered {
+		s.delivered[d] = true
+	}
+	if failed {
+		s.commitApplied = false
+		return errInjected
+	}
+	return nil
+}
+
+func (t *testSinkTx) Rollback() error {
+	return nil
+}
+
+func testDeliveryEnvelope(upstream, id, data string) *Envelope {
+	return &Envelope{
+		Headers: map[string]string{DeliveryUpstreamHeader: upstream, DeliveryMessageIDHeader: id},
+		Data:    []byte(data),
+	}
+}
+
+func newTestSink(store *testSinkStore, failApply *bool) *TransactionalSink {
+	return NewTransactionalSink(store, func(ctx context.Context, tx SinkTx, e *Envelope) error {
+		if *failApply {
+			*failApply = false
+			return errInjected
+		}
+		t := tx.(*testSinkTx)
+		t.rows = append(t.rows, string(e.Data))
+		return nil
+	})
+}
+
+func TestDeliveryOf(t *testing.T) {
+	d, err := DeliveryOf(testDeliveryEnvelope("scheme_a", "42", ""))
+	assert.NoError(t, err)
+	assert.Equal(t, Delivery{Upstream: "scheme_a", MessageID: 42}, d)
+	assert.Equal(t, "scheme_a/42", d.String())
+
+	_, err = DeliveryOf(&Envelope{})
+	assert.ErrorIs(t, err, ErrNoDelivery)
+	_, err = DeliveryOf(&Envelope{Headers: map[string]string{DeliveryUpstreamHeader: "scheme_a"}})
+	assert.ErrorIs(t, err, ErrNoDelivery)
+	_, err = DeliveryOf(testDeliveryEnvelope("scheme_a", "x", ""))
+	assert.Error(t, err)
+}
+
+func TestTransactionalSinkReplay(t *testing.T) {
+	store := newTestSinkStore()
+	failApply := false
+	sink := newTestSink(store, &failApply)
+	ctx := context.Background()
+
+	applied, err := sink.Write(ctx, testDeliveryEnvelope("a", "1", "a1"))
+	assert.NoError(t, err)
+	assert.True(t, applied)
+
+	// The same id from another upstream is another message.
+	applied, err = sink.Write(ctx, testDeliveryEnvelope("b", "1", "b1"))
+	assert.NoError(t, err)
+	assert.True(t, applied)
+
+	applied, err = sink.Write(ctx, testDeliveryEnvelope("a", "1", "a1"))
+	assert.NoError(t, err)
+	assert.False(t, applied)
+	assert.Equal(t, []string{"a1", "b1"}, store.rows)
+
+	_, err = sink.Write(ctx, &Envelope{Data: []byte("plain")})
+	assert.ErrorIs(t, err, ErrNoDelivery)
+}
+
+func TestTransactionalSinkFailures(t *testing.T) {
+	ctx := context.Background()
+	messages := []*Envelope{
+		testDeliveryEnvelope("a", "1", "a1"),
+		testDeliveryEnvelope("a", "2", "a2"),
+		testDeliveryEnvelope("a", "3", "a3"),
+	}
+
+	cases := []struct {
+		name   string
+		inject func(store *testSinkStore, failApply *bool)
+	}{
+		{name: "apply", inject: func(store *testSinkStore, failApply *bool) { *failApply = true }},
+		{name: "commit_lost", inject: func(store *testSinkStore, failApply *bool) { store.failCommit = true }},
+		{name: "commit_applied", inject: func(store *testSinkStore, failApply *bool) {
+			store.failCommit, store.commitApplied = true, true
+		}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			store := newTestSinkStore()
+			failApply := false
+			sink := newTestSink(store, &failApply)
+
+			// The second message fails, then runtime delivers all unacknowledged messages again.
+			_, err := sink.Write(ctx, messages[0])
+			assert.NoError(t, err)
+			c.inject(store, &failApply)
+			_, err = sink.Write(ctx, messages[1])
+			assert.ErrorIs(t, err, errInjected)
+
+			for _, e := range messages {
+				_, err := sink.Write(ctx, e)
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, []string{"a1", "a2", "a3"}, store.rows)
+		})
+	}
+}
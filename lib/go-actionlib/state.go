@@ -0,0 +1,173 @@
+package actionlib
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// StateFDEnv is the environment variable with the file descriptor of the state channel,
+// which runtime passes to action if state is enabled for the node.
+const StateFDEnv = "GOSTREAMING_STATE_FD"
+
+// MaxStateValueLength is the maximum length of a state value.
+const MaxStateValueLength = 1 << 20
+
+// State operations and statuses.
+const (
+	stateOpGet    uint8 = 1
+	stateOpPut    uint8 = 2
+	stateOpDelete uint8 = 3
+
+	stateStatusOK       uint8 = 0
+	stateStatusNotFound uint8 = 1
+	stateStatusError    uint8 = 2
+)
+
+// Possible state errors.
+var (
+	ErrStateDisabled     = errors.New("state is not enabled for node")
+	ErrStateKeyNotFound  = errors.New("state key not found")
+	ErrStateKeyTooLong   = errors.New("state key is too long")
+	ErrStateValueTooLong = errors.New("state value is too long")
+)
+
+// inputSeq is the sequence number of the input message being processed.
+// Runtime uses it to bind state changes to input messages.
+var inputSeq uint64
+
+// inEvent is set while an event is processed. Changes made while processing
+// an event are not bound to input messages and are committed immediately.
+var inEvent uint32
+
+func nextInput() {
+	atomic.StoreUint32(&inEvent, 0)
+	atomic.AddUint64(&inputSeq, 1)
+}
+
+func beginEvent() {
+	atomic.StoreUint32(&inEvent, 1)
+}
+
+// currentInput returns the sequence number state changes are bound to, 0 means no input message.
+func currentInput() uint64 {
+	if atomic.LoadUint32(&inEvent) == 1 {
+		return 0
+	}
+	return atomic.LoadUint64(&inputSeq)
+}
+
+// State is a durable key-value store of the action served by runtime.
+//
+// Changes made while processing an input message are committed by runtime
+// only after the message is acknowledged to the upstream, so after a restart the state
+// matches the acknowledged messages and the rest of messages are processed again.
+// Changes made before reading the first input message or while processing an event
+// are committed immediately.
+// Reads always see the latest changes.
+type State struct {
+	lock sync.Mutex
+
+	conn   io.Closer
+	reader *bufio.Reader
+	writer *bufio.Writer
+}
+
+// OpenState connects to the state channel of runtime.
+// ErrStateDisabled is returned if state is not enabled for the node.
+func OpenState() (*State, error) {
+	rawFD := os.Getenv(StateFDEnv)
+	if rawFD == "" {
+		return nil, ErrStateDisabled
+	}
+
+	fd, err := strconv.Atoi(rawFD)
+	if err != nil {
+		return nil, fmt.Errorf("can not parse state fd %q: %w", rawFD, err)
+	}
+	return NewState(os.NewFile(uintptr(fd), "state")), nil
+}
+
+// NewState creates State over conn, it is useful for tests.
+func NewState(conn io.ReadWriteCloser) *State {
+	return &State{
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+		writer: bufio.NewWriter(conn),
+	}
+}
+
+// Get returns the value of key or ErrStateKeyNotFound.
+func (s *State) Get(key []byte) ([]byte, error) {
+	return s.call(stateOpGet, key, nil)
+}
+
+// Put sets the value of key.
+func (s *State) Put(key, value []byte) error {
+	_, err := s.call(stateOpPut, key, value)
+	return err
+}
+
+// Delete deletes key, deletion of a missing key is not an error.
+func (s *State) Delete(key []byte) error {
+	_, err := s.call(stateOpDelete, key, nil)
+	return err
+}
+
+// Close closes the state channel.
+func (s *State) Close() error {
+	return s.conn.Close()
+}
+
+func (s *State) call(op uint8, key, value []byte) ([]byte, error) {
+	if len(key) > math.MaxUint16 {
+		return nil, ErrStateKeyTooLong
+	}
+	if len(value) > MaxStateValueLength {
+		return nil, ErrStateValueTooLong
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.writer.WriteByte(op)
+	binary.Write(s.writer, binary.BigEndian, currentInput())
+	writeShortBytes(s.writer, key)
+	binary.Write(s.writer, binary.BigEndian, uint32(len(value)))
+	s.writer.Write(value)
+	if err := s.writer.Flush(); err != nil {
+		return nil, fmt.Errorf("write state request error: %w", err)
+	}
+
+	status, err := s.reader.ReadByte()
+	if err != nil {
+		return nil, fmt.Errorf("read state response error: %w", err)
+	}
+	length := uint32(0)
+	if err := binary.Read(s.reader, binary.BigEndian, &length); err != nil {
+		return nil, fmt.Errorf("read state response error: %w", err)
+	}
+	if length > MaxStateValueLength {
+		return nil, ErrStateValueTooLong
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(s.reader, data); err != nil {
+		return nil, fmt.Errorf("read state response error: %w", err)
+	}
+
+	switch status {
+	case stateStatusOK:
+		return data, nil
+	case stateStatusNotFound:
+		return nil, ErrStateKeyNotFound
+	default:
+		return nil, fmt.Errorf("state error: %s", string(data))
+	}
+}
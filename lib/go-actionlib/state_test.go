@@ -0,0 +1,106 @@
+package actionlib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type stateCall struct {
+	op  uint8
+	seq uint64
+}
+
+// serveState serves requests from conn with an in-memory store like runtime does.
+func serveState(conn net.Conn, calls chan<- stateCall) {
+	defer close(calls)
+
+	store := make(map[string][]byte)
+	for {
+		var op uint8
+		var seq uint64
+		if err := binary.Read(conn, binary.BigEndian, &op); err != nil {
+			return
+		}
+		binary.Read(conn, binary.BigEndian, &seq)
+		key, _ := readShortBytes(conn)
+		valueLength := uint32(0)
+		binary.Read(conn, binary.BigEndian, &valueLength)
+		value := make([]byte, valueLength)
+		io.ReadFull(conn, value)
+		calls <- stateCall{op: op, seq: seq}
+
+		status, data := stateStatusOK, []byte(nil)
+		switch op {
+		case stateOpGet:
+			v, ok := store[string(key)]
+			if !ok {
+				status = stateStatusNotFound
+			}
+			data = v
+		case stateOpPut:
+			store[string(key)] = value
+		case stateOpDelete:
+			delete(store, string(key))
+		default:
+			status, data = stateStatusError, []byte("bad op")
+		}
+
+		var buff bytes.Buffer
+		buff.WriteByte(status)
+		binary.Write(&buff, binary.BigEndian, uint32(len(data)))
+		buff.Write(data)
+		conn.Write(buff.Bytes())
+	}
+}
+
+func TestState(t *testing.T) {
+	client, server := net.Pipe()
+	calls := make(chan stateCall, 16)
+	go serveState(server, calls)
+
+	state := NewState(client)
+	seq := atomic.LoadUint64(&inputSeq)
+
+	_, err := state.Get([]byte("k"))
+	assert.ErrorIs(t, err, ErrStateKeyNotFound)
+	assert.Equal(t, stateCall{op: stateOpGet, seq: seq}, <-calls)
+
+	var in bytes.Buffer
+	stdin = &in
+	writeInput(t, &in, "msg")
+	_, err = ReadMessage()
+	assert.NoError(t, err)
+
+	assert.NoError(t, state.Put([]byte("k"), []byte("v")))
+	assert.Equal(t, stateCall{op: stateOpPut, seq: seq + 1}, <-calls)
+
+	value, err := state.Get([]byte("k"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("v"), value)
+	<-calls
+
+	assert.NoError(t, state.Delete([]byte("k")))
+	assert.Equal(t, stateCall{op: stateOpDelete, seq: seq + 1}, <-calls)
+	_, err = state.Get([]byte("k"))
+	assert.ErrorIs(t, err, ErrStateKeyNotFound)
+	<-calls
+
+	assert.ErrorIs(t, state.Put(make([]byte, 1<<16), nil), ErrStateKeyTooLong)
+	assert.ErrorIs(t, state.Put([]byte("k"), make([]byte, MaxStateValueLength+1)), ErrStateValueTooLong)
+
+	assert.NoError(t, state.Close())
+	_, ok := <-calls
+	assert.False(t, ok)
+}
+
+func TestOpenStateDisabled(t *testing.T) {
+	t.Setenv(StateFDEnv, "")
+	_, err := OpenState()
+	assert.ErrorIs(t, err, ErrStateDisabled)
+}
@@ -0,0 +1,109 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/GDVFox/gostreaming/machine_node/watcher"
+	"github.com/GDVFox/gostreaming/util"
+	"github.com/GDVFox/gostreaming/util/httplib"
+	"github.com/GDVFox/gostreaming/util/message"
+)
+
+// defaultDrainTimeout время ожидания завершения runtime после drain, если оно не задано в запросе.
+const defaultDrainTimeout = time.Minute
+
+// RuntimeStats возвращает подробную статистику runtime.
+func RuntimeStats(r *http.Request) (*httplib.Response, error) {
+	req := &message.RuntimeRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return httplib.NewBadRequestResponse(httplib.NewErrorBody(BadUnmarshalRequestErrorCode, err.Error())), nil
+	}
+
+	stats, err := watcher.RuntimeWatcher.StatsRuntime(req.SchemeName, req.ActionName)
+	if err != nil {
+		return commandErrorResponse(err), nil
+	}
+	statsData, err := json.Marshal(stats)
+	if err != nil {
+		return httplib.NewInternalErrorResponse(httplib.NewErrorBody(BadTelemetry, err.Error())), nil
+	}
+	return httplib.NewOKResponse(statsData, httplib.ContentTypeJSON), nil
+}
+
+// PauseAction приостанавливает получение входных сообщений runtime.
+func PauseAction(r *http.Request) (*httplib.Response, error) {
+	req := &message.RuntimeRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return httplib.NewBadRequestResponse(httplib.NewErrorBody(BadUnmarshalRequestErrorCode, err.Error())), nil
+	}
+
+	if err := watcher.RuntimeWatcher.PauseRuntime(req.SchemeName, req.ActionName); err != nil {
+		return commandErrorResponse(err), nil
+	}
+	return httplib.NewOKResponse(nil, httplib.ContentTypeRaw), nil
+}
+
+// ResumeAction возобновляет получение входных сообщений runtime.
+func ResumeAction(r *http.Request) (*httplib.Response, error) {
+	req := &message.RuntimeRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return httplib.NewBadRequestResponse(httplib.NewErrorBody(BadUnmarshalRequestErrorCode, err.Error())), nil
+	}
+
+	if err := watcher.RuntimeWatcher.ResumeRuntime(req.SchemeName, req.ActionName); err != nil {
+		return commandErrorResponse(err), nil
+	}
+	return httplib.NewOKResponse(nil, httplib.ContentTypeRaw), nil
+}
+
+// SetLogLevel изменяет уровень логирования runtime.
+func SetLogLevel(r *http.Request) (*httplib.Response, error) {
+	req := &message.LogLevelRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return httplib.NewBadRequestResponse(httplib.NewErrorBody(BadUnmarshalRequestErrorCode, err.Error())), nil
+	}
+
+	if err := watcher.RuntimeWatcher.SetLogLevelRuntime(req.SchemeName, req.ActionName, req.Level); err != nil {
+		return commandErrorResponse(err), nil
+	}
+	return httplib.NewOKResponse(nil, httplib.ContentTypeRaw), nil
+}
+
+// DrainAction завершает runtime после обработки и доставки полученных сообщений
+// и отвечает после его завершения.
+func DrainAction(r *http.Request) (*httplib.Response, error) {
+	logger := r.Context().Value(httplib.RequestLogger).(*util.Logger)
+
+	req := &message.DrainRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return httplib.NewBadRequestResponse(httplib.NewErrorBody(BadUnmarshalRequestErrorCode, err.Error())), nil
+	}
+	timeout := time.Duration(req.Timeout)
+	if timeout <= 0 {
+		timeout = defaultDrainTimeout
+	}
+
+	if err := watcher.RuntimeWatcher.DrainRuntime(req.SchemeName, req.ActionName, timeout); err != nil {
+		if err == watcher.ErrDrainTimeout {
+			logger.Warnf("action '%s' from scheme '%s' stopped before drain done", req.ActionName, req.SchemeName)
+			return httplib.NewInternalErrorResponse(httplib.NewErrorBody(DrainTimeoutErrorCode, err.Error())), nil
+		}
+		return commandErrorResponse(err), nil
+	}
+
+	logger.Infof("action '%s' from scheme '%s' drained", req.ActionName, req.SchemeName)
+	return httplib.NewOKResponse(nil, httplib.ContentTypeRaw), nil
+}
+
+func commandErrorResponse(err error) *httplib.Response {
+	switch err {
+	case watcher.ErrUnknownRuntime:
+		return httplib.NewNotFoundResponse(httplib.NewErrorBody(NoActionErrorCode, err.Error()))
+	case watcher.ErrCommandFailed:
+		return httplib.NewBadRequestResponse(httplib.NewErrorBody(CommandFailedErrorCode, err.Error()))
+	default:
+		return httplib.NewInternalErrorResponse(httplib.NewErrorBody(InternalError, err.Error()))
+	}
+}
@@ -7,4 +7,6 @@ var (
 	ETCDErrorCode                = "etcd_error"
 	InternalError                = "internal_error"
 	BadTelemetry                 = "bad_telemetry"
+	CommandFailedErrorCode       = "command_failed"
+	DrainTimeoutErrorCode        = "drain_timeout"
 )
@@ -0,0 +1,32 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/GDVFox/gostreaming/machine_node/watcher"
+	"github.com/GDVFox/gostreaming/util"
+	"github.com/GDVFox/gostreaming/util/httplib"
+	"github.com/GDVFox/gostreaming/util/message"
+)
+
+// ReplayMessage передает действию сообщение из очереди недоставленных сообщений.
+func ReplayMessage(r *http.Request) (*httplib.Response, error) {
+	logger := r.Context().Value(httplib.RequestLogger).(*util.Logger)
+
+	req := &message.ReplayRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return httplib.NewBadRequestResponse(httplib.NewErrorBody(BadUnmarshalRequestErrorCode, err.Error())), nil
+	}
+
+	if err := watcher.RuntimeWatcher.ReplayRuntime(req.SchemeName, req.ActionName, req.Metadata, req.Data); err != nil {
+		if err == watcher.ErrUnknownRuntime {
+			return httplib.NewNotFoundResponse(httplib.NewErrorBody(NoActionErrorCode, err.Error())), nil
+		}
+		logger.Errorf("can not replay message for action '%s' from scheme '%s': %s", req.ActionName, req.SchemeName, err)
+		return httplib.NewInternalErrorResponse(httplib.NewErrorBody(InternalError, err.Error())), nil
+	}
+
+	logger.Infof("replayed message for action '%s' from scheme '%s'", req.ActionName, req.SchemeName)
+	return httplib.NewOKResponse(nil, httplib.ContentTypeRaw), nil
+}
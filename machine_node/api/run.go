@@ -35,6 +35,7 @@ func RunAction(r *http.Request) (*httplib.Response, error) {
 
 	opt := &watcher.RuntimeOptions{
 		Port:             req.Port,
+		Replicas:         req.Replicas,
 		In:               req.In,
 		Out:              req.Out,
 		RuntimePath:      config.Conf.Runtime.BinaryPath,
@@ -44,10 +45,43 @@ func RunAction(r *http.Request) (*httplib.Response, error) {
 		Timeout:          time.Duration(config.Conf.Runtime.Timeout),
 		AckPeriod:        time.Duration(config.Conf.Runtime.AckPeriod),
 		ForwardLogDir:    config.Conf.Runtime.ForwardLogDir,
+		MaxInFlight:      config.Conf.Runtime.MaxInFlight,
+		TLS:              config.Conf.Runtime.TLS,
+		StateETCD:        config.Conf.ETCD,
 		ActionOptions: &watcher.ActionOptions{
 			Args:          req.Args,
 			Env:           req.Env,
 			ConnWhitelist: req.ConnWhitelist,
+			Codec:         req.Codec,
+			Metadata:      req.Metadata,
+			State:         req.State,
+
+			MaxPendingMessages: req.MaxPendingMessages,
+			MaxPendingBytes:    req.MaxPendingBytes,
+			BatchSize:          req.BatchSize,
+
+			Compression:        req.Compression,
+			CompressionLevel:   req.CompressionLevel,
+			CompressionMinSize: req.CompressionMinSize,
+
+			ForwardLogMaxItems: req.ForwardLogMaxItems,
+			ForwardLogMaxBytes: req.ForwardLogMaxBytes,
+			ForwardLogOverflow: req.ForwardLogOverflow,
+			ForwardLogStorage:  req.ForwardLogStorage,
+			ForwardLogSync:     req.ForwardLogSync,
+			ExactlyOnce:        req.ExactlyOnce,
+			Routing:            req.Routing,
+			MaxCrashes:         req.MaxCrashes,
+			MaxRestarts:        req.MaxRestarts,
+			RestartBackoff:     req.RestartBackoff,
+			RestartMaxBackoff:  req.RestartMaxBackoff,
+
+			ReadyTimeout:  req.ReadyTimeout,
+			ProbeInterval: req.ProbeInterval,
+			ProbeTimeout:  req.ProbeTimeout,
+
+			TickInterval:    req.TickInterval,
+			ShutdownTimeout: req.ShutdownTimeout,
 		},
 	}
 	runtime := watcher.NewRuntime(req.SchemeName, req.ActionName, actionBytes, logger, opt)
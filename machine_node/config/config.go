@@ -50,6 +50,12 @@ type RuntimeConfig struct {
 	AckPeriod util.Duration `yaml:"ack-period"`
 	// AckPeriod период отправки ack.
 	ForwardLogDir string `yaml:"forward-log-dir"`
+	// MaxInFlight максимальное число отправленных, но не подтвержденных сообщений
+	// для каждого получателя, 0 отключает ограничение.
+	MaxInFlight int `yaml:"max-in-flight"`
+	// TLS настройки взаимной TLS аутентификации между рантаймами,
+	// если не указаны, то сообщения передаются без шифрования.
+	TLS *watcher.TLSConfig `yaml:"tls"`
 }
 
 // NewRuntimeConfig возвращает RuntimeConfig с настройками по умолчанию.
@@ -62,5 +68,6 @@ func NewRuntimeConfig() *RuntimeConfig {
 		Timeout:          util.Duration(5 * time.Second),
 		AckPeriod:        util.Duration(5 * time.Second),
 		ForwardLogDir:    "/tmp/gostreaming-log",
+		MaxInFlight:      1 << 16,
 	}
 }
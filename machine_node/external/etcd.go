@@ -2,11 +2,14 @@ package external
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"path/filepath"
 
 	"github.com/DataDog/zstd"
 	"github.com/pkg/errors"
 
+	"github.com/GDVFox/gostreaming/util/message"
 	"github.com/GDVFox/gostreaming/util/storage"
 )
 
@@ -20,6 +23,19 @@ var (
 const (
 	plansPath   = "/plans"
 	actionsPath = "/actions"
+	// deadLettersPath очередь недоставленных сообщений, ключ содержит схему и идентификатор сообщения.
+	deadLettersPath = "/dead_letters"
+	// crashCountsPath счетчики отказов действий, ключ содержит схему и действие.
+	crashCountsPath = "/crash_counts"
+	// deadLetterDataPath данные недоставленных сообщений, ключ содержит схему, идентификатор сообщения и номер части.
+	deadLetterDataPath = "/dead_letter_data"
+
+	// deadLetterPartSize размер части данных недоставленного сообщения,
+	// по умолчанию etcd не принимает запросы больше 1.5 МБ.
+	deadLetterPartSize = 512 << 10
+	// maxDeadLetterDataSize ограничение на длину данных недоставленного сообщения в etcd,
+	// данные сверх него отбрасываются.
+	maxDeadLetterDataSize = 16 << 20
 
 	actionsCompressLevel = 11
 )
@@ -53,6 +69,93 @@ func (c *ETCDClient) LoadAction(ctx context.Context, name string) ([]byte, error
 	return action, nil
 }
 
+// SaveDeadLetter сохраняет недоставленное сообщение в очереди схемы. Данные сообщения
+// хранятся частями в отдельных ключах, так как могут не поместиться в один запрос к etcd.
+func (c *ETCDClient) SaveDeadLetter(ctx context.Context, letter *message.DeadLetter) error {
+	data := letter.Data
+	stored := *letter
+	stored.Data = nil
+	stored.DataParts = 0
+	stored.Size = len(data)
+	if len(data) > maxDeadLetterDataSize {
+		data = data[:maxDeadLetterDataSize]
+		stored.Truncated = true
+	}
+
+	// Данные записываются до сообщения, поэтому в очереди видны только сообщения с данными целиком.
+	for start := 0; start < len(data); start += deadLetterPartSize {
+		end := start + deadLetterPartSize
+		if end > len(data) {
+			end = len(data)
+		}
+		partKey := buildDeadLetterDataKey(letter.SchemeName, letter.ID, stored.DataParts)
+		if err := c.cli.Set(ctx, partKey, string(data[start:end])); err != nil {
+			return errors.Wrap(err, "can not save dead letter data to etcd")
+		}
+		stored.DataParts++
+	}
+
+	rawLetter, err := json.Marshal(&stored)
+	if err != nil {
+		return errors.Wrap(err, "can not marshal dead letter")
+	}
+
+	if err := c.cli.Set(ctx, buildDeadLetterKey(letter.SchemeName, letter.ID), string(rawLetter)); err != nil {
+		return errors.Wrap(err, "can not save dead letter to etcd")
+	}
+	return nil
+}
+
+// LoadCrashCounts получает счетчики отказов действия, nil если счетчиков нет.
+func (c *ETCDClient) LoadCrashCounts(ctx context.Context, schemeName, actionName string) ([]byte, error) {
+	resp, err := c.cli.Get(ctx, buildCrashCountsKey(schemeName, actionName))
+	if err != nil {
+		if err == storage.ErrNotFound {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "can not load crash counts from etcd")
+	}
+	return resp, nil
+}
+
+// SaveCrashCounts сохраняет счетчики отказов действия.
+func (c *ETCDClient) SaveCrashCounts(ctx context.Context, schemeName, actionName string, counts []byte) error {
+	if err := c.cli.Set(ctx, buildCrashCountsKey(schemeName, actionName), string(counts)); err != nil {
+		return errors.Wrap(err, "can not save crash counts to etcd")
+	}
+	return nil
+}
+
+// DeleteCrashCounts удаляет счетчики отказов остановленного действия.
+func (c *ETCDClient) DeleteCrashCounts(ctx context.Context, schemeName, actionName string) error {
+	if err := c.cli.Delete(ctx, buildCrashCountsKey(schemeName, actionName)); err != nil && err != storage.ErrNotFound {
+		return errors.Wrap(err, "can not delete crash counts from etcd")
+	}
+	return nil
+}
+
+// DeleteDeliveryMarks удаляет границы доставки остановленного действия, которые runtime
+// хранит в копии состояния под ключом key.
+func (c *ETCDClient) DeleteDeliveryMarks(ctx context.Context, key string) error {
+	if err := c.cli.DeletePrefix(ctx, key+"/"); err != nil {
+		return errors.Wrap(err, "can not delete delivery marks from etcd")
+	}
+	return nil
+}
+
 func buildActionKey(actionName string) string {
 	return filepath.Join(actionsPath, actionName)
 }
+
+func buildDeadLetterKey(schemeName, id string) string {
+	return filepath.Join(deadLettersPath, schemeName, id)
+}
+
+func buildDeadLetterDataKey(schemeName, id string, part int) string {
+	// Номер части дополняется нулями, чтобы etcd возвращал части по порядку.
+	return filepath.Join(deadLetterDataPath, schemeName, id, fmt.Sprintf("%08d", part))
+}
+
+func buildCrashCountsKey(schemeName, actionName string) string {
+	return filepath.Join(crashCountsPath, schemeName, actionName)
+}
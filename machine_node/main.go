@@ -50,7 +50,7 @@ func main() {
 	}
 
 	watcherContext, watcherCancel := context.WithCancel(context.Background())
-	if err := watcher.StartWatcher(watcherContext, logger, config.Conf.Watcher); err != nil {
+	if err := watcher.StartWatcher(watcherContext, logger, config.Conf.Watcher, external.ETCD); err != nil {
 		logger.Fatalf("can not init external resources: %v", err)
 		return
 	}
@@ -61,6 +61,12 @@ func main() {
 	r.HandleFunc("/run", httplib.CreateHandler(api.RunAction, logger)).Methods(http.MethodPost)
 	r.HandleFunc("/stop", httplib.CreateHandler(api.StopAction, logger)).Methods(http.MethodPost)
 	r.HandleFunc("/change_out", httplib.CreateHandler(api.ChangeActionOut, logger)).Methods(http.MethodPost)
+	r.HandleFunc("/replay", httplib.CreateHandler(api.ReplayMessage, logger)).Methods(http.MethodPost)
+	r.HandleFunc("/stats", httplib.CreateHandler(api.RuntimeStats, logger)).Methods(http.MethodPost)
+	r.HandleFunc("/pause", httplib.CreateHandler(api.PauseAction, logger)).Methods(http.MethodPost)
+	r.HandleFunc("/resume", httplib.CreateHandler(api.ResumeAction, logger)).Methods(http.MethodPost)
+	r.HandleFunc("/drain", httplib.CreateHandler(api.DrainAction, logger)).Methods(http.MethodPost)
+	r.HandleFunc("/log_level", httplib.CreateHandler(api.SetLogLevel, logger)).Methods(http.MethodPost)
 
 	signalChannel := make(chan os.Signal, 1)
 	signal.Notify(signalChannel, syscall.SIGINT, syscall.SIGTERM)
@@ -0,0 +1,205 @@
+package watcher
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/GDVFox/gostreaming/util/message"
+)
+
+// crashCountsFile имя файла со счетчиками отказов действия, совпадает с именем в runtime.
+const crashCountsFile = "crash_counts"
+
+// maxDeadLetterAttempts число неудачных попыток сохранить недоставленное сообщение,
+// после которых его файл переносится в карантин.
+const maxDeadLetterAttempts = 10
+
+// errBadDeadLetter возвращается, если файл недоставленного сообщения нельзя сохранить ни при какой попытке.
+var errBadDeadLetter = errors.New("bad dead letter")
+
+// DeadLetterStorage хранилище очереди недоставленных сообщений схем и счетчиков отказов действий.
+// Счетчики хранятся вне машины, так как после отказа действие может быть запущено на другой машине.
+// Через него же удаляются границы доставки режима exactly-once, которые runtime хранит в копии состояния.
+type DeadLetterStorage interface {
+	SaveDeadLetter(ctx context.Context, letter *message.DeadLetter) error
+	LoadCrashCounts(ctx context.Context, schemeName, actionName string) ([]byte, error)
+	SaveCrashCounts(ctx context.Context, schemeName, actionName string, counts []byte) error
+	DeleteCrashCounts(ctx context.Context, schemeName, actionName string) error
+	DeleteDeliveryMarks(ctx context.Context, key string) error
+}
+
+func (r *Runtime) deadLetterDir() string {
+	return path.Join(r.opt.ForwardLogDir, r.Name(), "dead_letters")
+}
+
+// deadLetterQuarantineDir каталог для файлов недоставленных сообщений, которые не удалось сохранить.
+// В отличие от deadLetterDir он не удаляется при остановке действия, файлы из него разбираются вручную.
+func (r *Runtime) deadLetterQuarantineDir() string {
+	return path.Join(r.opt.ForwardLogDir, r.Name(), "dead_letters_quarantine")
+}
+
+// deadLetterDirModTime возвращает время изменения каталога недоставленных сообщений или нулевое время,
+// если каталога нет. Runtime записывает файлы в каталог через переименование, поэтому любая запись
+// изменяет время изменения каталога.
+func (r *Runtime) deadLetterDirModTime() time.Time {
+	info, err := os.Stat(r.deadLetterDir())
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// deadLetterFiles возвращает файлы недоставленных сообщений, которые runtime сохранил целиком.
+func (r *Runtime) deadLetterFiles() ([]string, error) {
+	return filepath.Glob(filepath.Join(r.deadLetterDir(), "*.json"))
+}
+
+// readCrashCounts читает счетчики отказов действия, nil если runtime их не сохранял.
+func (r *Runtime) readCrashCounts() ([]byte, error) {
+	counts, err := os.ReadFile(filepath.Join(r.deadLetterDir(), crashCountsFile))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("can not read crash counts: %w", err)
+	}
+	return counts, nil
+}
+
+// writeCrashCounts записывает счетчики отказов действия до его запуска.
+func (r *Runtime) writeCrashCounts(counts []byte) error {
+	if err := os.MkdirAll(r.deadLetterDir(), 0755); err != nil {
+		return fmt.Errorf("can not create dead letter dir: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(r.deadLetterDir(), crashCountsFile), counts, 0644); err != nil {
+		return fmt.Errorf("can not write crash counts: %w", err)
+	}
+	return nil
+}
+
+// restoreCrashCounts передает запускаемому действию счетчики отказов,
+// накопленные на этой или другой машине.
+func (w *Watcher) restoreCrashCounts(ctx context.Context, r *Runtime) error {
+	if r.opt.ActionOptions.MaxCrashes <= 0 {
+		return nil
+	}
+
+	counts, err := w.storage.LoadCrashCounts(ctx, r.SchemeName(), r.ActionName())
+	if err != nil {
+		return err
+	}
+	if counts == nil {
+		return nil
+	}
+	return r.writeCrashCounts(counts)
+}
+
+// syncDeadLetters переносит недоставленные сообщения действия в хранилище и сохраняет
+// счетчики отказов, если они изменились после предыдущего переноса.
+func (w *Watcher) syncDeadLetters(ctx context.Context, runtime *workingRuntime) {
+	r := runtime.runtime
+
+	runtime.deadLettersMutex.Lock()
+	defer runtime.deadLettersMutex.Unlock()
+
+	// Время изменения запоминается до чтения каталога, чтобы файлы, записанные во время
+	// переноса, были перенесены при следующей проверке.
+	runtime.deadLettersModTime = r.deadLetterDirModTime()
+	files, err := r.deadLetterFiles()
+	if err != nil {
+		w.logger.Errorf("runtime '%s': can not list dead letters: %s", r.Name(), err)
+	}
+	for _, file := range files {
+		if err := w.saveDeadLetter(ctx, r, file); err != nil {
+			w.logger.Errorf("runtime '%s': %s", r.Name(), err)
+			w.retryDeadLetter(runtime, file, err)
+			continue
+		}
+		delete(runtime.deadLetterAttempts, file)
+		w.logger.Infof("runtime '%s': dead letter %s saved", r.Name(), filepath.Base(file))
+	}
+
+	if r.opt.ActionOptions.MaxCrashes <= 0 {
+		return
+	}
+	counts, err := r.readCrashCounts()
+	if err != nil {
+		w.logger.Errorf("runtime '%s': %s", r.Name(), err)
+		return
+	}
+	if counts == nil || bytes.Equal(counts, runtime.crashCounts) {
+		return
+	}
+	if err := w.storage.SaveCrashCounts(ctx, r.SchemeName(), r.ActionName(), counts); err != nil {
+		w.logger.Errorf("runtime '%s': %s", r.Name(), err)
+		return
+	}
+	runtime.crashCounts = counts
+}
+
+// deadLettersChanged возвращает true, если каталог недоставленных сообщений изменился после
+// предыдущего переноса или остались сообщения, которые не удалось сохранить.
+func (runtime *workingRuntime) deadLettersChanged() bool {
+	runtime.deadLettersMutex.Lock()
+	defer runtime.deadLettersMutex.Unlock()
+
+	if len(runtime.deadLetterAttempts) != 0 {
+		return true
+	}
+	return !runtime.runtime.deadLetterDirModTime().Equal(runtime.deadLettersModTime)
+}
+
+// retryDeadLetter учитывает неудачную попытку сохранить сообщение из файла file и переносит файл
+// в карантин, если сохранить его невозможно или попытки исчерпаны, чтобы не повторять их бесконечно.
+func (w *Watcher) retryDeadLetter(runtime *workingRuntime, file string, saveErr error) {
+	r := runtime.runtime
+
+	if !errors.Is(saveErr, errBadDeadLetter) {
+		if runtime.deadLetterAttempts == nil {
+			runtime.deadLetterAttempts = make(map[string]int)
+		}
+		runtime.deadLetterAttempts[file]++
+		if runtime.deadLetterAttempts[file] < maxDeadLetterAttempts {
+			return
+		}
+	}
+	delete(runtime.deadLetterAttempts, file)
+
+	if err := os.MkdirAll(r.deadLetterQuarantineDir(), 0755); err != nil {
+		w.logger.Errorf("runtime '%s': can not create dead letter quarantine dir: %s", r.Name(), err)
+		return
+	}
+	quarantined := filepath.Join(r.deadLetterQuarantineDir(), filepath.Base(file))
+	if err := os.Rename(file, quarantined); err != nil {
+		w.logger.Errorf("runtime '%s': can not quarantine dead letter: %s", r.Name(), err)
+		return
+	}
+	w.logger.Errorf("runtime '%s': dead letter can not be saved, moved to %s", r.Name(), quarantined)
+}
+
+// saveDeadLetter сохраняет сообщение из файла file и удаляет файл.
+func (w *Watcher) saveDeadLetter(ctx context.Context, r *Runtime, file string) error {
+	rawLetter, err := os.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("can not read dead letter: %w", err)
+	}
+
+	letter := &message.DeadLetter{}
+	if err := json.Unmarshal(rawLetter, letter); err != nil {
+		return fmt.Errorf("can not decode dead letter %s: %s: %w", file, err, errBadDeadLetter)
+	}
+	letter.SchemeName = r.SchemeName()
+	letter.ActionName = r.ActionName()
+
+	if err := w.storage.SaveDeadLetter(ctx, letter); err != nil {
+		return err
+	}
+	if err := os.Remove(file); err != nil {
+		return fmt.Errorf("can not remove saved dead letter: %w", err)
+	}
+	return nil
+}
@@ -10,8 +10,8 @@ import (
 var RuntimeWatcher *Watcher
 
 // StartWatcher инициализирует синглтон RuntimeWatcher и запускает его.
-func StartWatcher(ctx context.Context, l *util.Logger, cfg *Config) error {
-	RuntimeWatcher = newWatcher(l, cfg)
+func StartWatcher(ctx context.Context, l *util.Logger, cfg *Config, storage DeadLetterStorage) error {
+	RuntimeWatcher = newWatcher(l, cfg, storage)
 	go RuntimeWatcher.run(ctx)
 	return nil
 }
@@ -22,6 +22,8 @@ import (
 
 	"github.com/GDVFox/gostreaming/util"
 	"github.com/GDVFox/gostreaming/util/connutil"
+	"github.com/GDVFox/gostreaming/util/message"
+	"github.com/GDVFox/gostreaming/util/storage"
 )
 
 const (
@@ -29,6 +31,17 @@ const (
 	PingCommand uint8 = 0x1
 	// ChangeOutCommand команда для изменения выходного потока.
 	ChangeOutCommand uint8 = 0x2
+	// ReplayCommand команда для повторной передачи действию сообщения из очереди недоставленных сообщений.
+	ReplayCommand uint8 = 0x3
+	// StatsCommand команда для получения подробной статистики runtime.
+	StatsCommand uint8 = 0x4
+	// PauseCommand и ResumeCommand команды для приостановки и возобновления получения входных сообщений.
+	PauseCommand  uint8 = 0x5
+	ResumeCommand uint8 = 0x6
+	// DrainCommand команда для завершения runtime после обработки и доставки полученных сообщений.
+	DrainCommand uint8 = 0x7
+	// LogLevelCommand команда для изменения уровня логирования.
+	LogLevelCommand uint8 = 0x8
 )
 
 const (
@@ -42,11 +55,52 @@ const (
 var (
 	ErrCommandFailed = errors.New("command returned not OK response")
 	ErrBadOut        = errors.New("address must be in format <host>:<port>")
+	ErrBadMetrics    = errors.New("metrics are too large")
+	ErrBadLastExit   = errors.New("last exit reason is too large")
+	ErrBadStats      = errors.New("stats are too large")
+	ErrDrainTimeout  = errors.New("runtime did not drain in time and was stopped")
+)
+
+// maxMetricsSize ограничение на размер пользовательских метрик в ответе на ping.
+const maxMetricsSize = 16 << 20
+
+// maxLastExitSize ограничение на размер причины последнего отказа действия в ответе на ping.
+const maxLastExitSize = 4 << 10
+
+// statePath префикс копий состояния действий в etcd, ключ содержит схему и действие.
+const statePath = "/state"
+
+// runtimeTelemetryHeader часть ответа на ping фиксированного размера.
+type runtimeTelemetryHeader struct {
+	OldestOutput      uint64
+	ActionStatus      uint8
+	ProtocolVersion   uint16
+	ForwardLogItems   uint64
+	ForwardLogBytes   uint64
+	OverflowBlocked   uint64
+	OverflowDropped   uint64
+	OverflowDropBytes uint64
+	ActionCrashes     uint64
+}
+
+// Состояния действия, о которых сообщает runtime.
+const (
+	actionStatusRunning      uint8 = 0
+	actionStatusStarting     uint8 = 1
+	actionStatusUnresponsive uint8 = 2
 )
 
 // RuntimeTelemetry информация о состоянии runtime.
 type RuntimeTelemetry struct {
-	OldestOutput uint32
+	OldestOutput uint64
+	Status       message.RuntimeStatus
+	// ProtocolVersion версия протокола, о которой сообщило действие, 0 если действие не подтвердило готовность.
+	ProtocolVersion uint16
+	ForwardLog      message.ForwardLogTelemetry
+	Metrics         map[string]*message.ActionMetric
+	// Crashes число отказов действия, которые runtime обработал перезапуском, LastExit причина последнего.
+	Crashes  uint64
+	LastExit string
 }
 
 // ActionOptions опции для запуска действия
@@ -54,6 +108,42 @@ type ActionOptions struct {
 	Args          []string          `json:"args"`
 	Env           map[string]string `json:"env"`
 	ConnWhitelist []string          `json:"conn_whitelist"`
+	Codec         string            `json:"codec"`
+	Metadata      bool              `json:"metadata"`
+	State         bool              `json:"state"`
+
+	MaxPendingMessages int `json:"max_pending_messages"`
+	MaxPendingBytes    int `json:"max_pending_bytes"`
+	// Максимальное число входных сообщений в одном пакете, 0 отключает пакеты.
+	BatchSize int `json:"batch_size"`
+
+	Compression        string `json:"compression"`
+	CompressionLevel   int    `json:"compression_level"`
+	CompressionMinSize int    `json:"compression_min_size"`
+
+	ForwardLogMaxItems int    `json:"forward_log_max_items"`
+	ForwardLogMaxBytes int    `json:"forward_log_max_bytes"`
+	ForwardLogOverflow string `json:"forward_log_overflow"`
+	ForwardLogStorage  string `json:"forward_log_storage"`
+	ForwardLogSync     string `json:"forward_log_sync"`
+	// Режим exactly-once задается для всей схемы.
+	ExactlyOnce bool `json:"exactly_once"`
+	// Режимы передачи сообщений в порядке выходных адресов.
+	Routing []string `json:"routing"`
+	// Число отказов действия на одном сообщении, после которого оно передается
+	// в очередь недоставленных сообщений, 0 отключает подсчет.
+	MaxCrashes int `json:"max_crashes"`
+	// Число перезапусков отказавшего действия подряд и задержки между ними.
+	MaxRestarts       int           `json:"max_restarts"`
+	RestartBackoff    util.Duration `json:"restart_backoff"`
+	RestartMaxBackoff util.Duration `json:"restart_max_backoff"`
+
+	ReadyTimeout  util.Duration `json:"ready_timeout"`
+	ProbeInterval util.Duration `json:"probe_interval"`
+	ProbeTimeout  util.Duration `json:"probe_timeout"`
+
+	TickInterval    util.Duration `json:"tick_interval"`
+	ShutdownTimeout util.Duration `json:"shutdown_timeout"`
 }
 
 // RuntimeOptions набор параметров при запуске действия.
@@ -72,6 +162,11 @@ type RuntimeOptions struct {
 	Timeout       time.Duration
 	AckPeriod     time.Duration
 	ForwardLogDir string
+	MaxInFlight   int
+	// TLS настройки выпуска сертификатов runtime, nil отключает TLS.
+	TLS *TLSConfig
+	// StateETCD etcd, в котором хранится копия состояния действий, nil отключает копию.
+	StateETCD *storage.ETCDConfig
 }
 
 // Runtime структура, представляющая собой запущенное действие
@@ -148,11 +243,33 @@ func (r *Runtime) Start(ctx context.Context) error {
 		"--log-file="+logFileAddr,
 		"--log-level="+r.opt.RuntimeLogsLevel,
 		"--ack-period="+r.opt.AckPeriod.String(),
-		"--buffer-dir="+path.Join(r.opt.ForwardLogDir, r.Name(), util.RandString(16)),
+		"--max-in-flight="+strconv.Itoa(r.opt.MaxInFlight),
+		// Буфер и состояние переживают перезапуск действия, чтобы после отказа
+		// неподтвержденные сообщения были отправлены повторно.
+		"--buffer-dir="+r.bufferDir(),
+		"--state-dir="+r.stateDir(),
+		"--delivery-dir="+r.deliveryDir(),
+		"--dead-letter-dir="+r.deadLetterDir(),
 		"--in="+strings.Join(r.opt.In, ","),
 		"--out="+strings.Join(r.opt.Out, ","),
 		"--action-opt="+string(actionOptions),
 	)
+	// Локальное состояние теряется, если после отказа действие будет запущено на другой машине,
+	// поэтому подтвержденное состояние и границы доставки режима exactly-once копируются в etcd.
+	if r.opt.StateETCD != nil && (r.opt.ActionOptions.State || r.opt.ActionOptions.ExactlyOnce) {
+		r.cmd.Args = append(r.cmd.Args,
+			"--state-etcd="+strings.Join(r.opt.StateETCD.Endpoints, ","),
+			"--state-etcd-timeout="+time.Duration(r.opt.StateETCD.Timeout).String(),
+			"--state-key="+r.stateKey(),
+		)
+	}
+	if r.opt.TLS != nil {
+		certFile, keyFile, err := r.opt.TLS.issueCertificate(r.Name(), path.Join(r.opt.ForwardLogDir, r.Name(), "tls"))
+		if err != nil {
+			return fmt.Errorf("can not issue certificate: %w", err)
+		}
+		r.cmd.Args = append(r.cmd.Args, "--tls-cert="+certFile, "--tls-key="+keyFile, "--tls-ca="+r.opt.TLS.CAFile)
+	}
 
 	r.stderr, err = r.cmd.StderrPipe()
 	if err != nil {
@@ -245,11 +362,58 @@ func (r *Runtime) Ping() (*RuntimeTelemetry, error) {
 		return nil, ErrCommandFailed
 	}
 
-	telemetry := &RuntimeTelemetry{}
-	if err := binary.Read(r.serviceConn, binary.BigEndian, telemetry); err != nil {
+	header := &runtimeTelemetryHeader{}
+	if err := binary.Read(r.serviceConn, binary.BigEndian, header); err != nil {
 		return nil, err
 	}
 
+	var metricsLength uint32
+	if err := binary.Read(r.serviceConn, binary.BigEndian, &metricsLength); err != nil {
+		return nil, err
+	}
+	if metricsLength > maxMetricsSize {
+		return nil, ErrBadMetrics
+	}
+	rawMetrics := make([]byte, metricsLength)
+	if err := binary.Read(r.serviceConn, binary.BigEndian, rawMetrics); err != nil {
+		return nil, err
+	}
+
+	var lastExitLength uint32
+	if err := binary.Read(r.serviceConn, binary.BigEndian, &lastExitLength); err != nil {
+		return nil, err
+	}
+	if lastExitLength > maxLastExitSize {
+		return nil, ErrBadLastExit
+	}
+	lastExit := make([]byte, lastExitLength)
+	if err := binary.Read(r.serviceConn, binary.BigEndian, lastExit); err != nil {
+		return nil, err
+	}
+
+	telemetry := &RuntimeTelemetry{
+		OldestOutput:    header.OldestOutput,
+		Status:          message.RuntimeStatusOK,
+		ProtocolVersion: header.ProtocolVersion,
+		ForwardLog: message.ForwardLogTelemetry{
+			Items:        header.ForwardLogItems,
+			Bytes:        header.ForwardLogBytes,
+			Blocked:      header.OverflowBlocked,
+			Dropped:      header.OverflowDropped,
+			DroppedBytes: header.OverflowDropBytes,
+		},
+		Crashes:  header.ActionCrashes,
+		LastExit: string(lastExit),
+	}
+	switch header.ActionStatus {
+	case actionStatusStarting:
+		telemetry.Status = message.RuntimeStatusStarting
+	case actionStatusUnresponsive:
+		telemetry.Status = message.RuntimeStatusUnresponsive
+	}
+	if err := json.Unmarshal(rawMetrics, &telemetry.Metrics); err != nil {
+		return nil, fmt.Errorf("can not decode metrics: %w", err)
+	}
 	return telemetry, nil
 }
 
@@ -279,6 +443,122 @@ func (r *Runtime) ChangeOut(oldOut, newOut string) error {
 	return nil
 }
 
+// Replay передает действию сообщение из очереди недоставленных сообщений.
+func (r *Runtime) Replay(metadata, data []byte) error {
+	r.communicationMutex.Lock()
+	defer r.communicationMutex.Unlock()
+
+	if err := binary.Write(r.serviceConn, binary.BigEndian, ReplayCommand); err != nil {
+		return fmt.Errorf("can not send replay command: %w", err)
+	}
+	if err := r.writeReplayPart(metadata); err != nil {
+		return fmt.Errorf("can not send replay metadata: %w", err)
+	}
+	if err := r.writeReplayPart(data); err != nil {
+		return fmt.Errorf("can not send replay data: %w", err)
+	}
+
+	var resp uint8
+	if err := binary.Read(r.serviceConn, binary.BigEndian, &resp); err != nil {
+		return err
+	}
+
+	if resp != OKResponse {
+		return ErrCommandFailed
+	}
+	return nil
+}
+
+// Stats возвращает подробную статистику runtime.
+func (r *Runtime) Stats() (*message.RuntimeStats, error) {
+	r.communicationMutex.Lock()
+	defer r.communicationMutex.Unlock()
+
+	if err := binary.Write(r.serviceConn, binary.BigEndian, StatsCommand); err != nil {
+		return nil, fmt.Errorf("can not send stats command: %w", err)
+	}
+
+	var resp uint8
+	if err := binary.Read(r.serviceConn, binary.BigEndian, &resp); err != nil {
+		return nil, err
+	}
+	if resp != OKResponse {
+		return nil, ErrCommandFailed
+	}
+
+	var statsLength uint32
+	if err := binary.Read(r.serviceConn, binary.BigEndian, &statsLength); err != nil {
+		return nil, err
+	}
+	if statsLength > maxMetricsSize {
+		return nil, ErrBadStats
+	}
+	rawStats := make([]byte, statsLength)
+	if err := binary.Read(r.serviceConn, binary.BigEndian, rawStats); err != nil {
+		return nil, err
+	}
+
+	stats := &message.RuntimeStats{}
+	if err := json.Unmarshal(rawStats, stats); err != nil {
+		return nil, fmt.Errorf("can not decode stats: %w", err)
+	}
+	stats.SchemeName = r.schemeName
+	stats.ActionName = r.actionName
+	return stats, nil
+}
+
+// Pause приостанавливает получение входных сообщений.
+func (r *Runtime) Pause() error {
+	return r.sendCommand(PauseCommand, nil)
+}
+
+// Resume возобновляет получение входных сообщений.
+func (r *Runtime) Resume() error {
+	return r.sendCommand(ResumeCommand, nil)
+}
+
+// Drain передает runtime команду drain, после которой он завершается сам, см. WaitDrained.
+func (r *Runtime) Drain() error {
+	return r.sendCommand(DrainCommand, nil)
+}
+
+// SetLogLevel изменяет уровень логирования runtime и действия.
+func (r *Runtime) SetLogLevel(level string) error {
+	return r.sendCommand(LogLevelCommand, []byte(level))
+}
+
+// sendCommand передает команду command, за которой следует payload с длиной, если он не nil.
+func (r *Runtime) sendCommand(command uint8, payload []byte) error {
+	r.communicationMutex.Lock()
+	defer r.communicationMutex.Unlock()
+
+	if err := binary.Write(r.serviceConn, binary.BigEndian, command); err != nil {
+		return fmt.Errorf("can not send command %d: %w", command, err)
+	}
+	if payload != nil {
+		if err := r.writeReplayPart(payload); err != nil {
+			return fmt.Errorf("can not send command %d payload: %w", command, err)
+		}
+	}
+
+	var resp uint8
+	if err := binary.Read(r.serviceConn, binary.BigEndian, &resp); err != nil {
+		return err
+	}
+
+	if resp != OKResponse {
+		return ErrCommandFailed
+	}
+	return nil
+}
+
+func (r *Runtime) writeReplayPart(part []byte) error {
+	if err := binary.Write(r.serviceConn, binary.BigEndian, uint32(len(part))); err != nil {
+		return err
+	}
+	return binary.Write(r.serviceConn, binary.BigEndian, part)
+}
+
 func (r *Runtime) writeChangeOutAddr(addr string) error {
 	if err := binary.Write(r.serviceConn, binary.BigEndian, uint64(len(addr))); err != nil {
 		return fmt.Errorf("can not send change out length: %w", err)
@@ -289,30 +569,106 @@ func (r *Runtime) writeChangeOutAddr(addr string) error {
 	return nil
 }
 
+func (r *Runtime) bufferDir() string {
+	return path.Join(r.opt.ForwardLogDir, r.Name(), "log")
+}
+
+func (r *Runtime) stateDir() string {
+	return path.Join(r.opt.ForwardLogDir, r.Name(), "state")
+}
+
+// stateKey префикс ключей копии состояния действия в etcd.
+func (r *Runtime) stateKey() string {
+	return path.Join(statePath, r.SchemeName(), r.ActionName())
+}
+
+// replicatesDelivery возвращает true, если runtime копирует границы доставки в etcd.
+func (r *Runtime) replicatesDelivery() bool {
+	return r.opt.ActionOptions.ExactlyOnce && r.opt.StateETCD != nil
+}
+
+// deliveryKey префикс ключей границ доставки в копии состояния, совпадает с путем в runtime.
+func (r *Runtime) deliveryKey() string {
+	return path.Join(r.stateKey(), "delivery")
+}
+
+func (r *Runtime) deliveryDir() string {
+	return path.Join(r.opt.ForwardLogDir, r.Name(), "delivery")
+}
+
+// RemoveBuffer удаляет forward log остановленного действия, отметки о доставленных
+// сообщениях, так как после удаления логов нумерация сообщений начинается заново,
+// и каталог недоставленных сообщений, которые к этому моменту уже перенесены в etcd.
+// Вызывается только при явной остановке, после отказа буфер нужен перезапущенному действию.
+func (r *Runtime) RemoveBuffer() error {
+	if err := os.RemoveAll(r.bufferDir()); err != nil {
+		return fmt.Errorf("can not remove forward log: %w", err)
+	}
+	if err := os.RemoveAll(r.deliveryDir()); err != nil {
+		return fmt.Errorf("can not remove delivered messages: %w", err)
+	}
+	if err := os.RemoveAll(r.deadLetterDir()); err != nil {
+		return fmt.Errorf("can not remove dead letters: %w", err)
+	}
+	return nil
+}
+
 // Stop завершает работу действия, возвращает ошибку из stderr.
 func (r *Runtime) Stop() error {
-	defer os.Remove(r.binPath)
-	defer os.Remove(r.serviceSockPath)
-	defer func() {
-		if r.stderr != nil {
-			r.stderr.Close()
-		}
-	}()
-	defer func() {
-		if r.serviceConn != nil {
-			r.serviceConn.Close()
-		}
-	}()
+	defer r.release()
 
-	if err := r.cmd.Process.Signal(syscall.SIGTERM); err != nil {
-		return fmt.Errorf("can not send SIGTERM to runtime: %w", err)
+	return r.terminate(r.waitProcessAsync())
+}
+
+// WaitDrained ожидает завершения runtime после команды drain не дольше timeout.
+// Если runtime не завершился за это время, то он останавливается так же, как в Stop,
+// и возвращается ErrDrainTimeout.
+func (r *Runtime) WaitDrained(timeout time.Duration) error {
+	defer r.release()
+
+	procErrs := r.waitProcessAsync()
+	select {
+	case err := <-procErrs:
+		r.logger.Info("runtime drained")
+		return err
+	case <-time.After(timeout):
 	}
-	r.logger.Info("SIGTERM sended")
 
+	r.logger.Warnf("runtime did not drain in %s, stopping", timeout)
+	if err := r.terminate(procErrs); err != nil {
+		return err
+	}
+	return ErrDrainTimeout
+}
+
+// release удаляет временные файлы и закрывает соединения завершенного runtime.
+func (r *Runtime) release() {
+	if r.serviceConn != nil {
+		r.serviceConn.Close()
+	}
+	if r.stderr != nil {
+		r.stderr.Close()
+	}
+	os.Remove(r.serviceSockPath)
+	os.Remove(r.binPath)
+}
+
+// waitProcessAsync ожидает завершения процесса runtime в отдельной горутине.
+func (r *Runtime) waitProcessAsync() <-chan error {
 	procErrs := make(chan error, 1)
 	go func() {
 		procErrs <- r.waitProcess()
 	}()
+	return procErrs
+}
+
+// terminate передает runtime SIGTERM и ожидает результата из procErrs, а по истечении
+// времени ожидания завершает процесс SIGKILL.
+func (r *Runtime) terminate(procErrs <-chan error) error {
+	if err := r.cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		return fmt.Errorf("can not send SIGTERM to runtime: %w", err)
+	}
+	r.logger.Info("SIGTERM sended")
 
 	select {
 	case <-time.After(r.opt.Timeout):
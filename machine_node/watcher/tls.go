@@ -0,0 +1,112 @@
+package watcher
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/GDVFox/gostreaming/util"
+)
+
+// Возможные ошибки выпуска сертификатов.
+var (
+	ErrBadCAKey = errors.New("CA private key can not be used for signing")
+)
+
+// TLSConfig настройки взаимной TLS аутентификации между runtime.
+// Для каждого запускаемого runtime выпускается сертификат, подписанный центром сертификации,
+// в котором указано имя runtime. Получатель сообщений принимает только подключения
+// с сертификатами этого центра и сверяет имя вышестоящего узла с именем из сертификата.
+type TLSConfig struct {
+	// CAFile сертификат центра сертификации, общий для всех Machine Node.
+	CAFile string `yaml:"ca-file"`
+	// CAKeyFile закрытый ключ центра сертификации для подписи сертификатов runtime.
+	CAKeyFile string `yaml:"ca-key-file"`
+	// CertTTL время действия выпускаемых сертификатов, 0 означает defaultCertTTL.
+	CertTTL util.Duration `yaml:"cert-ttl"`
+}
+
+// defaultCertTTL время действия сертификатов runtime по умолчанию.
+const defaultCertTTL = 365 * 24 * time.Hour
+
+// issueCertificate выпускает сертификат для runtime с именем name и записывает его
+// вместе с закрытым ключом в dir. Возвращает пути к файлам сертификата и ключа.
+func (c *TLSConfig) issueCertificate(name, dir string) (string, string, error) {
+	ca, err := tls.LoadX509KeyPair(c.CAFile, c.CAKeyFile)
+	if err != nil {
+		return "", "", fmt.Errorf("can not load CA: %w", err)
+	}
+	caCert, err := x509.ParseCertificate(ca.Certificate[0])
+	if err != nil {
+		return "", "", fmt.Errorf("can not parse CA certificate: %w", err)
+	}
+	caKey, ok := ca.PrivateKey.(crypto.Signer)
+	if !ok {
+		return "", "", ErrBadCAKey
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", fmt.Errorf("can not generate key: %w", err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return "", "", fmt.Errorf("can not generate serial number: %w", err)
+	}
+
+	ttl := time.Duration(c.CertTTL)
+	if ttl == 0 {
+		ttl = defaultCertTTL
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    now.Add(-time.Minute),
+		NotAfter:     now.Add(ttl),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		// runtime одновременно принимает подключения вышестоящих узлов и подключается к нижестоящим.
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, caCert, key.Public(), caKey)
+	if err != nil {
+		return "", "", fmt.Errorf("can not create certificate: %w", err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return "", "", fmt.Errorf("can not marshal key: %w", err)
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", "", fmt.Errorf("can not create tls dir: %w", err)
+	}
+	certFile := filepath.Join(dir, "runtime.crt")
+	if err := writePEM(certFile, "CERTIFICATE", certDER); err != nil {
+		return "", "", err
+	}
+	keyFile := filepath.Join(dir, "runtime.key")
+	if err := writePEM(keyFile, "PRIVATE KEY", keyDER); err != nil {
+		return "", "", err
+	}
+	return certFile, keyFile, nil
+}
+
+func writePEM(file, blockType string, der []byte) error {
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	if err := os.WriteFile(file, data, 0600); err != nil {
+		return fmt.Errorf("can not write %s: %w", file, err)
+	}
+	return nil
+}
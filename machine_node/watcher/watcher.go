@@ -19,7 +19,22 @@ var (
 type workingRuntime struct {
 	runtime      *Runtime
 	pingsFailed  int
-	oldestOutput uint32
+	oldestOutput uint64
+	forwardLog   message.ForwardLogTelemetry
+	status       message.RuntimeStatus
+	metrics      map[string]*message.ActionMetric
+	crashes      uint64
+	lastExit     string
+	// crashCounts счетчики отказов, последними сохраненные в хранилище.
+	crashCounts []byte
+
+	// deadLettersMutex защищает поля ниже, так как перенос недоставленных сообщений
+	// выполняется без блокировки списка рантаймов.
+	deadLettersMutex sync.Mutex
+	// deadLetterAttempts число неудачных попыток сохранить файлы недоставленных сообщений.
+	deadLetterAttempts map[string]int
+	// deadLettersModTime время изменения каталога недоставленных сообщений при последнем переносе.
+	deadLettersModTime time.Time
 }
 
 // Config набор настроек для Watcher
@@ -44,15 +59,17 @@ type Watcher struct {
 	runtimesMutex sync.RWMutex
 	runtimes      map[string]*workingRuntime
 
-	cfg    *Config
-	logger *util.Logger
+	cfg     *Config
+	storage DeadLetterStorage
+	logger  *util.Logger
 }
 
 // NewWatcher создает новый объект watcher
-func newWatcher(l *util.Logger, cfg *Config) *Watcher {
+func newWatcher(l *util.Logger, cfg *Config, storage DeadLetterStorage) *Watcher {
 	return &Watcher{
 		runtimes: make(map[string]*workingRuntime),
 		cfg:      cfg,
+		storage:  storage,
 		logger:   l.WithName("watcher"),
 	}
 }
@@ -62,6 +79,9 @@ func (w *Watcher) StartRuntime(ctx context.Context, r *Runtime) error {
 	w.runtimesMutex.Lock()
 	defer w.runtimesMutex.Unlock()
 
+	if err := w.restoreCrashCounts(ctx, r); err != nil {
+		return err
+	}
 	if err := r.Start(ctx); err != nil {
 		return err
 	}
@@ -71,9 +91,14 @@ func (w *Watcher) StartRuntime(ctx context.Context, r *Runtime) error {
 		return ErrRuntimeAlreadyRegistered
 	}
 
+	status := message.RuntimeStatusOK
+	if r.opt.ActionOptions.ReadyTimeout > 0 {
+		status = message.RuntimeStatusStarting
+	}
 	w.runtimes[runtimeName] = &workingRuntime{
 		runtime:     r,
 		pingsFailed: 0,
+		status:      status,
 	}
 
 	w.logger.Infof("runtime '%s' started", runtimeName)
@@ -95,6 +120,15 @@ func (w *Watcher) StopRuntime(schemeName, actionName string) error {
 	if err := runtime.runtime.Stop(); err != nil {
 		return err
 	}
+	// Недоставленные сообщения остаются в очереди схемы после остановки действия, а счетчики отказов нет.
+	w.syncDeadLetters(context.Background(), runtime)
+	if err := w.storage.DeleteCrashCounts(context.Background(), schemeName, actionName); err != nil {
+		w.logger.Warnf("runtime '%s': %s", runtimeName, err)
+	}
+	w.removeDeliveryMarks(runtime.runtime)
+	if err := runtime.runtime.RemoveBuffer(); err != nil {
+		w.logger.Warnf("runtime '%s': %s", runtimeName, err)
+	}
 
 	w.logger.Infof("runtime '%s' stopped", runtimeName)
 	return nil
@@ -119,6 +153,123 @@ func (w *Watcher) ChangeOutRuntime(schemeName, actionName, oldOut, newOut string
 	return nil
 }
 
+// ReplayRuntime передает действию сообщение из очереди недоставленных сообщений.
+func (w *Watcher) ReplayRuntime(schemeName, actionName string, metadata, data []byte) error {
+	w.runtimesMutex.RLock()
+	defer w.runtimesMutex.RUnlock()
+
+	runtimeName := buildRuntimeName(schemeName, actionName)
+	runtime, ok := w.runtimes[runtimeName]
+	if !ok {
+		return ErrUnknownRuntime
+	}
+
+	if err := runtime.runtime.Replay(metadata, data); err != nil {
+		return err
+	}
+
+	w.logger.Infof("runtime '%s' replayed message", runtimeName)
+	return nil
+}
+
+// StatsRuntime возвращает подробную статистику рантайма.
+func (w *Watcher) StatsRuntime(schemeName, actionName string) (*message.RuntimeStats, error) {
+	w.runtimesMutex.RLock()
+	defer w.runtimesMutex.RUnlock()
+
+	runtime, ok := w.runtimes[buildRuntimeName(schemeName, actionName)]
+	if !ok {
+		return nil, ErrUnknownRuntime
+	}
+	return runtime.runtime.Stats()
+}
+
+// PauseRuntime приостанавливает получение входных сообщений рантаймом.
+func (w *Watcher) PauseRuntime(schemeName, actionName string) error {
+	return w.commandRuntime(schemeName, actionName, "paused", (*Runtime).Pause)
+}
+
+// ResumeRuntime возобновляет получение входных сообщений рантаймом.
+func (w *Watcher) ResumeRuntime(schemeName, actionName string) error {
+	return w.commandRuntime(schemeName, actionName, "resumed", (*Runtime).Resume)
+}
+
+// SetLogLevelRuntime изменяет уровень логирования рантайма.
+func (w *Watcher) SetLogLevelRuntime(schemeName, actionName, level string) error {
+	return w.commandRuntime(schemeName, actionName, "changed log level to "+level, func(r *Runtime) error {
+		return r.SetLogLevel(level)
+	})
+}
+
+func (w *Watcher) commandRuntime(schemeName, actionName, done string, command func(r *Runtime) error) error {
+	w.runtimesMutex.RLock()
+	defer w.runtimesMutex.RUnlock()
+
+	runtimeName := buildRuntimeName(schemeName, actionName)
+	runtime, ok := w.runtimes[runtimeName]
+	if !ok {
+		return ErrUnknownRuntime
+	}
+
+	if err := command(runtime.runtime); err != nil {
+		return err
+	}
+
+	w.logger.Infof("runtime '%s' %s", runtimeName, done)
+	return nil
+}
+
+// DrainRuntime передает рантайму команду drain и ожидает его завершения не дольше timeout.
+// Рантайм перестает отслеживаться сразу после команды, поэтому его завершение не считается отказом.
+// Если рантайм не завершился вовремя, то он останавливается, но forward log сохраняется,
+// чтобы недоставленные сообщения были отправлены при следующем запуске.
+func (w *Watcher) DrainRuntime(schemeName, actionName string, timeout time.Duration) error {
+	runtimeName := buildRuntimeName(schemeName, actionName)
+
+	w.runtimesMutex.Lock()
+	runtime, ok := w.runtimes[runtimeName]
+	if !ok {
+		w.runtimesMutex.Unlock()
+		return ErrUnknownRuntime
+	}
+	if err := runtime.runtime.Drain(); err != nil {
+		w.runtimesMutex.Unlock()
+		return err
+	}
+	delete(w.runtimes, runtimeName)
+	w.runtimesMutex.Unlock()
+	w.logger.Infof("runtime '%s' draining", runtimeName)
+
+	drainErr := runtime.runtime.WaitDrained(timeout)
+	w.syncDeadLetters(context.Background(), runtime)
+	if drainErr != nil {
+		return drainErr
+	}
+
+	// После drain рантайм остановлен так же, как при явной остановке.
+	if err := w.storage.DeleteCrashCounts(context.Background(), schemeName, actionName); err != nil {
+		w.logger.Warnf("runtime '%s': %s", runtimeName, err)
+	}
+	w.removeDeliveryMarks(runtime.runtime)
+	if err := runtime.runtime.RemoveBuffer(); err != nil {
+		w.logger.Warnf("runtime '%s': %s", runtimeName, err)
+	}
+
+	w.logger.Infof("runtime '%s' drained", runtimeName)
+	return nil
+}
+
+// removeDeliveryMarks удаляет границы доставки явно остановленного действия из копии,
+// так как вместе с forward log нумерация сообщений начинается заново, см. Runtime.RemoveBuffer.
+func (w *Watcher) removeDeliveryMarks(r *Runtime) {
+	if !r.replicatesDelivery() {
+		return
+	}
+	if err := w.storage.DeleteDeliveryMarks(context.Background(), r.deliveryKey()); err != nil {
+		w.logger.Warnf("runtime '%s': %s", r.Name(), err)
+	}
+}
+
 // GetRuntimesTelemetry возвращает информацию о состояниях действий.
 func (w *Watcher) GetRuntimesTelemetry() []*message.RuntimeTelemetry {
 	w.runtimesMutex.Lock()
@@ -126,7 +277,7 @@ func (w *Watcher) GetRuntimesTelemetry() []*message.RuntimeTelemetry {
 
 	runtimes := make([]*message.RuntimeTelemetry, 0, len(w.runtimes))
 	for _, runtime := range w.runtimes {
-		status := message.RuntimeStatusOK
+		status := runtime.status
 		if runtime.pingsFailed > 0 {
 			status = message.RuntimeStatusPending
 		}
@@ -136,6 +287,10 @@ func (w *Watcher) GetRuntimesTelemetry() []*message.RuntimeTelemetry {
 			ActionName:   runtime.runtime.ActionName(),
 			Status:       status,
 			OldestOutput: runtime.oldestOutput,
+			ForwardLog:   runtime.forwardLog,
+			Metrics:      runtime.metrics,
+			Crashes:      runtime.crashes,
+			LastExit:     runtime.lastExit,
 		}
 
 		runtimes = append(runtimes, telemetry)
@@ -157,17 +312,40 @@ func (w *Watcher) run(ctx context.Context) {
 		case <-ctx.Done():
 			return
 		case <-ticker.C:
-			w.pingRuntimes()
+			w.pingRuntimes(ctx)
 		}
 	}
 }
 
-func (w *Watcher) pingRuntimes() {
+func (w *Watcher) pingRuntimes(ctx context.Context) {
 	defer w.logger.Debugf("ping runtimes done")
 
-	w.runtimesMutex.RLock()
-	defer w.runtimesMutex.RUnlock()
+	failed, changed := w.collectPings()
 
+	// Обращения к хранилищу выполняются без блокировки, чтобы не задерживать управление рантаймами.
+	for _, runtime := range failed {
+		runtimeName := runtime.runtime.Name()
+		if err := runtime.runtime.Stop(); err != nil {
+			w.logger.Errorf("runtime '%s' stop failed: skipping runtime: %v", runtimeName, err)
+		}
+		// Счетчики отказов нужны действию, которое будет запущено вместо отказавшего.
+		w.syncDeadLetters(ctx, runtime)
+		w.logger.Warnf("runtime '%s' stopped", runtimeName)
+	}
+	for _, runtime := range changed {
+		w.syncDeadLetters(ctx, runtime)
+	}
+}
+
+// collectPings обновляет состояние рантаймов по ответам на ping и удаляет из списка рантаймы,
+// не ответившие PingsToStop раз подряд. Возвращает удаленные рантаймы и рантаймы,
+// у которых появились недоставленные сообщения или изменилось число отказов.
+func (w *Watcher) collectPings() ([]*workingRuntime, []*workingRuntime) {
+	w.runtimesMutex.Lock()
+	defer w.runtimesMutex.Unlock()
+
+	failed := make([]*workingRuntime, 0)
+	changed := make([]*workingRuntime, 0)
 	for runtimeName, runtime := range w.runtimes {
 		telemetry, err := runtime.runtime.Ping()
 		if err != nil {
@@ -176,17 +354,29 @@ func (w *Watcher) pingRuntimes() {
 
 			if runtime.pingsFailed >= w.cfg.PingsToStop {
 				w.logger.Warnf("runtime '%s' %d pings failed: stopping runtime", runtimeName, runtime.pingsFailed)
-
 				delete(w.runtimes, runtimeName)
-				if err := runtime.runtime.Stop(); err != nil {
-					w.logger.Errorf("runtime '%s' stop failed: skipping runtime: %v", runtimeName, err)
-				}
-				w.logger.Warnf("runtime '%s' stopped", runtimeName)
+				failed = append(failed, runtime)
 			}
 
 			continue
 		}
+		if telemetry.Status != runtime.status {
+			w.logger.Infof("runtime '%s' action status changed: %s -> %s", runtimeName, runtime.status, telemetry.Status)
+		}
 		runtime.oldestOutput = telemetry.OldestOutput
+		runtime.forwardLog = telemetry.ForwardLog
+		runtime.status = telemetry.Status
+		runtime.metrics = telemetry.Metrics
+		crashed := telemetry.Crashes != runtime.crashes
+		if crashed {
+			w.logger.Warnf("runtime '%s' action restarted after crash: %s", runtimeName, telemetry.LastExit)
+		}
+		runtime.crashes = telemetry.Crashes
+		runtime.lastExit = telemetry.LastExit
 		runtime.pingsFailed = 0
+		if crashed || runtime.deadLettersChanged() {
+			changed = append(changed, runtime)
+		}
 	}
+	return failed, changed
 }
@@ -12,4 +12,8 @@ var (
 	ETCDErrorCode                = "etcd_error"
 	MachineErrorCode             = "machine_error"
 	RenderGraphErrorCode         = "render_graph_error"
+	BadDeadLetterErrorCode       = "bad_dead_letter"
+	BadTimeoutErrorCode          = "bad_timeout"
+	BadLogLevelErrorCode         = "bad_log_level"
+	CommandRejectedErrorCode     = "command_rejected"
 )
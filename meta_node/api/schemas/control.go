@@ -0,0 +1,136 @@
+package schemas
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+
+	"github.com/GDVFox/gostreaming/meta_node/api/common"
+	"github.com/GDVFox/gostreaming/meta_node/watcher"
+	"github.com/GDVFox/gostreaming/util/httplib"
+)
+
+// defaultDrainTimeout время ожидания drain каждого узла, если оно не задано в запросе.
+const defaultDrainTimeout = time.Minute
+
+// SchemeStats подробная статистика узлов схемы.
+type SchemeStats struct {
+	Nodes []*watcher.NodeStats `json:"nodes"`
+}
+
+// GetSchemeStats возвращает подробную статистику всех узлов схемы или узла node_name.
+func GetSchemeStats(r *http.Request) (*httplib.Response, error) {
+	schemeName, nodeName, resp := controlVars(r)
+	if resp != nil {
+		return resp, nil
+	}
+
+	nodes, err := watcher.Watcher.GetPlanStats(r.Context(), schemeName, nodeName)
+	if err != nil {
+		return controlErrorResponse(err), nil
+	}
+
+	statsData, err := json.Marshal(&SchemeStats{Nodes: nodes})
+	if err != nil {
+		return httplib.NewInternalErrorResponse(httplib.NewErrorBody(common.MachineErrorCode, err.Error())), nil
+	}
+	return httplib.NewOKResponse(statsData, httplib.ContentTypeJSON), nil
+}
+
+// PauseScheme приостанавливает получение входных сообщений всеми узлами схемы или узлом node_name.
+func PauseScheme(r *http.Request) (*httplib.Response, error) {
+	schemeName, nodeName, resp := controlVars(r)
+	if resp != nil {
+		return resp, nil
+	}
+
+	if err := watcher.Watcher.PausePlan(r.Context(), schemeName, nodeName); err != nil {
+		return controlErrorResponse(err), nil
+	}
+	return httplib.NewOKResponse(nil, httplib.ContentTypeRaw), nil
+}
+
+// ResumeScheme возобновляет получение входных сообщений всеми узлами схемы или узлом node_name.
+func ResumeScheme(r *http.Request) (*httplib.Response, error) {
+	schemeName, nodeName, resp := controlVars(r)
+	if resp != nil {
+		return resp, nil
+	}
+
+	if err := watcher.Watcher.ResumePlan(r.Context(), schemeName, nodeName); err != nil {
+		return controlErrorResponse(err), nil
+	}
+	return httplib.NewOKResponse(nil, httplib.ContentTypeRaw), nil
+}
+
+// SetSchemeLogLevel изменяет уровень логирования всех узлов схемы или узла node_name.
+func SetSchemeLogLevel(r *http.Request) (*httplib.Response, error) {
+	schemeName, nodeName, resp := controlVars(r)
+	if resp != nil {
+		return resp, nil
+	}
+
+	level := r.FormValue("level")
+	if level == "" {
+		return httplib.NewBadRequestResponse(httplib.NewErrorBody(common.BadLogLevelErrorCode, "level must be not empty")), nil
+	}
+
+	if err := watcher.Watcher.SetPlanLogLevel(r.Context(), schemeName, nodeName, level); err != nil {
+		return controlErrorResponse(err), nil
+	}
+	return httplib.NewOKResponse(nil, httplib.ContentTypeRaw), nil
+}
+
+// DrainScheme завершает схему после обработки и доставки уже полученных сообщений.
+func DrainScheme(r *http.Request) (*httplib.Response, error) {
+	vars := mux.Vars(r)
+	schemeName := vars["scheme_name"]
+	if schemeName == "" {
+		return httplib.NewBadRequestResponse(httplib.NewErrorBody(common.BadNameErrorCode, "scheme_name must be not empty")), nil
+	}
+
+	timeout := defaultDrainTimeout
+	if timeoutStr := r.FormValue("timeout"); timeoutStr != "" {
+		var err error
+		timeout, err = time.ParseDuration(timeoutStr)
+		if err != nil {
+			return httplib.NewBadRequestResponse(httplib.NewErrorBody(common.BadTimeoutErrorCode, err.Error())), nil
+		}
+		if timeout <= 0 {
+			return httplib.NewBadRequestResponse(httplib.NewErrorBody(common.BadTimeoutErrorCode, "timeout must be positive")), nil
+		}
+	}
+
+	if err := watcher.Watcher.DrainPlan(schemeName, timeout); err != nil {
+		return controlErrorResponse(err), nil
+	}
+	return httplib.NewOKResponse(nil, httplib.ContentTypeRaw), nil
+}
+
+func controlVars(r *http.Request) (string, string, *httplib.Response) {
+	vars := mux.Vars(r)
+	schemeName := vars["scheme_name"]
+	if schemeName == "" {
+		return "", "", httplib.NewBadRequestResponse(httplib.NewErrorBody(common.BadNameErrorCode, "scheme_name must be not empty"))
+	}
+	// node_name есть только в путях команд для отдельного узла.
+	return schemeName, vars["node_name"], nil
+}
+
+func controlErrorResponse(err error) *httplib.Response {
+	switch errors.Cause(err) {
+	case watcher.ErrNoAction, watcher.ErrNoHost:
+		return httplib.NewBadRequestResponse(httplib.NewErrorBody(common.BadNameErrorCode, err.Error()))
+	case watcher.ErrCommandRejected:
+		return httplib.NewBadRequestResponse(httplib.NewErrorBody(common.CommandRejectedErrorCode, err.Error()))
+	case watcher.ErrUnknownPlan:
+		return httplib.NewNotFoundResponse(httplib.NewErrorBody(common.BadSchemeErrorCode, err.Error()))
+	default:
+		return httplib.NewInternalErrorResponse(httplib.NewErrorBody(common.MachineErrorCode,
+			fmt.Sprintf("unknown error: %s", err.Error())))
+	}
+}
@@ -0,0 +1,148 @@
+package schemas
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+
+	"github.com/GDVFox/gostreaming/meta_node/api/common"
+	"github.com/GDVFox/gostreaming/meta_node/external"
+	"github.com/GDVFox/gostreaming/meta_node/watcher"
+	"github.com/GDVFox/gostreaming/util/httplib"
+	"github.com/GDVFox/gostreaming/util/message"
+	"github.com/GDVFox/gostreaming/util/storage"
+)
+
+// DeadLetterList список недоставленных сообщений схемы.
+type DeadLetterList struct {
+	DeadLetters []*message.DeadLetter `json:"dead_letters"`
+}
+
+// ListDeadLetters получает очередь недоставленных сообщений схемы.
+func ListDeadLetters(r *http.Request) (*httplib.Response, error) {
+	vars := mux.Vars(r)
+	schemeName := vars["scheme_name"]
+	if schemeName == "" {
+		return httplib.NewBadRequestResponse(httplib.NewErrorBody(common.BadNameErrorCode, "scheme_name must be not empty")), nil
+	}
+
+	ids, err := external.ETCD.LoadDeadLetterIDs(r.Context(), schemeName)
+	if err != nil {
+		return httplib.NewInternalErrorResponse(httplib.NewErrorBody(common.ETCDErrorCode, err.Error())), nil
+	}
+
+	letters := &DeadLetterList{DeadLetters: make([]*message.DeadLetter, 0, len(ids))}
+	for _, id := range ids {
+		letter, err := external.ETCD.LoadDeadLetterInfo(r.Context(), schemeName, id)
+		if err != nil {
+			// Сообщение могло быть повторно передано или удалено после получения списка.
+			if errors.Cause(err) == storage.ErrNotFound {
+				continue
+			}
+			return httplib.NewInternalErrorResponse(httplib.NewErrorBody(common.ETCDErrorCode, err.Error())), nil
+		}
+		letters.DeadLetters = append(letters.DeadLetters, letter)
+	}
+
+	lettersData, err := json.Marshal(letters)
+	if err != nil {
+		return httplib.NewInternalErrorResponse(httplib.NewErrorBody(common.BadDeadLetterErrorCode, err.Error())), nil
+	}
+
+	return httplib.NewOKResponse(lettersData, httplib.ContentTypeJSON), nil
+}
+
+// GetDeadLetter получает недоставленное сообщение схемы.
+func GetDeadLetter(r *http.Request) (*httplib.Response, error) {
+	schemeName, id, resp := deadLetterVars(r)
+	if resp != nil {
+		return resp, nil
+	}
+
+	letter, err := external.ETCD.LoadDeadLetter(r.Context(), schemeName, id)
+	if err != nil {
+		if errors.Cause(err) == storage.ErrNotFound {
+			return httplib.NewNotFoundResponse(httplib.NewErrorBody(common.NameNotFoundErrorCode, err.Error())), nil
+		}
+		return httplib.NewInternalErrorResponse(httplib.NewErrorBody(common.ETCDErrorCode, err.Error())), nil
+	}
+
+	letterData, err := json.Marshal(letter)
+	if err != nil {
+		return httplib.NewInternalErrorResponse(httplib.NewErrorBody(common.BadDeadLetterErrorCode, err.Error())), nil
+	}
+
+	return httplib.NewOKResponse(letterData, httplib.ContentTypeJSON), nil
+}
+
+// DeleteDeadLetter удаляет недоставленное сообщение схемы без повторной передачи.
+func DeleteDeadLetter(r *http.Request) (*httplib.Response, error) {
+	schemeName, id, resp := deadLetterVars(r)
+	if resp != nil {
+		return resp, nil
+	}
+
+	if err := external.ETCD.DeleteDeadLetter(r.Context(), schemeName, id); err != nil {
+		if errors.Cause(err) == storage.ErrNotFound {
+			return httplib.NewNotFoundResponse(httplib.NewErrorBody(common.NameNotFoundErrorCode, err.Error())), nil
+		}
+		return httplib.NewInternalErrorResponse(httplib.NewErrorBody(common.ETCDErrorCode, err.Error())), nil
+	}
+
+	return httplib.NewOKResponse(nil, httplib.ContentTypeRaw), nil
+}
+
+// ReplayDeadLetter передает недоставленное сообщение узлу, который его отклонил, и удаляет его из очереди.
+func ReplayDeadLetter(r *http.Request) (*httplib.Response, error) {
+	schemeName, id, resp := deadLetterVars(r)
+	if resp != nil {
+		return resp, nil
+	}
+
+	letter, err := external.ETCD.LoadDeadLetter(r.Context(), schemeName, id)
+	if err != nil {
+		if errors.Cause(err) == storage.ErrNotFound {
+			return httplib.NewNotFoundResponse(httplib.NewErrorBody(common.NameNotFoundErrorCode, err.Error())), nil
+		}
+		return httplib.NewInternalErrorResponse(httplib.NewErrorBody(common.ETCDErrorCode, err.Error())), nil
+	}
+
+	if letter.Truncated {
+		return httplib.NewBadRequestResponse(httplib.NewErrorBody(common.BadDeadLetterErrorCode,
+			fmt.Sprintf("dead letter data was truncated from %d bytes and can not be replayed", letter.Size))), nil
+	}
+
+	err = watcher.Watcher.ReplayMessage(r.Context(), schemeName, letter.ActionName, letter.Metadata, letter.Data)
+	if err != nil {
+		if errors.Cause(err) == watcher.ErrNoAction || errors.Cause(err) == watcher.ErrNoHost {
+			return httplib.NewBadRequestResponse(httplib.NewErrorBody(common.BadNameErrorCode, err.Error())), nil
+		} else if errors.Cause(err) == watcher.ErrUnknownPlan {
+			return httplib.NewNotFoundResponse(httplib.NewErrorBody(common.BadSchemeErrorCode, err.Error())), nil
+		}
+		return httplib.NewInternalErrorResponse(httplib.NewErrorBody(common.MachineErrorCode,
+			fmt.Sprintf("unknown error: %s", err.Error()))), nil
+	}
+
+	// Если действие снова отклонит сообщение, оно вернется в очередь с новым идентификатором.
+	if err := external.ETCD.DeleteDeadLetter(r.Context(), schemeName, id); err != nil && errors.Cause(err) != storage.ErrNotFound {
+		return httplib.NewInternalErrorResponse(httplib.NewErrorBody(common.ETCDErrorCode, err.Error())), nil
+	}
+
+	return httplib.NewOKResponse(nil, httplib.ContentTypeRaw), nil
+}
+
+func deadLetterVars(r *http.Request) (string, string, *httplib.Response) {
+	vars := mux.Vars(r)
+	schemeName := vars["scheme_name"]
+	if schemeName == "" {
+		return "", "", httplib.NewBadRequestResponse(httplib.NewErrorBody(common.BadNameErrorCode, "scheme_name must be not empty"))
+	}
+	id := vars["dead_letter_id"]
+	if id == "" {
+		return "", "", httplib.NewBadRequestResponse(httplib.NewErrorBody(common.BadNameErrorCode, "dead_letter_id must be not empty"))
+	}
+	return schemeName, id, nil
+}
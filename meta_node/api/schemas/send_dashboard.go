@@ -5,6 +5,7 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"net/http"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -18,6 +19,7 @@ import (
 	"github.com/GDVFox/gostreaming/meta_node/watcher"
 	"github.com/GDVFox/gostreaming/util"
 	"github.com/GDVFox/gostreaming/util/httplib"
+	"github.com/GDVFox/gostreaming/util/message"
 )
 
 const (
@@ -139,8 +141,10 @@ func buildGraph(nodes []*watcher.NodeTelemetry) ([]byte, error) {
 		graphvizNode.SetShape(cgraph.RectangleShape)
 		graphvizNode.SetLabel(buildLabel(node))
 
-		if node.IsRunning {
+		if node.IsRunning && node.Status == message.RuntimeStatusOK {
 			graphvizNode.SetColor("green")
+		} else if node.IsRunning {
+			graphvizNode.SetColor("orange")
 		} else {
 			graphvizNode.SetColor("red")
 		}
@@ -182,9 +186,84 @@ func buildLabel(node *watcher.NodeTelemetry) string {
 	b.WriteString(node.Address)
 	b.WriteString("\\l")
 
+	if node.IsRunning {
+		b.WriteString("Status: ")
+		b.WriteString(node.Status.String())
+		b.WriteString("\\l")
+	}
+
 	b.WriteString("OldestOutput: ")
-	b.WriteString(strconv.Itoa(int(node.OldestOutput)))
+	b.WriteString(strconv.FormatUint(node.OldestOutput, 10))
 	b.WriteString("\\l")
 
+	b.WriteString("ForwardLog: ")
+	b.WriteString(strconv.FormatUint(node.ForwardLog.Items, 10))
+	b.WriteString(" items, ")
+	b.WriteString(strconv.FormatUint(node.ForwardLog.Bytes, 10))
+	b.WriteString(" bytes\\l")
+	if node.ForwardLog.Blocked != 0 || node.ForwardLog.Dropped != 0 {
+		b.WriteString("Overflow: blocked=")
+		b.WriteString(strconv.FormatUint(node.ForwardLog.Blocked, 10))
+		b.WriteString(" dropped=")
+		b.WriteString(strconv.FormatUint(node.ForwardLog.Dropped, 10))
+		b.WriteString("\\l")
+	}
+	if node.Crashes != 0 {
+		b.WriteString("Crashes: ")
+		b.WriteString(strconv.FormatUint(node.Crashes, 10))
+		if node.LastExit != "" {
+			b.WriteString(" (")
+			b.WriteString(escapeLabel(node.LastExit))
+			b.WriteString(")")
+		}
+		b.WriteString("\\l")
+	}
+
+	metricNames := make([]string, 0, len(node.Metrics))
+	for name := range node.Metrics {
+		metricNames = append(metricNames, name)
+	}
+	sort.Strings(metricNames)
+	for _, name := range metricNames {
+		b.WriteString(name)
+		b.WriteString(": ")
+		b.WriteString(formatMetric(node.Metrics[name]))
+		b.WriteString("\\l")
+	}
+
 	return b.String()
 }
+
+// maxLabelReasonLength ограничение на длину причины отказа в подписи узла.
+const maxLabelReasonLength = 80
+
+// escapeLabel готовит произвольный текст для подписи узла: оставляет первую строку
+// ограниченной длины и экранирует символы, которые graphviz обрабатывает в подписи.
+func escapeLabel(text string) string {
+	if i := strings.IndexAny(text, "\r\n"); i >= 0 {
+		text = text[:i]
+	}
+	if len(text) > maxLabelReasonLength {
+		text = text[:maxLabelReasonLength] + "..."
+	}
+	return strings.NewReplacer("\\", "\\\\", "\"", "\\\"").Replace(text)
+}
+
+func formatMetric(metric *message.ActionMetric) string {
+	formatFloat := func(f float64) string {
+		return strconv.FormatFloat(f, 'g', 6, 64)
+	}
+
+	if metric.Type != message.MetricTypeHistogram {
+		return formatFloat(metric.Value)
+	}
+
+	avg := 0.0
+	if metric.Count != 0 {
+		avg = metric.Sum / float64(metric.Count)
+	}
+	return "count=" + strconv.FormatUint(metric.Count, 10) +
+		" avg=" + formatFloat(avg) +
+		" min=" + formatFloat(metric.Min) +
+		" max=" + formatFloat(metric.Max)
+}
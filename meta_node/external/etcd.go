@@ -4,17 +4,23 @@ import (
 	"context"
 	"encoding/json"
 	"path/filepath"
+	"sort"
 
 	"github.com/DataDog/zstd"
 	"github.com/pkg/errors"
 
 	"github.com/GDVFox/gostreaming/meta_node/planner"
+	"github.com/GDVFox/gostreaming/util/message"
 	"github.com/GDVFox/gostreaming/util/storage"
 )
 
 const (
 	plansPath   = "/plans"
 	actionsPath = "/actions"
+	// deadLettersPath очередь недоставленных сообщений, которую заполняют machine_node.
+	deadLettersPath = "/dead_letters"
+	// deadLetterDataPath данные недоставленных сообщений, machine_node сохраняет их частями.
+	deadLetterDataPath = "/dead_letter_data"
 
 	actionsCompressLevel = 11
 )
@@ -122,6 +128,73 @@ func (c *ETCDClient) DeleteAction(ctx context.Context, name string) error {
 	return nil
 }
 
+// LoadDeadLetterIDs получает список идентификаторов недоставленных сообщений схемы.
+func (c *ETCDClient) LoadDeadLetterIDs(ctx context.Context, schemeName string) ([]string, error) {
+	// Разделитель в конце префикса нужен, чтобы не получить сообщения схем с общим началом имени.
+	ids, err := c.cli.List(ctx, buildDeadLetterKey(schemeName, "")+"/")
+	if err != nil {
+		return nil, errors.Wrap(err, "can not list of dead letters from etcd")
+	}
+	return ids, nil
+}
+
+// LoadDeadLetterInfo получает недоставленное сообщение схемы без данных, если они хранятся отдельно.
+func (c *ETCDClient) LoadDeadLetterInfo(ctx context.Context, schemeName, id string) (*message.DeadLetter, error) {
+	resp, err := c.cli.Get(ctx, buildDeadLetterKey(schemeName, id))
+	if err != nil {
+		return nil, errors.Wrap(err, "can not load dead letter from etcd")
+	}
+
+	letter := &message.DeadLetter{}
+	if err := json.Unmarshal(resp, letter); err != nil {
+		return nil, errors.Wrap(err, "can not unmarshal dead letter")
+	}
+	return letter, nil
+}
+
+// LoadDeadLetter получает недоставленное сообщение схемы вместе с данными.
+func (c *ETCDClient) LoadDeadLetter(ctx context.Context, schemeName, id string) (*message.DeadLetter, error) {
+	letter, err := c.LoadDeadLetterInfo(ctx, schemeName, id)
+	if err != nil {
+		return nil, err
+	}
+	if letter.DataParts == 0 {
+		return letter, nil
+	}
+
+	parts, err := c.cli.LoadPrefix(ctx, buildDeadLetterDataPrefix(schemeName, id))
+	if err != nil {
+		return nil, errors.Wrap(err, "can not load dead letter data from etcd")
+	}
+	if len(parts) != letter.DataParts {
+		return nil, errors.Errorf("dead letter data is incomplete: got %d parts, expected %d", len(parts), letter.DataParts)
+	}
+
+	// Номера частей дополнены нулями, поэтому порядок ключей совпадает с порядком частей.
+	partKeys := make([]string, 0, len(parts))
+	for key := range parts {
+		partKeys = append(partKeys, key)
+	}
+	sort.Strings(partKeys)
+
+	letter.Data = make([]byte, 0, letter.Size)
+	for _, key := range partKeys {
+		letter.Data = append(letter.Data, parts[key]...)
+	}
+	return letter, nil
+}
+
+// DeleteDeadLetter удаляет недоставленное сообщение схемы вместе с данными.
+func (c *ETCDClient) DeleteDeadLetter(ctx context.Context, schemeName, id string) error {
+	if err := c.cli.Delete(ctx, buildDeadLetterKey(schemeName, id)); err != nil {
+		return errors.Wrap(err, "can not delete dead letter from etcd")
+	}
+	if err := c.cli.DeletePrefix(ctx, buildDeadLetterDataPrefix(schemeName, id)); err != nil {
+		return errors.Wrap(err, "can not delete dead letter data from etcd")
+	}
+	return nil
+}
+
 func buildActionKey(actionName string) string {
 	return filepath.Join(actionsPath, actionName)
 }
@@ -129,3 +202,12 @@ func buildActionKey(actionName string) string {
 func buildPlansKey(planName string) string {
 	return filepath.Join(plansPath, planName)
 }
+
+func buildDeadLetterKey(schemeName, id string) string {
+	return filepath.Join(deadLettersPath, schemeName, id)
+}
+
+func buildDeadLetterDataPrefix(schemeName, id string) string {
+	// Разделитель в конце префикса нужен, чтобы не получить данные сообщений с общим началом идентификатора.
+	return filepath.Join(deadLetterDataPath, schemeName, id) + "/"
+}
@@ -65,6 +65,19 @@ func main() {
 	r.HandleFunc("/schemas/{scheme_name:[a-zA-z0-9]+}/stop", httplib.CreateHandler(schemas.StopScheme, logger)).Methods(http.MethodPut)
 	r.HandleFunc("/schemas/{scheme_name:[a-zA-z0-9]+}/dashboard", httplib.CreateHandler(schemas.GetDashboard, logger)).Methods(http.MethodGet)
 	r.HandleFunc("/schemas/{scheme_name:[a-zA-z0-9]+}/send_dashboard", httplib.CreateWSHandler(schemas.SendDashboard, logger)).Methods(http.MethodGet)
+	r.HandleFunc("/schemas/{scheme_name:[a-zA-z0-9]+}/stats", httplib.CreateHandler(schemas.GetSchemeStats, logger)).Methods(http.MethodGet)
+	r.HandleFunc("/schemas/{scheme_name:[a-zA-z0-9]+}/pause", httplib.CreateHandler(schemas.PauseScheme, logger)).Methods(http.MethodPut)
+	r.HandleFunc("/schemas/{scheme_name:[a-zA-z0-9]+}/resume", httplib.CreateHandler(schemas.ResumeScheme, logger)).Methods(http.MethodPut)
+	r.HandleFunc("/schemas/{scheme_name:[a-zA-z0-9]+}/log_level", httplib.CreateHandler(schemas.SetSchemeLogLevel, logger)).Methods(http.MethodPut)
+	r.HandleFunc("/schemas/{scheme_name:[a-zA-z0-9]+}/drain", httplib.CreateHandler(schemas.DrainScheme, logger)).Methods(http.MethodPut)
+	r.HandleFunc("/schemas/{scheme_name:[a-zA-z0-9]+}/nodes/{node_name:[a-zA-z0-9]+}/stats", httplib.CreateHandler(schemas.GetSchemeStats, logger)).Methods(http.MethodGet)
+	r.HandleFunc("/schemas/{scheme_name:[a-zA-z0-9]+}/nodes/{node_name:[a-zA-z0-9]+}/pause", httplib.CreateHandler(schemas.PauseScheme, logger)).Methods(http.MethodPut)
+	r.HandleFunc("/schemas/{scheme_name:[a-zA-z0-9]+}/nodes/{node_name:[a-zA-z0-9]+}/resume", httplib.CreateHandler(schemas.ResumeScheme, logger)).Methods(http.MethodPut)
+	r.HandleFunc("/schemas/{scheme_name:[a-zA-z0-9]+}/nodes/{node_name:[a-zA-z0-9]+}/log_level", httplib.CreateHandler(schemas.SetSchemeLogLevel, logger)).Methods(http.MethodPut)
+	r.HandleFunc("/schemas/{scheme_name:[a-zA-z0-9]+}/dead_letters", httplib.CreateHandler(schemas.ListDeadLetters, logger)).Methods(http.MethodGet)
+	r.HandleFunc("/schemas/{scheme_name:[a-zA-z0-9]+}/dead_letters/{dead_letter_id:[a-zA-z0-9\\-]+}", httplib.CreateHandler(schemas.GetDeadLetter, logger)).Methods(http.MethodGet)
+	r.HandleFunc("/schemas/{scheme_name:[a-zA-z0-9]+}/dead_letters/{dead_letter_id:[a-zA-z0-9\\-]+}", httplib.CreateHandler(schemas.DeleteDeadLetter, logger)).Methods(http.MethodDelete)
+	r.HandleFunc("/schemas/{scheme_name:[a-zA-z0-9]+}/dead_letters/{dead_letter_id:[a-zA-z0-9\\-]+}/replay", httplib.CreateHandler(schemas.ReplayDeadLetter, logger)).Methods(http.MethodPut)
 
 	signalChannel := make(chan os.Signal, 1)
 	signal.Notify(signalChannel, syscall.SIGINT, syscall.SIGTERM)
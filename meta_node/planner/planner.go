@@ -6,6 +6,7 @@ import (
 	"github.com/pkg/errors"
 
 	"github.com/GDVFox/gostreaming/meta_node/parser"
+	"github.com/GDVFox/gostreaming/util"
 )
 
 // Возможные ошибки
@@ -16,8 +17,13 @@ var (
 	ErrUnknownNode       = errors.New("unknown node")
 	ErrFoundCycle        = errors.New("found cycle")
 	ErrAlreadyUsed       = errors.New("node already used in dataflow")
+	ErrUnknownRoutingOut = errors.New("routing is set for node which is not out")
+	ErrDeadLetterIsOut   = errors.New("dead letter node is already out of node")
 )
 
+// deadLetterRouting режим передачи, в котором узел получает только отклоненные сообщения.
+const deadLetterRouting = "dead_letter"
+
 // Plan содержит информацию, необходимую для запуска обработки потока на серверах.
 type Plan struct {
 	Name   string      `json:"name"`
@@ -37,6 +43,42 @@ type NodePlan struct {
 	Env           map[string]string  `json:"env"`
 	Addresses     []*AddrDescription `json:"addresses"`
 	ConnWhitelist []string           `json:"conn_whitelist"`
+	Codec         string             `json:"codec"`
+	Metadata      bool               `json:"metadata"`
+	State         bool               `json:"state"`
+	Replicas      int                `json:"replicas"`
+
+	MaxPendingMessages int `json:"max_pending_messages"`
+	MaxPendingBytes    int `json:"max_pending_bytes"`
+	// Максимальное число входных сообщений в одном пакете, 0 отключает пакеты.
+	BatchSize int `json:"batch_size"`
+
+	Compression        string `json:"compression"`
+	CompressionLevel   int    `json:"compression_level"`
+	CompressionMinSize int    `json:"compression_min_size"`
+
+	ForwardLogMaxItems int    `json:"forward_log_max_items"`
+	ForwardLogMaxBytes int    `json:"forward_log_max_bytes"`
+	ForwardLogOverflow string `json:"forward_log_overflow"`
+	ForwardLogStorage  string `json:"forward_log_storage"`
+	ForwardLogSync     string `json:"forward_log_sync"`
+	// Режим exactly-once задается для всей схемы.
+	ExactlyOnce bool `json:"exactly_once"`
+	// Режимы передачи сообщений в порядке Out.
+	Routing []string `json:"routing"`
+	// Число отказов действия на одном сообщении до передачи его в очередь недоставленных сообщений.
+	MaxCrashes int `json:"max_crashes"`
+	// Число перезапусков отказавшего действия подряд и задержки между ними.
+	MaxRestarts       int           `json:"max_restarts"`
+	RestartBackoff    util.Duration `json:"restart_backoff"`
+	RestartMaxBackoff util.Duration `json:"restart_max_backoff"`
+
+	ReadyTimeout  util.Duration `json:"ready_timeout"`
+	ProbeInterval util.Duration `json:"probe_interval"`
+	ProbeTimeout  util.Duration `json:"probe_timeout"`
+
+	TickInterval    util.Duration `json:"tick_interval"`
+	ShutdownTimeout util.Duration `json:"shutdown_timeout"`
 }
 
 // node вершина в дереве связей узлов.
@@ -93,6 +135,9 @@ func (s *Planner) Plan() (*Plan, error) {
 	if err != nil {
 		return nil, err
 	}
+	if err := s.scheduleDeadLetters(); err != nil {
+		return nil, err
+	}
 	orderedNodePlans := make([]*NodePlan, 0)
 	colors := make(map[string]byte, 0)
 
@@ -109,9 +154,19 @@ func (s *Planner) Plan() (*Plan, error) {
 				in[i] = s.scheme.Name + "_" + s.nodes[n].Name
 			}
 			out := make([]string, len(s.nodeConnections[node].Out))
+			routing := make([]string, len(s.nodeConnections[node].Out))
 			// По умолчанию используется первый адрес.
 			for i, n := range s.nodeConnections[node].Out {
 				out[i] = s.nodes[n].Addresses[0].Host + ":" + strconv.Itoa(s.nodes[n].Addresses[0].Port)
+				routing[i] = nodeDescr.Routing[n]
+				if n == nodeDescr.DeadLetter {
+					routing[i] = deadLetterRouting
+				}
+			}
+			for n := range nodeDescr.Routing {
+				if !containsString(s.nodeConnections[node].Out, n) || n == nodeDescr.DeadLetter {
+					return nil, errors.Wrapf(ErrUnknownRoutingOut, "%s -> %s", node, n)
+				}
 			}
 			orderedNodePlans = append(orderedNodePlans, &NodePlan{
 				Name:          nodeDescr.Name,
@@ -124,6 +179,37 @@ func (s *Planner) Plan() (*Plan, error) {
 				Env:           nodeDescr.Env,
 				Addresses:     nodeDescr.Addresses,
 				ConnWhitelist: nodeDescr.ConnWhitelist,
+				Codec:         nodeDescr.Codec,
+				Metadata:      nodeDescr.Metadata,
+				State:         nodeDescr.State,
+				Replicas:      nodeDescr.Replicas,
+
+				MaxPendingMessages: nodeDescr.MaxPendingMessages,
+				MaxPendingBytes:    nodeDescr.MaxPendingBytes,
+				BatchSize:          nodeDescr.BatchSize,
+
+				Compression:        nodeDescr.Compression,
+				CompressionLevel:   nodeDescr.CompressionLevel,
+				CompressionMinSize: nodeDescr.CompressionMinSize,
+
+				ForwardLogMaxItems: nodeDescr.ForwardLogMaxItems,
+				ForwardLogMaxBytes: nodeDescr.ForwardLogMaxBytes,
+				ForwardLogOverflow: nodeDescr.ForwardLogOverflow,
+				ForwardLogStorage:  nodeDescr.ForwardLogStorage,
+				ForwardLogSync:     nodeDescr.ForwardLogSync,
+				ExactlyOnce:        s.scheme.ExactlyOnce,
+				Routing:            routing,
+				MaxCrashes:         nodeDescr.MaxCrashes,
+				MaxRestarts:        nodeDescr.MaxRestarts,
+				RestartBackoff:     nodeDescr.RestartBackoff,
+				RestartMaxBackoff:  nodeDescr.RestartMaxBackoff,
+
+				ReadyTimeout:  nodeDescr.ReadyTimeout,
+				ProbeInterval: nodeDescr.ProbeInterval,
+				ProbeTimeout:  nodeDescr.ProbeTimeout,
+
+				TickInterval:    nodeDescr.TickInterval,
+				ShutdownTimeout: nodeDescr.ShutdownTimeout,
 			})
 			continue
 		}
@@ -149,6 +235,36 @@ func (s *Planner) Plan() (*Plan, error) {
 	}, nil
 }
 
+// scheduleDeadLetters добавляет связи узлов с их узлами для отклоненных сообщений.
+// Такой узел может не участвовать в потоке данных, тогда он получает только отклоненные сообщения.
+func (s *Planner) scheduleDeadLetters() error {
+	queue := make([]string, 0, len(s.used))
+	for _, n := range s.scheme.Nodes {
+		if _, ok := s.used[n.Name]; ok {
+			queue = append(queue, n.Name)
+		}
+	}
+
+	for i := 0; i < len(queue); i++ {
+		name := queue[i]
+		deadLetter := s.nodes[name].DeadLetter
+		if deadLetter == "" {
+			continue
+		}
+		if containsString(s.nodeConnections[name].Out, deadLetter) {
+			return errors.Wrapf(ErrDeadLetterIsOut, "%s -> %s", name, deadLetter)
+		}
+
+		s.nodeConnections[name].Out = append(s.nodeConnections[name].Out, deadLetter)
+		s.nodeConnections[deadLetter].In = append(s.nodeConnections[deadLetter].In, name)
+		if _, ok := s.used[deadLetter]; !ok {
+			s.used[deadLetter] = struct{}{}
+			queue = append(queue, deadLetter)
+		}
+	}
+	return nil
+}
+
 func (s *Planner) scheduleNode(r parser.Node) (*node, error) {
 	switch v := r.(type) {
 	case *parser.ActionNode:
@@ -249,3 +365,12 @@ func (s *Planner) scheduleSequentialNode(r *parser.OperaionNode) (*node, error)
 		Out: out,
 	}, nil
 }
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
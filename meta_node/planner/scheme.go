@@ -4,6 +4,7 @@ import (
 	"regexp"
 	"strconv"
 
+	"github.com/GDVFox/gostreaming/util"
 	"github.com/pkg/errors"
 )
 
@@ -22,10 +23,40 @@ var (
 	ErrEmptyArg                 = errors.New("arg can not be empty")
 	ErrEmptyEnvVarName          = errors.New("env variable name can not be empty")
 	ErrNotValidIP               = errors.New("expected valid ip")
+	ErrUnknownCodec             = errors.New("unknown codec")
+	ErrNegativePendingLimit     = errors.New("pending limit can not be negative")
+	ErrNegativeBatchSize        = errors.New("batch size can not be negative")
+	ErrNegativeDuration         = errors.New("duration can not be negative")
+	ErrUnknownCompression       = errors.New("unknown compression")
+	ErrBadCompressionLevel      = errors.New("compression level must be in [0, 22]")
+	ErrNegativeCompressionSize  = errors.New("compression min size can not be negative")
+	ErrNegativeForwardLogLimit  = errors.New("forward log limit can not be negative")
+	ErrUnknownOverflowPolicy    = errors.New("unknown forward log overflow policy")
+	ErrUnknownLogStorage        = errors.New("unknown forward log storage")
+	ErrUnknownLogSync           = errors.New("unknown forward log sync mode")
+	ErrLogSyncWithoutFile       = errors.New("forward log sync mode can be set only for file storage")
+	ErrExactlyOnceMemoryLog     = errors.New("exactly-once requires durable forward log storage")
+	ErrUnknownRouting           = errors.New("unknown routing mode")
+	ErrNegativeMaxCrashes       = errors.New("max crashes can not be negative")
+	ErrBadMaxRestarts           = errors.New("max restarts must be -1 or greater")
+	ErrUnknownDeadLetterNode    = errors.New("dead letter node is not described in scheme")
+	ErrDeadLetterToItself       = errors.New("node can not be dead letter node of itself")
 )
 
 var (
 	nodeNameReg = regexp.MustCompile(`^[a-zA-Z0-9]+$`)
+	// knownCodecs кодеки, поддерживаемые actionlib, пустое значение означает кодек по умолчанию.
+	knownCodecs = map[string]struct{}{"": {}, "json": {}, "gob": {}, "csv": {}, "line": {}}
+	// knownCompressions алгоритмы сжатия сообщений между runtime, пустое значение отключает сжатие.
+	knownCompressions = map[string]struct{}{"": {}, "none": {}, "zstd": {}}
+	// knownOverflowPolicies политики переполнения forward log, пустое значение означает block.
+	knownOverflowPolicies = map[string]struct{}{"": {}, "block": {}, "drop_oldest": {}, "fail": {}}
+	// knownLogStorages хранилища forward log, пустое значение означает leveldb.
+	knownLogStorages = map[string]struct{}{"": {}, "leveldb": {}, "memory": {}, "file": {}}
+	// knownLogSyncs режимы сброса на диск файлового хранилища, пустое значение означает segment.
+	knownLogSyncs = map[string]struct{}{"": {}, "none": {}, "segment": {}, "always": {}}
+	// knownRoutings режимы передачи сообщений нижестоящим узлам, пустое значение означает broadcast.
+	knownRoutings = map[string]struct{}{"": {}, "broadcast": {}, "round_robin": {}, "hash": {}}
 )
 
 // AddrDescription описание адреса сервера, на котором будет запущено действие
@@ -42,6 +73,48 @@ type NodeDescription struct {
 	Args          []string           `yaml:"args" json:"args"`
 	Env           map[string]string  `yaml:"env" json:"env"`
 	ConnWhitelist []string           `yaml:"conn_whitelist" json:"conn_whitelist"`
+	Codec         string             `yaml:"codec" json:"codec"`
+	Metadata      bool               `yaml:"metadata" json:"metadata"`
+	State         bool               `yaml:"state" json:"state"`
+	// Число процессов действия, между которыми распределяются входные сообщения, 0 означает один процесс.
+	Replicas int `yaml:"replicas" json:"replicas"`
+	// Ограничения неподтвержденного вывода источника, 0 означает отсутствие ограничения.
+	MaxPendingMessages int `yaml:"max_pending_messages" json:"max_pending_messages"`
+	MaxPendingBytes    int `yaml:"max_pending_bytes" json:"max_pending_bytes"`
+	// Максимальное число входных сообщений в одном пакете, 0 отключает пакеты.
+	BatchSize int `yaml:"batch_size" json:"batch_size"`
+	// Алгоритм сжатия выходных сообщений, его уровень и минимальная длина сжимаемого пакета.
+	Compression        string `yaml:"compression" json:"compression"`
+	CompressionLevel   int    `yaml:"compression_level" json:"compression_level"`
+	CompressionMinSize int    `yaml:"compression_min_size" json:"compression_min_size"`
+	// Ограничения forward log, 0 означает отсутствие ограничения, и политика его переполнения.
+	ForwardLogMaxItems int    `yaml:"forward_log_max_items" json:"forward_log_max_items"`
+	ForwardLogMaxBytes int    `yaml:"forward_log_max_bytes" json:"forward_log_max_bytes"`
+	ForwardLogOverflow string `yaml:"forward_log_overflow" json:"forward_log_overflow"`
+	// Хранилище forward log и режим сброса на диск для файлового хранилища.
+	ForwardLogStorage string `yaml:"forward_log_storage" json:"forward_log_storage"`
+	ForwardLogSync    string `yaml:"forward_log_sync" json:"forward_log_sync"`
+	// Режимы передачи сообщений по имени нижестоящего узла, по умолчанию узел получает все сообщения.
+	Routing map[string]string `yaml:"routing" json:"routing"`
+	// Узел, который получает отклоненные действием сообщения, по умолчанию они сохраняются в очереди схемы.
+	DeadLetter string `yaml:"dead_letter" json:"dead_letter"`
+	// Число отказов действия на одном сообщении, после которого оно считается отклоненным, 0 отключает подсчет.
+	MaxCrashes int `yaml:"max_crashes" json:"max_crashes"`
+	// Число перезапусков отказавшего действия подряд, после которого узел перезапускается
+	// на другой машине, 0 означает 5, -1 отключает перезапуск.
+	MaxRestarts int `yaml:"max_restarts" json:"max_restarts"`
+	// Начальная и максимальная задержка перезапуска действия, 0 означает 1 секунду и 1 минуту.
+	RestartBackoff    util.Duration `yaml:"restart_backoff" json:"restart_backoff"`
+	RestartMaxBackoff util.Duration `yaml:"restart_max_backoff" json:"restart_max_backoff"`
+	// Время ожидания подтверждения готовности действия, 0 означает, что подтверждение не требуется.
+	ReadyTimeout util.Duration `yaml:"ready_timeout" json:"ready_timeout"`
+	// Период и время ожидания ответа проверок работоспособности действия, 0 отключает проверки.
+	ProbeInterval util.Duration `yaml:"probe_interval" json:"probe_interval"`
+	ProbeTimeout  util.Duration `yaml:"probe_timeout" json:"probe_timeout"`
+	// Период тиков для действий, которые читают события, 0 отключает тики.
+	TickInterval util.Duration `yaml:"tick_interval" json:"tick_interval"`
+	// Время ожидания ответа действия на уведомление об остановке.
+	ShutdownTimeout util.Duration `yaml:"shutdown_timeout" json:"shutdown_timeout"`
 }
 
 // Check выполняет проверку правильности описания узла.
@@ -74,6 +147,61 @@ func (d *NodeDescription) Check() error {
 		}
 		// при этом допускается пустое value, как в unix системах.
 	}
+	if _, ok := knownCodecs[d.Codec]; !ok {
+		return errors.Wrapf(ErrUnknownCodec, "%s", d.Codec)
+	}
+	if d.MaxPendingMessages < 0 || d.MaxPendingBytes < 0 {
+		return ErrNegativePendingLimit
+	}
+	if d.Replicas < 0 {
+		return ErrExpectedPositiveReplicas
+	}
+	if d.BatchSize < 0 {
+		return ErrNegativeBatchSize
+	}
+	if _, ok := knownCompressions[d.Compression]; !ok {
+		return errors.Wrapf(ErrUnknownCompression, "%s", d.Compression)
+	}
+	if d.CompressionLevel < 0 || d.CompressionLevel > 22 {
+		return ErrBadCompressionLevel
+	}
+	if d.CompressionMinSize < 0 {
+		return ErrNegativeCompressionSize
+	}
+	if d.ForwardLogMaxItems < 0 || d.ForwardLogMaxBytes < 0 {
+		return ErrNegativeForwardLogLimit
+	}
+	if _, ok := knownOverflowPolicies[d.ForwardLogOverflow]; !ok {
+		return errors.Wrapf(ErrUnknownOverflowPolicy, "%s", d.ForwardLogOverflow)
+	}
+	if _, ok := knownLogStorages[d.ForwardLogStorage]; !ok {
+		return errors.Wrapf(ErrUnknownLogStorage, "%s", d.ForwardLogStorage)
+	}
+	if _, ok := knownLogSyncs[d.ForwardLogSync]; !ok {
+		return errors.Wrapf(ErrUnknownLogSync, "%s", d.ForwardLogSync)
+	}
+	if d.ForwardLogSync != "" && d.ForwardLogStorage != "file" {
+		return ErrLogSyncWithoutFile
+	}
+	for out, mode := range d.Routing {
+		if _, ok := knownRoutings[mode]; !ok {
+			return errors.Wrapf(ErrUnknownRouting, "%s: %s", out, mode)
+		}
+	}
+	if d.DeadLetter == d.Name {
+		return ErrDeadLetterToItself
+	}
+	if d.MaxCrashes < 0 {
+		return ErrNegativeMaxCrashes
+	}
+	if d.MaxRestarts < -1 {
+		return ErrBadMaxRestarts
+	}
+	if d.ReadyTimeout < 0 || d.ProbeInterval < 0 || d.ProbeTimeout < 0 ||
+		d.TickInterval < 0 || d.ShutdownTimeout < 0 ||
+		d.RestartBackoff < 0 || d.RestartMaxBackoff < 0 {
+		return ErrNegativeDuration
+	}
 
 	return nil
 }
@@ -84,6 +212,8 @@ type Scheme struct {
 	Name     string             `yaml:"name" json:"name"`
 	Nodes    []*NodeDescription `yaml:"nodes" json:"nodes"`
 	Dataflow string             `yaml:"dataflow" json:"dataflow"`
+	// Режим exactly-once: узлы отбрасывают повторно полученные сообщения.
+	ExactlyOnce bool `yaml:"exactly_once" json:"exactly_once"`
 }
 
 // Check выполняет проверку правильности задания схемы.
@@ -98,6 +228,11 @@ func (s *Scheme) Check() error {
 		if err := node.Check(); err != nil {
 			return err
 		}
+		// После перезапуска узел должен знать, какие сообщения уже обработаны,
+		// а выходы, хранящиеся в памяти, теряются вместе с этим знанием.
+		if s.ExactlyOnce && node.ForwardLogStorage == "memory" {
+			return errors.Wrapf(ErrExactlyOnceMemoryLog, "%s", node.Name)
+		}
 		if _, ok := names[node.Name]; ok {
 			return errors.Wrapf(ErrNodeNameUsed, "%s", node.Name)
 		}
@@ -111,6 +246,12 @@ func (s *Scheme) Check() error {
 		}
 	}
 
+	for _, node := range s.Nodes {
+		if _, ok := names[node.DeadLetter]; node.DeadLetter != "" && !ok {
+			return errors.Wrapf(ErrUnknownDeadLetterNode, "%s: %s", node.Name, node.DeadLetter)
+		}
+	}
+
 	if s.Dataflow == "" {
 		return ErrExpectedDataflow
 	}
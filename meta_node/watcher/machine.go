@@ -21,6 +21,8 @@ import (
 var (
 	ErrNoAction     = errors.New("no action")
 	ErrMachineError = errors.New("machine internal error")
+	// ErrCommandRejected возвращается, если runtime отказался выполнить команду управления.
+	ErrCommandRejected = errors.New("command rejected")
 )
 
 var (
@@ -29,6 +31,12 @@ var (
 	runPath       = "/v1/run"
 	stopPath      = "/v1/stop"
 	changeOutPath = "/v1/change_out"
+	replayPath    = "/v1/replay"
+	statsPath     = "/v1/stats"
+	pausePath     = "/v1/pause"
+	resumePath    = "/v1/resume"
+	drainPath     = "/v1/drain"
+	logLevelPath  = "/v1/log_level"
 )
 
 // MachineConfig настройки машины, на котором запущен machine_node
@@ -46,6 +54,9 @@ type MachineConfig struct {
 // Machine абстракция машины
 type Machine struct {
 	client *http.Client
+	// drainClient не ограничивает время запроса, так как drain ожидает завершения runtime,
+	// время ожидания задается контекстом запроса.
+	drainClient *http.Client
 
 	addr   string
 	cfg    *MachineConfig
@@ -59,9 +70,10 @@ func NewMachine(l *util.Logger, cfg *MachineConfig) *Machine {
 		client: &http.Client{
 			Timeout: time.Duration(cfg.Timeout),
 		},
-		addr:   addr,
-		cfg:    cfg,
-		logger: l.WithName("machine " + addr),
+		drainClient: &http.Client{},
+		addr:        addr,
+		cfg:         cfg,
+		logger:      l.WithName("machine " + addr),
 	}
 }
 
@@ -105,6 +117,37 @@ func (m *Machine) SendRunAction(ctx context.Context, schemeName string, node *pl
 		Args:          node.Args,
 		Env:           node.Env,
 		ConnWhitelist: node.ConnWhitelist,
+		Codec:         node.Codec,
+		Metadata:      node.Metadata,
+		State:         node.State,
+		Replicas:      node.Replicas,
+
+		MaxPendingMessages: node.MaxPendingMessages,
+		MaxPendingBytes:    node.MaxPendingBytes,
+		BatchSize:          node.BatchSize,
+
+		Compression:        node.Compression,
+		CompressionLevel:   node.CompressionLevel,
+		CompressionMinSize: node.CompressionMinSize,
+
+		ForwardLogMaxItems: node.ForwardLogMaxItems,
+		ForwardLogMaxBytes: node.ForwardLogMaxBytes,
+		ForwardLogOverflow: node.ForwardLogOverflow,
+		ForwardLogStorage:  node.ForwardLogStorage,
+		ForwardLogSync:     node.ForwardLogSync,
+		ExactlyOnce:        node.ExactlyOnce,
+		Routing:            node.Routing,
+		MaxCrashes:         node.MaxCrashes,
+		MaxRestarts:        node.MaxRestarts,
+		RestartBackoff:     node.RestartBackoff,
+		RestartMaxBackoff:  node.RestartMaxBackoff,
+
+		ReadyTimeout:  node.ReadyTimeout,
+		ProbeInterval: node.ProbeInterval,
+		ProbeTimeout:  node.ProbeTimeout,
+
+		TickInterval:    node.TickInterval,
+		ShutdownTimeout: node.ShutdownTimeout,
 	}
 	return m.sendCommand(machineURL.String(), reqBody)
 }
@@ -143,20 +186,128 @@ func (m *Machine) SendChangeOut(ctx context.Context, schemeName, actionName, old
 	return m.sendCommand(machineURL.String(), reqBody)
 }
 
+// SendReplay отправляет действию сообщение из очереди недоставленных сообщений.
+func (m *Machine) SendReplay(ctx context.Context, schemeName, actionName string, metadata, data []byte) error {
+	defer m.logger.Infof("sended replay for action '%s' for plan '%s'", actionName, schemeName)
+
+	machineURL := &url.URL{
+		Scheme: runHTTPScheme,
+		Host:   m.addr,
+		Path:   replayPath,
+	}
+	reqBody := &message.ReplayRequest{
+		SchemeName: schemeName,
+		ActionName: actionName,
+		Metadata:   metadata,
+		Data:       data,
+	}
+	return m.sendCommand(machineURL.String(), reqBody)
+}
+
+// SendStats запрашивает подробную статистику действия.
+func (m *Machine) SendStats(ctx context.Context, schemeName, actionName string) (*message.RuntimeStats, error) {
+	reqBody := &message.RuntimeRequest{
+		SchemeName: schemeName,
+		ActionName: actionName,
+	}
+	stats := &message.RuntimeStats{}
+	if err := m.doCommand(ctx, m.client, m.commandURL(statsPath), reqBody, stats); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// SendPause отправляет запрос на приостановку получения входных сообщений действием.
+func (m *Machine) SendPause(ctx context.Context, schemeName, actionName string) error {
+	defer m.logger.Infof("sended pause for action '%s' for plan '%s'", actionName, schemeName)
+
+	reqBody := &message.RuntimeRequest{
+		SchemeName: schemeName,
+		ActionName: actionName,
+	}
+	return m.doCommand(ctx, m.client, m.commandURL(pausePath), reqBody, nil)
+}
+
+// SendResume отправляет запрос на возобновление получения входных сообщений действием.
+func (m *Machine) SendResume(ctx context.Context, schemeName, actionName string) error {
+	defer m.logger.Infof("sended resume for action '%s' for plan '%s'", actionName, schemeName)
+
+	reqBody := &message.RuntimeRequest{
+		SchemeName: schemeName,
+		ActionName: actionName,
+	}
+	return m.doCommand(ctx, m.client, m.commandURL(resumePath), reqBody, nil)
+}
+
+// SendLogLevel отправляет запрос на изменение уровня логирования действия.
+func (m *Machine) SendLogLevel(ctx context.Context, schemeName, actionName, level string) error {
+	defer m.logger.Infof("sended log level %s for action '%s' for plan '%s'", level, actionName, schemeName)
+
+	reqBody := &message.LogLevelRequest{
+		SchemeName: schemeName,
+		ActionName: actionName,
+		Level:      level,
+	}
+	return m.doCommand(ctx, m.client, m.commandURL(logLevelPath), reqBody, nil)
+}
+
+// SendDrain отправляет запрос на drain действия и ожидает его завершения не дольше timeout.
+func (m *Machine) SendDrain(ctx context.Context, schemeName, actionName string, timeout time.Duration) error {
+	defer m.logger.Infof("sended drain for action '%s' for plan '%s'", actionName, schemeName)
+
+	// machine_node отвечает после остановки runtime, которая после timeout занимает не больше Timeout.
+	drainCtx, cancel := context.WithTimeout(ctx, timeout+2*time.Duration(m.cfg.Timeout))
+	defer cancel()
+
+	reqBody := &message.DrainRequest{
+		SchemeName: schemeName,
+		ActionName: actionName,
+		Timeout:    util.Duration(timeout),
+	}
+	return m.doCommand(drainCtx, m.drainClient, m.commandURL(drainPath), reqBody, nil)
+}
+
+func (m *Machine) commandURL(path string) string {
+	machineURL := &url.URL{
+		Scheme: runHTTPScheme,
+		Host:   m.addr,
+		Path:   path,
+	}
+	return machineURL.String()
+}
+
 func (m *Machine) sendCommand(url string, cmd interface{}) error {
+	return m.doCommand(context.Background(), m.client, url, cmd, nil)
+}
+
+// doCommand отправляет команду cmd и, если result не nil, декодирует в него ответ.
+func (m *Machine) doCommand(ctx context.Context, client *http.Client, url string, cmd, result interface{}) error {
 	reqBodyEncoded, err := json.Marshal(cmd)
 	if err != nil {
 		return err
 	}
 
-	resp, err := m.client.Post(url, "application/json", bytes.NewReader(reqBodyEncoded))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(reqBodyEncoded))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
 	if err != nil {
 		return errors.Wrap(ErrMachineError, err.Error())
 	}
+	defer resp.Body.Close()
 
 	if resp.StatusCode == http.StatusNoContent {
 		return nil
 	}
+	if resp.StatusCode == http.StatusOK && result != nil {
+		if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+			return fmt.Errorf("can not decode response %s: %w", err.Error(), ErrMachineError)
+		}
+		return nil
+	}
 	if resp.StatusCode == http.StatusNotFound {
 		return ErrNoAction
 	}
@@ -165,5 +316,8 @@ func (m *Machine) sendCommand(url string, cmd interface{}) error {
 	if err := json.NewDecoder(resp.Body).Decode(machineError); err != nil {
 		return fmt.Errorf("can not decode error response %s: %w", err.Error(), ErrMachineError)
 	}
+	if resp.StatusCode == http.StatusBadRequest && result == nil {
+		return errors.Wrap(ErrCommandRejected, machineError.Message)
+	}
 	return fmt.Errorf("machine error %s: %w", machineError.Message, ErrMachineError)
 }
@@ -3,6 +3,7 @@ package watcher
 import (
 	"context"
 	"fmt"
+	"time"
 
 	"github.com/GDVFox/gostreaming/meta_node/planner"
 	"github.com/GDVFox/gostreaming/util"
@@ -81,6 +82,54 @@ func (w *MachineWatcher) sendChangeOut(ctx context.Context, schemeName, oldOut,
 	return machine.SendChangeOut(ctx, schemeName, node.Name, oldOut, newOut)
 }
 
+func (w *MachineWatcher) sendReplay(ctx context.Context, schemeName string, metadata, data []byte, node *planner.NodePlan) error {
+	machine, ok := w.machines[node.Host]
+	if !ok {
+		return ErrNoHost
+	}
+	return machine.SendReplay(ctx, schemeName, node.Name, metadata, data)
+}
+
+func (w *MachineWatcher) sendStats(ctx context.Context, schemeName string, node *planner.NodePlan) (*message.RuntimeStats, error) {
+	machine, ok := w.machines[node.Host]
+	if !ok {
+		return nil, ErrNoHost
+	}
+	return machine.SendStats(ctx, schemeName, node.Name)
+}
+
+func (w *MachineWatcher) sendPause(ctx context.Context, schemeName string, node *planner.NodePlan) error {
+	machine, ok := w.machines[node.Host]
+	if !ok {
+		return ErrNoHost
+	}
+	return machine.SendPause(ctx, schemeName, node.Name)
+}
+
+func (w *MachineWatcher) sendResume(ctx context.Context, schemeName string, node *planner.NodePlan) error {
+	machine, ok := w.machines[node.Host]
+	if !ok {
+		return ErrNoHost
+	}
+	return machine.SendResume(ctx, schemeName, node.Name)
+}
+
+func (w *MachineWatcher) sendLogLevel(ctx context.Context, schemeName, level string, node *planner.NodePlan) error {
+	machine, ok := w.machines[node.Host]
+	if !ok {
+		return ErrNoHost
+	}
+	return machine.SendLogLevel(ctx, schemeName, node.Name, level)
+}
+
+func (w *MachineWatcher) sendDrain(ctx context.Context, schemeName string, timeout time.Duration, node *planner.NodePlan) error {
+	machine, ok := w.machines[node.Host]
+	if !ok {
+		return ErrNoHost
+	}
+	return machine.SendDrain(ctx, schemeName, node.Name, timeout)
+}
+
 func (w *MachineWatcher) pingMachines() map[string]*message.RuntimeTelemetry {
 	w.logger.Debug("started ping machines")
 
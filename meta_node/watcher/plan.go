@@ -21,10 +21,23 @@ type NodeTelemetry struct {
 	Action       string
 	Address      string
 	IsRunning    bool
-	OldestOutput uint32
+	Status       message.RuntimeStatus
+	OldestOutput uint64
+	ForwardLog   message.ForwardLogTelemetry
+	Metrics      map[string]*message.ActionMetric
+	Crashes      uint64
+	LastExit     string
 	PrevName     []string
 }
 
+// NodeStats подробная статистика узла. Error содержит причину, по которой статистику получить не удалось.
+type NodeStats struct {
+	Name    string                `json:"name"`
+	Address string                `json:"address"`
+	Stats   *message.RuntimeStats `json:"stats,omitempty"`
+	Error   string                `json:"error,omitempty"`
+}
+
 // PlanTelemetry телеметрия плана, хранящая статистику по каждому узлу и связи узлов.
 type PlanTelemetry struct {
 	Name  string
@@ -50,6 +63,8 @@ type Plan struct {
 
 	planNodesMutex sync.RWMutex
 	plan           *planDescription
+	// drained выставляется при drain плана, после чего узлы не восстанавливаются и не останавливаются.
+	drained bool
 
 	logger *util.Logger
 	cfg    *PlanConfig
@@ -118,6 +133,138 @@ func (p *Plan) StartNodes(ctx context.Context) error {
 	return startErr
 }
 
+// Replay передает узлу actionName сообщение из очереди недоставленных сообщений.
+func (p *Plan) Replay(ctx context.Context, actionName string, metadata, data []byte) error {
+	p.planNodesMutex.RLock()
+	defer p.planNodesMutex.RUnlock()
+
+	node, ok := p.plan.planNames[actionName]
+	if !ok {
+		return errors.Wrapf(ErrNoAction, "scheme does not contain node: %s", actionName)
+	}
+	return p.machineWatcher.sendReplay(ctx, p.planName, metadata, data, node)
+}
+
+// Stats возвращает подробную статистику узла nodeName или всех узлов плана, если nodeName пустой.
+func (p *Plan) Stats(ctx context.Context, nodeName string) ([]*NodeStats, error) {
+	p.planNodesMutex.RLock()
+	defer p.planNodesMutex.RUnlock()
+
+	nodes, err := p.selectNodes(nodeName)
+	if err != nil {
+		return nil, err
+	}
+
+	nodesStats := make([]*NodeStats, 0, len(nodes))
+	for _, node := range nodes {
+		nodeStats := &NodeStats{
+			Name:    node.Name,
+			Address: node.Host + ":" + strconv.Itoa(node.Port),
+		}
+		// Узел может восстанавливаться, поэтому ошибка одного узла не прерывает сбор статистики.
+		stats, err := p.machineWatcher.sendStats(ctx, p.planName, node)
+		if err != nil {
+			nodeStats.Error = err.Error()
+		} else {
+			nodeStats.Stats = stats
+		}
+		nodesStats = append(nodesStats, nodeStats)
+	}
+	return nodesStats, nil
+}
+
+// Pause приостанавливает получение входных сообщений узлом nodeName или всеми узлами плана.
+func (p *Plan) Pause(ctx context.Context, nodeName string) error {
+	return p.commandNodes(ctx, nodeName, "pause", func(node *planner.NodePlan) error {
+		return p.machineWatcher.sendPause(ctx, p.planName, node)
+	})
+}
+
+// Resume возобновляет получение входных сообщений узлом nodeName или всеми узлами плана.
+func (p *Plan) Resume(ctx context.Context, nodeName string) error {
+	return p.commandNodes(ctx, nodeName, "resume", func(node *planner.NodePlan) error {
+		return p.machineWatcher.sendResume(ctx, p.planName, node)
+	})
+}
+
+// SetLogLevel изменяет уровень логирования узла nodeName или всех узлов плана.
+func (p *Plan) SetLogLevel(ctx context.Context, nodeName, level string) error {
+	return p.commandNodes(ctx, nodeName, "log level", func(node *planner.NodePlan) error {
+		return p.machineWatcher.sendLogLevel(ctx, p.planName, level, node)
+	})
+}
+
+// Drain завершает узлы плана после обработки и доставки уже полученных сообщений.
+// Узлы завершаются начиная с источников, каждому узлу дается не больше timeout.
+// Узел, который не удалось завершить через drain, останавливается.
+func (p *Plan) Drain(ctx context.Context, timeout time.Duration) error {
+	p.planNodesMutex.Lock()
+	defer p.planNodesMutex.Unlock()
+
+	if p.drained {
+		return nil
+	}
+	p.drained = true
+	p.logger.Info("draining nodes")
+
+	var drainErr error
+	for i := len(p.plan.nodes) - 1; i >= 0; i-- {
+		node := p.plan.nodes[i]
+		err := p.machineWatcher.sendDrain(ctx, p.planName, timeout, node)
+		if err == nil || errors.Cause(err) == ErrNoAction {
+			continue
+		}
+
+		p.logger.Errorf("can not drain node '%s': %s", node.Name, err)
+		if drainErr == nil {
+			drainErr = errors.Wrapf(err, "can not drain node %s", node.Name)
+		}
+		if err := p.machineWatcher.sendStopAction(ctx, p.planName, node); err != nil && errors.Cause(err) != ErrNoAction {
+			p.logger.Errorf("can not send stop action '%s': %s, skipping", node.Action, err)
+		}
+	}
+
+	p.logger.Info("nodes drained")
+	return drainErr
+}
+
+// commandNodes выполняет command для узла nodeName или для всех узлов плана.
+// Ошибка узла не прерывает выполнение команды для остальных узлов, возвращается первая ошибка.
+func (p *Plan) commandNodes(ctx context.Context, nodeName, commandName string, command func(node *planner.NodePlan) error) error {
+	p.planNodesMutex.RLock()
+	defer p.planNodesMutex.RUnlock()
+
+	nodes, err := p.selectNodes(nodeName)
+	if err != nil {
+		return err
+	}
+
+	var commandErr error
+	for _, node := range nodes {
+		if err := command(node); err != nil {
+			p.logger.Warnf("%s for node '%s' failed: %s", commandName, node.Name, err)
+			if commandErr == nil {
+				commandErr = errors.Wrapf(err, "node %s", node.Name)
+			}
+		}
+	}
+	return commandErr
+}
+
+// selectNodes возвращает узел nodeName или все узлы плана, если nodeName пустой.
+// selectNodes не tread-safe для planNode, должен запускаться под мьютексом.
+func (p *Plan) selectNodes(nodeName string) ([]*planner.NodePlan, error) {
+	if nodeName == "" {
+		return p.plan.nodes, nil
+	}
+
+	node, ok := p.plan.planNames[nodeName]
+	if !ok {
+		return nil, errors.Wrapf(ErrNoAction, "scheme does not contain node: %s", nodeName)
+	}
+	return []*planner.NodePlan{node}, nil
+}
+
 // RunProtection запускает проверку работоспобности.
 func (p *Plan) RunProtection(ctx context.Context) error {
 	defer p.logger.Infof("protection stopped")
@@ -163,7 +310,12 @@ func (p *Plan) GetTelemetry() *PlanTelemetry {
 		runtimeTelemetry, isRunning := runtimesTelemetry[runtimeName]
 		if isRunning {
 			nodeTelemetry.IsRunning = true
+			nodeTelemetry.Status = runtimeTelemetry.Status
 			nodeTelemetry.OldestOutput = runtimeTelemetry.OldestOutput
+			nodeTelemetry.ForwardLog = runtimeTelemetry.ForwardLog
+			nodeTelemetry.Metrics = runtimeTelemetry.Metrics
+			nodeTelemetry.Crashes = runtimeTelemetry.Crashes
+			nodeTelemetry.LastExit = runtimeTelemetry.LastExit
 		}
 
 		nodesTelemetry = append(nodesTelemetry, nodeTelemetry)
@@ -179,6 +331,10 @@ func (p *Plan) protectPlan(ctx context.Context) {
 	p.planNodesMutex.Lock()
 	defer p.planNodesMutex.Unlock()
 
+	if p.drained {
+		return
+	}
+
 	p.logger.Debug("check started")
 	defer p.logger.Debug("check done")
 
@@ -272,6 +428,11 @@ func (p *Plan) stopNodes(ctx context.Context) error {
 	p.planNodesMutex.RLock()
 	defer p.planNodesMutex.RUnlock()
 
+	// Узлы уже завершены при drain.
+	if p.drained {
+		return nil
+	}
+
 	p.logger.Info("stopping nodes")
 
 	// останавливаем в обратном порядке.
@@ -132,6 +132,91 @@ func (w *PlanWatcher) GetPlanTelemetry(planName string) (*PlanTelemetry, error)
 	return plan.plan.GetTelemetry(), nil
 }
 
+// ReplayMessage передает узлу работающего плана сообщение из очереди недоставленных сообщений.
+func (w *PlanWatcher) ReplayMessage(ctx context.Context, planName, actionName string, metadata, data []byte) error {
+	w.plansInWorkMutex.Lock()
+	defer w.plansInWorkMutex.Unlock()
+
+	plan, ok := w.plansInWork[planName]
+	if !ok {
+		return ErrUnknownPlan
+	}
+	return plan.plan.Replay(ctx, actionName, metadata, data)
+}
+
+// GetPlanStats возвращает подробную статистику узла nodeName или всех узлов плана, если nodeName пустой.
+func (w *PlanWatcher) GetPlanStats(ctx context.Context, planName, nodeName string) ([]*NodeStats, error) {
+	plan, err := w.workingPlan(planName)
+	if err != nil {
+		return nil, err
+	}
+	return plan.plan.Stats(ctx, nodeName)
+}
+
+// PausePlan приостанавливает получение входных сообщений узлом nodeName или всеми узлами плана.
+func (w *PlanWatcher) PausePlan(ctx context.Context, planName, nodeName string) error {
+	plan, err := w.workingPlan(planName)
+	if err != nil {
+		return err
+	}
+	return plan.plan.Pause(ctx, nodeName)
+}
+
+// ResumePlan возобновляет получение входных сообщений узлом nodeName или всеми узлами плана.
+func (w *PlanWatcher) ResumePlan(ctx context.Context, planName, nodeName string) error {
+	plan, err := w.workingPlan(planName)
+	if err != nil {
+		return err
+	}
+	return plan.plan.Resume(ctx, nodeName)
+}
+
+// SetPlanLogLevel изменяет уровень логирования узла nodeName или всех узлов плана.
+func (w *PlanWatcher) SetPlanLogLevel(ctx context.Context, planName, nodeName, level string) error {
+	plan, err := w.workingPlan(planName)
+	if err != nil {
+		return err
+	}
+	return plan.plan.SetLogLevel(ctx, nodeName, level)
+}
+
+// DrainPlan завершает план после обработки и доставки уже полученных сообщений.
+// В отличие от StopPlan не удерживает блокировку планов на время drain, так как он может быть долгим.
+func (w *PlanWatcher) DrainPlan(planName string, timeout time.Duration) error {
+	plan, err := w.workingPlan(planName)
+	if err != nil {
+		return err
+	}
+
+	w.logger.Infof("plan '%s' draining", planName)
+	drainErr := plan.plan.Drain(w.ctx, timeout)
+
+	w.plansInWorkMutex.Lock()
+	defer w.plansInWorkMutex.Unlock()
+
+	plan.stopPlan()
+	<-plan.done
+
+	// План мог быть остановлен и запущен заново во время drain.
+	if w.plansInWork[planName] == plan {
+		delete(w.plansInWork, planName)
+	}
+
+	w.logger.Infof("plan '%s' drained", planName)
+	return drainErr
+}
+
+func (w *PlanWatcher) workingPlan(planName string) (*workingPlan, error) {
+	w.plansInWorkMutex.Lock()
+	defer w.plansInWorkMutex.Unlock()
+
+	plan, ok := w.plansInWork[planName]
+	if !ok {
+		return nil, ErrUnknownPlan
+	}
+	return plan, nil
+}
+
 // StopPlan останавливает работу плана.
 func (w *PlanWatcher) StopPlan(planName string) error {
 	w.plansInWorkMutex.Lock()
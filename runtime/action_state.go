@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+
+	upstreambackup "github.com/GDVFox/gostreaming/runtime/upstream_backup"
+)
+
+// stateFDEnv переменная окружения, через которую действию передается дескриптор канала состояния.
+const stateFDEnv = "GOSTREAMING_STATE_FD"
+
+// maxStateValueSize максимальный размер значения в состоянии.
+const maxStateValueSize = 1 << 20
+
+// Операции с состоянием.
+const (
+	stateOpGet    uint8 = 1
+	stateOpPut    uint8 = 2
+	stateOpDelete uint8 = 3
+)
+
+// Статусы ответов на операции с состоянием.
+const (
+	stateStatusOK       uint8 = 0
+	stateStatusNotFound uint8 = 1
+	stateStatusError    uint8 = 2
+)
+
+var (
+	errStateValueTooLong = errors.New("state value is too long")
+	errUnknownStateOp    = errors.New("unknown state operation")
+	errUnknownInput      = errors.New("unknown input message")
+)
+
+// stateRequest запрос действия к состоянию.
+// Запрос состоит из операции, номера обрабатываемого входного сообщения,
+// ключа с uint16 длиной и значения с uint32 длиной.
+type stateRequest struct {
+	op    uint8
+	seq   uint64
+	key   []byte
+	value []byte
+}
+
+// inputTracker связывает порядковые номера входных сообщений, переданных действию,
+// с самими сообщениями до тех пор, пока действие на них не ответит.
+type inputTracker struct {
+	lock     sync.Mutex
+	isSource bool
+	last     uint64
+	answered uint64
+	inputs   map[uint64]upstreambackup.StateInput
+}
+
+func newInputTracker(isSource bool) *inputTracker {
+	return &inputTracker{
+		isSource: isSource,
+		inputs:   make(map[uint64]upstreambackup.StateInput),
+	}
+}
+
+// Sent запоминает сообщение, переданное действию.
+func (t *inputTracker) Sent(msg *upstreambackup.UpstreamMessage) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.last++
+	t.inputs[t.last] = upstreambackup.StateInput{InputID: msg.InputID, MessageID: msg.Header.MessageID}
+}
+
+// Answered отмечает, что действие ответило на самое старое из переданных сообщений.
+func (t *inputTracker) Answered() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.answered++
+	delete(t.inputs, t.answered)
+}
+
+// Reset забывает переданные сообщения, перезапущенное действие нумерует их заново.
+func (t *inputTracker) Reset() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.last = 0
+	t.answered = 0
+	t.inputs = make(map[uint64]upstreambackup.StateInput)
+}
+
+// Get возвращает входное сообщение с номером seq.
+func (t *inputTracker) Get(seq uint64) (upstreambackup.StateInput, error) {
+	// Источник не имеет входных сообщений, поэтому его состояние подтверждается
+	// вместе с любыми выходными сообщениями, как и подтверждения DummyUpstreamMessage.
+	if t.isSource {
+		return upstreambackup.StateInput{}, nil
+	}
+	// До первого входного сообщения действие может только инициализировать состояние.
+	if seq == 0 {
+		return upstreambackup.StateInput{Immediate: true}, nil
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	input, ok := t.inputs[seq]
+	if !ok {
+		return upstreambackup.StateInput{}, fmt.Errorf("%d: %w", seq, errUnknownInput)
+	}
+	return input, nil
+}
+
+// newStatePipe создает канал состояния, один конец которого передается действию.
+func newStatePipe() (runtimeEnd, actionEnd *os.File, err error) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, fmt.Errorf("can not create socketpair: %w", err)
+	}
+	return os.NewFile(uintptr(fds[0]), "state-runtime"), os.NewFile(uintptr(fds[1]), "state-action"), nil
+}
+
+// handleState обслуживает запросы действия к состоянию.
+func (r *Runtime) handleState(ctx context.Context, p *actionProcess, conn *os.File) error {
+	defer p.logger.Info("handle state stopped")
+
+	// Разблокируем чтение при завершении работы.
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stopped:
+		}
+	}()
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+	for {
+		req, err := readStateRequest(reader)
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, os.ErrClosed) || ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("can not read state request: %w", err)
+		}
+
+		status, data := r.processStateRequest(p, req)
+		writer.WriteByte(status)
+		binary.Write(writer, binary.BigEndian, uint32(len(data)))
+		writer.Write(data)
+		if err := writer.Flush(); err != nil {
+			return fmt.Errorf("can not write state response: %w", err)
+		}
+	}
+}
+
+func (r *Runtime) processStateRequest(p *actionProcess, req *stateRequest) (uint8, []byte) {
+	if req.op == stateOpGet {
+		value, err := r.state.Get(req.key)
+		if errors.Is(err, upstreambackup.ErrStateKeyNotFound) {
+			return stateStatusNotFound, nil
+		}
+		if err != nil {
+			r.logger.Errorf("state get failed: %s", err)
+			return stateStatusError, []byte(err.Error())
+		}
+		return stateStatusOK, value
+	}
+
+	input, err := p.inputs.Get(req.seq)
+	if err != nil {
+		r.logger.Errorf("state change failed: %s", err)
+		return stateStatusError, []byte(err.Error())
+	}
+
+	switch req.op {
+	case stateOpPut:
+		err = r.state.Put(input, req.key, req.value)
+	case stateOpDelete:
+		err = r.state.Delete(input, req.key)
+	default:
+		err = fmt.Errorf("%d: %w", req.op, errUnknownStateOp)
+	}
+	if err != nil {
+		r.logger.Errorf("state change failed: %s", err)
+		return stateStatusError, []byte(err.Error())
+	}
+	return stateStatusOK, nil
+}
+
+func readStateRequest(reader io.Reader) (*stateRequest, error) {
+	req := &stateRequest{}
+	if err := binary.Read(reader, binary.BigEndian, &req.op); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(reader, binary.BigEndian, &req.seq); err != nil {
+		return nil, fmt.Errorf("can not read input seq: %w", err)
+	}
+
+	keyLength := uint16(0)
+	if err := binary.Read(reader, binary.BigEndian, &keyLength); err != nil {
+		return nil, fmt.Errorf("can not read key length: %w", err)
+	}
+	req.key = make([]byte, keyLength)
+	if _, err := io.ReadFull(reader, req.key); err != nil {
+		return nil, fmt.Errorf("can not read key: %w", err)
+	}
+
+	valueLength := uint32(0)
+	if err := binary.Read(reader, binary.BigEndian, &valueLength); err != nil {
+		return nil, fmt.Errorf("can not read value length: %w", err)
+	}
+	if valueLength > maxStateValueSize {
+		return nil, errStateValueTooLong
+	}
+	req.value = make([]byte, valueLength)
+	if _, err := io.ReadFull(reader, req.value); err != nil {
+		return nil, fmt.Errorf("can not read value: %w", err)
+	}
+	return req, nil
+}
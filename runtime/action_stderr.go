@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+const (
+	// recordSeparator начинает структурированную запись в STDERR действия.
+	// Запись занимает одну строку: разделитель, тип записи, пробел, JSON и '\n'.
+	recordSeparator byte = 0x1e
+	// maxRecordSize максимальный размер структурированной записи.
+	maxRecordSize = 1 << 20
+	// stderrChunkSize размер блока, которым читается STDERR.
+	stderrChunkSize = 4096
+)
+
+const (
+	logRecordKind    = "log"
+	metricRecordKind = "metric"
+)
+
+var (
+	errRecordTooLong = errors.New("record is too long")
+)
+
+// actionLogRecord запись лога действия.
+type actionLogRecord struct {
+	Level   string                 `json:"level"`
+	Message string                 `json:"msg"`
+	Fields  map[string]interface{} `json:"fields"`
+}
+
+// handleErr разбирает STDERR действия. Структурированные записи обрабатываются по типу,
+// остальные данные считаются ошибками, как это было для старых действий.
+func (r *Runtime) handleErr(ctx context.Context, cmdErr io.Reader) error {
+	defer r.logger.Info("handle STDERR stopped")
+
+	reader := bufio.NewReaderSize(cmdErr, stderrChunkSize)
+	for {
+		// Если буфер пуст, то Peek прочитает очередной блок данных.
+		first, err := reader.Peek(1)
+		if err != nil {
+			return fmt.Errorf("can not read stderr data: %w", err)
+		}
+
+		if first[0] == recordSeparator {
+			record, err := readRecord(reader)
+			if errors.Is(err, errRecordTooLong) {
+				r.logger.Warnf("STDERR: skipped record: %s", err)
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("can not read stderr record: %w", err)
+			}
+
+			r.handleRecord(record)
+			continue
+		}
+
+		// Неструктурированные данные логируем до начала следующей записи.
+		raw, _ := reader.Peek(reader.Buffered())
+		if i := bytes.IndexByte(raw, recordSeparator); i >= 0 {
+			raw = raw[:i]
+		}
+		if text := bytes.TrimRight(raw, "\n"); len(text) != 0 {
+			r.logger.Errorf("STDERR: %s", string(text))
+		}
+		reader.Discard(len(raw))
+	}
+}
+
+// readRecord читает запись вместе с разделителем до конца строки.
+func readRecord(reader *bufio.Reader) ([]byte, error) {
+	var record []byte
+	for {
+		line, err := reader.ReadSlice('\n')
+		if len(record)+len(line) > maxRecordSize {
+			if err := skipLine(reader, err); err != nil {
+				return nil, err
+			}
+			return nil, errRecordTooLong
+		}
+		record = append(record, line...)
+
+		if errors.Is(err, bufio.ErrBufferFull) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return record, nil
+	}
+}
+
+func skipLine(reader *bufio.Reader, lastErr error) error {
+	for errors.Is(lastErr, bufio.ErrBufferFull) {
+		_, lastErr = reader.ReadSlice('\n')
+	}
+	return lastErr
+}
+
+func (r *Runtime) handleRecord(record []byte) {
+	record = bytes.TrimSuffix(record[1:], []byte{'\n'})
+	kind, payload := record, []byte(nil)
+	if i := bytes.IndexByte(record, ' '); i >= 0 {
+		kind, payload = record[:i], record[i+1:]
+	}
+
+	switch string(kind) {
+	case logRecordKind:
+		r.handleLogRecord(payload)
+	case metricRecordKind:
+		r.handleMetricRecord(payload)
+	default:
+		r.logger.Warnf("STDERR: unknown record kind %q", kind)
+	}
+}
+
+func (r *Runtime) handleLogRecord(payload []byte) {
+	record := &actionLogRecord{}
+	if err := json.Unmarshal(payload, record); err != nil {
+		r.logger.Warnf("STDERR: can not decode log record: %s", err)
+		return
+	}
+
+	keys := make([]string, 0, len(record.Fields))
+	for key := range record.Fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	keysAndValues := make([]interface{}, 0, 2*len(keys))
+	for _, key := range keys {
+		keysAndValues = append(keysAndValues, key, record.Fields[key])
+	}
+
+	switch record.Level {
+	case "debug":
+		r.actionLogger.Debugw(record.Message, keysAndValues...)
+	case "info":
+		r.actionLogger.Infow(record.Message, keysAndValues...)
+	case "warn":
+		r.actionLogger.Warnw(record.Message, keysAndValues...)
+	default:
+		r.actionLogger.Errorw(record.Message, keysAndValues...)
+	}
+}
+
+func (r *Runtime) handleMetricRecord(payload []byte) {
+	sample := &metricSample{}
+	if err := json.Unmarshal(payload, sample); err != nil {
+		r.logger.Warnf("STDERR: can not decode metric record: %s", err)
+		return
+	}
+
+	if err := r.metrics.Observe(sample); err != nil {
+		r.logger.Warnf("STDERR: can not observe metric: %s", err)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap/zapcore"
+)
+
+func logRecord(payload string) string {
+	return string(recordSeparator) + logRecordKind + " " + payload + "\n"
+}
+
+func TestHandleErr(t *testing.T) {
+	tests := []struct {
+		name    string
+		stderr  string
+		entries []logEntry
+	}{
+		{
+			name:   "raw lines and records",
+			stderr: "panic: oops\n" + logRecord(`{"level":"info","msg":"started","fields":{"b":2,"a":1}}`) + "goroutine 1\n",
+			entries: []logEntry{
+				{Level: zapcore.ErrorLevel, Message: "STDERR: panic: oops"},
+				{Level: zapcore.InfoLevel, Logger: "action", Message: "started"},
+				{Level: zapcore.ErrorLevel, Message: "STDERR: goroutine 1"},
+			},
+		},
+		{
+			name:   "records one by one",
+			stderr: logRecord(`{"level":"debug","msg":"first"}`) + logRecord(`{"level":"warn","msg":"second"}`),
+			entries: []logEntry{
+				{Level: zapcore.DebugLevel, Logger: "action", Message: "first"},
+				{Level: zapcore.WarnLevel, Logger: "action", Message: "second"},
+			},
+		},
+		{
+			name:   "truncated record",
+			stderr: "before\n" + strings.TrimSuffix(logRecord(`{"level":"info","msg":"lost"}`), "\n"),
+			entries: []logEntry{
+				{Level: zapcore.ErrorLevel, Message: "STDERR: before"},
+			},
+		},
+		{
+			name:   "oversized record",
+			stderr: logRecord(`{"level":"info","msg":"`+strings.Repeat("x", maxRecordSize)+`"}`) + logRecord(`{"level":"info","msg":"next"}`),
+			entries: []logEntry{
+				{Level: zapcore.WarnLevel, Message: "STDERR: skipped record: record is too long"},
+				{Level: zapcore.InfoLevel, Logger: "action", Message: "next"},
+			},
+		},
+		{
+			name:   "unknown level",
+			stderr: logRecord(`{"level":"fatal","msg":"unknown"}`),
+			entries: []logEntry{
+				{Level: zapcore.ErrorLevel, Logger: "action", Message: "unknown"},
+			},
+		},
+		{
+			name:   "unknown kind",
+			stderr: string(recordSeparator) + "trace {}\n",
+			entries: []logEntry{
+				{Level: zapcore.WarnLevel, Message: `STDERR: unknown record kind "trace"`},
+			},
+		},
+		{
+			name:   "bad json",
+			stderr: logRecord(`{"level":`),
+			entries: []logEntry{
+				{Level: zapcore.WarnLevel, Message: "STDERR: can not decode log record: unexpected end of JSON input"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r, logs := newTestRuntime(t)
+
+			err := r.handleErr(context.Background(), strings.NewReader(test.stderr))
+			assert.ErrorIs(t, err, io.EOF)
+
+			entries := takeEntries(logs)
+			// Последняя запись сообщает об остановке разбора.
+			assert.Equal(t, "handle STDERR stopped", entries[len(entries)-1].Message)
+			assert.Equal(t, test.entries, entries[:len(entries)-1])
+		})
+	}
+}
+
+func TestHandleErrLogFields(t *testing.T) {
+	r, logs := newTestRuntime(t)
+
+	err := r.handleErr(context.Background(), strings.NewReader(logRecord(`{"level":"info","msg":"m","fields":{"b":"2","a":1}}`)))
+	assert.ErrorIs(t, err, io.EOF)
+
+	entries := logs.FilterMessage("m").All()
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, map[string]interface{}{"a": float64(1), "b": "2"}, entries[0].ContextMap())
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+
+	upstreambackup "github.com/GDVFox/gostreaming/runtime/upstream_backup"
+)
+
+// batchEnv переменная окружения, через которую действию передается
+// максимальное число входных сообщений в пакете.
+const batchEnv = "GOSTREAMING_BATCH"
+
+// maxBatchLength максимальная длина пакета, действие разбивает большие пакеты на несколько.
+const maxBatchLength = 16 << 20
+
+// controlHeader длина управляющего кадра. Флаг продолжения с нулевой длиной
+// не используется для данных, поэтому управляющие кадры можно передавать вместе с ними.
+// За ним следует uint32 длина содержимого и само содержимое, которое начинается с типа кадра.
+const controlHeader = moreMessagesFlag | metadataFlag
+
+// Типы управляющих кадров.
+const (
+	// controlBatch содержит uint32 число кадров и сами кадры.
+	controlBatch uint8 = 1
+	// controlBatchOptIn передается действием, если оно умеет читать пакеты.
+	controlBatchOptIn uint8 = 2
+)
+
+var (
+	errBadControlFrame = errors.New("bad control frame")
+	errControlTooLong  = errors.New("control frame is too long")
+	errUnknownControl  = errors.New("unknown control frame")
+)
+
+// batchingEnabled возвращает true, если процесс действия согласился получать пакеты.
+func (r *Runtime) batchingEnabled(p *actionProcess) bool {
+	return r.opt.BatchSize > 1 && atomic.LoadUint32(&p.batching) == 1
+}
+
+// nextInputs возвращает сообщения для следующей передачи действию: первое ожидается,
+// а остальные, если действие читает пакеты, забираются только если уже получены.
+func (r *Runtime) nextInputs(p *actionProcess, first *upstreambackup.UpstreamMessage) []*upstreambackup.UpstreamMessage {
+	msgs := []*upstreambackup.UpstreamMessage{first}
+	if !r.batchingEnabled(p) {
+		return msgs
+	}
+
+	for len(msgs) < r.opt.BatchSize {
+		select {
+		case msg, ok := <-r.dispatch:
+			if msg == nil && !ok {
+				return msgs
+			}
+			msgs = append(msgs, msg)
+		default:
+			return msgs
+		}
+	}
+	return msgs
+}
+
+// writeInputs передает сообщения действию, несколько сообщений передаются пакетами
+// длиной не больше maxBatchLength.
+func (r *Runtime) writeInputs(w io.Writer, msgs []*upstreambackup.UpstreamMessage) error {
+	for len(msgs) != 0 {
+		var batch, frame bytes.Buffer
+		count := 0
+		for _, msg := range msgs {
+			frame.Reset()
+			if err := r.writeInput(&frame, msg); err != nil {
+				return err
+			}
+			if count != 0 && 4+batch.Len()+frame.Len() > maxBatchLength {
+				break
+			}
+			batch.Write(frame.Bytes())
+			count++
+		}
+
+		if count == 1 {
+			if _, err := w.Write(batch.Bytes()); err != nil {
+				return fmt.Errorf("can not write message: %w", err)
+			}
+		} else {
+			payload := make([]byte, 4, 4+batch.Len())
+			binary.BigEndian.PutUint32(payload, uint32(count))
+			payload = append(payload, batch.Bytes()...)
+			if err := writeControl(w, controlBatch, payload); err != nil {
+				return err
+			}
+		}
+		msgs = msgs[count:]
+	}
+	return nil
+}
+
+// writeInput передает одно сообщение в формате кадра данных.
+func (r *Runtime) writeInput(w io.Writer, msg *upstreambackup.UpstreamMessage) error {
+	// Метаданные передаются только действиям, которые их ожидают,
+	// иначе старые действия не смогут разобрать сообщение.
+	messageLength := msg.Header.MessageLength
+	metadata := msg.Metadata
+	// Повторно переданное из очереди недоставленных сообщение не получено от вышестоящего узла,
+	// поэтому заголовков доставки у него нет.
+	if r.opt.Metadata && r.opt.ExactlyOnce && !msg.Detached {
+		var err error
+		if metadata, err = upstreambackup.WithDeliveryHeaders(metadata, msg.Upstream, msg.Header.MessageID); err != nil {
+			return fmt.Errorf("can not add delivery headers: %w", err)
+		}
+	}
+	withMetadata := r.opt.Metadata && len(metadata) != 0
+	if withMetadata {
+		messageLength |= metadataFlag
+	}
+	if err := binary.Write(w, binary.BigEndian, messageLength); err != nil {
+		return fmt.Errorf("can not write message length: %w", err)
+	}
+	if withMetadata {
+		if err := binary.Write(w, binary.BigEndian, uint32(len(metadata))); err != nil {
+			return fmt.Errorf("can not write message metadata length: %w", err)
+		}
+		if err := binary.Write(w, binary.BigEndian, metadata); err != nil {
+			return fmt.Errorf("can not write message metadata: %w", err)
+		}
+	}
+
+	if err := binary.Write(w, binary.BigEndian, msg.Data); err != nil {
+		return fmt.Errorf("can not write message data: %w", err)
+	}
+	return nil
+}
+
+func writeControl(w io.Writer, controlType uint8, payload []byte) error {
+	header := []uint32{controlHeader, uint32(1 + len(payload))}
+	if err := binary.Write(w, binary.BigEndian, header); err != nil {
+		return fmt.Errorf("can not write control header: %w", err)
+	}
+	frame := make([]byte, 0, 1+len(payload))
+	frame = append(frame, controlType)
+	frame = append(frame, payload...)
+	if _, err := w.Write(frame); err != nil {
+		return fmt.Errorf("can not write control frame: %w", err)
+	}
+	return nil
+}
+
+// outputReader читает кадры вывода действия, раскрывая пакеты.
+// Остальные управляющие кадры передаются в onControl.
+type outputReader struct {
+	r         io.Reader
+	batch     *bytes.Reader
+	frames    uint32
+	onControl func(controlType uint8, payload []byte) error
+}
+
+func newOutputReader(r io.Reader, onControl func(controlType uint8, payload []byte) error) *outputReader {
+	return &outputReader{r: r, onControl: onControl}
+}
+
+// Next читает длину следующего кадра данных и возвращает источник, из которого читается его тело.
+// Для отклоненного действием сообщения возвращается длина controlHeader и причина отклонения.
+func (o *outputReader) Next() (uint32, io.Reader, error) {
+	for {
+		if o.frames != 0 {
+			o.frames--
+			length := uint32(0)
+			if err := binary.Read(o.batch, binary.BigEndian, &length); err != nil {
+				return 0, nil, fmt.Errorf("can not read batch message length: %w", err)
+			}
+			return length, o.batch, nil
+		}
+		if o.batch != nil && o.batch.Len() != 0 {
+			return 0, nil, fmt.Errorf("batch has %d extra bytes: %w", o.batch.Len(), errBadControlFrame)
+		}
+
+		length := uint32(0)
+		if err := binary.Read(o.r, binary.BigEndian, &length); err != nil {
+			return 0, nil, fmt.Errorf("can not read message length: %w", err)
+		}
+		if length != controlHeader {
+			return length, o.r, nil
+		}
+
+		controlType, payload, err := readControl(o.r)
+		if err != nil {
+			return 0, nil, err
+		}
+		// Отклонение заменяет выход для входного сообщения, поэтому возвращается вместо кадра данных
+		// с длиной controlHeader, которая не используется для данных.
+		if controlType == controlReject {
+			return controlHeader, bytes.NewReader(payload), nil
+		}
+		if controlType != controlBatch {
+			if err := o.onControl(controlType, payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		}
+		if len(payload) < 4 {
+			return 0, nil, errBadControlFrame
+		}
+		o.frames = binary.BigEndian.Uint32(payload)
+		o.batch = bytes.NewReader(payload[4:])
+	}
+}
+
+func readControl(r io.Reader) (uint8, []byte, error) {
+	length := uint32(0)
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return 0, nil, fmt.Errorf("can not read control length: %w", err)
+	}
+	if length == 0 {
+		return 0, nil, errBadControlFrame
+	}
+	if length > maxBatchLength+5 {
+		return 0, nil, errControlTooLong
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, fmt.Errorf("can not read control frame: %w", err)
+	}
+	return payload[0], payload[1:], nil
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -2,6 +2,7 @@ package config
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"strings"
 	"time"
@@ -17,6 +18,53 @@ type ActionOptions struct {
 	Args          []string          `json:"args"`
 	Env           map[string]string `json:"env"`
 	ConnWhitelist []string          `json:"conn_whitelist"`
+	Codec         string            `json:"codec"`
+	Metadata      bool              `json:"metadata"`
+	State         bool              `json:"state"`
+
+	// Ограничения неподтвержденного вывода источника, 0 означает отсутствие ограничения.
+	MaxPendingMessages int `json:"max_pending_messages"`
+	MaxPendingBytes    int `json:"max_pending_bytes"`
+	// Максимальное число входных сообщений в одном пакете, 0 отключает пакеты.
+	BatchSize int `json:"batch_size"`
+
+	// Алгоритм сжатия сообщений для нижестоящих узлов, его уровень и минимальная длина сжимаемого пакета.
+	Compression        string `json:"compression"`
+	CompressionLevel   int    `json:"compression_level"`
+	CompressionMinSize int    `json:"compression_min_size"`
+
+	// Ограничения forward log, 0 означает отсутствие ограничения, и политика его переполнения.
+	ForwardLogMaxItems int    `json:"forward_log_max_items"`
+	ForwardLogMaxBytes int    `json:"forward_log_max_bytes"`
+	ForwardLogOverflow string `json:"forward_log_overflow"`
+	// Хранилище forward log и режим сброса на диск для файлового хранилища.
+	ForwardLogStorage string `json:"forward_log_storage"`
+	ForwardLogSync    string `json:"forward_log_sync"`
+	// Режим exactly-once: повторно полученные сообщения отбрасываются,
+	// а действию с метаданными передаются заголовки доставки.
+	ExactlyOnce bool `json:"exactly_once"`
+	// Режимы передачи сообщений нижестоящим узлам в порядке out, по умолчанию broadcast.
+	Routing []string `json:"routing"`
+	// Число отказов действия на одном входном сообщении, после которого сообщение
+	// передается в очередь недоставленных сообщений, 0 отключает подсчет отказов.
+	MaxCrashes int `json:"max_crashes"`
+	// Число перезапусков отказавшего действия подряд, после которого runtime завершается,
+	// 0 означает 5, отрицательное значение отключает перезапуск.
+	MaxRestarts int `json:"max_restarts"`
+	// Начальная и максимальная задержка перезапуска, 0 означает 1 секунду и 1 минуту.
+	RestartBackoff    util.Duration `json:"restart_backoff"`
+	RestartMaxBackoff util.Duration `json:"restart_max_backoff"`
+
+	// Время ожидания подтверждения готовности, 0 означает, что подтверждение не требуется.
+	ReadyTimeout util.Duration `json:"ready_timeout"`
+	// Период проверок работоспособности, 0 отключает проверки.
+	ProbeInterval util.Duration `json:"probe_interval"`
+	// Время ожидания ответа на проверку, 0 означает три периода.
+	ProbeTimeout util.Duration `json:"probe_timeout"`
+	// Период тиков для действий, которые читают события, 0 отключает тики.
+	TickInterval util.Duration `json:"tick_interval"`
+	// Время ожидания ответа на уведомление об остановке, 0 означает 5 секунд.
+	ShutdownTimeout util.Duration `json:"shutdown_timeout"`
 }
 
 // EnvAsSlice возвращает Env в формате слайса строк вида "name=value".
@@ -43,12 +91,30 @@ type Config struct {
 
 	ACKPeriodRaw  string
 	ForwardLogDir string
+	StateDir      string
+	DeliveryDir   string
+	DeadLetterDir string
+	MaxInFlight   int
+
+	// Адреса etcd для копии состояния действия и префикс ее ключей.
+	// Пустой StateETCDRaw отключает копию.
+	StateETCDRaw        string
+	StateETCDTimeoutRaw string
+	StateKey            string
+
+	// Сертификат и ключ runtime, сертификат центра сертификации для взаимной TLS аутентификации.
+	// Пустой TLSCertFile отключает TLS.
+	TLSCertFile string
+	TLSKeyFile  string
+	TLSCAFile   string
 
 	In            []string
 	Out           []string
 	ActionOptions *ActionOptions
 
-	ACKPeriod time.Duration
+	ACKPeriod        time.Duration
+	StateETCD        []string
+	StateETCDTimeout time.Duration
 }
 
 // Parse загружает данные конфига.
@@ -70,5 +136,16 @@ func (c *Config) Parse() error {
 	}
 	c.ACKPeriod = dur
 
+	if c.StateETCDRaw != "" {
+		c.StateETCD = strings.Split(c.StateETCDRaw, ",")
+		if c.StateKey == "" {
+			return errors.New("state key must be set for state replica")
+		}
+		c.StateETCDTimeout, err = time.ParseDuration(c.StateETCDTimeoutRaw)
+		if err != nil {
+			return fmt.Errorf("can not parse state etcd timeout: %w", err)
+		}
+	}
+
 	return nil
 }
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/GDVFox/gostreaming/util/message"
+)
+
+// drainCheckInterval период проверки завершения этапов drain.
+const drainCheckInterval = 100 * time.Millisecond
+
+// Возможные ошибки команд управления.
+var (
+	errPauseSource    = errors.New("source without max_pending limits can not be paused")
+	errResumeDraining = errors.New("runtime is draining")
+)
+
+// pauseGate приостанавливает получение входных сообщений runtime.
+// После drain получение не возобновляется.
+type pauseGate struct {
+	lock sync.Mutex
+	// resumed закрывается при возобновлении, nil если получение не приостановлено.
+	resumed  chan struct{}
+	draining bool
+}
+
+// Pause приостанавливает получение, повторный вызов ничего не делает.
+func (g *pauseGate) Pause() {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if g.resumed == nil {
+		g.resumed = make(chan struct{})
+	}
+}
+
+// Resume возобновляет получение, если runtime не выполняет drain.
+func (g *pauseGate) Resume() error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if g.draining {
+		return errResumeDraining
+	}
+	if g.resumed != nil {
+		close(g.resumed)
+		g.resumed = nil
+	}
+	return nil
+}
+
+// Drain приостанавливает получение навсегда. Возвращает false, если drain уже начат.
+func (g *pauseGate) Drain() bool {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if g.draining {
+		return false
+	}
+	g.draining = true
+	if g.resumed == nil {
+		g.resumed = make(chan struct{})
+	}
+	return true
+}
+
+// Resumed возвращает канал, который будет закрыт при возобновлении получения,
+// или nil, если получение не приостановлено.
+func (g *pauseGate) Resumed() <-chan struct{} {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	return g.resumed
+}
+
+// State возвращает true, если получение приостановлено и если runtime выполняет drain.
+func (g *pauseGate) State() (bool, bool) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	return g.resumed != nil, g.draining
+}
+
+// Pause приостанавливает получение входных сообщений. Вышестоящие узлы не получают подтверждений
+// и останавливаются при заполнении своих окон. Источник можно приостановить, только если
+// его вывод ограничен кредитами: новые кредиты не передаются до возобновления.
+func (r *Runtime) Pause() error {
+	if r.isSource && !r.creditsEnabled() {
+		return errPauseSource
+	}
+	r.pause.Pause()
+	r.logger.Info("input consumption paused")
+	return nil
+}
+
+// Resume возобновляет получение входных сообщений.
+func (r *Runtime) Resume() error {
+	if err := r.pause.Resume(); err != nil {
+		return err
+	}
+	r.logger.Info("input consumption resumed")
+	return nil
+}
+
+// Drain прекращает получение входных сообщений и завершает runtime после того, как действие
+// ответит на все полученные сообщения, а нижестоящие узлы подтвердят все выходные сообщения.
+func (r *Runtime) Drain() {
+	if !r.pause.Drain() {
+		return
+	}
+	r.logger.Info("drain started")
+	close(r.drain)
+}
+
+// SetLogLevel изменяет уровень логирования runtime и действия.
+func (r *Runtime) SetLogLevel(level string) error {
+	if err := r.logger.SetLevel(level); err != nil {
+		return err
+	}
+	r.logger.Infof("log level changed to %s", level)
+	return nil
+}
+
+// GetStats возвращает подробную статистику runtime и его процессов.
+func (r *Runtime) GetStats() (*message.RuntimeStats, error) {
+	oldestOutput, err := r.GetOldestOutput()
+	if err != nil {
+		return nil, err
+	}
+
+	logStats := r.GetForwardLogStats()
+	actionStatus, protocolVersion := r.GetActionStatus()
+	crashes, lastExit := r.GetCrashes()
+	paused, draining := r.pause.State()
+	stats := &message.RuntimeStats{
+		Status:          runtimeStatus(actionStatus),
+		ProtocolVersion: protocolVersion,
+		Paused:          paused,
+		Draining:        draining,
+		LogLevel:        r.logger.Level(),
+		Received:        atomic.LoadUint64(&r.received),
+		InFlight:        atomic.LoadInt64(&r.inFlight),
+		OldestOutput:    oldestOutput,
+		ForwardLog: message.ForwardLogTelemetry{
+			Items:        logStats.Items,
+			Bytes:        logStats.Bytes,
+			Blocked:      logStats.Blocked,
+			Dropped:      logStats.Dropped,
+			DroppedBytes: logStats.DroppedBytes,
+		},
+		Crashes:   crashes,
+		LastExit:  lastExit,
+		Processes: make([]*message.ProcessStats, 0, len(r.processes)),
+		Metrics:   r.GetMetrics(),
+	}
+	for _, p := range r.processes {
+		processStatus, processVersion := p.liveness.Status(r.opt.ReadyTimeout > 0)
+		stats.Processes = append(stats.Processes, &message.ProcessStats{
+			Index:           p.index,
+			Status:          runtimeStatus(processStatus),
+			ProtocolVersion: processVersion,
+			Batching:        atomic.LoadUint32(&p.batching) == 1,
+			Queued:          len(p.messagesQueue),
+		})
+	}
+	return stats, nil
+}
+
+// runtimeStatus переводит состояние действия в состояние, которое видят machine_node и meta_node.
+func runtimeStatus(actionStatus uint8) message.RuntimeStatus {
+	switch actionStatus {
+	case actionStatusStarting:
+		return message.RuntimeStatusStarting
+	case actionStatusUnresponsive:
+		return message.RuntimeStatusUnresponsive
+	default:
+		return message.RuntimeStatusOK
+	}
+}
+
+// waitDrained ожидает выполнения done, проверяя его с периодом drainCheckInterval.
+// Возвращает false, если ожидание прервано отменой ctx или runCtx.
+func (r *Runtime) waitDrained(ctx, runCtx context.Context, done func() bool) bool {
+	ticker := time.NewTicker(drainCheckInterval)
+	defer ticker.Stop()
+
+	for !done() {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-runCtx.Done():
+			return false
+		case <-ticker.C:
+		}
+	}
+	return true
+}
+
+// inputsAnswered возвращает true, если действие ответило на все полученные сообщения.
+func (r *Runtime) inputsAnswered() bool {
+	return atomic.LoadInt64(&r.inFlight) == 0
+}
+
+// outputsDelivered возвращает true, если нижестоящие узлы подтвердили все выходные сообщения.
+func (r *Runtime) outputsDelivered() bool {
+	return r.forwarder.ForwardLogStats().Items == 0
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap/zaptest/observer"
+
+	"github.com/GDVFox/gostreaming/runtime/config"
+	upstreambackup "github.com/GDVFox/gostreaming/runtime/upstream_backup"
+	"github.com/GDVFox/gostreaming/util"
+)
+
+// isClosed возвращает true, если канал ch закрыт.
+func isClosed(ch <-chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+// logMessages возвращает сообщения runtime в порядке записи, записи вложенных логгеров,
+// например, forwarder, пропускаются.
+func logMessages(logs *observer.ObservedLogs) []string {
+	messages := make([]string, 0, logs.Len())
+	for _, e := range logs.All() {
+		if e.LoggerName == "" {
+			messages = append(messages, e.Message)
+		}
+	}
+	return messages
+}
+
+func TestPauseGate(t *testing.T) {
+	g := &pauseGate{}
+	assert.Nil(t, g.Resumed())
+	paused, draining := g.State()
+	assert.False(t, paused)
+	assert.False(t, draining)
+
+	g.Pause()
+	resumed := g.Resumed()
+	assert.NotNil(t, resumed)
+	assert.False(t, isClosed(resumed))
+	// Повторная приостановка не заменяет канал, поэтому ожидающие его не пропустят возобновление.
+	g.Pause()
+	assert.Equal(t, resumed, g.Resumed())
+	paused, _ = g.State()
+	assert.True(t, paused)
+
+	assert.NoError(t, g.Resume())
+	assert.True(t, isClosed(resumed))
+	assert.Nil(t, g.Resumed())
+	assert.NoError(t, g.Resume())
+
+	assert.True(t, g.Drain())
+	assert.False(t, g.Drain())
+	paused, draining = g.State()
+	assert.True(t, paused)
+	assert.True(t, draining)
+	assert.ErrorIs(t, g.Resume(), errResumeDraining)
+	assert.False(t, isClosed(g.Resumed()))
+}
+
+func TestPauseGateDrainWhilePaused(t *testing.T) {
+	g := &pauseGate{}
+	g.Pause()
+	resumed := g.Resumed()
+
+	// Drain сохраняет канал приостановки, и он больше не закрывается.
+	assert.True(t, g.Drain())
+	assert.Equal(t, resumed, g.Resumed())
+	assert.ErrorIs(t, g.Resume(), errResumeDraining)
+	assert.False(t, isClosed(resumed))
+	paused, draining := g.State()
+	assert.True(t, paused)
+	assert.True(t, draining)
+}
+
+func TestRuntimePause(t *testing.T) {
+	r, _ := newTestRuntime(t)
+	r.opt = &config.ActionOptions{}
+	startTestForwarder(t, r)
+
+	assert.NoError(t, r.Pause())
+	assert.NotNil(t, r.pause.Resumed())
+	assert.NoError(t, r.Resume())
+	assert.Nil(t, r.pause.Resumed())
+
+	// Источник без ограничения вывода нельзя остановить, не останавливая действие.
+	r.isSource = true
+	assert.ErrorIs(t, r.Pause(), errPauseSource)
+	assert.Nil(t, r.pause.Resumed())
+}
+
+func TestRuntimeDrain(t *testing.T) {
+	r, logs := newTestRuntime(t)
+	r.replays = make(chan *upstreambackup.UpstreamMessage, maxReplays)
+	r.dispatchDone = make(chan struct{})
+
+	assert.NoError(t, r.Pause())
+	r.Drain()
+	r.Drain()
+	assert.True(t, isClosed(r.drain))
+	assert.ErrorIs(t, r.Resume(), errResumeDraining)
+	assert.ErrorIs(t, r.Replay(nil, []byte("data")), errReplayStopped)
+	assert.Equal(t, []string{"input consumption paused", "drain started"}, logMessages(logs))
+}
+
+func TestWaitDrained(t *testing.T) {
+	r, _ := newTestRuntime(t)
+
+	assert.True(t, r.waitDrained(context.Background(), context.Background(), func() bool { return true }))
+
+	checks := int32(0)
+	start := time.Now()
+	assert.True(t, r.waitDrained(context.Background(), context.Background(), func() bool {
+		return atomic.AddInt32(&checks, 1) == 3
+	}))
+	assert.GreaterOrEqual(t, time.Since(start), 2*drainCheckInterval)
+
+	// Ожидание прерывается отменой любого из контекстов.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.False(t, r.waitDrained(ctx, context.Background(), func() bool { return false }))
+	assert.False(t, r.waitDrained(context.Background(), ctx, func() bool { return false }))
+}
+
+// newTestEventsRuntime создает Runtime с одним процессом, который читает события.
+func newTestEventsRuntime(t *testing.T) (*Runtime, *actionProcess, *observer.ObservedLogs) {
+	t.Helper()
+
+	r, logs := newTestRuntime(t)
+	r.opt = &config.ActionOptions{ShutdownTimeout: util.Duration(time.Minute)}
+	p := newActionProcess(0, false, r.opt, r.logger)
+	p.liveness.Ready(protocolVersion, capabilityEvents)
+	r.processes = []*actionProcess{p}
+	return r, p, logs
+}
+
+// startTestShutdown запускает handleShutdown и возвращает канал, закрываемый
+// при остановке процессов, и канал с результатом handleShutdown.
+func startTestShutdown(r *Runtime, ctx, runCtx context.Context) (<-chan struct{}, <-chan error) {
+	stopped := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- r.handleShutdown(ctx, runCtx, func() { close(stopped) })
+	}()
+	return stopped, done
+}
+
+// waitClosed ожидает закрытия канала ch не дольше секунды.
+func waitClosed(t *testing.T, ch <-chan struct{}, what string) {
+	t.Helper()
+
+	select {
+	case <-ch:
+	case <-time.After(time.Second):
+		t.Fatal(what)
+	}
+}
+
+// testEvent событие, которое фиктивный процесс прочитал из STDIN.
+type testEvent struct {
+	controlType uint8
+	at          time.Time
+}
+
+// readTestEvents читает управляющие кадры событий из STDIN фиктивного процесса p до закрытия in
+// и отвечает на каждое событие, освобождая очередь входных сообщений процесса.
+func readTestEvents(t *testing.T, p *actionProcess, in io.Reader) <-chan testEvent {
+	events := make(chan testEvent, 100)
+	go func() {
+		defer close(events)
+		for {
+			header := make([]uint32, 2)
+			if err := binary.Read(in, binary.BigEndian, header); err != nil {
+				return
+			}
+			frame := make([]byte, header[1])
+			if _, err := io.ReadFull(in, frame); err != nil {
+				return
+			}
+			if header[0] != controlHeader || len(frame) != 9 {
+				t.Errorf("unexpected frame %x: %x", header, frame)
+				return
+			}
+			<-p.messagesQueue
+			events <- testEvent{
+				controlType: frame[0],
+				at:          time.Unix(0, int64(binary.BigEndian.Uint64(frame[1:]))),
+			}
+		}
+	}()
+	return events
+}
+
+func TestHandleInEvents(t *testing.T) {
+	r, p, _ := newTestEventsRuntime(t)
+	startTestForwarder(t, r)
+	interval := 20 * time.Millisecond
+	r.opt.TickInterval = util.Duration(interval)
+
+	in, cmdIn := io.Pipe()
+	events := readTestEvents(t, p, in)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ticksDone, inDone := make(chan error, 1), make(chan error, 1)
+	go func() { ticksDone <- r.handleTicks(ctx, p) }()
+	go func() { inDone <- r.handleIn(ctx, p, cmdIn) }()
+
+	// Тики передаются с заданным интервалом.
+	ticks := make([]time.Time, 0)
+	for len(ticks) != 4 {
+		select {
+		case e := <-events:
+			assert.Equal(t, controlTick, e.controlType)
+			ticks = append(ticks, e.at)
+		case <-time.After(time.Second):
+			t.Fatalf("only %d ticks are sent", len(ticks))
+		}
+	}
+	for i := 1; i < len(ticks); i++ {
+		assert.GreaterOrEqual(t, ticks[i].Sub(ticks[i-1]), interval/2)
+	}
+
+	// Уведомление об остановке передается один раз, после него события не передаются,
+	// даже если тики продолжаются.
+	close(r.shutdown)
+	shutdowns := 0
+	timeout := time.After(5 * interval)
+	for waiting := true; waiting; {
+		select {
+		case e := <-events:
+			if e.controlType == controlShutdown {
+				shutdowns++
+				continue
+			}
+			assert.Zero(t, shutdowns, "tick after shutdown notice")
+		case <-timeout:
+			waiting = false
+		}
+	}
+	assert.Equal(t, 1, shutdowns)
+
+	cancel()
+	assert.NoError(t, <-inDone)
+	assert.NoError(t, <-ticksDone)
+	for e := range events {
+		t.Errorf("unexpected event %d after stop", e.controlType)
+	}
+}
+
+func TestHandleShutdownDrain(t *testing.T) {
+	r, p, logs := newTestEventsRuntime(t)
+	startTestForwarder(t, r)
+	atomic.StoreInt64(&r.inFlight, 2)
+	stopped, done := startTestShutdown(r, context.Background(), context.Background())
+
+	// Пока действие не ответило на все сообщения, уведомление об остановке не передается.
+	// Drain выполняется и для приостановленного runtime.
+	assert.NoError(t, r.Pause())
+	r.Drain()
+	time.Sleep(2 * drainCheckInterval)
+	assert.False(t, isClosed(r.shutdown))
+	atomic.AddInt64(&r.inFlight, -1)
+	time.Sleep(2 * drainCheckInterval)
+	assert.False(t, isClosed(r.shutdown))
+
+	// Процессы останавливаются только после ответа на уведомление.
+	atomic.AddInt64(&r.inFlight, -1)
+	waitClosed(t, r.shutdown, "shutdown notice is not sent")
+	time.Sleep(drainCheckInterval)
+	assert.False(t, isClosed(stopped))
+	close(p.shutdownDone)
+	waitClosed(t, stopped, "processes are not stopped")
+
+	// Выходных сообщений нет, поэтому drain завершается сразу после остановки процессов.
+	assert.NoError(t, <-done)
+	assert.Equal(t, []string{
+		"input consumption paused",
+		"drain started",
+		"drain: waiting for answers to received messages",
+		"sending shutdown notice to action",
+		"action answered shutdown notice",
+		"drain: waiting for delivery of output messages",
+		"drain done",
+	}, logMessages(logs))
+}
+
+func TestHandleShutdownDrainDelivery(t *testing.T) {
+	r, p, logs := newTestEventsRuntime(t)
+	newTestSourceForwarder(t, r, upstreambackup.ForwardLogLimits{})
+	assert.NoError(t, r.forwarder.Forward(0, 0, nil, []byte("undelivered"), true))
+	close(p.shutdownDone)
+
+	runCtx, cancelRun := context.WithCancel(context.Background())
+	defer cancelRun()
+	stopped, done := startTestShutdown(r, context.Background(), runCtx)
+	r.Drain()
+	waitClosed(t, stopped, "processes are not stopped")
+
+	// Процессы уже остановлены, а runtime ожидает доставки выходных сообщений.
+	select {
+	case err := <-done:
+		t.Fatalf("drain finished with undelivered messages: %v", err)
+	case <-time.After(2 * drainCheckInterval):
+	}
+	cancelRun()
+	assert.NoError(t, <-done)
+	assert.NotContains(t, logMessages(logs), "drain done")
+}
+
+func TestHandleShutdownStop(t *testing.T) {
+	r, p, logs := newTestEventsRuntime(t)
+	atomic.StoreInt64(&r.inFlight, 1)
+
+	// При остановке без drain уведомление передается сразу, даже если есть сообщения без ответа,
+	// а процессы останавливаются вместе с runtime.
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped, done := startTestShutdown(r, ctx, context.Background())
+	cancel()
+	waitClosed(t, r.shutdown, "shutdown notice is not sent")
+	close(p.shutdownDone)
+	assert.NoError(t, <-done)
+	assert.False(t, isClosed(stopped))
+	assert.Equal(t, []string{"sending shutdown notice to action", "action answered shutdown notice"}, logMessages(logs))
+}
+
+func TestRuntimeSetLogLevel(t *testing.T) {
+	r, logs := newTestRuntime(t)
+
+	// Логгер создан без NewLogger, поэтому уровень не изменяется, а команда завершается ошибкой.
+	assert.ErrorIs(t, r.SetLogLevel("debug"), util.ErrLevelNotChangeable)
+	assert.Empty(t, logMessages(logs))
+
+	l, err := util.NewLogger(&util.LoggingConfig{Logfile: "stdout", Level: "error"})
+	assert.NoError(t, err)
+	r.logger = l
+	assert.NoError(t, r.SetLogLevel("warn"))
+	assert.Equal(t, "warn", r.logger.Level())
+	assert.Error(t, r.SetLogLevel("verbose"))
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+// creditsEnv переменная окружения, которая сообщает источнику, что его вывод ограничен
+// и runtime будет передавать ему кредиты через STDIN.
+const creditsEnv = "GOSTREAMING_CREDITS"
+
+// unlimitedCredits окно для измерения, которое не ограничено в описании узла.
+// Освобожденные кредиты возвращаются и для него, поэтому окно не исчерпывается.
+const unlimitedCredits = math.MaxInt32
+
+// creditGrant разрешение источнику записать ещё Messages сообщений суммарной длиной Bytes.
+type creditGrant struct {
+	Messages uint32
+	Bytes    uint32
+}
+
+// creditsEnabled возвращает true, если неподтвержденный вывод действия ограничен.
+// Ограничение имеет смысл только для источников, у которых есть получатели,
+// иначе сообщения не записываются в forward log и кредиты не вернутся.
+func (r *Runtime) creditsEnabled() bool {
+	return r.isSource && r.forwarder.HasDownstreams() &&
+		(r.opt.MaxPendingMessages > 0 || r.opt.MaxPendingBytes > 0)
+}
+
+// handleCredits передает процессу источника кредиты: сначала его долю окна,
+// а затем долю кредитов сообщений, удаленных из forward log после подтверждения.
+// Окно и кредиты делятся между процессами поровну, поэтому суммарно они не превышают ограничений.
+// Сообщения, которые ещё хранятся в forward log, например, записанные процессом до перезапуска,
+// занимают окно, поэтому оно уменьшается на их количество и длину.
+func (r *Runtime) handleCredits(ctx context.Context, p *actionProcess, cmdIn io.Writer) error {
+	defer p.logger.Info("handle credits stopped")
+
+	// Удаленные сообщения считываются раньше записанных, поэтому сообщения, удаленные между вызовами,
+	// занимают окно, но их кредиты передаются ниже, и окно не превышает ограничений.
+	trimNotify := r.forwarder.TrimNotify()
+	lastMessages, lastBytes := r.forwarder.Trimmed()
+	writtenMessages, writtenBytes := r.forwarder.Written()
+
+	messages := creditsWindow(r.opt.MaxPendingMessages, writtenMessages-lastMessages)
+	bytes := creditsWindow(r.opt.MaxPendingBytes, writtenBytes-lastBytes)
+	messages, bytes = r.creditsShare(p, messages), r.creditsShare(p, bytes)
+	if err := writeCredits(cmdIn, messages, bytes); err != nil {
+		return err
+	}
+	p.logger.Infof("granted initial credits: %d messages, %d bytes", messages, bytes)
+
+	lastMessages, lastBytes = r.creditsShare(p, lastMessages), r.creditsShare(p, lastBytes)
+	for {
+		// Пока получение приостановлено, освобожденные кредиты накапливаются и передаются при возобновлении.
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-r.pause.Resumed():
+		case <-trimNotify:
+			trimNotify = r.forwarder.TrimNotify()
+		}
+		if r.pause.Resumed() == nil {
+			trimmedMessages, trimmedBytes := r.forwarder.Trimmed()
+			trimmedMessages, trimmedBytes = r.creditsShare(p, trimmedMessages), r.creditsShare(p, trimmedBytes)
+			if err := writeCredits(cmdIn, trimmedMessages-lastMessages, trimmedBytes-lastBytes); err != nil {
+				return err
+			}
+			p.logger.Debugf("granted credits: %d messages, %d bytes", trimmedMessages-lastMessages, trimmedBytes-lastBytes)
+			lastMessages, lastBytes = trimmedMessages, trimmedBytes
+		}
+	}
+}
+
+// creditsWindow возвращает окно для измерения с ограничением limit, из которого
+// pending сообщений ещё не удалены из forward log. 0 означает, что измерение не ограничено.
+func creditsWindow(limit int, pending uint64) uint64 {
+	if limit <= 0 {
+		return unlimitedCredits
+	}
+	return uint64(limit) - minUint64(pending, uint64(limit))
+}
+
+// creditsShare возвращает долю процесса p от total. Доли всех процессов в сумме равны total
+// и не уменьшаются с ростом total, поэтому разность долей можно передавать как кредиты.
+func (r *Runtime) creditsShare(p *actionProcess, total uint64) uint64 {
+	replicas := uint64(len(r.processes))
+	return total/replicas + minUint64(total%replicas, uint64(p.index+1)) - minUint64(total%replicas, uint64(p.index))
+}
+
+// writeCredits передает кредиты, разбивая их на части, которые помещаются в uint32.
+func writeCredits(w io.Writer, messages, bytes uint64) error {
+	for messages != 0 || bytes != 0 {
+		grant := creditGrant{
+			Messages: uint32(minUint64(messages, math.MaxUint32)),
+			Bytes:    uint32(minUint64(bytes, math.MaxUint32)),
+		}
+		if err := binary.Write(w, binary.BigEndian, &grant); err != nil {
+			return fmt.Errorf("can not write credits: %w", err)
+		}
+		messages -= uint64(grant.Messages)
+		bytes -= uint64(grant.Bytes)
+	}
+	return nil
+}
+
+func minUint64(a, b uint64) uint64 {
+	if a < b {
+		return a
+	}
+	return b
+}
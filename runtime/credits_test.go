@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/GDVFox/gostreaming/runtime/config"
+	upstreambackup "github.com/GDVFox/gostreaming/runtime/upstream_backup"
+)
+
+// readCredits возвращает кредиты, переданные процессу.
+func readCredits(t *testing.T, r io.Reader) []creditGrant {
+	t.Helper()
+
+	grants := make([]creditGrant, 0)
+	for {
+		grant := creditGrant{}
+		if err := binary.Read(r, binary.BigEndian, &grant); err != nil {
+			assert.ErrorIs(t, err, io.EOF)
+			return grants
+		}
+		grants = append(grants, grant)
+	}
+}
+
+// newTestSourceForwarder создает forwarder источника с получателем, который не запускается,
+// поэтому выходные сообщения остаются в forward log до удаления при переполнении.
+func newTestSourceForwarder(t *testing.T, r *Runtime, limits upstreambackup.ForwardLogLimits) {
+	t.Helper()
+
+	cfg := &upstreambackup.DefaultForwarderConfig{
+		ACKPeriod:     testAckPeriod,
+		ForwardLogDir: t.TempDir(),
+		Storage:       upstreambackup.StorageConfig{Backend: upstreambackup.StorageMemory},
+		LogLimits:     limits,
+	}
+	forwarder, err := upstreambackup.NewDefaultForwarder("test", []string{"downstream"}, cfg, r.logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.forwarder = forwarder
+}
+
+func TestCreditsWindow(t *testing.T) {
+	assert.EqualValues(t, unlimitedCredits, creditsWindow(0, 5))
+	assert.EqualValues(t, 10, creditsWindow(10, 0))
+	assert.EqualValues(t, 7, creditsWindow(10, 3))
+	assert.EqualValues(t, 0, creditsWindow(10, 10))
+	assert.EqualValues(t, 0, creditsWindow(10, 12))
+}
+
+func TestHandleCreditsRestart(t *testing.T) {
+	cases := []struct {
+		name     string
+		opt      *config.ActionOptions
+		replicas int
+		pending  int
+		expected []creditGrant
+	}{
+		{
+			name:     "empty log",
+			opt:      &config.ActionOptions{MaxPendingMessages: 10, MaxPendingBytes: 100},
+			replicas: 1,
+			expected: []creditGrant{{Messages: 10, Bytes: 100}},
+		},
+		{
+			name:     "pending messages",
+			opt:      &config.ActionOptions{MaxPendingMessages: 10, MaxPendingBytes: 100},
+			replicas: 1,
+			pending:  3,
+			expected: []creditGrant{{Messages: 7, Bytes: 91}},
+		},
+		{
+			name:     "window is full",
+			opt:      &config.ActionOptions{MaxPendingMessages: 2, MaxPendingBytes: 100},
+			replicas: 1,
+			pending:  3,
+			expected: []creditGrant{{Messages: 0, Bytes: 91}},
+		},
+		{
+			name:     "unlimited bytes",
+			opt:      &config.ActionOptions{MaxPendingMessages: 10},
+			replicas: 1,
+			pending:  3,
+			expected: []creditGrant{{Messages: 7, Bytes: unlimitedCredits}},
+		},
+		{
+			name:     "replicas",
+			opt:      &config.ActionOptions{MaxPendingMessages: 10, MaxPendingBytes: 100},
+			replicas: 2,
+			pending:  3,
+			expected: []creditGrant{{Messages: 4, Bytes: 46}},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r, _ := newTestRuntime(t)
+			r.opt = c.opt
+			for i := 0; i < c.replicas; i++ {
+				r.processes = append(r.processes, newActionProcess(i, true, c.opt, r.logger))
+			}
+
+			// Сообщения остаются в forward log, как после отказа процесса.
+			newTestSourceForwarder(t, r, upstreambackup.ForwardLogLimits{})
+			for i := 0; i < c.pending; i++ {
+				assert.NoError(t, r.forwarder.Forward(0, 0, nil, []byte("abc"), true))
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			var cmdIn bytes.Buffer
+			assert.NoError(t, r.handleCredits(ctx, r.processes[0], &cmdIn))
+			assert.Equal(t, c.expected, readCredits(t, &cmdIn))
+		})
+	}
+}
+
+// startTestCredits запускает handleCredits для единственного процесса источника r
+// и возвращает канал с переданными процессу кредитами.
+func startTestCredits(t *testing.T, r *Runtime) <-chan creditGrant {
+	t.Helper()
+
+	r.isSource = true
+	r.processes = []*actionProcess{newActionProcess(0, true, r.opt, r.logger)}
+
+	cmdOut, cmdIn := io.Pipe()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- r.handleCredits(ctx, r.processes[0], cmdIn) }()
+
+	grants := make(chan creditGrant, 16)
+	go func() {
+		defer close(grants)
+		for {
+			grant := creditGrant{}
+			if err := binary.Read(cmdOut, binary.BigEndian, &grant); err != nil {
+				return
+			}
+			grants <- grant
+		}
+	}()
+	t.Cleanup(func() {
+		cancel()
+		assert.NoError(t, <-done)
+		cmdIn.Close()
+	})
+	return grants
+}
+
+// takeGrant возвращает кредиты, переданные процессу, или nil, если их нет дольше нескольких периодов.
+func takeGrant(grants <-chan creditGrant) *creditGrant {
+	select {
+	case grant := <-grants:
+		return &grant
+	case <-time.After(10 * testAckPeriod):
+		return nil
+	}
+}
+
+func TestHandleCreditsPause(t *testing.T) {
+	r, _ := newTestRuntime(t)
+	r.opt = &config.ActionOptions{MaxPendingMessages: 10, MaxPendingBytes: 100}
+	// Сообщения удаляются из forward log при переполнении, а их кредиты возвращаются источнику.
+	newTestSourceForwarder(t, r, upstreambackup.ForwardLogLimits{MaxItems: 1, Overflow: upstreambackup.OverflowDropOldest})
+	grants := startTestCredits(t, r)
+	assert.Equal(t, &creditGrant{Messages: 10, Bytes: 100}, takeGrant(grants))
+
+	assert.NoError(t, r.forwarder.Forward(0, 0, nil, []byte("abc"), true))
+	assert.NoError(t, r.forwarder.Forward(0, 0, nil, []byte("abcd"), true))
+	assert.Equal(t, &creditGrant{Messages: 1, Bytes: 3}, takeGrant(grants))
+
+	// Пока источник приостановлен, освобожденные кредиты накапливаются.
+	assert.NoError(t, r.Pause())
+	assert.NoError(t, r.forwarder.Forward(0, 0, nil, []byte("ab"), true))
+	assert.NoError(t, r.forwarder.Forward(0, 0, nil, []byte("a"), true))
+	assert.Nil(t, takeGrant(grants))
+
+	assert.NoError(t, r.Resume())
+	assert.Equal(t, &creditGrant{Messages: 2, Bytes: 6}, takeGrant(grants))
+	assert.Nil(t, takeGrant(grants))
+}
+
+func TestHandleCreditsDrainWhilePaused(t *testing.T) {
+	r, _ := newTestRuntime(t)
+	r.opt = &config.ActionOptions{MaxPendingMessages: 10}
+	newTestSourceForwarder(t, r, upstreambackup.ForwardLogLimits{MaxItems: 1, Overflow: upstreambackup.OverflowDropOldest})
+	grants := startTestCredits(t, r)
+	assert.Equal(t, &creditGrant{Messages: 10, Bytes: unlimitedCredits}, takeGrant(grants))
+
+	// После drain источник не получает кредиты, даже если до него был приостановлен.
+	assert.NoError(t, r.Pause())
+	r.Drain()
+	assert.ErrorIs(t, r.Resume(), errResumeDraining)
+	assert.NoError(t, r.forwarder.Forward(0, 0, nil, []byte("abc"), true))
+	assert.NoError(t, r.forwarder.Forward(0, 0, nil, []byte("abc"), true))
+	assert.Nil(t, takeGrant(grants))
+}
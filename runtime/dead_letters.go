@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	upstreambackup "github.com/GDVFox/gostreaming/runtime/upstream_backup"
+	"github.com/GDVFox/gostreaming/util"
+	"github.com/GDVFox/gostreaming/util/message"
+)
+
+// controlReject передается действием вместо выхода, если оно не может обработать входное сообщение,
+// содержимое кадра — причина. Сообщение передается в очередь недоставленных сообщений.
+const controlReject uint8 = 8
+
+// crashCountsFile имя файла со счетчиками отказов действия в каталоге недоставленных сообщений.
+// machine_node переносит его вместе с действием, поэтому имя совпадает с именем в machine_node.
+const crashCountsFile = "crash_counts"
+
+// deadLetterExt расширение файлов недоставленных сообщений, которые забирает machine_node.
+const deadLetterExt = ".json"
+
+// maxReplays число сообщений для повторной обработки, которые ожидают передачи действию.
+const maxReplays = 64
+
+// Возможные ошибки повторной обработки.
+var (
+	errReplaySource    = errors.New("source does not receive messages")
+	errReplayStopped   = errors.New("runtime is stopped")
+	errReplayQueueFull = errors.New("too many messages are waiting for replay")
+)
+
+// deadLetterQueue сохраняет недоставленные сообщения узла в каталоге dir, откуда machine_node
+// переносит их в очередь недоставленных сообщений схемы, и считает отказы действия на входных сообщениях.
+type deadLetterQueue struct {
+	dir  string
+	node string
+
+	countsMutex sync.Mutex
+	counts      map[string]int
+}
+
+// newDeadLetterQueue открывает очередь узла node в каталоге dir
+// и загружает счетчики отказов, сохраненные до перезапуска.
+func newDeadLetterQueue(dir, node string) (*deadLetterQueue, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("can not create dead letter dir: %w", err)
+	}
+
+	q := &deadLetterQueue{dir: dir, node: node, counts: make(map[string]int)}
+	rawCounts, err := os.ReadFile(filepath.Join(dir, crashCountsFile))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("can not read crash counts: %w", err)
+	}
+	if len(rawCounts) != 0 {
+		if err := json.Unmarshal(rawCounts, &q.counts); err != nil {
+			return nil, fmt.Errorf("can not decode crash counts: %w", err)
+		}
+	}
+	return q, nil
+}
+
+// Put сохраняет недоставленное сообщение, файл появляется в каталоге целиком.
+func (q *deadLetterQueue) Put(letter *message.DeadLetter) error {
+	rawLetter, err := json.Marshal(letter)
+	if err != nil {
+		return fmt.Errorf("can not encode dead letter: %w", err)
+	}
+	return writeFileAtomic(filepath.Join(q.dir, letter.ID+deadLetterExt), rawLetter)
+}
+
+// Crashes возвращает число отказов действия на сообщении msg.
+func (q *deadLetterQueue) Crashes(msg *upstreambackup.UpstreamMessage) int {
+	q.countsMutex.Lock()
+	defer q.countsMutex.Unlock()
+
+	return q.counts[crashKey(msg)]
+}
+
+// AddCrash увеличивает и сохраняет число отказов действия на сообщении msg.
+func (q *deadLetterQueue) AddCrash(msg *upstreambackup.UpstreamMessage) (int, error) {
+	q.countsMutex.Lock()
+	defer q.countsMutex.Unlock()
+
+	key := crashKey(msg)
+	q.counts[key]++
+	return q.counts[key], q.saveCounts()
+}
+
+// ClearCrashes удаляет счетчик отказов обработанного сообщения msg.
+func (q *deadLetterQueue) ClearCrashes(msg *upstreambackup.UpstreamMessage) error {
+	q.countsMutex.Lock()
+	defer q.countsMutex.Unlock()
+
+	key := crashKey(msg)
+	if _, ok := q.counts[key]; !ok {
+		return nil
+	}
+	delete(q.counts, key)
+	return q.saveCounts()
+}
+
+func (q *deadLetterQueue) saveCounts() error {
+	rawCounts, err := json.Marshal(q.counts)
+	if err != nil {
+		return fmt.Errorf("can not encode crash counts: %w", err)
+	}
+	return writeFileAtomic(filepath.Join(q.dir, crashCountsFile), rawCounts)
+}
+
+// crashKey не меняется при повторной отправке сообщения, в том числе после перезапуска отправителя.
+func crashKey(msg *upstreambackup.UpstreamMessage) string {
+	return msg.Upstream + "/" + strconv.FormatUint(msg.Header.MessageID, 10)
+}
+
+// writeFileAtomic записывает data во временный файл и переименовывает его в path,
+// поэтому при отказе в path остается либо старое, либо новое содержимое.
+func writeFileAtomic(path string, data []byte) error {
+	tmpPath := path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("can not create %s: %w", tmpPath, err)
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return fmt.Errorf("can not write %s: %w", tmpPath, err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("can not sync %s: %w", tmpPath, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("can not close %s: %w", tmpPath, err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("can not rename %s: %w", tmpPath, err)
+	}
+	return nil
+}
+
+// deadLetter завершает обработку входного сообщения msg, которое действие не смогло обработать:
+// сообщение передается узлам с режимом передачи dead_letter, если они есть, иначе сохраняется
+// в очереди недоставленных сообщений. crashes число отказов действия на сообщении.
+func (r *Runtime) deadLetter(msg *upstreambackup.UpstreamMessage, reason string, crashes int) error {
+	// События и выходы источника не связаны с входными сообщениями, сохранять нечего.
+	if isEventInput(msg) || r.isSource {
+		r.logger.Warnf("action rejected input without message: %s", reason)
+		if isEventInput(msg) {
+			return nil
+		}
+		return r.forwarder.Forward(msg.InputID, msg.Header.MessageID, nil, nil, true)
+	}
+	r.logger.Warnf("message %d from %q moved to dead letters: %s", msg.Header.MessageID, msg.Upstream, reason)
+
+	if r.forwarder.HasDeadLetterRoute() {
+		metadata, err := upstreambackup.WithDeadLetterHeaders(msg.Metadata, r.deadLetters.node, reason, crashes)
+		if err != nil {
+			return fmt.Errorf("can not add dead letter headers: %w", err)
+		}
+		if msg.Detached {
+			return r.forwarder.ForwardDetachedDeadLetter(metadata, msg.Data)
+		}
+		return r.forwarder.ForwardDeadLetter(msg.InputID, msg.Header.MessageID, metadata, msg.Data)
+	}
+
+	createdAt := time.Now().UTC()
+	letter := &message.DeadLetter{
+		ID:        strconv.FormatInt(createdAt.UnixNano(), 10) + "-" + util.RandString(8),
+		Reason:    reason,
+		Crashes:   crashes,
+		Metadata:  msg.Metadata,
+		Data:      msg.Data,
+		CreatedAt: createdAt,
+	}
+	if !msg.Detached {
+		letter.Upstream, letter.MessageID = msg.Upstream, msg.Header.MessageID
+	}
+	if err := r.deadLetters.Put(letter); err != nil {
+		return err
+	}
+	if msg.Detached {
+		return nil
+	}
+	// Сообщение подтверждается только после сохранения, поэтому после отказа оно будет получено снова.
+	return r.forwarder.Forward(msg.InputID, msg.Header.MessageID, nil, nil, true)
+}
+
+// recordCrash увеличивает счетчик отказов действия для сообщения inputMsg, самого старого из сообщений,
+// на которые процесс p не ответил, так как отказ скорее всего вызван им.
+func (r *Runtime) recordCrash(p *actionProcess, inputMsg *upstreambackup.UpstreamMessage) {
+	if r.opt.MaxCrashes <= 0 || r.isSource {
+		return
+	}
+	if inputMsg == nil || isEventInput(inputMsg) || inputMsg.Detached {
+		return
+	}
+
+	crashes, err := r.deadLetters.AddCrash(inputMsg)
+	if err != nil {
+		p.logger.Errorf("can not save crash count: %s", err)
+		return
+	}
+	p.logger.Warnf("action crashed on message %d from %q, crashes: %d", inputMsg.Header.MessageID, inputMsg.Upstream, crashes)
+}
+
+// crashedTooOften проверяет, что действие отказывало на сообщении msg не меньше MaxCrashes раз,
+// такое сообщение передается в очередь недоставленных сообщений вместо действия.
+func (r *Runtime) crashedTooOften(msg *upstreambackup.UpstreamMessage) (int, bool) {
+	if r.opt.MaxCrashes <= 0 {
+		return 0, false
+	}
+	crashes := r.deadLetters.Crashes(msg)
+	return crashes, crashes >= r.opt.MaxCrashes
+}
+
+// dropCrashedTooOften передает сообщение msg в очередь недоставленных сообщений вместо действия,
+// если действие отказывало на нем слишком часто. Возвращает true, если сообщение передано.
+func (r *Runtime) dropCrashedTooOften(msg *upstreambackup.UpstreamMessage) (bool, error) {
+	crashes, ok := r.crashedTooOften(msg)
+	if !ok {
+		return false, nil
+	}
+
+	reason := fmt.Sprintf("action crashed %d times on the message", crashes)
+	if err := r.deadLetter(msg, reason, crashes); err != nil {
+		return false, fmt.Errorf("can not move message to dead letters: %w", err)
+	}
+	if err := r.deadLetters.ClearCrashes(msg); err != nil {
+		return false, fmt.Errorf("can not clear crash count: %w", err)
+	}
+	return true, nil
+}
+
+// Replay передает действию сообщение из очереди недоставленных сообщений. Сообщение не подтверждается
+// вышестоящим узлам, а его выходы передаются так же, как выходы событий.
+// Replay не ждет освобождения очереди, так как отвечает на команду machine_node.
+func (r *Runtime) Replay(metadata, data []byte) error {
+	if r.isSource {
+		return errReplaySource
+	}
+	select {
+	case <-r.dispatchDone:
+		return errReplayStopped
+	case <-r.drain:
+		return errReplayStopped
+	default:
+	}
+	select {
+	case r.replays <- upstreambackup.NewDetachedMessage(metadata, data):
+		return nil
+	default:
+		return errReplayQueueFull
+	}
+}
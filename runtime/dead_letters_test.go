@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/GDVFox/gostreaming/runtime/config"
+	upstreambackup "github.com/GDVFox/gostreaming/runtime/upstream_backup"
+	"github.com/GDVFox/gostreaming/util/message"
+)
+
+// readDeadLetters возвращает недоставленные сообщения, сохраненные в каталоге dir.
+func readDeadLetters(t *testing.T, dir string) []*message.DeadLetter {
+	t.Helper()
+
+	files, err := filepath.Glob(filepath.Join(dir, "*"+deadLetterExt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	letters := make([]*message.DeadLetter, 0, len(files))
+	for _, file := range files {
+		rawLetter, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		letter := &message.DeadLetter{}
+		if err := json.Unmarshal(rawLetter, letter); err != nil {
+			t.Fatal(err)
+		}
+		letters = append(letters, letter)
+	}
+	return letters
+}
+
+func newTestDeadLetterRuntime(t *testing.T, maxCrashes int) (*Runtime, string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	q, err := newDeadLetterQueue(dir, "scheme_node")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, _ := newTestRuntime(t)
+	r.deadLetters = q
+	r.opt = &config.ActionOptions{MaxCrashes: maxCrashes}
+	startTestForwarder(t, r)
+	return r, dir
+}
+
+func TestDeadLetterQueueCrashCounts(t *testing.T) {
+	dir := t.TempDir()
+	q, err := newDeadLetterQueue(dir, "scheme_node")
+	assert.NoError(t, err)
+
+	first, second := newTestInput("a", 0, 1, "first"), newTestInput("b", 1, 1, "second")
+	for i := 1; i <= 2; i++ {
+		crashes, err := q.AddCrash(first)
+		assert.NoError(t, err)
+		assert.Equal(t, i, crashes)
+	}
+	_, err = q.AddCrash(second)
+	assert.NoError(t, err)
+
+	// Счетчики сохраняются после перезапуска runtime, в том числе для повторно полученного сообщения.
+	q, err = newDeadLetterQueue(dir, "scheme_node")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, q.Crashes(newTestInput("a", 0, 1, "first")))
+	assert.Equal(t, 1, q.Crashes(second))
+	assert.Zero(t, q.Crashes(newTestInput("a", 0, 2, "other")))
+
+	assert.NoError(t, q.ClearCrashes(first))
+	assert.NoError(t, q.ClearCrashes(first))
+	q, err = newDeadLetterQueue(dir, "scheme_node")
+	assert.NoError(t, err)
+	assert.Zero(t, q.Crashes(first))
+	assert.Equal(t, 1, q.Crashes(second))
+}
+
+func TestDeadLetterQueueBadCounts(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, crashCountsFile), []byte("{"), 0644))
+
+	_, err := newDeadLetterQueue(dir, "scheme_node")
+	assert.Error(t, err)
+}
+
+func TestDropCrashedTooOften(t *testing.T) {
+	r, dir := newTestDeadLetterRuntime(t, 2)
+	msg := newTestInput("a", 0, 7, "poison")
+
+	_, err := r.deadLetters.AddCrash(msg)
+	assert.NoError(t, err)
+	dropped, err := r.dropCrashedTooOften(msg)
+	assert.NoError(t, err)
+	assert.False(t, dropped)
+	assert.Empty(t, readDeadLetters(t, dir))
+
+	_, err = r.deadLetters.AddCrash(msg)
+	assert.NoError(t, err)
+	dropped, err = r.dropCrashedTooOften(msg)
+	assert.NoError(t, err)
+	assert.True(t, dropped)
+
+	letters := readDeadLetters(t, dir)
+	if assert.Len(t, letters, 1) {
+		assert.Equal(t, "a", letters[0].Upstream)
+		assert.EqualValues(t, 7, letters[0].MessageID)
+		assert.Equal(t, 2, letters[0].Crashes)
+		assert.Equal(t, []byte("poison"), letters[0].Data)
+		assert.Equal(t, "action crashed 2 times on the message", letters[0].Reason)
+	}
+	assert.Equal(t, upstreambackup.UpstreamAck{0: 7}, takeAck(r))
+
+	// После переноса в очередь счетчик удаляется, в том числе из файла.
+	assert.Zero(t, r.deadLetters.Crashes(msg))
+	q, err := newDeadLetterQueue(dir, "scheme_node")
+	assert.NoError(t, err)
+	assert.Zero(t, q.Crashes(msg))
+}
+
+func TestDropCrashedTooOftenDisabled(t *testing.T) {
+	r, dir := newTestDeadLetterRuntime(t, 0)
+	msg := newTestInput("a", 0, 7, "poison")
+
+	for i := 0; i < 3; i++ {
+		_, err := r.deadLetters.AddCrash(msg)
+		assert.NoError(t, err)
+	}
+	dropped, err := r.dropCrashedTooOften(msg)
+	assert.NoError(t, err)
+	assert.False(t, dropped)
+	assert.Empty(t, readDeadLetters(t, dir))
+}
+
+func TestDeadLetterAckAfterPut(t *testing.T) {
+	r, dir := newTestDeadLetterRuntime(t, 0)
+	msg := newTestInput("a", 0, 3, "rejected")
+
+	// Сообщение нельзя сохранить, поэтому оно не подтверждается и будет получено снова.
+	assert.NoError(t, os.RemoveAll(dir))
+	assert.Error(t, r.deadLetter(msg, "bad message", 0))
+	assert.Nil(t, takeAck(r))
+
+	assert.NoError(t, os.MkdirAll(dir, 0755))
+	assert.NoError(t, r.deadLetter(msg, "bad message", 0))
+	assert.Equal(t, upstreambackup.UpstreamAck{0: 3}, takeAck(r))
+	letters := readDeadLetters(t, dir)
+	if assert.Len(t, letters, 1) {
+		assert.Equal(t, "bad message", letters[0].Reason)
+		assert.Zero(t, letters[0].Crashes)
+	}
+}
+
+func TestDeadLetterDetached(t *testing.T) {
+	r, dir := newTestDeadLetterRuntime(t, 0)
+
+	// Повторно переданное сообщение сохраняется без отправителя и не подтверждается.
+	assert.NoError(t, r.deadLetter(upstreambackup.NewDetachedMessage(nil, []byte("replayed")), "bad message", 0))
+	assert.Nil(t, takeAck(r))
+	letters := readDeadLetters(t, dir)
+	if assert.Len(t, letters, 1) {
+		assert.Empty(t, letters[0].Upstream)
+		assert.Equal(t, []byte("replayed"), letters[0].Data)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"time"
+
+	upstreambackup "github.com/GDVFox/gostreaming/runtime/upstream_backup"
+)
+
+// capabilityEvents действие читает события: периодические тики и уведомление об остановке.
+const capabilityEvents uint32 = 1 << 2
+
+// Управляющие кадры событий, содержат int64 время события в наносекундах unix.
+const (
+	controlTick     uint8 = 6
+	controlShutdown uint8 = 7
+)
+
+// defaultShutdownTimeout время ожидания ответа на уведомление об остановке по умолчанию.
+const defaultShutdownTimeout = 5 * time.Second
+
+// Отметки событий в очереди входных сообщений. Действие отвечает на событие
+// так же, как на входное сообщение, поэтому отметка позволяет отличить ответ на событие.
+var (
+	tickInput     = newEventInput()
+	shutdownInput = newEventInput()
+)
+
+func newEventInput() *upstreambackup.UpstreamMessage {
+	msg := *upstreambackup.DummyUpstreamMessage
+	return &msg
+}
+
+// isEventInput возвращает true, если msg является отметкой события.
+func isEventInput(msg *upstreambackup.UpstreamMessage) bool {
+	return msg == tickInput || msg == shutdownInput
+}
+
+// eventsEnabled возвращает true, если процесс действия подтвердил, что читает события.
+func (r *Runtime) eventsEnabled(p *actionProcess) bool {
+	capabilities, ok := p.liveness.Capabilities()
+	return ok && capabilities&capabilityEvents != 0
+}
+
+// handleTicks периодически передает действию тики, если оно их читает.
+// Если действие ещё не ответило на предыдущий тик, то следующий пропускается.
+func (r *Runtime) handleTicks(ctx context.Context, p *actionProcess) error {
+	defer p.logger.Info("handle ticks stopped")
+
+	select {
+	case <-ctx.Done():
+		return nil
+	case <-p.liveness.ready:
+	}
+	if r.opt.TickInterval <= 0 || !r.eventsEnabled(p) {
+		return nil
+	}
+
+	ticker := time.NewTicker(time.Duration(r.opt.TickInterval))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			select {
+			case p.ticks <- struct{}{}:
+			default:
+				p.logger.Debug("previous tick is not sent, skipping tick")
+			}
+		}
+	}
+}
+
+// handleShutdown после отмены ctx передает процессам действия уведомление об остановке
+// и ожидает ответа от всех процессов, которые читают события, после чего runCtx может быть отменен.
+// При drain уведомление передается после ответа действия на все полученные сообщения,
+// затем процессы останавливаются через stopProcesses и runtime ожидает доставки выходных сообщений.
+func (r *Runtime) handleShutdown(ctx, runCtx context.Context, stopProcesses context.CancelFunc) error {
+	select {
+	case <-runCtx.Done():
+		return nil
+	case <-ctx.Done():
+		return r.notifyShutdown(runCtx)
+	case <-r.drain:
+	}
+
+	r.logger.Info("drain: waiting for answers to received messages")
+	r.waitDrained(ctx, runCtx, r.inputsAnswered)
+	if err := r.notifyShutdown(runCtx); err != nil {
+		return err
+	}
+	stopProcesses()
+
+	r.logger.Info("drain: waiting for delivery of output messages")
+	if r.waitDrained(ctx, runCtx, r.outputsDelivered) {
+		r.logger.Info("drain done")
+	}
+	return nil
+}
+
+// notifyShutdown передает процессам действия, которые читают события, уведомление об остановке
+// и ожидает их ответа не дольше shutdown_timeout.
+func (r *Runtime) notifyShutdown(runCtx context.Context) error {
+	waiting := make([]*actionProcess, 0, len(r.processes))
+	for _, p := range r.processes {
+		if r.eventsEnabled(p) {
+			waiting = append(waiting, p)
+		}
+	}
+	if len(waiting) == 0 {
+		return nil
+	}
+
+	timeout := time.Duration(r.opt.ShutdownTimeout)
+	if timeout <= 0 {
+		timeout = defaultShutdownTimeout
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	r.logger.Info("sending shutdown notice to action")
+	close(r.shutdown)
+	for _, p := range waiting {
+		select {
+		case <-runCtx.Done():
+			return nil
+		case <-p.shutdownDone:
+			p.logger.Info("action answered shutdown notice")
+		case <-timer.C:
+			r.logger.Warnf("action did not answer shutdown notice in %s", timeout)
+			return nil
+		}
+	}
+	return nil
+}
+
+// writeEvent передает действию событие.
+func writeEvent(w io.Writer, controlType uint8, at time.Time) error {
+	payload := make([]byte, 8)
+	binary.BigEndian.PutUint64(payload, uint64(at.UnixNano()))
+	return writeControl(w, controlType, payload)
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// protocolEnv переменная окружения с версией протокола runtime.
+// Она сообщает действию, что runtime поддерживает подтверждение готовности и управляющие кадры.
+const protocolEnv = "GOSTREAMING_PROTOCOL"
+
+// protocolVersion последняя версия протокола, которую поддерживает runtime.
+const protocolVersion uint16 = 1
+
+// Возможности, которые действие объявляет при подтверждении готовности.
+const (
+	// capabilityProbes действие отвечает на проверки работоспособности.
+	capabilityProbes uint32 = 1 << 0
+	// capabilityBatch действие читает пакеты, аналогично controlBatchOptIn.
+	capabilityBatch uint32 = 1 << 1
+)
+
+// Управляющие кадры подтверждения готовности и проверок работоспособности.
+const (
+	// controlReady содержит uint16 версию протокола и uint32 возможности действия.
+	controlReady uint8 = 3
+	// controlProbe содержит uint64 номер проверки, который действие возвращает в controlProbeReply.
+	controlProbe      uint8 = 4
+	controlProbeReply uint8 = 5
+)
+
+// Состояния действия, которые передаются в телеметрии, упорядочены от лучшего к худшему.
+const (
+	// actionStatusRunning действие работает.
+	actionStatusRunning uint8 = 0
+	// actionStatusStarting действие запущено, но ещё не подтвердило готовность.
+	actionStatusStarting uint8 = 1
+	// actionStatusUnresponsive действие не ответило на проверку работоспособности.
+	actionStatusUnresponsive uint8 = 2
+)
+
+var (
+	errActionNotReady = errors.New("action is not ready")
+)
+
+// liveness хранит результаты подтверждения готовности и проверок работоспособности действия.
+type liveness struct {
+	lock         sync.Mutex
+	ready        chan struct{}
+	isReady      bool
+	version      uint16
+	capabilities uint32
+
+	lastProbe uint64
+	// probeSent время отправки неотвеченной проверки, нулевое, если все проверки отвечены.
+	probeSent    time.Time
+	unresponsive bool
+}
+
+func newLiveness() *liveness {
+	return &liveness{ready: make(chan struct{})}
+}
+
+// Ready запоминает подтверждение готовности.
+func (l *liveness) Ready(version uint16, capabilities uint32) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.isReady {
+		return
+	}
+	l.isReady = true
+	l.version = version
+	l.capabilities = capabilities
+	close(l.ready)
+}
+
+// Reset сбрасывает результаты проверок перед перезапуском действия,
+// перезапущенное действие должно заново подтвердить готовность.
+func (l *liveness) Reset() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.ready = make(chan struct{})
+	l.isReady = false
+	l.version = 0
+	l.capabilities = 0
+	l.probeSent = time.Time{}
+	l.unresponsive = false
+}
+
+// NextProbe возвращает номер следующей проверки и false, если предыдущая проверка ещё не отвечена.
+func (l *liveness) NextProbe(now time.Time) (uint64, bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if !l.probeSent.IsZero() {
+		return 0, false
+	}
+	l.lastProbe++
+	l.probeSent = now
+	return l.lastProbe, true
+}
+
+// ProbeReplied отмечает ответ на проверку.
+func (l *liveness) ProbeReplied(probe uint64) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if probe != l.lastProbe {
+		return
+	}
+	l.probeSent = time.Time{}
+	l.unresponsive = false
+}
+
+// Check проверяет, что неотвеченная проверка отправлена не раньше timeout назад.
+// Возвращает true, если действие только что перестало отвечать.
+func (l *liveness) Check(now time.Time, timeout time.Duration) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.unresponsive || l.probeSent.IsZero() || now.Sub(l.probeSent) < timeout {
+		return false
+	}
+	l.unresponsive = true
+	return true
+}
+
+// Capabilities возвращает возможности действия и false, если действие ещё не подтвердило готовность.
+func (l *liveness) Capabilities() (uint32, bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.capabilities, l.isReady
+}
+
+// Status возвращает состояние действия для телеметрии.
+// needReady означает, что действие считается запущенным только после подтверждения готовности.
+func (l *liveness) Status(needReady bool) (uint8, uint16) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	switch {
+	case needReady && !l.isReady:
+		return actionStatusStarting, l.version
+	case l.unresponsive:
+		return actionStatusUnresponsive, l.version
+	default:
+		return actionStatusRunning, l.version
+	}
+}
+
+// handleControl обрабатывает управляющие кадры из вывода действия.
+func (r *Runtime) handleControl(p *actionProcess, controlType uint8, payload []byte) error {
+	switch controlType {
+	case controlBatchOptIn:
+		r.enableBatching(p)
+	case controlReady:
+		if len(payload) != 6 {
+			return fmt.Errorf("ready: %w", errBadControlFrame)
+		}
+		version := binary.BigEndian.Uint16(payload)
+		if version == 0 || version > protocolVersion {
+			return fmt.Errorf("action declared unsupported protocol version %d", version)
+		}
+		capabilities := binary.BigEndian.Uint32(payload[2:])
+		p.liveness.Ready(version, capabilities)
+		p.logger.Infof("action is ready: protocol version %d, capabilities %#x", version, capabilities)
+		if capabilities&capabilityBatch != 0 {
+			r.enableBatching(p)
+		}
+	case controlProbeReply:
+		if len(payload) != 8 {
+			return fmt.Errorf("probe reply: %w", errBadControlFrame)
+		}
+		p.liveness.ProbeReplied(binary.BigEndian.Uint64(payload))
+	default:
+		return fmt.Errorf("%d: %w", controlType, errUnknownControl)
+	}
+	return nil
+}
+
+func (r *Runtime) enableBatching(p *actionProcess) {
+	if atomic.CompareAndSwapUint32(&p.batching, 0, 1) {
+		p.logger.Info("action reads batches")
+	}
+}
+
+// handleLiveness ожидает подтверждения готовности действия и периодически проверяет,
+// что действие читает входные сообщения. Проверки передаются через handleIn,
+// поэтому если действие перестало читать STDIN, то проверка не будет даже отправлена.
+func (r *Runtime) handleLiveness(ctx context.Context, p *actionProcess) error {
+	defer p.logger.Info("handle liveness stopped")
+
+	var readyTimeout <-chan time.Time
+	if r.opt.ReadyTimeout > 0 {
+		timer := time.NewTimer(time.Duration(r.opt.ReadyTimeout))
+		defer timer.Stop()
+		readyTimeout = timer.C
+	}
+	select {
+	case <-ctx.Done():
+		return nil
+	case <-readyTimeout:
+		return fmt.Errorf("no handshake in %s: %w", time.Duration(r.opt.ReadyTimeout), errActionNotReady)
+	case <-p.liveness.ready:
+	}
+
+	if r.opt.ProbeInterval <= 0 {
+		return nil
+	}
+	if p.liveness.capabilities&capabilityProbes == 0 {
+		p.logger.Warn("action does not answer probes, liveness is not checked")
+		return nil
+	}
+
+	interval := time.Duration(r.opt.ProbeInterval)
+	timeout := time.Duration(r.opt.ProbeTimeout)
+	if timeout <= 0 {
+		timeout = 3 * interval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case now := <-ticker.C:
+			if p.liveness.Check(now, timeout) {
+				p.logger.Warnf("action did not answer probe in %s, marked unresponsive", timeout)
+			}
+
+			probe, ok := p.liveness.NextProbe(now)
+			if !ok {
+				continue
+			}
+			select {
+			case p.probes <- probe:
+			default:
+			}
+		}
+	}
+}
+
+// writeProbe передает действию проверку работоспособности.
+func writeProbe(w io.Writer, probe uint64) error {
+	payload := make([]byte, 8)
+	binary.BigEndian.PutUint64(payload, probe)
+	return writeControl(w, controlProbe, payload)
+}
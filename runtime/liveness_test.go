@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/GDVFox/gostreaming/runtime/config"
+)
+
+// testProbeTimeout время ожидания ответа на проверку в тестах liveness.
+const testProbeTimeout = time.Second
+
+func TestLiveness(t *testing.T) {
+	start := time.Now()
+
+	cases := []struct {
+		name      string
+		steps     func(t *testing.T, l *liveness)
+		needReady bool
+		expected  uint8
+	}{
+		{
+			name:      "starting before ready",
+			steps:     func(t *testing.T, l *liveness) {},
+			needReady: true,
+			expected:  actionStatusStarting,
+		},
+		{
+			name:     "running without handshake",
+			steps:    func(t *testing.T, l *liveness) {},
+			expected: actionStatusRunning,
+		},
+		{
+			name: "running after ready",
+			steps: func(t *testing.T, l *liveness) {
+				l.Ready(protocolVersion, capabilityProbes)
+			},
+			needReady: true,
+			expected:  actionStatusRunning,
+		},
+		{
+			name: "probe is not late",
+			steps: func(t *testing.T, l *liveness) {
+				l.Ready(protocolVersion, capabilityProbes)
+				_, ok := l.NextProbe(start)
+				assert.True(t, ok)
+				assert.False(t, l.Check(start.Add(testProbeTimeout-time.Millisecond), testProbeTimeout))
+			},
+			needReady: true,
+			expected:  actionStatusRunning,
+		},
+		{
+			name: "unresponsive",
+			steps: func(t *testing.T, l *liveness) {
+				l.Ready(protocolVersion, capabilityProbes)
+				_, ok := l.NextProbe(start)
+				assert.True(t, ok)
+				// Пока проверка не отвечена, следующая не отправляется.
+				_, ok = l.NextProbe(start.Add(testProbeTimeout))
+				assert.False(t, ok)
+				// Действие отмечается неотвечающим только один раз.
+				assert.True(t, l.Check(start.Add(testProbeTimeout), testProbeTimeout))
+				assert.False(t, l.Check(start.Add(2*testProbeTimeout), testProbeTimeout))
+			},
+			needReady: true,
+			expected:  actionStatusUnresponsive,
+		},
+		{
+			name: "reply resets unresponsive",
+			steps: func(t *testing.T, l *liveness) {
+				l.Ready(protocolVersion, capabilityProbes)
+				probe, _ := l.NextProbe(start)
+				assert.True(t, l.Check(start.Add(testProbeTimeout), testProbeTimeout))
+				l.ProbeReplied(probe)
+				assert.False(t, l.Check(start.Add(2*testProbeTimeout), testProbeTimeout))
+
+				next, ok := l.NextProbe(start.Add(2 * testProbeTimeout))
+				assert.True(t, ok)
+				assert.Equal(t, probe+1, next)
+			},
+			needReady: true,
+			expected:  actionStatusRunning,
+		},
+		{
+			name: "stale reply is ignored",
+			steps: func(t *testing.T, l *liveness) {
+				l.Ready(protocolVersion, capabilityProbes)
+				probe, _ := l.NextProbe(start)
+				l.ProbeReplied(probe)
+				_, ok := l.NextProbe(start.Add(testProbeTimeout))
+				assert.True(t, ok)
+
+				// Повторный ответ на предыдущую проверку не считается ответом на текущую.
+				l.ProbeReplied(probe)
+				assert.True(t, l.Check(start.Add(2*testProbeTimeout), testProbeTimeout))
+				l.ProbeReplied(probe)
+			},
+			needReady: true,
+			expected:  actionStatusUnresponsive,
+		},
+		{
+			name: "reset before restart",
+			steps: func(t *testing.T, l *liveness) {
+				l.Ready(protocolVersion, capabilityProbes)
+				l.NextProbe(start)
+				assert.True(t, l.Check(start.Add(testProbeTimeout), testProbeTimeout))
+
+				// Перезапущенное действие заново подтверждает готовность, а проверки начинаются сначала.
+				l.Reset()
+				_, ok := l.Capabilities()
+				assert.False(t, ok)
+				_, ok = l.NextProbe(start.Add(testProbeTimeout))
+				assert.True(t, ok)
+			},
+			needReady: true,
+			expected:  actionStatusStarting,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			l := newLiveness()
+			c.steps(t, l)
+			status, _ := l.Status(c.needReady)
+			assert.Equal(t, c.expected, status)
+		})
+	}
+}
+
+func TestLivenessReady(t *testing.T) {
+	l := newLiveness()
+	l.Ready(protocolVersion, capabilityProbes)
+	assert.True(t, isClosed(l.ready))
+
+	// Повторное подтверждение готовности не изменяет объявленные возможности.
+	l.Ready(protocolVersion, capabilityProbes|capabilityBatch)
+	capabilities, ok := l.Capabilities()
+	assert.True(t, ok)
+	assert.Equal(t, capabilityProbes, capabilities)
+	_, version := l.Status(true)
+	assert.Equal(t, protocolVersion, version)
+}
+
+// readyPayload возвращает содержимое кадра controlReady.
+func readyPayload(version uint16, capabilities uint32) []byte {
+	payload := make([]byte, 6)
+	binary.BigEndian.PutUint16(payload, version)
+	binary.BigEndian.PutUint32(payload[2:], capabilities)
+	return payload
+}
+
+func TestHandleControl(t *testing.T) {
+	cases := []struct {
+		name        string
+		controlType uint8
+		payload     []byte
+		expectedErr error
+		errMessage  string
+		ready       bool
+		batching    uint32
+	}{
+		{
+			name:        "ready",
+			controlType: controlReady,
+			payload:     readyPayload(protocolVersion, capabilityProbes|capabilityBatch),
+			ready:       true,
+			batching:    1,
+		},
+		{
+			name:        "short ready",
+			controlType: controlReady,
+			payload:     readyPayload(protocolVersion, 0)[:5],
+			expectedErr: errBadControlFrame,
+		},
+		{
+			name:        "long ready",
+			controlType: controlReady,
+			payload:     append(readyPayload(protocolVersion, 0), 0),
+			expectedErr: errBadControlFrame,
+		},
+		{
+			name:        "zero version",
+			controlType: controlReady,
+			payload:     readyPayload(0, 0),
+			errMessage:  "action declared unsupported protocol version 0",
+		},
+		{
+			name:        "newer version",
+			controlType: controlReady,
+			payload:     readyPayload(protocolVersion+1, capabilityBatch),
+			errMessage:  fmt.Sprintf("action declared unsupported protocol version %d", protocolVersion+1),
+		},
+		{
+			name:        "short probe reply",
+			controlType: controlProbeReply,
+			payload:     make([]byte, 7),
+			expectedErr: errBadControlFrame,
+		},
+		{
+			name:        "long probe reply",
+			controlType: controlProbeReply,
+			payload:     make([]byte, 9),
+			expectedErr: errBadControlFrame,
+		},
+		{
+			name:        "batch opt-in",
+			controlType: controlBatchOptIn,
+			batching:    1,
+		},
+		{
+			name:        "unknown",
+			controlType: 255,
+			expectedErr: errUnknownControl,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r, _ := newTestRuntime(t)
+			p := newActionProcess(0, false, &config.ActionOptions{}, r.logger)
+
+			err := r.handleControl(p, c.controlType, c.payload)
+			switch {
+			case c.expectedErr != nil:
+				assert.ErrorIs(t, err, c.expectedErr)
+			case c.errMessage != "":
+				assert.EqualError(t, err, c.errMessage)
+			default:
+				assert.NoError(t, err)
+			}
+
+			// Готовность и пакетная передача включаются только корректными кадрами.
+			_, ready := p.liveness.Capabilities()
+			assert.Equal(t, c.ready, ready)
+			assert.Equal(t, c.batching, atomic.LoadUint32(&p.batching))
+		})
+	}
+}
+
+func TestHandleControlProbeReply(t *testing.T) {
+	r, _ := newTestRuntime(t)
+	p := newActionProcess(0, false, &config.ActionOptions{}, r.logger)
+	start := time.Now()
+
+	probe, _ := p.liveness.NextProbe(start)
+	payload := make([]byte, 8)
+	binary.BigEndian.PutUint64(payload, probe)
+	assert.NoError(t, r.handleControl(p, controlProbeReply, payload))
+	assert.False(t, p.liveness.Check(start.Add(testProbeTimeout), testProbeTimeout))
+}
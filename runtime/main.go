@@ -14,6 +14,7 @@ import (
 	"github.com/GDVFox/gostreaming/runtime/config"
 	upstreambackup "github.com/GDVFox/gostreaming/runtime/upstream_backup"
 	"github.com/GDVFox/gostreaming/util"
+	"github.com/GDVFox/gostreaming/util/storage"
 )
 
 func init() {
@@ -29,6 +30,16 @@ func init() {
 	flag.StringVar(&config.Conf.ActionOptionsRaw, "action-opt", "", "Action args and env variables in JSON format")
 	flag.StringVar(&config.Conf.ACKPeriodRaw, "ack-period", "5s", "Period for sending ACK in duration format")
 	flag.StringVar(&config.Conf.ForwardLogDir, "buffer-dir", "/tmp/gostreaming-logs", "Directory for buffers")
+	flag.IntVar(&config.Conf.MaxInFlight, "max-in-flight", 1<<16, "Max number of unacknowledged messages sent to downstream, 0 means no limit")
+	flag.StringVar(&config.Conf.TLSCertFile, "tls-cert", "", "Certificate of runtime for TLS, empty means no TLS")
+	flag.StringVar(&config.Conf.TLSKeyFile, "tls-key", "", "Private key of runtime certificate")
+	flag.StringVar(&config.Conf.TLSCAFile, "tls-ca", "", "CA certificates for peers verification")
+	flag.StringVar(&config.Conf.StateDir, "state-dir", "/tmp/gostreaming-state", "Directory for action state")
+	flag.StringVar(&config.Conf.StateETCDRaw, "state-etcd", "", "Etcd endpoints for action state replica, empty means no replica")
+	flag.StringVar(&config.Conf.StateETCDTimeoutRaw, "state-etcd-timeout", "5s", "Timeout for etcd requests of action state replica")
+	flag.StringVar(&config.Conf.StateKey, "state-key", "", "Etcd key prefix for action state replica")
+	flag.StringVar(&config.Conf.DeliveryDir, "delivery-dir", "/tmp/gostreaming-delivery", "Directory for delivered messages in exactly-once mode")
+	flag.StringVar(&config.Conf.DeadLetterDir, "dead-letter-dir", "/tmp/gostreaming-dead-letters", "Directory for messages rejected by action")
 }
 
 func main() {
@@ -43,6 +54,22 @@ func main() {
 	forwarderConfig := &upstreambackup.DefaultForwarderConfig{
 		ACKPeriod:     config.Conf.ACKPeriod,
 		ForwardLogDir: config.Conf.ForwardLogDir,
+		MaxInFlight:   config.Conf.MaxInFlight,
+		Compression: upstreambackup.CompressionConfig{
+			Codec:   config.Conf.ActionOptions.Compression,
+			Level:   config.Conf.ActionOptions.CompressionLevel,
+			MinSize: config.Conf.ActionOptions.CompressionMinSize,
+		},
+		Storage: upstreambackup.StorageConfig{
+			Backend: config.Conf.ActionOptions.ForwardLogStorage,
+			Sync:    config.Conf.ActionOptions.ForwardLogSync,
+		},
+		LogLimits: upstreambackup.ForwardLogLimits{
+			MaxItems: uint64(config.Conf.ActionOptions.ForwardLogMaxItems),
+			MaxBytes: uint64(config.Conf.ActionOptions.ForwardLogMaxBytes),
+			Overflow: config.Conf.ActionOptions.ForwardLogOverflow,
+		},
+		Routing: config.Conf.ActionOptions.Routing,
 	}
 
 	// всегда чистим файлы в runtime.
@@ -64,16 +91,84 @@ func main() {
 		cancel()
 	}()
 
-	receiver := upstreambackup.NewDefaultReceiver(":"+strconv.Itoa(config.Conf.Port), config.Conf.In, logger)
+	if config.Conf.TLSCertFile != "" {
+		forwarderConfig.TLS, err = upstreambackup.LoadTLSConfig(config.Conf.TLSCertFile, config.Conf.TLSKeyFile, config.Conf.TLSCAFile)
+		if err != nil {
+			logger.Errorf("can not load tls config: %v", err)
+			fmt.Fprintf(os.Stderr, "can not load tls config: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	isSource := len(config.Conf.In) == 0
+	// Копия нужна и для состояния, и для границ доставки режима exactly-once,
+	// так как после отказа действие может быть запущено на другой машине.
+	var replica upstreambackup.StateReplica
+	if len(config.Conf.StateETCD) != 0 && (config.Conf.ActionOptions.State || config.Conf.ActionOptions.ExactlyOnce) {
+		etcdReplica, err := upstreambackup.NewETCDStateReplica(&storage.ETCDConfig{
+			Endpoints: config.Conf.StateETCD,
+			Timeout:   util.Duration(config.Conf.StateETCDTimeout),
+			Retry:     util.NewRetryConfig(),
+		}, config.Conf.StateKey)
+		if err != nil {
+			logger.Errorf("can not init state replica: %v", err)
+			fmt.Fprintf(os.Stderr, "can not init state replica: %v\n", err)
+			os.Exit(1)
+		}
+		defer etcdReplica.Close()
+		replica = etcdReplica
+	}
+
+	// Источнику нечего отбрасывать, так как он не получает сообщений,
+	// но нумерация его выходных сообщений тоже должна продолжаться на другой машине.
+	if config.Conf.ActionOptions.ExactlyOnce {
+		forwarderConfig.Delivery, err = upstreambackup.NewDeliveryStore(config.Conf.DeliveryDir, replica)
+		if err != nil {
+			logger.Errorf("can not init delivery store: %v", err)
+			fmt.Fprintf(os.Stderr, "can not init delivery store: %v\n", err)
+			os.Exit(1)
+		}
+		defer forwarderConfig.Delivery.Close()
+	}
+
+	receiver := upstreambackup.NewDefaultReceiver(":"+strconv.Itoa(config.Conf.Port), config.Conf.In, forwarderConfig.TLS, forwarderConfig.Delivery, logger)
 	forwarder, err := upstreambackup.NewDefaultForwarder(config.Conf.Name, config.Conf.Out, forwarderConfig, logger)
 	if err != nil {
 		logger.Errorf("can not init forwarder: %v", err)
 		fmt.Fprintf(os.Stderr, "can not init forwarder: %v\n", err)
 		os.Exit(1)
 	}
+	if forwarderConfig.Delivery != nil {
+		if err := forwarderConfig.Delivery.Recover(forwarder.RestoredInputs()); err != nil {
+			logger.Errorf("can not recover delivered messages: %v", err)
+			fmt.Fprintf(os.Stderr, "can not recover delivered messages: %v\n", err)
+			os.Exit(1)
+		}
+	}
 
-	isSource := len(config.Conf.In) == 0
-	runtime, err := NewRuntime(config.Conf.ActionPath, isSource, receiver, forwarder, config.Conf.ActionOptions, logger)
+	var state *upstreambackup.StateStore
+	if config.Conf.ActionOptions.State {
+		state, err = upstreambackup.NewStateStore(config.Conf.StateDir, replica)
+		if err != nil {
+			logger.Errorf("can not init state: %v", err)
+			fmt.Fprintf(os.Stderr, "can not init state: %v\n", err)
+			os.Exit(1)
+		}
+		defer state.Close()
+	}
+
+	var deadLetters *deadLetterQueue
+	if !isSource {
+		deadLetters, err = newDeadLetterQueue(config.Conf.DeadLetterDir, config.Conf.Name)
+		if err != nil {
+			logger.Errorf("can not init dead letters: %v", err)
+			fmt.Fprintf(os.Stderr, "can not init dead letters: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	runtime, err := NewRuntime(config.Conf.ActionPath, isSource, config.Conf.Replicas, receiver, forwarder, state,
+		forwarderConfig.Delivery, deadLetters, config.Conf.ActionOptions, logger)
 	if err != nil {
 		logger.Errorf("failed to create runtime: %v", err)
 		fmt.Fprintf(os.Stderr, "failed to create runtime: %v\n", err)
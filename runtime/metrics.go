@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+
+	"github.com/GDVFox/gostreaming/util/message"
+)
+
+// maxActionMetrics ограничение на количество пользовательских метрик одного действия.
+const maxActionMetrics = 1024
+
+// Возможные ошибки метрик.
+var (
+	ErrUnknownMetricType  = errors.New("unknown metric type")
+	ErrMetricTypeMismatch = errors.New("metric type mismatch")
+	ErrTooManyMetrics     = errors.New("too many metrics")
+	ErrBadMetricValue     = errors.New("bad metric value")
+)
+
+// metricSample значение метрики, полученное от действия.
+type metricSample struct {
+	Name  string  `json:"name"`
+	Type  string  `json:"type"`
+	Value float64 `json:"value"`
+}
+
+// actionMetrics агрегирует пользовательские метрики действия.
+type actionMetrics struct {
+	mutex   sync.Mutex
+	metrics map[string]*message.ActionMetric
+}
+
+func newActionMetrics() *actionMetrics {
+	return &actionMetrics{
+		metrics: make(map[string]*message.ActionMetric),
+	}
+}
+
+// Observe добавляет значение метрики в агрегат.
+func (m *actionMetrics) Observe(sample *metricSample) error {
+	if math.IsNaN(sample.Value) || math.IsInf(sample.Value, 0) {
+		return fmt.Errorf("%s: %w", sample.Name, ErrBadMetricValue)
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	metric, ok := m.metrics[sample.Name]
+	if !ok {
+		if len(m.metrics) >= maxActionMetrics {
+			return fmt.Errorf("%s: %w", sample.Name, ErrTooManyMetrics)
+		}
+		metric = &message.ActionMetric{Type: sample.Type}
+	}
+	if metric.Type != sample.Type {
+		return fmt.Errorf("%s: got %s, expected %s: %w", sample.Name, sample.Type, metric.Type, ErrMetricTypeMismatch)
+	}
+
+	switch sample.Type {
+	case message.MetricTypeCounter:
+		if sample.Value < 0 {
+			return fmt.Errorf("%s: counter can not decrease: %w", sample.Name, ErrBadMetricValue)
+		}
+		metric.Value += sample.Value
+	case message.MetricTypeGauge:
+		metric.Value = sample.Value
+	case message.MetricTypeHistogram:
+		if metric.Count == 0 || sample.Value < metric.Min {
+			metric.Min = sample.Value
+		}
+		if metric.Count == 0 || sample.Value > metric.Max {
+			metric.Max = sample.Value
+		}
+		metric.Count++
+		metric.Sum += sample.Value
+	default:
+		return fmt.Errorf("%s: %s: %w", sample.Name, sample.Type, ErrUnknownMetricType)
+	}
+
+	m.metrics[sample.Name] = metric
+	return nil
+}
+
+// Snapshot возвращает копию текущих значений метрик.
+func (m *actionMetrics) Snapshot() map[string]*message.ActionMetric {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	snapshot := make(map[string]*message.ActionMetric, len(m.metrics))
+	for name, metric := range m.metrics {
+		metricCopy := *metric
+		snapshot[name] = &metricCopy
+	}
+	return snapshot
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/GDVFox/gostreaming/util/message"
+)
+
+func TestActionMetricsObserve(t *testing.T) {
+	m := newActionMetrics()
+
+	samples := []*metricSample{
+		{Name: "processed", Type: message.MetricTypeCounter, Value: 1},
+		{Name: "processed", Type: message.MetricTypeCounter, Value: 2.5},
+		{Name: "queue", Type: message.MetricTypeGauge, Value: 10},
+		{Name: "queue", Type: message.MetricTypeGauge, Value: 3},
+		{Name: "latency", Type: message.MetricTypeHistogram, Value: 5},
+		{Name: "latency", Type: message.MetricTypeHistogram, Value: -1},
+		{Name: "latency", Type: message.MetricTypeHistogram, Value: 8},
+	}
+	for _, sample := range samples {
+		assert.NoError(t, m.Observe(sample))
+	}
+
+	assert.Equal(t, map[string]*message.ActionMetric{
+		"processed": {Type: message.MetricTypeCounter, Value: 3.5},
+		"queue":     {Type: message.MetricTypeGauge, Value: 3},
+		"latency":   {Type: message.MetricTypeHistogram, Count: 3, Sum: 12, Min: -1, Max: 8},
+	}, m.Snapshot())
+}
+
+func TestActionMetricsTypeMismatch(t *testing.T) {
+	m := newActionMetrics()
+
+	assert.NoError(t, m.Observe(&metricSample{Name: "x", Type: message.MetricTypeCounter, Value: 1}))
+	assert.ErrorIs(t, m.Observe(&metricSample{Name: "x", Type: message.MetricTypeGauge, Value: 5}), ErrMetricTypeMismatch)
+	assert.ErrorIs(t, m.Observe(&metricSample{Name: "x", Type: message.MetricTypeHistogram, Value: 5}), ErrMetricTypeMismatch)
+
+	// Значение с другим типом не меняет метрику.
+	assert.Equal(t, map[string]*message.ActionMetric{
+		"x": {Type: message.MetricTypeCounter, Value: 1},
+	}, m.Snapshot())
+}
+
+func TestActionMetricsBadSamples(t *testing.T) {
+	m := newActionMetrics()
+
+	assert.ErrorIs(t, m.Observe(&metricSample{Name: "c", Type: message.MetricTypeCounter, Value: -1}), ErrBadMetricValue)
+	assert.ErrorIs(t, m.Observe(&metricSample{Name: "g", Type: message.MetricTypeGauge, Value: math.NaN()}), ErrBadMetricValue)
+	assert.ErrorIs(t, m.Observe(&metricSample{Name: "h", Type: message.MetricTypeHistogram, Value: math.Inf(1)}), ErrBadMetricValue)
+	assert.ErrorIs(t, m.Observe(&metricSample{Name: "s", Type: "summary", Value: 1}), ErrUnknownMetricType)
+
+	// Отклоненное первое значение не создает метрику.
+	assert.Empty(t, m.Snapshot())
+}
+
+func TestActionMetricsLimit(t *testing.T) {
+	m := newActionMetrics()
+
+	for i := 0; i < maxActionMetrics; i++ {
+		assert.NoError(t, m.Observe(&metricSample{Name: strconv.Itoa(i), Type: message.MetricTypeGauge, Value: 1}))
+	}
+	assert.ErrorIs(t, m.Observe(&metricSample{Name: "new", Type: message.MetricTypeGauge, Value: 1}), ErrTooManyMetrics)
+	// Существующие метрики продолжают обновляться.
+	assert.NoError(t, m.Observe(&metricSample{Name: "0", Type: message.MetricTypeGauge, Value: 2}))
+	assert.Len(t, m.Snapshot(), maxActionMetrics)
+}
+
+func TestActionMetricsSnapshotCopy(t *testing.T) {
+	m := newActionMetrics()
+
+	assert.NoError(t, m.Observe(&metricSample{Name: "c", Type: message.MetricTypeCounter, Value: 1}))
+	snapshot := m.Snapshot()
+	assert.NoError(t, m.Observe(&metricSample{Name: "c", Type: message.MetricTypeCounter, Value: 1}))
+
+	assert.Equal(t, float64(1), snapshot["c"].Value)
+	assert.Equal(t, float64(2), m.Snapshot()["c"].Value)
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+
+	"golang.org/x/sync/errgroup"
+
+	"github.com/GDVFox/gostreaming/runtime/config"
+	upstreambackup "github.com/GDVFox/gostreaming/runtime/upstream_backup"
+	"github.com/GDVFox/gostreaming/util"
+)
+
+// actionProcess один из запущенных процессов действия. Входные сообщения распределяются
+// между процессами, а их выходные сообщения передаются в общий forwarder.
+type actionProcess struct {
+	index int
+	cmd   *exec.Cmd
+	// batching выставляется, когда процесс соглашается получать пакеты.
+	batching uint32
+
+	messagesQueue chan *upstreambackup.UpstreamMessage
+	inputs        *inputTracker
+	liveness      *liveness
+	probes        chan uint64
+	ticks         chan struct{}
+	// shutdownDone закрывается после ответа процесса на уведомление об остановке.
+	shutdownDone chan struct{}
+	// answering сообщение, на которое процесс отвечал при завершении,
+	// resend сообщения, которые передаются процессу первыми после перезапуска.
+	answering *upstreambackup.UpstreamMessage
+	resend    []*upstreambackup.UpstreamMessage
+
+	logger *util.Logger
+}
+
+func newActionProcess(index int, isSource bool, opt *config.ActionOptions, l *util.Logger) *actionProcess {
+	return &actionProcess{
+		index:         index,
+		messagesQueue: make(chan *upstreambackup.UpstreamMessage, maxInt(opt.BatchSize, 1)),
+		inputs:        newInputTracker(isSource),
+		liveness:      newLiveness(),
+		probes:        make(chan uint64, 1),
+		ticks:         make(chan struct{}, 1),
+		shutdownDone:  make(chan struct{}),
+		logger:        l,
+	}
+}
+
+// startProcess запускает процесс действия и обработчики его потоков в wg.
+// Обработчики, после завершения которых процесс не может работать, вызывают stop.
+func (r *Runtime) startProcess(ctx context.Context, wg *errgroup.Group, stop context.CancelFunc, p *actionProcess, uid, gid uint32) error {
+	p.cmd = exec.CommandContext(ctx, r.path, r.opt.Args...)
+	p.cmd.Env = os.Environ()
+	p.cmd.Env = append(p.cmd.Env, r.opt.EnvAsSlice()...)
+	p.cmd.Env = append(p.cmd.Env, protocolEnv+"="+strconv.Itoa(int(protocolVersion)))
+	if r.opt.Codec != "" {
+		p.cmd.Env = append(p.cmd.Env, codecEnv+"="+r.opt.Codec)
+	}
+	if r.creditsEnabled() {
+		p.cmd.Env = append(p.cmd.Env, creditsEnv+"=1")
+	}
+	if r.opt.BatchSize > 0 {
+		p.cmd.Env = append(p.cmd.Env, batchEnv+"="+strconv.Itoa(r.opt.BatchSize))
+	}
+	p.cmd.SysProcAttr = &syscall.SysProcAttr{}
+	p.cmd.SysProcAttr.Credential = &syscall.Credential{Uid: uid, Gid: gid}
+
+	inCmd, err := p.cmd.StdinPipe()
+	if err != nil {
+		return fmt.Errorf("can not get stdin pipe: %w", err)
+	}
+
+	outCmd, err := p.cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("can not get stdout pipe: %w", err)
+	}
+
+	errCmd, err := p.cmd.StderrPipe()
+	if err != nil {
+		return fmt.Errorf("can not get stderr pipe: %w", err)
+	}
+
+	var stateConn *os.File
+	if r.state != nil {
+		var stateActionConn *os.File
+		stateConn, stateActionConn, err = newStatePipe()
+		if err != nil {
+			return fmt.Errorf("can not create state pipe: %w", err)
+		}
+		// Конец канала действия закрываем после запуска, так как у действия будет своя копия.
+		defer stateActionConn.Close()
+
+		// Дескрипторы ExtraFiles нумеруются в действии начиная с 3.
+		p.cmd.ExtraFiles = []*os.File{stateActionConn}
+		p.cmd.Env = append(p.cmd.Env, stateFDEnv+"=3")
+	}
+
+	// Запускаем команду асинхронно, так как используем StdoutPipe, StderrPipe.
+	// Когда команда завершиться, то StdoutPipe, StderrPipe будут закрыты автоматически.
+	// https://golang.org/pkg/os/exec/#Cmd.StdoutPipe
+	if err := p.cmd.Start(); err != nil {
+		if stateConn != nil {
+			stateConn.Close()
+		}
+		return err
+	}
+	p.logger.Infof("action started with command: %s", p.cmd.String())
+
+	wg.Go(func() error {
+		defer stop()
+		return r.handleOut(ctx, p, outCmd)
+	})
+	wg.Go(func() error {
+		defer stop()
+		return r.handleErr(ctx, errCmd)
+	})
+	wg.Go(func() error {
+		defer stop()
+		return r.handleIn(ctx, p, inCmd)
+	})
+	wg.Go(func() error {
+		return r.handleLiveness(ctx, p)
+	})
+	wg.Go(func() error {
+		return r.handleTicks(ctx, p)
+	})
+	if stateConn != nil {
+		wg.Go(func() error {
+			return r.handleState(ctx, p, stateConn)
+		})
+	}
+	return nil
+}
+
+// handleDispatch передает входные сообщения процессам действия в порядке получения.
+// Сообщение забирает первый процесс, который готов его передать действию.
+func (r *Runtime) handleDispatch(ctx context.Context) error {
+	defer r.logger.Info("handle dispatch stopped")
+	defer close(r.dispatch)
+	defer close(r.dispatchDone)
+
+	for {
+		// Пока получение приостановлено, сообщения остаются у receiver, а повторная обработка продолжается.
+		messages := r.receiver.Messages()
+		resumed := r.pause.Resumed()
+		if resumed != nil {
+			messages = nil
+		}
+
+		var msg *upstreambackup.UpstreamMessage
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-resumed:
+			continue
+		case msg = <-r.replays:
+		case received, ok := <-messages:
+			if received == nil && !ok {
+				return nil
+			}
+			msg = received
+			atomic.AddUint64(&r.received, 1)
+
+			// Процессы могут ответить на сообщения не по порядку, поэтому forwarder
+			// должен знать, в каком порядке сообщения были переданы.
+			// Сообщение, на котором действие отказывало слишком часто, подтверждается
+			// без передачи действию, поэтому порядок нужен и при подсчете отказов.
+			if r.replicas > 1 || r.opt.MaxCrashes > 0 {
+				r.forwarder.Dispatched(msg.InputID, msg.Header.MessageID)
+			}
+			if dropped, err := r.dropCrashedTooOften(msg); err != nil {
+				return err
+			} else if dropped {
+				continue
+			}
+		}
+
+		atomic.AddInt64(&r.inFlight, 1)
+		select {
+		case <-ctx.Done():
+			return nil
+		case r.dispatch <- msg:
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os/exec"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+
+	upstreambackup "github.com/GDVFox/gostreaming/runtime/upstream_backup"
+)
+
+// Значения по умолчанию для перезапуска отказавшего действия.
+const (
+	defaultMaxRestarts       = 5
+	defaultRestartBackoff    = time.Second
+	defaultRestartMaxBackoff = time.Minute
+)
+
+// errActionStart возвращается, если процесс действия не удалось запустить.
+var errActionStart = errors.New("can not start action")
+
+// maxExitReasonLength ограничение на длину причины завершения действия в телеметрии.
+const maxExitReasonLength = 1024
+
+// crashStats число отказов процессов действия и причина последнего отказа.
+type crashStats struct {
+	crashes uint64
+
+	lastExitLock sync.Mutex
+	lastExit     string
+}
+
+// Add учитывает отказ процесса с причиной err.
+func (s *crashStats) Add(err error) {
+	atomic.AddUint64(&s.crashes, 1)
+
+	reason := err.Error()
+	if len(reason) > maxExitReasonLength {
+		reason = reason[:maxExitReasonLength]
+	}
+	s.lastExitLock.Lock()
+	s.lastExit = reason
+	s.lastExitLock.Unlock()
+}
+
+// Get возвращает число отказов и причину последнего отказа.
+func (s *crashStats) Get() (uint64, string) {
+	s.lastExitLock.Lock()
+	defer s.lastExitLock.Unlock()
+
+	return atomic.LoadUint64(&s.crashes), s.lastExit
+}
+
+// superviseProcess запускает процесс действия p и перезапускает его после отказа, не останавливая
+// runtime: соединения с вышестоящими и нижестоящими узлами сохраняются, а сообщения,
+// на которые процесс не ответил, передаются перезапущенному процессу.
+func (r *Runtime) superviseProcess(ctx context.Context, p *actionProcess, uid, gid uint32) error {
+	maxRestarts := r.opt.MaxRestarts
+	if maxRestarts == 0 {
+		maxRestarts = defaultMaxRestarts
+	}
+	backoff := time.Duration(r.opt.RestartBackoff)
+	if backoff <= 0 {
+		backoff = defaultRestartBackoff
+	}
+	maxBackoff := time.Duration(r.opt.RestartMaxBackoff)
+	if maxBackoff <= 0 {
+		maxBackoff = defaultRestartMaxBackoff
+	}
+
+	restarts := 0
+	delay := backoff
+	for attempt := 0; ; attempt++ {
+		startedAt := time.Now()
+		err := r.runProcess(ctx, p, uid, gid)
+		// Процесс остановлен вместе с runtime или завершился сам, например, источник закончил вывод.
+		if err == nil || ctx.Err() != nil {
+			return err
+		}
+		// Первый запуск не повторяется, так как ошибка скорее всего в параметрах запуска.
+		if attempt == 0 && errors.Is(err, errActionStart) {
+			return err
+		}
+
+		r.crashes.Add(err)
+		inputs := r.unansweredInputs(p)
+		if len(inputs) != 0 {
+			r.recordCrash(p, inputs[0])
+		}
+		p.logger.Errorf("action crashed with %d unanswered messages: %s", len(inputs), err)
+
+		if maxRestarts < 0 || r.shuttingDown() {
+			return err
+		}
+		// Процесс, который проработал дольше максимальной задержки, считается восстановившимся.
+		if time.Since(startedAt) > maxBackoff {
+			restarts = 0
+			delay = backoff
+		}
+		if restarts >= maxRestarts {
+			return fmt.Errorf("action crashed %d times in a row: %w", restarts+1, err)
+		}
+		restarts++
+
+		p.logger.Warnf("restarting action in %s, restart %d of %d", delay, restarts, maxRestarts)
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil
+		case <-timer.C:
+		}
+		delay *= 2
+		if delay > maxBackoff {
+			delay = maxBackoff
+		}
+
+		r.resetProcess(p, inputs)
+	}
+}
+
+// runProcess запускает процесс действия p и ожидает его завершения.
+// Возвращает nil, если процесс завершился успешно или был остановлен вместе с runtime.
+func (r *Runtime) runProcess(ctx context.Context, p *actionProcess, uid, gid uint32) error {
+	cancelableCtx, processCancel := context.WithCancel(ctx)
+	defer processCancel()
+
+	wg, processCtx := errgroup.WithContext(cancelableCtx)
+	if err := r.startProcess(processCtx, wg, processCancel, p, uid, gid); err != nil {
+		processCancel()
+		wg.Wait()
+		r.waitProcess(ctx, p)
+		return fmt.Errorf("%w: %s", errActionStart, err)
+	}
+
+	ioErr := wg.Wait()
+	exitErr := r.waitProcess(ctx, p)
+	if ioErr != nil && !errors.Is(ioErr, net.ErrClosed) && !errors.Is(ioErr, io.EOF) {
+		return fmt.Errorf("action io got error: %w", ioErr)
+	}
+	return exitErr
+}
+
+// waitProcess ожидает завершения процесса действия p. Завершение сигналом
+// считается ошибкой, только если runtime не останавливается.
+func (r *Runtime) waitProcess(ctx context.Context, p *actionProcess) error {
+	if p.cmd == nil || p.cmd.Process == nil {
+		return nil
+	}
+
+	err := p.cmd.Wait()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == -1 && ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+// unansweredInputs возвращает входные сообщения, на которые отказавший процесс p не ответил,
+// в порядке передачи. События не возвращаются, так как их не нужно передавать повторно.
+func (r *Runtime) unansweredInputs(p *actionProcess) []*upstreambackup.UpstreamMessage {
+	if r.isSource {
+		return nil
+	}
+
+	inputs := make([]*upstreambackup.UpstreamMessage, 0, cap(p.messagesQueue)+1)
+	if p.answering != nil && !isEventInput(p.answering) {
+		inputs = append(inputs, p.answering)
+	}
+	for {
+		select {
+		case msg := <-p.messagesQueue:
+			if !isEventInput(msg) {
+				inputs = append(inputs, msg)
+			}
+		default:
+			return inputs
+		}
+	}
+}
+
+// resetProcess подготавливает процесс p к перезапуску: новый процесс заново подтверждает
+// готовность и нумерует входные сообщения, а inputs будут переданы ему первыми,
+// перед сообщениями, которые отказавший процесс получил, но не успел передать действию.
+func (r *Runtime) resetProcess(p *actionProcess, inputs []*upstreambackup.UpstreamMessage) {
+	atomic.StoreUint32(&p.batching, 0)
+	p.liveness.Reset()
+	p.inputs.Reset()
+	p.answering = nil
+	p.resend = append(inputs, p.resend...)
+	select {
+	case <-p.probes:
+	default:
+	}
+	select {
+	case <-p.ticks:
+	default:
+	}
+
+	// Изменения состояния, сделанные при обработке сообщений, будут сделаны повторно.
+	if r.state != nil && len(inputs) != 0 {
+		stateInputs := make([]upstreambackup.StateInput, 0, len(inputs))
+		for _, msg := range inputs {
+			stateInputs = append(stateInputs, upstreambackup.StateInput{InputID: msg.InputID, MessageID: msg.Header.MessageID})
+		}
+		r.state.Rollback(stateInputs)
+	}
+}
+
+// shuttingDown возвращает true, если действию уже передано уведомление об остановке.
+func (r *Runtime) shuttingDown() bool {
+	select {
+	case <-r.shutdown:
+		return true
+	default:
+		return false
+	}
+}
+
+// GetCrashes возвращает число отказов действия и причину последнего отказа.
+func (r *Runtime) GetCrashes() (uint64, string) {
+	return r.crashes.Get()
+}
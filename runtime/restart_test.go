@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	actionlib "github.com/GDVFox/gostreaming/lib/go-actionlib"
+	"github.com/GDVFox/gostreaming/runtime/config"
+	upstreambackup "github.com/GDVFox/gostreaming/runtime/upstream_backup"
+	"github.com/GDVFox/gostreaming/util"
+)
+
+// Переменные окружения фиктивного действия, которое запускается из тестового бинарного файла.
+const (
+	// testActionEnv режим фиктивного действия: testActionCrash или testActionRecord.
+	testActionEnv = "GOSTREAMING_TEST_ACTION"
+	// testActionDirEnv каталог, в котором фиктивное действие записывает полученные сообщения.
+	testActionDirEnv = "GOSTREAMING_TEST_ACTION_DIR"
+)
+
+// Режимы фиктивного действия.
+const (
+	// testActionCrash завершается с ошибкой сразу после запуска. Действие запускается
+	// не из тестового бинарного файла, а из скрипта, так как тесты задержек перезапуска
+	// требуют, чтобы процесс завершался быстрее минимальной задержки.
+	testActionCrash = "crash"
+	// testActionRecord записывает входные сообщения в файл и возвращает их как выходы.
+	// На сообщении "crash" действие отказывает, но только при первом получении.
+	testActionRecord = "record"
+)
+
+func TestMain(m *testing.M) {
+	if mode := os.Getenv(testActionEnv); mode != "" {
+		os.Exit(runTestAction(mode))
+	}
+	os.Exit(m.Run())
+}
+
+// runTestAction выполняет фиктивное действие и возвращает код завершения.
+func runTestAction(mode string) int {
+	dir := os.Getenv(testActionDirEnv)
+	record, err := os.OpenFile(filepath.Join(dir, "inputs"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return 2
+	}
+	defer record.Close()
+
+	handler := actionlib.HandlerFunc(func(ctx context.Context, message []byte) ([][]byte, error) {
+		if _, err := record.WriteString(string(message) + "\n"); err != nil {
+			return nil, err
+		}
+		if string(message) == "crash" {
+			marker, err := os.OpenFile(filepath.Join(dir, "crashed"), os.O_CREATE|os.O_EXCL, 0644)
+			if err == nil {
+				marker.Close()
+				os.Exit(1)
+			}
+		}
+		return [][]byte{message}, nil
+	})
+	if err := actionlib.Run(context.Background(), handler, actionlib.WithErrorPolicy(actionlib.FatalPolicy())); err != nil {
+		return 3
+	}
+	return 0
+}
+
+// newTestActionRuntime создает Runtime, действие которого — фиктивное действие в режиме mode.
+func newTestActionRuntime(t *testing.T, mode string, opt *config.ActionOptions) (*Runtime, *actionProcess, string) {
+	t.Helper()
+
+	// Процессы действия запускаются от имени отдельного пользователя.
+	if os.Geteuid() != 0 {
+		t.Skip("action processes can be started only by root")
+	}
+	path, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	opt.Env = map[string]string{testActionEnv: mode, testActionDirEnv: dir}
+	if mode == testActionCrash {
+		path = filepath.Join(dir, "action.sh")
+		if err := os.WriteFile(path, []byte("#!/bin/sh\nexit 1\n"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r, _ := newTestRuntime(t)
+	r.path = path
+	r.opt = opt
+	r.dispatch = make(chan *upstreambackup.UpstreamMessage)
+	startTestForwarder(t, r)
+
+	p := newActionProcess(0, false, opt, r.logger)
+	r.processes = []*actionProcess{p}
+	return r, p, dir
+}
+
+// superviseTestProcess запускает superviseProcess для процесса p и возвращает канал с его результатом.
+func superviseTestProcess(ctx context.Context, r *Runtime, p *actionProcess) <-chan error {
+	done := make(chan error, 1)
+	go func() {
+		done <- r.superviseProcess(ctx, p, uint32(os.Getuid()), uint32(os.Getgid()))
+	}()
+	return done
+}
+
+// readTestInputs возвращает сообщения, которые получило фиктивное действие.
+func readTestInputs(t *testing.T, dir string) []string {
+	t.Helper()
+
+	f, err := os.Open(filepath.Join(dir, "inputs"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	inputs := make([]string, 0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		inputs = append(inputs, scanner.Text())
+	}
+	return inputs
+}
+
+func TestSuperviseProcessBackoff(t *testing.T) {
+	r, p, _ := newTestActionRuntime(t, testActionCrash, &config.ActionOptions{
+		MaxRestarts:       5,
+		RestartBackoff:    util.Duration(10 * time.Millisecond),
+		RestartMaxBackoff: util.Duration(40 * time.Millisecond),
+	})
+	l, logs := newTestLogger(t)
+	p.logger = l
+
+	err := <-superviseTestProcess(context.Background(), r, p)
+	assert.EqualError(t, err, "action crashed 6 times in a row: exit status 1")
+
+	// Задержка удваивается до максимальной, а число перезапусков ограничено.
+	restarts := make([]string, 0)
+	for _, e := range logs.FilterMessageSnippet("restarting action").All() {
+		restarts = append(restarts, e.Message)
+	}
+	assert.Equal(t, []string{
+		"restarting action in 10ms, restart 1 of 5",
+		"restarting action in 20ms, restart 2 of 5",
+		"restarting action in 40ms, restart 3 of 5",
+		"restarting action in 40ms, restart 4 of 5",
+		"restarting action in 40ms, restart 5 of 5",
+	}, restarts)
+
+	crashes, lastExit := r.GetCrashes()
+	assert.EqualValues(t, 6, crashes)
+	assert.Equal(t, "exit status 1", lastExit)
+}
+
+func TestSuperviseProcessNoRestarts(t *testing.T) {
+	r, p, _ := newTestActionRuntime(t, testActionCrash, &config.ActionOptions{MaxRestarts: -1})
+
+	err := <-superviseTestProcess(context.Background(), r, p)
+	assert.EqualError(t, err, "exit status 1")
+	crashes, _ := r.GetCrashes()
+	assert.EqualValues(t, 1, crashes)
+}
+
+func TestSuperviseProcessStartFailure(t *testing.T) {
+	r, p, dir := newTestActionRuntime(t, testActionCrash, &config.ActionOptions{})
+	r.path = filepath.Join(dir, "missing")
+
+	// Действие, которое не удалось запустить, не перезапускается и не считается отказавшим.
+	err := <-superviseTestProcess(context.Background(), r, p)
+	assert.True(t, errors.Is(err, errActionStart), err)
+	crashes, _ := r.GetCrashes()
+	assert.Zero(t, crashes)
+}
+
+func TestSuperviseProcessResend(t *testing.T) {
+	r, p, dir := newTestActionRuntime(t, testActionRecord, &config.ActionOptions{
+		BatchSize:      4,
+		RestartBackoff: util.Duration(10 * time.Millisecond),
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := superviseTestProcess(ctx, r, p)
+
+	inputs := []string{"first", "crash", "second", "third"}
+	for i, data := range inputs {
+		atomic.AddInt64(&r.inFlight, 1)
+		r.dispatch <- newTestInput("a", 0, uint64(i+1), data)
+	}
+
+	// Сообщения, на которые действие не ответило до отказа, передаются перезапущенному действию
+	// в исходном порядке, а подтверждаются только после ответа на них.
+	acked := uint64(0)
+	deadline := time.After(10 * time.Second)
+	for acked != uint64(len(inputs)) {
+		select {
+		case ack := <-r.forwarder.AckMessages():
+			acked = ack[0]
+		case <-deadline:
+			t.Fatalf("messages are not acknowledged, last ack: %d", acked)
+		}
+	}
+	assert.Equal(t, []string{"first", "crash", "crash", "second", "third"}, readTestInputs(t, dir))
+	assert.Zero(t, atomic.LoadInt64(&r.inFlight))
+	crashes, _ := r.GetCrashes()
+	assert.EqualValues(t, 1, crashes)
+
+	cancel()
+	assert.NoError(t, <-done)
+}
+
+func TestUnansweredInputs(t *testing.T) {
+	r, _ := newTestRuntime(t)
+	p := newActionProcess(0, false, &config.ActionOptions{BatchSize: 4}, r.logger)
+
+	first, second, third := newTestInput("a", 0, 1, "1"), newTestInput("a", 0, 2, "2"), newTestInput("b", 1, 1, "3")
+	p.answering = first
+	p.messagesQueue <- second
+	p.messagesQueue <- tickInput
+	p.messagesQueue <- third
+
+	// События не передаются повторно, а сообщения возвращаются в порядке передачи действию.
+	inputs := r.unansweredInputs(p)
+	assert.Equal(t, []*upstreambackup.UpstreamMessage{first, second, third}, inputs)
+	assert.Empty(t, p.messagesQueue)
+
+	// Сообщения, которые процесс получил, но не успел передать действию, передаются после них.
+	notSent := newTestInput("a", 0, 3, "4")
+	p.resend = []*upstreambackup.UpstreamMessage{notSent}
+	p.probes <- 1
+	r.resetProcess(p, inputs)
+	assert.Equal(t, []*upstreambackup.UpstreamMessage{first, second, third, notSent}, p.resend)
+	assert.Nil(t, p.answering)
+	assert.Empty(t, p.probes)
+
+	r.isSource = true
+	assert.Empty(t, r.unansweredInputs(p))
+}
+
+func TestCrashStatsLongReason(t *testing.T) {
+	stats := &crashStats{}
+	stats.Add(errors.New(strings.Repeat("x", 2*maxExitReasonLength)))
+
+	crashes, lastExit := stats.Get()
+	assert.EqualValues(t, 1, crashes)
+	assert.Len(t, lastExit, maxExitReasonLength)
+}
@@ -7,12 +7,11 @@ import (
 	"fmt"
 	"io"
 	"net"
-	"os"
 	"os/exec"
 	"os/user"
 	"strconv"
 	"sync/atomic"
-	"syscall"
+	"time"
 
 	"golang.org/x/sync/errgroup"
 
@@ -20,43 +19,110 @@ import (
 	"github.com/GDVFox/gostreaming/runtime/config"
 	upstreambackup "github.com/GDVFox/gostreaming/runtime/upstream_backup"
 	"github.com/GDVFox/gostreaming/util"
+	"github.com/GDVFox/gostreaming/util/message"
 	"github.com/coreos/go-iptables/iptables"
 )
 
+// moreMessagesFlag выставляется действием в длине выходного сообщения,
+// если за ним последуют другие выходные сообщения для того же входного.
+const moreMessagesFlag uint32 = 1 << 31
+
+// metadataFlag выставляется в длине сообщения, если перед данными передается блок метаданных.
+const metadataFlag uint32 = 1 << 30
+
+// messageLengthMask выделяет длину сообщения без флагов.
+const messageLengthMask = metadataFlag - 1
+
+// codecEnv переменная окружения, через которую действию передается имя кодека сообщений.
+const codecEnv = "GOSTREAMING_CODEC"
+
 // Runtime обертка над действием.
 type Runtime struct {
+	// Счетчики изменяются атомарно, поэтому расположены в начале структуры.
+	// received число полученных входных сообщений, inFlight число сообщений, на которые действие не ответило.
+	received uint64
+	inFlight int64
+	crashes  crashStats
+
 	path      string
 	isRunning uint32
 	isSource  bool
+	replicas  int
 
 	receiver  *upstreambackup.DefaultReceiver
 	forwarder *upstreambackup.DefaultForwarder
-	opt       *config.ActionOptions
-
-	messagesQueue chan *upstreambackup.UpstreamMessage
-	logger        *util.Logger
+	state     *upstreambackup.StateStore
+	// delivery границы доставки режима exactly-once, nil если режим не используется.
+	delivery *upstreambackup.DeliveryStore
+	// deadLetters очередь недоставленных сообщений, nil для источника.
+	deadLetters *deadLetterQueue
+	opt         *config.ActionOptions
+
+	processes []*actionProcess
+	// dispatch входные сообщения в порядке получения, их забирают процессы действия.
+	dispatch chan *upstreambackup.UpstreamMessage
+	// replays сообщения из очереди недоставленных сообщений для повторной обработки,
+	// dispatchDone закрывается после остановки распределения входных сообщений.
+	replays      chan *upstreambackup.UpstreamMessage
+	dispatchDone chan struct{}
+	metrics      *actionMetrics
+	logger       *util.Logger
+	actionLogger *util.Logger
+
+	// shutdown закрывается для передачи уведомления об остановке.
+	shutdown chan struct{}
+	// pause приостанавливает получение входных сообщений, drain закрывается при запросе drain.
+	pause pauseGate
+	drain chan struct{}
 
 	uniqName string
 	ipt      *iptables.IPTables
 }
 
-// NewRuntime создает новый объект Runtime.
-func NewRuntime(path string, isSource bool, in *upstreambackup.DefaultReceiver, out *upstreambackup.DefaultForwarder, opt *config.ActionOptions, l *util.Logger) (*Runtime, error) {
+// NewRuntime создает новый объект Runtime, который запускает replicas процессов действия.
+// state может быть nil, если состояние для действия не используется, delivery nil вне режима exactly-once,
+// deadLetters nil для источника.
+func NewRuntime(path string, isSource bool, replicas int, in *upstreambackup.DefaultReceiver, out *upstreambackup.DefaultForwarder,
+	state *upstreambackup.StateStore, delivery *upstreambackup.DeliveryStore, deadLetters *deadLetterQueue,
+	opt *config.ActionOptions, l *util.Logger) (*Runtime, error) {
 	ipt, err := iptables.New()
 	if err != nil {
 		return nil, err
 	}
+
+	replicas = maxInt(replicas, 1)
+	logger := l.WithName("runtime")
+	processes := make([]*actionProcess, 0, replicas)
+	for i := 0; i < replicas; i++ {
+		processLogger := logger
+		if replicas > 1 {
+			processLogger = logger.WithName("process " + strconv.Itoa(i))
+		}
+		processes = append(processes, newActionProcess(i, isSource, opt, processLogger))
+	}
+
 	return &Runtime{
-		path:          path,
-		isSource:      isSource,
-		isRunning:     0,
-		receiver:      in,
-		forwarder:     out,
-		opt:           opt,
-		messagesQueue: make(chan *upstreambackup.UpstreamMessage, 1),
-		logger:        l.WithName("runtime"),
-		uniqName:      util.RandString(20),
-		ipt:           ipt,
+		path:         path,
+		isSource:     isSource,
+		isRunning:    0,
+		replicas:     replicas,
+		receiver:     in,
+		forwarder:    out,
+		state:        state,
+		delivery:     delivery,
+		deadLetters:  deadLetters,
+		opt:          opt,
+		processes:    processes,
+		dispatch:     make(chan *upstreambackup.UpstreamMessage),
+		replays:      make(chan *upstreambackup.UpstreamMessage, maxReplays),
+		dispatchDone: make(chan struct{}),
+		shutdown:     make(chan struct{}),
+		drain:        make(chan struct{}),
+		metrics:      newActionMetrics(),
+		logger:       logger,
+		actionLogger: l.WithName("action"),
+		uniqName:     util.RandString(20),
+		ipt:          ipt,
 	}, nil
 }
 
@@ -64,7 +130,9 @@ func NewRuntime(path string, isSource bool, in *upstreambackup.DefaultReceiver,
 func (r *Runtime) Run(ctx context.Context) error {
 	defer r.logger.Info("runtime stopped")
 
-	cancelableCtx, runtimeCancel := context.WithCancel(ctx)
+	// Действие, которое читает события, останавливается не сразу после отмены ctx,
+	// а после ответа на уведомление об остановке, поэтому отмена ctx не наследуется.
+	cancelableCtx, runtimeCancel := context.WithCancel(context.Background())
 	defer runtimeCancel()
 
 	if err := r.createUser(); err != nil {
@@ -93,80 +161,49 @@ func (r *Runtime) Run(ctx context.Context) error {
 		return fmt.Errorf("can not parse gid: %w", err)
 	}
 
-	wg, runCtx := errgroup.WithContext(cancelableCtx)
-	runActionCommand := exec.CommandContext(runCtx, r.path, r.opt.Args...)
-	runActionCommand.Env = os.Environ()
-	runActionCommand.Env = append(runActionCommand.Env, r.opt.EnvAsSlice()...)
-	runActionCommand.SysProcAttr = &syscall.SysProcAttr{}
-	runActionCommand.SysProcAttr.Credential = &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}
-
-	inCmd, err := runActionCommand.StdinPipe()
-	if err != nil {
-		return fmt.Errorf("can not get stdin pipe: %w", err)
-	}
-
-	outCmd, err := runActionCommand.StdoutPipe()
-	if err != nil {
-		return fmt.Errorf("can not get stdout pipe: %w", err)
-	}
-
-	errCmd, err := runActionCommand.StderrPipe()
-	if err != nil {
-		return fmt.Errorf("can not get stderr pipe: %w", err)
-	}
-
 	// Выставляем флаг запуска, так как следующие операции будут асинхронно все запускать.
 	atomic.StoreUint32(&r.isRunning, 1)
 	defer atomic.StoreUint32(&r.isRunning, 0)
 
-	// Запускаем команду асинхронно, так как используем StdoutPipe, StderrPipe.
-	// Когда команда завершиться, то StdoutPipe, StderrPipe будут закрыты автоматически.
-	// https://golang.org/pkg/os/exec/#Cmd.StdoutPipe
-	if err := runActionCommand.Start(); err != nil {
-		return fmt.Errorf("can not start action: %w", err)
+	// Отказавший процесс перезапускается отдельно от остальных, а runtime
+	// останавливается, только если процесс нельзя перезапустить.
+	// При drain процессы останавливаются раньше runtime, который ожидает доставки их выходов.
+	wg, runCtx := errgroup.WithContext(cancelableCtx)
+	processesCtx, stopProcesses := context.WithCancel(runCtx)
+	defer stopProcesses()
+	for _, p := range r.processes {
+		p := p
+		wg.Go(func() error {
+			err := r.superviseProcess(processesCtx, p, uint32(uid), uint32(gid))
+			if err != nil || processesCtx.Err() == nil {
+				runtimeCancel()
+			}
+			return err
+		})
 	}
-	r.logger.Infof("action started with command: %s", runActionCommand.String())
-
 	wg.Go(func() error {
 		defer runtimeCancel()
-		return r.handleOut(runCtx, outCmd)
+		return r.handleDispatch(runCtx)
 	})
 	wg.Go(func() error {
 		defer runtimeCancel()
-		return r.handleErr(runCtx, errCmd)
-	})
-	wg.Go(func() error {
-		defer runtimeCancel()
-		return r.handleIn(runCtx, inCmd)
+		return r.handleAcks(runCtx)
 	})
 	wg.Go(func() error {
 		defer runtimeCancel()
-		return r.handleAcks(runCtx)
+		return r.forwarder.Run(runCtx)
 	})
 	wg.Go(func() error {
 		defer runtimeCancel()
-		return r.forwarder.Run(runCtx)
+		return r.handleShutdown(ctx, runCtx, stopProcesses)
 	})
 	wg.Go(func() error {
 		defer runtimeCancel()
 		return r.receiver.Run(runCtx)
 	})
 	if err := wg.Wait(); err != nil && !errors.Is(err, net.ErrClosed) && !errors.Is(err, io.EOF) {
-		return fmt.Errorf("action io got error: %w", err)
-	}
-
-	r.logger.Info("io done, waiting command end")
-	if err := runActionCommand.Wait(); err != nil {
-		exitErr, ok := err.(*exec.ExitError)
-		if !ok {
-			return err
-		}
-		if exitErr.Success() || exitErr.ExitCode() == -1 {
-			return nil
-		}
-		return exitErr
+		return err
 	}
-
 	return nil
 }
 
@@ -175,16 +212,43 @@ func (r *Runtime) IsRunning() bool {
 	return atomic.LoadUint32(&r.isRunning) == 1
 }
 
+// GetActionStatus возвращает состояние действия и версию протокола, о которой оно сообщило.
+// Если процессов несколько, то возвращается худшее из их состояний.
+func (r *Runtime) GetActionStatus() (uint8, uint16) {
+	var status uint8
+	var version uint16
+	for _, p := range r.processes {
+		processStatus, processVersion := p.liveness.Status(r.opt.ReadyTimeout > 0)
+		if processStatus > status {
+			status = processStatus
+		}
+		if version == 0 || (processVersion != 0 && processVersion < version) {
+			version = processVersion
+		}
+	}
+	return status, version
+}
+
+// GetMetrics возвращает пользовательские метрики действия.
+func (r *Runtime) GetMetrics() map[string]*message.ActionMetric {
+	return r.metrics.Snapshot()
+}
+
 // ChangeOut заменяет отправку в oldOut на отправку в newOut.
 func (r *Runtime) ChangeOut(oldOut, newOut string) error {
 	return r.forwarder.ChangeOut(oldOut, newOut)
 }
 
 // GetOldestOutput возвращает самый старый output_message_id, который хранится в логе.
-func (r *Runtime) GetOldestOutput() (uint32, error) {
+func (r *Runtime) GetOldestOutput() (uint64, error) {
 	return r.forwarder.GetOldestOutput()
 }
 
+// GetForwardLogStats возвращает размер forward log и число срабатываний политики переполнения.
+func (r *Runtime) GetForwardLogStats() upstreambackup.ForwardLogStats {
+	return r.forwarder.ForwardLogStats()
+}
+
 func (r *Runtime) createUser() error {
 	cmd := exec.Command("adduser", "--no-create-home", "--disabled-password", r.uniqName)
 	_, err := cmd.CombinedOutput()
@@ -243,90 +307,242 @@ func (r *Runtime) removeFirewall() error {
 
 // inCmd закроет handleIn, так как он писатель и может это делать по
 // https://golang.org/pkg/os/exec/#Cmd.StdinPipe
-func (r *Runtime) handleIn(ctx context.Context, cmdIn io.WriteCloser) error {
-	defer r.logger.Info("handle STDIN stopped")
+func (r *Runtime) handleIn(ctx context.Context, p *actionProcess, cmdIn io.WriteCloser) error {
+	defer p.logger.Info("handle STDIN stopped")
 
 	cmdWriter := ctxio.NewContextWriter(ctx, cmdIn)
 	defer cmdWriter.Close()
-	defer close(r.messagesQueue)
 
+	// Источник не читает входные сообщения, поэтому STDIN используется для кредитов.
+	if r.creditsEnabled() {
+		return r.handleCredits(ctx, p, cmdWriter)
+	}
+
+	// Сообщения, на которые процесс не ответил до отказа, передаются перезапущенному процессу первыми.
+	resend := p.resend
+	p.resend = nil
+	for i, msg := range resend {
+		dropped, err := r.dropCrashedTooOften(msg)
+		if err != nil {
+			return err
+		}
+		if dropped {
+			atomic.AddInt64(&r.inFlight, -1)
+			continue
+		}
+		p.logger.Debugf("resend input data from input %d with number %d", msg.InputID, msg.Header.MessageID)
+		if err := r.sendInputs(ctx, p, cmdWriter, resend[i:i+1]); err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			p.resend = append(p.resend, resend[i+1:]...)
+			return nil
+		}
+	}
+
+	shutdown := r.shutdown
 	for {
 		select {
 		case <-ctx.Done():
 			return nil
-		case msg, ok := <-r.receiver.Messages():
-			if msg == nil && !ok {
-				return nil
+		case probe := <-p.probes:
+			if err := writeProbe(cmdWriter, probe); err != nil {
+				return err
 			}
-
-			r.logger.Debugf("got input data from input %d with number %d", msg.InputID, msg.Header.MessageID)
-
-			select {
-			case <-ctx.Done():
+		case <-p.ticks:
+			if err := r.sendEvent(ctx, p, cmdWriter, tickInput, controlTick); err != nil {
+				return err
+			}
+		case <-shutdown:
+			// Процессы, которые не читают события, получают сообщения до остановки.
+			if !r.eventsEnabled(p) {
+				shutdown = nil
+				continue
+			}
+			if err := r.sendEvent(ctx, p, cmdWriter, shutdownInput, controlShutdown); err != nil {
+				return err
+			}
+			// После уведомления об остановке входные сообщения не передаются,
+			// но STDIN не закрывается до остановки действия.
+			<-ctx.Done()
+			return nil
+		case msg, ok := <-r.dispatch:
+			if msg == nil && !ok {
 				return nil
-			case r.messagesQueue <- msg:
 			}
 
-			if err := binary.Write(cmdWriter, binary.BigEndian, msg.Header.MessageLength); err != nil {
-				return fmt.Errorf("can not write message length: %w", err)
+			msgs := r.nextInputs(p, msg)
+			for _, msg := range msgs {
+				p.logger.Debugf("got input data from input %d with number %d", msg.InputID, msg.Header.MessageID)
 			}
-
-			if err := binary.Write(cmdWriter, binary.BigEndian, msg.Data); err != nil {
-				return fmt.Errorf("can not write message data: %w", err)
+			if err := r.sendInputs(ctx, p, cmdWriter, msgs); err != nil {
+				return err
 			}
 		}
 	}
 }
 
-func (r *Runtime) handleErr(ctx context.Context, cmdErr io.Reader) error {
-	defer r.logger.Info("handle STDERR stopped")
-
-	errData := make([]byte, 4096)
-	for {
-		n, err := cmdErr.Read(errData)
-		if err != nil {
-			return fmt.Errorf("can not read stderr data: %w", err)
+// sendInputs передает действию входные сообщения msgs, отмечая их в очереди входных сообщений.
+// Если ctx отменен до передачи, то сообщения сохраняются для передачи перезапущенному процессу.
+func (r *Runtime) sendInputs(ctx context.Context, p *actionProcess, w io.Writer, msgs []*upstreambackup.UpstreamMessage) error {
+	for i, msg := range msgs {
+		select {
+		case <-ctx.Done():
+			p.resend = append(p.resend, msgs[i:]...)
+			return nil
+		case p.messagesQueue <- msg:
+		}
+		if r.state != nil {
+			p.inputs.Sent(msg)
 		}
-		r.logger.Errorf("STDERR: %s", string(errData[:n]))
 	}
+	return r.writeInputs(w, msgs)
 }
 
-func (r *Runtime) handleOut(ctx context.Context, cmdOut io.Reader) error {
-	defer r.logger.Info("handle STDOUT stopped")
+// sendEvent передает действию событие, отмечая его в очереди входных сообщений.
+func (r *Runtime) sendEvent(ctx context.Context, p *actionProcess, w io.Writer, input *upstreambackup.UpstreamMessage, controlType uint8) error {
+	select {
+	case <-ctx.Done():
+		return nil
+	case p.messagesQueue <- input:
+	}
+	return writeEvent(w, controlType, time.Now())
+}
 
+func (r *Runtime) handleOut(ctx context.Context, p *actionProcess, cmdOut io.Reader) error {
+	defer p.logger.Info("handle STDOUT stopped")
+
+	frames := newOutputReader(cmdOut, func(controlType uint8, payload []byte) error {
+		return r.handleControl(p, controlType, payload)
+	})
+	// Сообщение, из которого будет получен ожидаемый выход, nil до первого выхода для него.
+	// Если процесс отказал, то сообщение будет передано перезапущенному процессу.
+	var inputMsg *upstreambackup.UpstreamMessage
+	defer func() { p.answering = inputMsg }()
 	for {
-		// Сообщение, из которого будет получено ожидаемый выход.
-		inputMsg := upstreambackup.DummyUpstreamMessage
-		if !r.isSource {
-			var ok bool
-			select {
-			case <-ctx.Done():
-				return nil
-			case inputMsg, ok = <-r.messagesQueue:
-				if inputMsg == nil && !ok {
+		// В этом месте ждем, что при отключении писатель, т.е. действие,
+		// закроет io.Reader и разблокирует нас. Управляющие кадры читаются
+		// и до получения входных сообщений.
+		messsageLength, frame, err := frames.Next()
+		if err != nil {
+			return err
+		}
+
+		// Входное сообщение передается в очередь до записи в STDIN действия,
+		// поэтому к первому выходу для него оно уже в очереди.
+		if inputMsg == nil {
+			inputMsg = upstreambackup.DummyUpstreamMessage
+			if !r.isSource {
+				select {
+				case <-ctx.Done():
 					return nil
+				case inputMsg = <-p.messagesQueue:
 				}
 			}
 		}
-		// В этом месте ждем, что при отключении писатель, т.е. действие,
-		// закроет io.Reader и разблокирует нас.
-		messsageLength := uint32(0)
-		if err := binary.Read(cmdOut, binary.BigEndian, &messsageLength); err != nil {
-			return fmt.Errorf("can not read message length: %w", err)
+
+		if messsageLength == controlHeader {
+			reason, err := io.ReadAll(frame)
+			if err != nil {
+				return fmt.Errorf("can not read reject reason: %w", err)
+			}
+			if err := r.deadLetter(inputMsg, string(reason), 0); err != nil {
+				return fmt.Errorf("can not move message to dead letters: %w", err)
+			}
+			r.answered(p, inputMsg)
+			inputMsg = nil
+			continue
+		}
+
+		// Действие может ответить на одно входное сообщение несколькими выходными,
+		// поэтому ожидаем следующее входное сообщение только после последнего выхода.
+		isLast := messsageLength&moreMessagesFlag == 0
+		hasMetadata := messsageLength&metadataFlag != 0
+		messsageLength &= messageLengthMask
+		p.logger.Debugf("got output data from action with length %d (last: %t)", messsageLength, isLast)
+
+		// Если действие не передало метаданные, то выход наследует метаданные входного сообщения.
+		metadata := inputMsg.Metadata
+		if hasMetadata {
+			var metadataLength uint32
+			if err := binary.Read(frame, binary.BigEndian, &metadataLength); err != nil {
+				return fmt.Errorf("can not read message metadata length: %w", err)
+			}
+			if metadataLength > upstreambackup.MaxMetadataLength {
+				return fmt.Errorf("got metadata with length %d: %w", metadataLength, upstreambackup.ErrMetadataTooLong)
+			}
+			metadata = make([]byte, metadataLength)
+			if err := binary.Read(frame, binary.BigEndian, metadata); err != nil {
+				return fmt.Errorf("can not read message metadata: %w", err)
+			}
 		}
-		r.logger.Debugf("got output data from action with length %d", messsageLength)
 
 		data := make([]byte, messsageLength)
-		if err := binary.Read(cmdOut, binary.BigEndian, data); err != nil {
+		if err := binary.Read(frame, binary.BigEndian, data); err != nil {
 			return fmt.Errorf("can not read message data: %w", err)
 		}
 
-		if err := r.forwarder.Forward(inputMsg.InputID, inputMsg.Header.MessageID, data); err != nil {
+		if isEventInput(inputMsg) || inputMsg.Detached {
+			if err := r.forwarder.ForwardDetached(metadata, data); err != nil {
+				return fmt.Errorf("can not forward event output: %w", err)
+			}
+		} else if err := r.forwarder.Forward(inputMsg.InputID, inputMsg.Header.MessageID, metadata, data, isLast); err != nil {
 			return fmt.Errorf("can not forward message: %w", err)
 		}
+		if !isLast {
+			continue
+		}
+		r.answered(p, inputMsg)
+		inputMsg = nil
+	}
+}
+
+// answered отмечает, что процесс p ответил на входное сообщение inputMsg.
+func (r *Runtime) answered(p *actionProcess, inputMsg *upstreambackup.UpstreamMessage) {
+	switch {
+	case inputMsg == shutdownInput:
+		close(p.shutdownDone)
+		return
+	case isEventInput(inputMsg) || r.isSource:
+		return
+	}
+	atomic.AddInt64(&r.inFlight, -1)
+	if r.state != nil {
+		p.inputs.Answered()
+	}
+	if r.opt.MaxCrashes > 0 {
+		if err := r.deadLetters.ClearCrashes(inputMsg); err != nil {
+			p.logger.Errorf("can not clear crash count: %s", err)
+		}
 	}
 }
 
+// commit фиксирует изменения состояния и границы доставки сообщений, подтвержденных ack.
+// Границы записываются в копию вместе с изменениями состояния, поэтому после запуска
+// на другой машине подтвержденные сообщения не обрабатываются повторно.
+func (r *Runtime) commit(ack upstreambackup.UpstreamAck) error {
+	var marks *upstreambackup.DeliveryMarks
+	if r.delivery != nil {
+		marks = r.delivery.Committed(ack)
+	}
+
+	if r.state != nil {
+		if err := r.state.Commit(ack, marks); err != nil {
+			return fmt.Errorf("can not commit state: %w", err)
+		}
+		if marks != nil {
+			r.delivery.Replicated(marks)
+		}
+		return nil
+	}
+	if marks != nil {
+		if err := r.delivery.Replicate(marks); err != nil {
+			return fmt.Errorf("can not commit deliveries: %w", err)
+		}
+	}
+	return nil
+}
+
 func (r *Runtime) handleAcks(ctx context.Context) error {
 	defer r.logger.Info("handle ACK stopped")
 
@@ -343,6 +559,12 @@ func (r *Runtime) handleAcks(ctx context.Context) error {
 			}
 
 			r.logger.Debugf("got ACK: %s", ack)
+
+			// Состояние фиксируется до отправки подтверждения, иначе после отказа
+			// изменения подтвержденных сообщений будут потеряны.
+			if err := r.commit(ack); err != nil {
+				return err
+			}
 			select {
 			case <-ctx.Done():
 				return nil
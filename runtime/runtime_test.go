@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+
+	upstreambackup "github.com/GDVFox/gostreaming/runtime/upstream_backup"
+	"github.com/GDVFox/gostreaming/util"
+)
+
+// logEntry запись лога, проверяемая в тестах.
+type logEntry struct {
+	Level   zapcore.Level
+	Logger  string
+	Message string
+}
+
+// newTestLogger создает логгер, записи которого сохраняются для проверки.
+func newTestLogger(t *testing.T) (*util.Logger, *observer.ObservedLogs) {
+	t.Helper()
+
+	core, logs := observer.New(zapcore.DebugLevel)
+	return &util.Logger{SugaredLogger: zap.New(core).Sugar()}, logs
+}
+
+// takeEntries возвращает записи лога, сделанные с момента предыдущего вызова.
+func takeEntries(logs *observer.ObservedLogs) []logEntry {
+	entries := make([]logEntry, 0, logs.Len())
+	for _, e := range logs.TakeAll() {
+		entries = append(entries, logEntry{Level: e.Level, Logger: e.LoggerName, Message: e.Message})
+	}
+	return entries
+}
+
+// newTestRuntime создает Runtime без соединений и процессов действия.
+func newTestRuntime(t *testing.T) (*Runtime, *observer.ObservedLogs) {
+	t.Helper()
+
+	l, logs := newTestLogger(t)
+	r := &Runtime{
+		metrics:      newActionMetrics(),
+		logger:       l,
+		actionLogger: l.WithName("action"),
+		shutdown:     make(chan struct{}),
+		drain:        make(chan struct{}),
+	}
+	return r, logs
+}
+
+// testAckPeriod период подтверждений forwarder в тестах.
+const testAckPeriod = 10 * time.Millisecond
+
+// startTestForwarder запускает у r forwarder без получателей, подтверждения входных
+// сообщений которого можно получить из AckMessages.
+func startTestForwarder(t *testing.T, r *Runtime) {
+	t.Helper()
+
+	cfg := &upstreambackup.DefaultForwarderConfig{ACKPeriod: testAckPeriod, ForwardLogDir: t.TempDir()}
+	forwarder, err := upstreambackup.NewDefaultForwarder("test", nil, cfg, r.logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.forwarder = forwarder
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- forwarder.Run(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+// takeAck возвращает подтверждение forwarder или nil, если его нет дольше нескольких периодов.
+func takeAck(r *Runtime) upstreambackup.UpstreamAck {
+	select {
+	case ack := <-r.forwarder.AckMessages():
+		return ack
+	case <-time.After(10 * testAckPeriod):
+		return nil
+	}
+}
+
+// newTestInput создает входное сообщение id от вышестоящего узла upstream с номером входа inputID.
+func newTestInput(upstream string, inputID uint16, id uint64, data string) *upstreambackup.UpstreamMessage {
+	msg := upstreambackup.NewDetachedMessage(nil, []byte(data))
+	msg.Detached = false
+	msg.Upstream = upstream
+	msg.InputID = inputID
+	msg.Header.MessageID = id
+	return msg
+}
+
+// testReplica копия состояния, которая запоминает каждое применение изменений.
+type testReplica struct {
+	applied []upstreambackup.StateChange
+	marks   []*upstreambackup.DeliveryMarks
+}
+
+func (r *testReplica) Load() (map[string][]byte, error) {
+	return map[string][]byte{}, nil
+}
+
+func (r *testReplica) LoadDelivery() (*upstreambackup.DeliveryMarks, error) {
+	return &upstreambackup.DeliveryMarks{}, nil
+}
+
+func (r *testReplica) Apply(changes []upstreambackup.StateChange, marks *upstreambackup.DeliveryMarks) error {
+	r.applied = append(r.applied, changes...)
+	r.marks = append(r.marks, marks)
+	return nil
+}
+
+func TestRuntimeCommit(t *testing.T) {
+	replica := &testReplica{}
+	delivery, err := upstreambackup.NewDeliveryStore(t.TempDir(), replica)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer delivery.Close()
+	assert.NoError(t, delivery.Recover(nil))
+	inputID, err := delivery.Register("a")
+	assert.NoError(t, err)
+
+	r, _ := newTestRuntime(t)
+	r.delivery = delivery
+
+	// Без состояния границы записываются в копию отдельно и только один раз.
+	assert.NoError(t, r.commit(upstreambackup.UpstreamAck{inputID: 3}))
+	assert.NoError(t, r.commit(upstreambackup.UpstreamAck{inputID: 3}))
+	assert.Equal(t, []*upstreambackup.DeliveryMarks{{Delivered: map[string]uint64{"a": 3}}}, replica.marks)
+
+	// С состоянием границы записываются одним изменением копии вместе с ним.
+	r.state, err = upstreambackup.NewStateStore(t.TempDir(), replica)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.state.Close()
+	replica.marks = nil
+	input := upstreambackup.StateInput{InputID: inputID, MessageID: 4}
+	assert.NoError(t, r.state.Put(input, []byte("key"), []byte("value")))
+	assert.NoError(t, r.commit(upstreambackup.UpstreamAck{inputID: 4}))
+	assert.Equal(t, []*upstreambackup.DeliveryMarks{{Delivered: map[string]uint64{"a": 4}}}, replica.marks)
+	assert.Equal(t, []upstreambackup.StateChange{{Key: []byte("key"), Value: []byte("value")}}, replica.applied)
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -11,6 +12,7 @@ import (
 	"sync"
 
 	"github.com/GDVFox/ctxio"
+	upstreambackup "github.com/GDVFox/gostreaming/runtime/upstream_backup"
 	"github.com/GDVFox/gostreaming/util"
 	"golang.org/x/sync/errgroup"
 )
@@ -20,8 +22,22 @@ const (
 	PingCommand uint8 = 0x1
 	// ChangeOutCommand команда для изменения выходного потока.
 	ChangeOutCommand uint8 = 0x2
+	// ReplayCommand команда для повторной передачи действию сообщения из очереди недоставленных сообщений.
+	ReplayCommand uint8 = 0x3
+	// StatsCommand команда для получения подробной статистики runtime.
+	StatsCommand uint8 = 0x4
+	// PauseCommand и ResumeCommand команды для приостановки и возобновления получения входных сообщений.
+	PauseCommand  uint8 = 0x5
+	ResumeCommand uint8 = 0x6
+	// DrainCommand команда для завершения runtime после обработки и доставки полученных сообщений.
+	DrainCommand uint8 = 0x7
+	// LogLevelCommand команда для изменения уровня логирования.
+	LogLevelCommand uint8 = 0x8
 )
 
+// maxLogLevelLength ограничение на длину уровня логирования в команде.
+const maxLogLevelLength = 16
+
 const (
 	// OKResponse ответ, предполагающий успешное выполнение действия.
 	OKResponse uint8 = 0x0
@@ -32,7 +48,17 @@ const (
 )
 
 type runtimeTelemetry struct {
-	OldestOutput uint32
+	OldestOutput    uint64
+	ActionStatus    uint8
+	ProtocolVersion uint16
+	// Размер forward log и число срабатываний политики переполнения.
+	ForwardLogItems   uint64
+	ForwardLogBytes   uint64
+	OverflowBlocked   uint64
+	OverflowDropped   uint64
+	OverflowDropBytes uint64
+	// Число отказов процессов действия, причина последнего отказа передается после метрик.
+	ActionCrashes uint64
 }
 
 // ServiceServer UDP сервис для получения команд от machine_node.
@@ -136,6 +162,25 @@ func (s *ServiceServer) handleService(ctx context.Context, conn net.Conn) {
 		case ChangeOutCommand:
 			s.logger.Info("got change out command")
 			err = s.changeOut(ctx, conn)
+		case ReplayCommand:
+			s.logger.Info("got replay command")
+			err = s.replay(ctx, conn)
+		case StatsCommand:
+			s.logger.Debug("got stats command")
+			err = s.stats(ctx, conn)
+		case PauseCommand:
+			s.logger.Info("got pause command")
+			err = s.respond(ctx, conn, s.runtime.Pause())
+		case ResumeCommand:
+			s.logger.Info("got resume command")
+			err = s.respond(ctx, conn, s.runtime.Resume())
+		case DrainCommand:
+			s.logger.Info("got drain command")
+			s.runtime.Drain()
+			err = s.respond(ctx, conn, nil)
+		case LogLevelCommand:
+			s.logger.Info("got log level command")
+			err = s.logLevel(ctx, conn)
 		default:
 			s.logger.Warn("got unknown command")
 			err = s.unknown(ctx, conn)
@@ -162,10 +207,39 @@ func (s *ServiceServer) ping(ctx context.Context, conn net.Conn) error {
 			return err
 		}
 
+		actionStatus, protocolVersion := s.runtime.GetActionStatus()
+		logStats := s.runtime.GetForwardLogStats()
+		crashes, lastExit := s.runtime.GetCrashes()
 		telemetry := runtimeTelemetry{
-			OldestOutput: oldestOutput,
+			OldestOutput:      oldestOutput,
+			ActionStatus:      actionStatus,
+			ProtocolVersion:   protocolVersion,
+			ForwardLogItems:   logStats.Items,
+			ForwardLogBytes:   logStats.Bytes,
+			OverflowBlocked:   logStats.Blocked,
+			OverflowDropped:   logStats.Dropped,
+			OverflowDropBytes: logStats.DroppedBytes,
+			ActionCrashes:     crashes,
+		}
+		if err := binary.Write(connWriter, binary.BigEndian, telemetry); err != nil {
+			return err
 		}
-		return binary.Write(connWriter, binary.BigEndian, telemetry)
+
+		// Метрики имеют переменный размер, поэтому передаются после телеметрии в виде JSON с длиной.
+		metrics, err := json.Marshal(s.runtime.GetMetrics())
+		if err != nil {
+			return fmt.Errorf("can not encode metrics: %w", err)
+		}
+		if err := binary.Write(connWriter, binary.BigEndian, uint32(len(metrics))); err != nil {
+			return err
+		}
+		if err := binary.Write(connWriter, binary.BigEndian, metrics); err != nil {
+			return err
+		}
+		if err := binary.Write(connWriter, binary.BigEndian, uint32(len(lastExit))); err != nil {
+			return err
+		}
+		return binary.Write(connWriter, binary.BigEndian, []byte(lastExit))
 	}
 
 	return binary.Write(connWriter, binary.BigEndian, FailResponse)
@@ -210,6 +284,95 @@ func (s *ServiceServer) readChangeOutAddr(r io.Reader) (string, error) {
 	return string(rawAddr), nil
 }
 
+func (s *ServiceServer) replay(ctx context.Context, conn net.Conn) error {
+	connWriter := ctxio.NewContextWriter(ctx, conn)
+	defer connWriter.Free()
+
+	connReader := ctxio.NewContextReader(ctx, conn)
+	defer connReader.Free()
+
+	metadata, err := s.readReplayPart(connReader, upstreambackup.MaxMetadataLength)
+	if err != nil {
+		return fmt.Errorf("can not read replay metadata: %w", err)
+	}
+	data, err := s.readReplayPart(connReader, int(messageLengthMask))
+	if err != nil {
+		return fmt.Errorf("can not read replay data: %w", err)
+	}
+
+	if err := s.runtime.Replay(metadata, data); err != nil {
+		s.logger.Errorf("can not replay message: %s", err)
+		return binary.Write(connWriter, binary.BigEndian, FailResponse)
+	}
+	return binary.Write(connWriter, binary.BigEndian, OKResponse)
+}
+
+// readReplayPart читает блок с uint32 длиной не больше maxLength, формат общий для команд с данными.
+func (s *ServiceServer) readReplayPart(r io.Reader, maxLength int) ([]byte, error) {
+	var length uint32
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	if int(length) > maxLength {
+		return nil, fmt.Errorf("got length %d, max is %d", length, maxLength)
+	}
+
+	part := make([]byte, length)
+	if _, err := io.ReadFull(r, part); err != nil {
+		return nil, err
+	}
+	return part, nil
+}
+
+func (s *ServiceServer) stats(ctx context.Context, conn net.Conn) error {
+	connWriter := ctxio.NewContextWriter(ctx, conn)
+	defer connWriter.Free()
+
+	if !s.runtime.IsRunning() {
+		return binary.Write(connWriter, binary.BigEndian, FailResponse)
+	}
+	stats, err := s.runtime.GetStats()
+	if err != nil {
+		s.logger.Errorf("service: can not get stats: %s", err)
+		return binary.Write(connWriter, binary.BigEndian, FailResponse)
+	}
+	rawStats, err := json.Marshal(stats)
+	if err != nil {
+		return fmt.Errorf("can not encode stats: %w", err)
+	}
+
+	if err := binary.Write(connWriter, binary.BigEndian, OKResponse); err != nil {
+		return err
+	}
+	if err := binary.Write(connWriter, binary.BigEndian, uint32(len(rawStats))); err != nil {
+		return err
+	}
+	return binary.Write(connWriter, binary.BigEndian, rawStats)
+}
+
+func (s *ServiceServer) logLevel(ctx context.Context, conn net.Conn) error {
+	connReader := ctxio.NewContextReader(ctx, conn)
+	defer connReader.Free()
+
+	level, err := s.readReplayPart(connReader, maxLogLevelLength)
+	if err != nil {
+		return fmt.Errorf("can not read log level: %w", err)
+	}
+	return s.respond(ctx, conn, s.runtime.SetLogLevel(string(level)))
+}
+
+// respond отвечает OKResponse, если команда выполнена без ошибки err, и FailResponse иначе.
+func (s *ServiceServer) respond(ctx context.Context, conn net.Conn, err error) error {
+	connWriter := ctxio.NewContextWriter(ctx, conn)
+	defer connWriter.Free()
+
+	if err != nil {
+		s.logger.Errorf("service: command failed: %s", err)
+		return binary.Write(connWriter, binary.BigEndian, FailResponse)
+	}
+	return binary.Write(connWriter, binary.BigEndian, OKResponse)
+}
+
 func (s *ServiceServer) unknown(ctx context.Context, conn net.Conn) error {
 	connWriter := ctxio.NewContextWriter(ctx, conn)
 	defer connWriter.Free()
@@ -5,17 +5,18 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"os"
 	"sync"
 	"sync/atomic"
 
 	"github.com/syndtr/goleveldb/leveldb"
+	leveldbutil "github.com/syndtr/goleveldb/leveldb/util"
 )
 
 var (
 	errBufferEmpty = errors.New("buffer is empty")
 )
 
+// logBuffer хранилище записей forward log в LevelDB.
 type logBuffer struct {
 	lock sync.Mutex
 
@@ -25,21 +26,51 @@ type logBuffer struct {
 	front uint64
 	tail  uint64
 	size  int64
+
+	// appended закрывается и заменяется новым каналом после каждой записи,
+	// поэтому итераторы ожидают новых записей, не нагружая процессор.
+	appended chan struct{}
 }
 
+// metaKeyPrefix начинает ключи служебных записей. Такие ключи больше ключа любой записи лога,
+// поэтому не попадают в диапазоны, которые читаются при обходе лога.
+var metaKeyPrefix = []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
+
+// newLogBuffer открывает буфер в dataDir. Если в dataDir остались записи после предыдущего
+// запуска, то буфер продолжает работу с ними: записи удаляются только с начала,
+// поэтому оставшиеся записи занимают непрерывный диапазон ключей.
 func newLogBuffer(dataDir string) (*logBuffer, error) {
 	db, err := leveldb.OpenFile(dataDir, nil)
 	if err != nil {
 		return nil, fmt.Errorf("can not open underlying db: %w", err)
 	}
 
-	return &logBuffer{
+	b := &logBuffer{
 		dataDir: dataDir,
 		db:      db,
 		front:   0,
 		tail:    0,
 		size:    0,
-	}, nil
+
+		appended: make(chan struct{}),
+	}
+
+	iter := db.NewIterator(&leveldbutil.Range{Limit: metaKeyPrefix}, nil)
+	defer iter.Release()
+	if iter.First() {
+		b.front = binary.BigEndian.Uint64(iter.Key())
+		if !iter.Last() {
+			db.Close()
+			return nil, fmt.Errorf("can not find last item: %w", iter.Error())
+		}
+		b.tail = binary.BigEndian.Uint64(iter.Key()) + 1
+		b.size = int64(b.tail - b.front)
+	}
+	if err := iter.Error(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("can not read items: %w", err)
+	}
+	return b, nil
 }
 
 func (b *logBuffer) Append(item *forwardLogItem) error {
@@ -58,9 +89,57 @@ func (b *logBuffer) Append(item *forwardLogItem) error {
 
 	atomic.AddUint64(&b.tail, 1)
 	atomic.AddInt64(&b.size, 1)
+
+	close(b.appended)
+	b.appended = make(chan struct{})
 	return nil
 }
 
+// Tail возвращает ключ, который получит следующая запись, и канал,
+// который будет закрыт после этой записи.
+func (b *logBuffer) Tail() (uint64, <-chan struct{}) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return atomic.LoadUint64(&b.tail), b.appended
+}
+
+// ReadRange загружает записи с ключами из [from, to) в порядке возрастания, пока их не больше maxItems,
+// а суммарная длина данных не больше maxBytes. Первая запись загружается всегда.
+// Возвращает ключ, с которого нужно продолжить чтение.
+// Записи берутся из forwardLogItems, после использования их нужно вернуть в пул.
+func (b *logBuffer) ReadRange(from, to uint64, maxItems, maxBytes int, items []*forwardLogItem) ([]*forwardLogItem, uint64, error) {
+	iter := b.db.NewIterator(&leveldbutil.Range{Start: uint64Key(from), Limit: uint64Key(to)}, nil)
+	defer iter.Release()
+
+	next := from
+	bytesRead := 0
+	for len(items) < maxItems && iter.Next() {
+		item := forwardLogItems.Get()
+		if err := item.readIn(bytes.NewReader(iter.Value())); err != nil {
+			forwardLogItems.Put(item)
+			return items, next, fmt.Errorf("can not decode item: %w", err)
+		}
+
+		bytesRead += len(item.Metadata) + len(item.Data)
+		if len(items) != 0 && bytesRead > maxBytes {
+			forwardLogItems.Put(item)
+			break
+		}
+		items = append(items, item)
+		next = binary.BigEndian.Uint64(iter.Key()) + 1
+	}
+	if err := iter.Error(); err != nil {
+		return items, next, fmt.Errorf("can not read items: %w", err)
+	}
+
+	// Записи между from и to могли быть удалены, тогда продолжать нужно с to.
+	if len(items) < maxItems && bytesRead <= maxBytes {
+		next = to
+	}
+	return items, next, nil
+}
+
 func (b *logBuffer) LoadFirst(item *forwardLogItem) error {
 	b.lock.Lock()
 	defer b.lock.Unlock()
@@ -82,6 +161,28 @@ func (b *logBuffer) LoadFirst(item *forwardLogItem) error {
 	return nil
 }
 
+// LoadLast загружает последнюю запись буфера.
+func (b *logBuffer) LoadLast(item *forwardLogItem) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if atomic.LoadInt64(&b.size) == 0 {
+		return errBufferEmpty
+	}
+
+	key := uint64Key(atomic.LoadUint64(&b.tail) - 1)
+	value, err := b.db.Get(key, nil)
+	if err != nil {
+		return fmt.Errorf("can not read item: %w", err)
+	}
+
+	if err := item.readIn(bytes.NewReader(value)); err != nil {
+		return fmt.Errorf("can not decode item: %w", err)
+	}
+
+	return nil
+}
+
 func (b *logBuffer) TrimFirst() error {
 	b.lock.Lock()
 	defer b.lock.Unlock()
@@ -90,7 +191,7 @@ func (b *logBuffer) TrimFirst() error {
 		return errBufferEmpty
 	}
 
-	key := uint64Key(atomic.LoadUint64(&b.tail))
+	key := uint64Key(atomic.LoadUint64(&b.front))
 	if err := b.db.Delete(key, nil); err != nil {
 		return fmt.Errorf("can not trim item: %w", err)
 	}
@@ -100,25 +201,48 @@ func (b *logBuffer) TrimFirst() error {
 	return nil
 }
 
-func (b *logBuffer) Size() int64 {
-	b.lock.Lock()
-	defer b.lock.Unlock()
+// Front возвращает ключ первой записи.
+func (b *logBuffer) Front() uint64 {
+	return atomic.LoadUint64(&b.front)
+}
 
-	return atomic.LoadInt64(&b.size)
+// GetMeta возвращает значение служебной записи name, nil если записи нет.
+func (b *logBuffer) GetMeta(name string) ([]byte, error) {
+	value, err := b.db.Get(metaKey(name), nil)
+	if errors.Is(err, leveldb.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can not read %s: %w", name, err)
+	}
+	return value, nil
+}
+
+// PutMeta сохраняет значение служебной записи name.
+func (b *logBuffer) PutMeta(name string, value []byte) error {
+	if err := b.db.Put(metaKey(name), value, nil); err != nil {
+		return fmt.Errorf("can not save %s: %w", name, err)
+	}
+	return nil
 }
 
-func (b *logBuffer) NewIterator() *LogBufferIterator {
+func (b *logBuffer) Size() int64 {
 	b.lock.Lock()
 	defer b.lock.Unlock()
 
-	return NewLogBufferIterator(b)
+	return atomic.LoadInt64(&b.size)
 }
 
+// Close закрывает буфер. Записи не удаляются, чтобы после перезапуска
+// неподтвержденные сообщения были отправлены повторно.
 func (b *logBuffer) Close() error {
-	defer os.RemoveAll(b.dataDir)
 	return b.db.Close()
 }
 
+func metaKey(name string) []byte {
+	return append(append([]byte{}, metaKeyPrefix...), name...)
+}
+
 func uint64Key(k uint64) []byte {
 	key := make([]byte, 8)
 	binary.BigEndian.PutUint64(key, k)
@@ -1,10 +1,8 @@
 package upstreambackup
 
 import (
-	"bytes"
 	"context"
 	"fmt"
-	"sync/atomic"
 )
 
 // LogBufferIterator итератор для прямого передвижения по logBuffer.
@@ -12,11 +10,11 @@ type LogBufferIterator struct {
 	wasStarted bool
 	lastKey    uint64
 
-	logBuffer *logBuffer
+	logBuffer logStorage
 }
 
 // NewLogBufferIterator содает новый LogBufferIterator, чтение начинается с начала лога.
-func NewLogBufferIterator(logBuffer *logBuffer) *LogBufferIterator {
+func NewLogBufferIterator(logBuffer logStorage) *LogBufferIterator {
 	return &LogBufferIterator{
 		wasStarted: false,
 		lastKey:    0,
@@ -24,32 +22,39 @@ func NewLogBufferIterator(logBuffer *logBuffer) *LogBufferIterator {
 	}
 }
 
-// Next загружает в item следющий элемент.
-// В случае, если итератор находится в конце лога, блокируется в ожидании новых записей.
-func (i *LogBufferIterator) Next(ctx context.Context, item *forwardLogItem) error {
+// NextBatch добавляет в items следующие элементы, но не больше maxItems и не больше maxBytes
+// суммарной длины данных, кроме первого элемента. В случае, если итератор находится в конце лога,
+// блокируется в ожидании новых записей, поэтому возвращает хотя бы один элемент.
+// Элементы берутся из пула, после использования их нужно вернуть через forwardLogItems.Put.
+func (i *LogBufferIterator) NextBatch(ctx context.Context, maxItems, maxBytes int, items []*forwardLogItem) ([]*forwardLogItem, error) {
 	if !i.wasStarted {
 		i.wasStarted = true
-		i.lastKey = atomic.LoadUint64(&i.logBuffer.front)
+		i.lastKey = i.logBuffer.Front()
 	}
 
-	for atomic.LoadUint64(&i.logBuffer.tail) == i.lastKey {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		default:
+	for {
+		tail, appended := i.logBuffer.Tail()
+		// Записи до front уже подтверждены всеми получателями и удалены.
+		if front := i.logBuffer.Front(); i.lastKey < front {
+			i.lastKey = front
 		}
-	}
 
-	key := uint64Key(i.lastKey)
-	value, err := i.logBuffer.db.Get(key, nil)
-	if err != nil {
-		return fmt.Errorf("can not read item: %w", err)
-	}
+		if i.lastKey < tail {
+			var err error
+			items, i.lastKey, err = i.logBuffer.ReadRange(i.lastKey, tail, maxItems, maxBytes, items)
+			if err != nil {
+				return items, fmt.Errorf("can not read items: %w", err)
+			}
+			if len(items) != 0 {
+				return items, nil
+			}
+			continue
+		}
 
-	if err := item.readIn(bytes.NewReader(value)); err != nil {
-		return fmt.Errorf("can not decode item: %w", err)
+		select {
+		case <-ctx.Done():
+			return items, ctx.Err()
+		case <-appended:
+		}
 	}
-
-	i.lastKey++
-	return nil
 }
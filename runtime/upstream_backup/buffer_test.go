@@ -0,0 +1,458 @@
+package upstreambackup
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/GDVFox/gostreaming/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestLog(t testing.TB) *ForwardLog {
+	l, err := NewForwardLog(t.TempDir(), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.buffer.Close() })
+	return l
+}
+
+func newTestLogger() (*util.Logger, error) {
+	return util.NewLogger(&util.LoggingConfig{Logfile: "stdout", Level: "error"})
+}
+
+func writeTestLog(t testing.TB, l *ForwardLog, from, to uint64, data []byte) {
+	for id := from; id < to; id++ {
+		if err := l.Write(0, id, id, nil, data, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// acceptTestHello читает hello сообщение отправителя и отвечает последней версией протокола
+// с возможностями отправителя и выбранным алгоритмом сжатия.
+func acceptTestHello(conn net.Conn, compression uint8) error {
+	hello := &helloMessage{}
+	if err := hello.readIn(conn); err != nil {
+		return err
+	}
+	reply := &helloReplyMessage{
+		Version:      maxProtocolVersion,
+		MinVersion:   minProtocolVersion,
+		MaxVersion:   maxProtocolVersion,
+		Capabilities: hello.Capabilities,
+		Compression:  compression,
+	}
+	return reply.writeOut(conn)
+}
+
+func TestLogBufferTrim(t *testing.T) {
+	l := newTestLog(t)
+	writeTestLog(t, l, 1, 6, []byte("data"))
+
+	inputMax, err := l.Trim(3)
+	assert.NoError(t, err)
+	assert.Equal(t, map[uint16]uint64{0: 3}, inputMax)
+	assert.EqualValues(t, 2, l.buffer.Size())
+
+	for key := uint64(0); key < 5; key++ {
+		_, err := l.buffer.(*logBuffer).db.Get(uint64Key(key), nil)
+		assert.Equal(t, key >= 3, err == nil, "key %d", key)
+	}
+
+	oldest, err := l.GetOldestOutput()
+	assert.NoError(t, err)
+	assert.EqualValues(t, 4, oldest)
+}
+
+func TestForwardLogReopen(t *testing.T) {
+	dir := t.TempDir()
+	l, err := NewForwardLog(dir, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestLog(t, l, 1, 6, []byte("data"))
+	_, err = l.Trim(2)
+	assert.NoError(t, err)
+	writtenMessages, writtenBytes := l.Written()
+	assert.EqualValues(t, 5, writtenMessages)
+	assert.EqualValues(t, 20, writtenBytes)
+	assert.NoError(t, l.Close())
+
+	l, err = NewForwardLog(dir, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	assert.EqualValues(t, 3, l.buffer.Size())
+	assert.EqualValues(t, 12, l.Stats().Bytes)
+	assert.EqualValues(t, 6, l.NextOutput())
+	// Записи предыдущего запуска учитываются как записанные, но не как удаленные.
+	writtenMessages, writtenBytes = l.Written()
+	assert.EqualValues(t, 3, writtenMessages)
+	assert.EqualValues(t, 12, writtenBytes)
+	trimmedMessages, _ := l.Trimmed()
+	assert.Zero(t, trimmedMessages)
+
+	items, err := l.NewIterator().NextBatch(context.Background(), 10, 1<<20, nil)
+	assert.NoError(t, err)
+	assert.Len(t, items, 3)
+	assert.EqualValues(t, 3, items[0].Header.OutputMessageID)
+
+	// Записи предыдущего запуска удаляются без подтверждения входных сообщений.
+	writeTestLog(t, l, 6, 8, []byte("data"))
+	inputMax, err := l.Trim(6)
+	assert.NoError(t, err)
+	assert.Equal(t, map[uint16]uint64{0: 6}, inputMax)
+	assert.EqualValues(t, 1, l.buffer.Size())
+}
+
+func newTestLimitedLog(t *testing.T, limits *ForwardLogLimits) *ForwardLog {
+	l, err := NewForwardLog(t.TempDir(), nil, limits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return l
+}
+
+func TestForwardLogUnknownOverflow(t *testing.T) {
+	_, err := NewForwardLog(t.TempDir(), nil, &ForwardLogLimits{Overflow: "wait"})
+	assert.ErrorIs(t, err, ErrUnknownOverflowPolicy)
+}
+
+func TestForwardLogOverflowFail(t *testing.T) {
+	l := newTestLimitedLog(t, &ForwardLogLimits{MaxBytes: 10, Overflow: OverflowFail})
+	writeTestLog(t, l, 0, 2, []byte("data"))
+
+	err := l.Write(0, 2, 2, nil, []byte("data"), true)
+	assert.ErrorIs(t, err, ErrForwardLogFull)
+	assert.Equal(t, ForwardLogStats{Items: 2, Bytes: 8}, l.Stats())
+}
+
+func TestForwardLogOverflowDropOldest(t *testing.T) {
+	l := newTestLimitedLog(t, &ForwardLogLimits{MaxItems: 3, Overflow: OverflowDropOldest})
+	writeTestLog(t, l, 1, 6, []byte("data"))
+
+	assert.Equal(t, ForwardLogStats{Items: 3, Bytes: 12, Dropped: 2, DroppedBytes: 8}, l.Stats())
+	oldest, err := l.GetOldestOutput()
+	assert.NoError(t, err)
+	assert.EqualValues(t, 3, oldest)
+
+	// Входные сообщения удаленных записей подтверждаются.
+	assert.Equal(t, map[uint16]uint64{0: 2}, l.TakeDropped())
+	assert.Empty(t, l.TakeDropped())
+}
+
+func TestForwardLogOverflowDropOldestReopen(t *testing.T) {
+	dir := t.TempDir()
+	limits := &ForwardLogLimits{MaxItems: 1, Overflow: OverflowDropOldest}
+	l, err := NewForwardLog(dir, nil, limits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestLog(t, l, 1, 5, []byte("data"))
+
+	// Отказ после удаления записей, но до записи нового сообщения, оставляет лог пустым.
+	assert.NoError(t, l.reserve(4))
+	assert.EqualValues(t, 0, l.buffer.Size())
+	assert.EqualValues(t, 4, l.Stats().Dropped)
+	assert.NoError(t, l.Close())
+
+	// Номера удаленных сообщений не используются повторно.
+	l, err = NewForwardLog(dir, nil, limits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	assert.EqualValues(t, 5, l.NextOutput())
+}
+
+func TestForwardLogOverflowBlock(t *testing.T) {
+	l := newTestLimitedLog(t, &ForwardLogLimits{MaxItems: 2})
+	writeTestLog(t, l, 1, 3, []byte("data"))
+
+	written := make(chan error)
+	go func() {
+		written <- l.Write(0, 3, 3, nil, []byte("data"), true)
+	}()
+	select {
+	case err := <-written:
+		t.Fatalf("write is not blocked: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	_, err := l.Trim(1)
+	assert.NoError(t, err)
+	assert.NoError(t, <-written)
+	assert.Equal(t, ForwardLogStats{Items: 2, Bytes: 8, Blocked: 1}, l.Stats())
+}
+
+func TestForwardLogOverflowBlockClose(t *testing.T) {
+	l, err := NewForwardLog(t.TempDir(), nil, &ForwardLogLimits{MaxItems: 1, Overflow: OverflowBlock})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestLog(t, l, 0, 1, []byte("data"))
+
+	written := make(chan error)
+	go func() {
+		written <- l.Write(0, 1, 1, nil, []byte("data"), true)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	assert.NoError(t, l.Close())
+	assert.ErrorIs(t, <-written, ErrForwardLogClosed)
+}
+
+func TestForwardLogReopenEmpty(t *testing.T) {
+	dir := t.TempDir()
+	l, err := NewForwardLog(dir, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestLog(t, l, 0, 5, []byte("data"))
+	_, err = l.Trim(4)
+	assert.NoError(t, err)
+	assert.NoError(t, l.Close())
+
+	// Нумерация продолжается, даже если все записи были удалены.
+	l, err = NewForwardLog(dir, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	assert.EqualValues(t, 0, l.buffer.Size())
+	assert.EqualValues(t, 5, l.NextOutput())
+}
+
+func TestLogBufferIteratorNextBatch(t *testing.T) {
+	l := newTestLog(t)
+	writeTestLog(t, l, 1, 6, []byte("data"))
+
+	iter := l.NewIterator()
+	items, err := iter.NextBatch(context.Background(), 3, 1<<20, nil)
+	assert.NoError(t, err)
+	assert.Len(t, items, 3)
+	assert.EqualValues(t, 1, items[0].Header.OutputMessageID)
+
+	// Первый элемент возвращается, даже если он больше maxBytes.
+	items, err = iter.NextBatch(context.Background(), 10, 1, items[:0])
+	assert.NoError(t, err)
+	assert.Len(t, items, 1)
+	assert.EqualValues(t, 4, items[0].Header.OutputMessageID)
+
+	items, err = iter.NextBatch(context.Background(), 10, 1<<20, items[:0])
+	assert.NoError(t, err)
+	assert.Len(t, items, 1)
+	assert.EqualValues(t, 5, items[0].Header.OutputMessageID)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = iter.NextBatch(ctx, 10, 1<<20, nil)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestLogBufferIteratorWaitsForAppend(t *testing.T) {
+	l := newTestLog(t)
+	iter := l.NewIterator()
+
+	done := make(chan []*forwardLogItem)
+	go func() {
+		items, err := iter.NextBatch(context.Background(), 10, 1<<20, nil)
+		assert.NoError(t, err)
+		done <- items
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("iterator returned from empty log")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	writeTestLog(t, l, 1, 2, []byte("data"))
+	select {
+	case items := <-done:
+		assert.Len(t, items, 1)
+		assert.Equal(t, []byte("data"), items[0].Data)
+	case <-time.After(time.Second):
+		t.Fatal("iterator is not woken up by append")
+	}
+}
+
+func TestLogBufferIteratorSkipsTrimmed(t *testing.T) {
+	l := newTestLog(t)
+	writeTestLog(t, l, 1, 4, []byte("data"))
+
+	iter := l.NewIterator()
+	items, err := iter.NextBatch(context.Background(), 1, 1<<20, nil)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 1, items[0].Header.OutputMessageID)
+
+	_, err = l.Trim(2)
+	assert.NoError(t, err)
+
+	items, err = iter.NextBatch(context.Background(), 10, 1<<20, items[:0])
+	assert.NoError(t, err)
+	assert.Len(t, items, 1)
+	assert.EqualValues(t, 3, items[0].Header.OutputMessageID)
+}
+
+func TestInFlightWindow(t *testing.T) {
+	w := newInFlightWindow(2)
+
+	available, err := w.Available(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 2, available)
+
+	w.Sent(1)
+	w.Sent(2)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = w.Available(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	done := make(chan int)
+	go func() {
+		available, err := w.Available(context.Background())
+		assert.NoError(t, err)
+		done <- available
+	}()
+	w.Acked(1)
+	assert.Equal(t, 1, <-done)
+
+	w.Acked(5)
+	available, err = w.Available(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 2, available)
+}
+
+// BenchmarkLogBufferIterator измеряет пропускную способность чтения лога пакетами
+// одновременно с записью в него.
+func BenchmarkLogBufferIterator(b *testing.B) {
+	l := newTestLog(b)
+	data := make([]byte, 128)
+	iter := l.NewIterator()
+
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+
+	done := make(chan error)
+	go func() {
+		var items []*forwardLogItem
+		for read := 0; read < b.N; {
+			var err error
+			items, err = iter.NextBatch(context.Background(), transmitBatchItems, transmitBatchBytes, items[:0])
+			if err != nil {
+				done <- err
+				return
+			}
+			read += len(items)
+			for _, item := range items {
+				forwardLogItems.Put(item)
+			}
+		}
+		done <- nil
+	}()
+
+	writeTestLog(b, l, 0, uint64(b.N), data)
+	if err := <-done; err != nil {
+		b.Fatal(err)
+	}
+}
+
+// BenchmarkDownstreamForwarder измеряет пропускную способность передачи сообщений из лога получателю.
+func BenchmarkDownstreamForwarder(b *testing.B) {
+	const name = "bench"
+
+	l := newTestLog(b)
+	data := make([]byte, 128)
+	logger, err := newTestLogger()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer listener.Close()
+
+	// Заголовок и данные каждого сообщения.
+	expected := int64(b.N) * int64(12+len(data))
+	received := make(chan error)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			received <- err
+			return
+		}
+		defer conn.Close()
+		if err := acceptTestHello(conn, compressionNone); err != nil {
+			received <- err
+			return
+		}
+		_, err = io.CopyN(io.Discard, conn, expected)
+		received <- err
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	downstream := NewDownstreamForwarder(0, name, listener.Addr().String(), l.NewIterator(), nil, 0, nil, nil, logger)
+	go downstream.Run(ctx)
+	go func() {
+		for range downstream.acks {
+		}
+	}()
+
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	writeTestLog(b, l, 0, uint64(b.N), data)
+	if err := <-received; err != nil {
+		b.Fatal(err)
+	}
+}
+
+// BenchmarkLogBufferIteratorIdle измеряет процессорное время, которое тратят итераторы
+// в ожидании новых записей. Метрика cpu/wall показывает долю одного ядра.
+func BenchmarkLogBufferIteratorIdle(b *testing.B) {
+	const iterators = 4
+
+	l := newTestLog(b)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var started int32
+	for i := 0; i < iterators; i++ {
+		iter := l.NewIterator()
+		go func() {
+			atomic.AddInt32(&started, 1)
+			iter.NextBatch(ctx, transmitBatchItems, transmitBatchBytes, nil)
+		}()
+	}
+	for atomic.LoadInt32(&started) != iterators {
+		time.Sleep(time.Millisecond)
+	}
+
+	startCPU := cpuTime(b)
+	start := time.Now()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	b.StopTimer()
+
+	b.ReportMetric(float64(cpuTime(b)-startCPU)/float64(time.Since(start)), "cpu/wall")
+}
+
+func cpuTime(b *testing.B) time.Duration {
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		b.Fatal(err)
+	}
+	return time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+}
@@ -0,0 +1,80 @@
+package upstreambackup
+
+import "sync"
+
+// inputCompletion входное сообщение, переданное действию.
+type inputCompletion struct {
+	messageID uint64
+	done      bool
+}
+
+// upstreamCompletions входные сообщения одного вышестоящего узла в порядке передачи действию.
+type upstreamCompletions struct {
+	inputs []*inputCompletion
+	// watermark наибольший номер сообщения, до которого включительно все сообщения обработаны.
+	watermark    uint64
+	hasWatermark bool
+}
+
+// inputCompletions отслеживает обработку входных сообщений, которые передаются
+// нескольким процессам действия и поэтому обрабатываются не в порядке получения.
+// Подтверждать вышестоящему узлу можно только сообщения до границы,
+// так как более ранние сообщения могут ещё обрабатываться.
+type inputCompletions struct {
+	lock      sync.Mutex
+	upstreams map[uint16]*upstreamCompletions
+}
+
+func newInputCompletions() *inputCompletions {
+	return &inputCompletions{
+		upstreams: make(map[uint16]*upstreamCompletions),
+	}
+}
+
+// Dispatched запоминает, что сообщение передано действию.
+func (c *inputCompletions) Dispatched(inputID uint16, messageID uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	upstream, ok := c.upstreams[inputID]
+	if !ok {
+		upstream = &upstreamCompletions{}
+		c.upstreams[inputID] = upstream
+	}
+	upstream.inputs = append(upstream.inputs, &inputCompletion{messageID: messageID})
+}
+
+// Complete отмечает обработку сообщения и возвращает границу подтверждения для inputID.
+// false возвращается, если ни одно сообщение до границы ещё не обработано.
+// Для сообщений, которые не передавались через Dispatched, граница равна самому сообщению.
+func (c *inputCompletions) Complete(inputID uint16, messageID uint64) (uint64, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	upstream, ok := c.upstreams[inputID]
+	if !ok {
+		return messageID, true
+	}
+
+	// Сообщение может быть передано повторно после переподключения вышестоящего узла,
+	// поэтому отмечается самое раннее необработанное сообщение с этим номером.
+	for _, input := range upstream.inputs {
+		if input.messageID == messageID && !input.done {
+			input.done = true
+			break
+		}
+	}
+
+	completed := 0
+	for completed < len(upstream.inputs) && upstream.inputs[completed].done {
+		// Граница не уменьшается при повторной обработке уже подтвержденных сообщений.
+		if messageID := upstream.inputs[completed].messageID; !upstream.hasWatermark || messageID > upstream.watermark {
+			upstream.watermark = messageID
+		}
+		upstream.hasWatermark = true
+		completed++
+	}
+	upstream.inputs = append(upstream.inputs[:0], upstream.inputs[completed:]...)
+
+	return upstream.watermark, upstream.hasWatermark
+}
@@ -0,0 +1,119 @@
+package upstreambackup
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInputCompletionsOutOfOrder(t *testing.T) {
+	c := newInputCompletions()
+	for _, id := range []uint64{3, 5, 8} {
+		c.Dispatched(1, id)
+	}
+	c.Dispatched(2, 4)
+
+	_, ok := c.Complete(1, 5)
+	assert.False(t, ok)
+
+	watermark, ok := c.Complete(2, 4)
+	assert.True(t, ok)
+	assert.EqualValues(t, 4, watermark)
+
+	watermark, ok = c.Complete(1, 3)
+	assert.True(t, ok)
+	assert.EqualValues(t, 5, watermark)
+
+	watermark, ok = c.Complete(1, 8)
+	assert.True(t, ok)
+	assert.EqualValues(t, 8, watermark)
+}
+
+func TestInputCompletionsReplay(t *testing.T) {
+	c := newInputCompletions()
+	for _, id := range []uint64{1, 2, 1, 2} {
+		c.Dispatched(0, id)
+	}
+
+	watermark, ok := c.Complete(0, 1)
+	assert.True(t, ok)
+	assert.EqualValues(t, 1, watermark)
+	watermark, _ = c.Complete(0, 2)
+	assert.EqualValues(t, 2, watermark)
+
+	// Повторно переданные сообщения не уменьшают границу.
+	watermark, _ = c.Complete(0, 1)
+	assert.EqualValues(t, 2, watermark)
+	watermark, _ = c.Complete(0, 2)
+	assert.EqualValues(t, 2, watermark)
+}
+
+func TestInputCompletionsUntracked(t *testing.T) {
+	c := newInputCompletions()
+
+	watermark, ok := c.Complete(0, 7)
+	assert.True(t, ok)
+	assert.EqualValues(t, 7, watermark)
+}
+
+func TestForwardLogOutOfOrder(t *testing.T) {
+	l := newTestLog(t)
+	f := &DefaultForwarder{
+		forwardLog:         l,
+		inputMax:           make(map[uint16]uint64),
+		completions:        newInputCompletions(),
+		downstreamsIndexes: map[string]uint16{"downstream": 0},
+	}
+	f.logger, _ = newTestLogger()
+
+	f.Dispatched(1, 10)
+	f.Dispatched(1, 11)
+
+	// Второй процесс отвечает раньше первого.
+	assert.NoError(t, f.Forward(1, 11, nil, []byte("b"), true))
+	assert.NoError(t, f.Forward(1, 10, nil, []byte("a"), true))
+
+	inputMax, err := l.Trim(0)
+	assert.NoError(t, err)
+	assert.Empty(t, inputMax)
+
+	inputMax, err = l.Trim(1)
+	assert.NoError(t, err)
+	assert.Equal(t, map[uint16]uint64{1: 11}, inputMax)
+	assert.Equal(t, UpstreamAck{1: 11}, f.inputMax)
+}
+
+func TestForwardDetached(t *testing.T) {
+	l := newTestLog(t)
+	f := &DefaultForwarder{
+		forwardLog:         l,
+		inputMax:           make(map[uint16]uint64),
+		completions:        newInputCompletions(),
+		downstreamsIndexes: map[string]uint16{"downstream": 0},
+	}
+	f.logger, _ = newTestLogger()
+
+	f.Dispatched(1, 10)
+
+	// Выход без входного сообщения записывается в лог, но не завершает входные сообщения
+	// и не изменяет подтверждения вышестоящим узлам, в том числе входу 0.
+	assert.NoError(t, f.ForwardDetached(nil, []byte("timer")))
+	messages, _ := l.Written()
+	assert.EqualValues(t, 1, messages)
+	assert.Empty(t, f.inputMax)
+	assert.NotContains(t, f.completions.upstreams, uint16(0))
+	assert.Len(t, f.completions.upstreams[1].inputs, 1)
+	assert.False(t, f.completions.upstreams[1].hasWatermark)
+
+	inputMax, err := l.Trim(0)
+	assert.NoError(t, err)
+	assert.Empty(t, inputMax)
+
+	assert.NoError(t, f.Forward(1, 10, nil, []byte("a"), true))
+	assert.Equal(t, UpstreamAck{1: 10}, f.inputMax)
+	assert.Empty(t, f.completions.upstreams[1].inputs)
+
+	inputMax, err = l.Trim(1)
+	assert.NoError(t, err)
+	assert.Equal(t, map[uint16]uint64{1: 10}, inputMax)
+}
@@ -0,0 +1,211 @@
+package upstreambackup
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/DataDog/zstd"
+)
+
+// Алгоритмы сжатия, которые поддерживает runtime.
+// В hello сообщении передается маска предлагаемых алгоритмов, а в ответе выбранный алгоритм.
+const (
+	compressionNone uint8 = 0
+	compressionZstd uint8 = 1 << 0
+)
+
+// Имена алгоритмов сжатия в описании узла.
+const (
+	CompressionNone = "none"
+	CompressionZstd = "zstd"
+)
+
+// DefaultCompressionMinSize минимальная длина пакета, который сжимается, по умолчанию.
+const DefaultCompressionMinSize = 512
+
+const (
+	// compressedFrameFlag выставляется в длине кадра, если его содержимое сжато.
+	// В этом случае за длиной следует uint32 длина содержимого до сжатия.
+	compressedFrameFlag uint32 = 1 << 31
+	// maxFrameLength максимальная длина содержимого кадра.
+	maxFrameLength = 1 << 28
+)
+
+// Возможные ошибки сжатия.
+var (
+	ErrUnknownCompression = errors.New("unknown compression")
+	ErrFrameTooLong       = errors.New("frame is too long")
+)
+
+// CompressionConfig параметры сжатия сообщений, передаваемых нижестоящим узлам.
+type CompressionConfig struct {
+	// Codec алгоритм сжатия, пустое значение или CompressionNone отключает сжатие.
+	Codec string
+	// Level уровень сжатия, 0 означает уровень по умолчанию.
+	Level int
+	// MinSize минимальная длина пакета, который сжимается, 0 означает DefaultCompressionMinSize.
+	MinSize int
+}
+
+// offer возвращает маску алгоритмов, которые предлагаются получателю.
+func (c *CompressionConfig) offer() (uint8, error) {
+	if c == nil {
+		return compressionNone, nil
+	}
+	switch c.Codec {
+	case "", CompressionNone:
+		return compressionNone, nil
+	case CompressionZstd:
+		return compressionZstd, nil
+	default:
+		return 0, fmt.Errorf("%s: %w", c.Codec, ErrUnknownCompression)
+	}
+}
+
+// chooseCompression выбирает алгоритм сжатия из предложенных отправителем.
+func chooseCompression(offer uint8) uint8 {
+	if offer&compressionZstd != 0 {
+		return compressionZstd
+	}
+	return compressionNone
+}
+
+func compressionName(compression uint8) string {
+	if compression == compressionZstd {
+		return CompressionZstd
+	}
+	return CompressionNone
+}
+
+// frameWriter передает пакеты сообщений кадрами, содержимое кадра сжимается,
+// если его длина не меньше минимальной и сжатие уменьшает её.
+type frameWriter struct {
+	w       io.Writer
+	level   int
+	minSize int
+
+	compressed []byte
+}
+
+func newFrameWriter(w io.Writer, cfg *CompressionConfig) *frameWriter {
+	fw := &frameWriter{
+		w:       w,
+		level:   zstd.DefaultCompression,
+		minSize: DefaultCompressionMinSize,
+	}
+	if cfg.Level != 0 {
+		fw.level = cfg.Level
+	}
+	if cfg.MinSize != 0 {
+		fw.minSize = cfg.MinSize
+	}
+	return fw
+}
+
+// WriteFrame передает payload одним кадром.
+func (w *frameWriter) WriteFrame(payload []byte) error {
+	if len(payload) > maxFrameLength {
+		return fmt.Errorf("frame with length %d: %w", len(payload), ErrFrameTooLong)
+	}
+
+	if len(payload) >= w.minSize {
+		var err error
+		w.compressed, err = zstd.CompressLevel(w.compressed[:0], payload, w.level)
+		if err != nil {
+			return fmt.Errorf("can not compress frame: %w", err)
+		}
+		if len(w.compressed) < len(payload) {
+			header := []uint32{compressedFrameFlag | uint32(len(w.compressed)), uint32(len(payload))}
+			if err := binary.Write(w.w, binary.BigEndian, header); err != nil {
+				return fmt.Errorf("can not write frame header: %w", err)
+			}
+			if _, err := w.w.Write(w.compressed); err != nil {
+				return fmt.Errorf("can not write frame: %w", err)
+			}
+			return nil
+		}
+	}
+
+	if err := binary.Write(w.w, binary.BigEndian, uint32(len(payload))); err != nil {
+		return fmt.Errorf("can not write frame header: %w", err)
+	}
+	if _, err := w.w.Write(payload); err != nil {
+		return fmt.Errorf("can not write frame: %w", err)
+	}
+	return nil
+}
+
+// frameReader читает содержимое кадров как непрерывный поток,
+// поэтому сообщения из него читаются так же, как из соединения без сжатия.
+type frameReader struct {
+	r       io.Reader
+	current io.Reader
+
+	compressed []byte
+	payload    []byte
+}
+
+func newFrameReader(r io.Reader) *frameReader {
+	return &frameReader{r: r}
+}
+
+func (f *frameReader) Read(p []byte) (int, error) {
+	for {
+		if f.current != nil {
+			n, err := f.current.Read(p)
+			if n != 0 || !errors.Is(err, io.EOF) {
+				return n, err
+			}
+		}
+		if err := f.nextFrame(); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (f *frameReader) nextFrame() error {
+	var length uint32
+	if err := binary.Read(f.r, binary.BigEndian, &length); err != nil {
+		return err
+	}
+	if length&compressedFrameFlag == 0 {
+		if length > maxFrameLength {
+			return fmt.Errorf("frame with length %d: %w", length, ErrFrameTooLong)
+		}
+		f.current = io.LimitReader(f.r, int64(length))
+		return nil
+	}
+
+	length &^= compressedFrameFlag
+	var payloadLength uint32
+	if err := binary.Read(f.r, binary.BigEndian, &payloadLength); err != nil {
+		return fmt.Errorf("can not read frame length: %w", err)
+	}
+	if length > maxFrameLength || payloadLength > maxFrameLength {
+		return fmt.Errorf("frame with length %d: %w", payloadLength, ErrFrameTooLong)
+	}
+
+	f.compressed = resizeBuffer(f.compressed, int(length))
+	if _, err := io.ReadFull(f.r, f.compressed); err != nil {
+		return fmt.Errorf("can not read frame: %w", err)
+	}
+	// Длина содержимого известна заранее, поэтому распаковка не выделяет больше памяти.
+	f.payload = resizeBuffer(f.payload, int(payloadLength))
+	decompressor := zstd.NewReader(bytes.NewReader(f.compressed))
+	defer decompressor.Close()
+	if _, err := io.ReadFull(decompressor, f.payload); err != nil {
+		return fmt.Errorf("can not decompress frame: %w", err)
+	}
+	f.current = bytes.NewReader(f.payload)
+	return nil
+}
+
+func resizeBuffer(b []byte, size int) []byte {
+	if cap(b) < size {
+		return make([]byte, size)
+	}
+	return b[:size]
+}
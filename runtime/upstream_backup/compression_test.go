@@ -0,0 +1,145 @@
+package upstreambackup
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testProtocol параметры соединения, в котором стороны поддерживают все возможности.
+var testProtocol = linkProtocol{Version: maxProtocolVersion, Capabilities: supportedCapabilities}
+
+func writeTestMessages(t testing.TB, w *bytes.Buffer, from, to uint64, data []byte) {
+	for id := from; id < to; id++ {
+		msg := &dataMessage{
+			Header:   dataMessageHeader{MessageID: id, MessageLength: uint32(len(data))},
+			Metadata: []byte("meta"),
+			Data:     data,
+		}
+		if err := msg.writeOut(w, testProtocol); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCompressionOffer(t *testing.T) {
+	var nilConfig *CompressionConfig
+	offer, err := nilConfig.offer()
+	assert.NoError(t, err)
+	assert.Equal(t, compressionNone, offer)
+
+	offer, err = (&CompressionConfig{Codec: CompressionZstd}).offer()
+	assert.NoError(t, err)
+	assert.Equal(t, compressionZstd, offer)
+	assert.Equal(t, compressionZstd, chooseCompression(offer))
+	assert.Equal(t, compressionNone, chooseCompression(compressionNone))
+
+	_, err = (&CompressionConfig{Codec: "lz4"}).offer()
+	assert.ErrorIs(t, err, ErrUnknownCompression)
+}
+
+func TestFrameRoundtrip(t *testing.T) {
+	data := bytes.Repeat([]byte("data"), 64)
+
+	var stream bytes.Buffer
+	frames := newFrameWriter(&stream, &CompressionConfig{Codec: CompressionZstd, MinSize: 512})
+
+	// Первый пакет меньше порога и передается без сжатия.
+	var batch bytes.Buffer
+	writeTestMessages(t, &batch, 1, 2, data)
+	assert.NoError(t, frames.WriteFrame(batch.Bytes()))
+	var header uint32
+	assert.NoError(t, binary.Read(bytes.NewReader(stream.Bytes()), binary.BigEndian, &header))
+	assert.Zero(t, header&compressedFrameFlag)
+	assert.EqualValues(t, batch.Len(), header)
+
+	uncompressedLength := stream.Len()
+	batch.Reset()
+	writeTestMessages(t, &batch, 2, 10, data)
+	assert.NoError(t, frames.WriteFrame(batch.Bytes()))
+	assert.NoError(t, binary.Read(bytes.NewReader(stream.Bytes()[uncompressedLength:]), binary.BigEndian, &header))
+	assert.NotZero(t, header&compressedFrameFlag)
+	assert.Less(t, stream.Len()-uncompressedLength, batch.Len())
+
+	reader := newFrameReader(&stream)
+	for id := uint64(1); id < 10; id++ {
+		msg := &dataMessage{}
+		assert.NoError(t, msg.readIn(reader, testProtocol))
+		assert.Equal(t, id, msg.Header.MessageID)
+		assert.Equal(t, []byte("meta"), msg.Metadata)
+		assert.Equal(t, data, msg.Data)
+	}
+}
+
+func TestFrameReaderTooLong(t *testing.T) {
+	var stream bytes.Buffer
+	binary.Write(&stream, binary.BigEndian, []uint32{compressedFrameFlag | 16, maxFrameLength + 1})
+
+	msg := &dataMessage{}
+	assert.ErrorIs(t, msg.readIn(newFrameReader(&stream), testProtocol), ErrFrameTooLong)
+}
+
+func TestDownstreamForwarderCompression(t *testing.T) {
+	l := newTestLog(t)
+	data := bytes.Repeat([]byte("data"), 64)
+	logger, err := newTestLogger()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	received := make(chan []*dataMessage)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			t.Error(err)
+			close(received)
+			return
+		}
+		defer conn.Close()
+		if err := acceptTestHello(conn, compressionZstd); err != nil {
+			t.Error(err)
+			close(received)
+			return
+		}
+
+		reader := newFrameReader(conn)
+		messages := make([]*dataMessage, 0, 10)
+		for len(messages) < cap(messages) {
+			msg := &dataMessage{}
+			if err := msg.readIn(reader, testProtocol); err != nil {
+				t.Error(err)
+				break
+			}
+			messages = append(messages, msg)
+		}
+		received <- messages
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	compression := &CompressionConfig{Codec: CompressionZstd, MinSize: 1}
+	downstream := NewDownstreamForwarder(0, "test", listener.Addr().String(), l.NewIterator(), nil, 0, compression, nil, logger)
+	go downstream.Run(ctx)
+	go func() {
+		for range downstream.acks {
+		}
+	}()
+
+	writeTestLog(t, l, 0, 10, data)
+	messages := <-received
+	assert.Len(t, messages, 10)
+	for i, msg := range messages {
+		assert.EqualValues(t, i, msg.Header.MessageID)
+		assert.Equal(t, data, msg.Data)
+	}
+}
@@ -0,0 +1,82 @@
+package upstreambackup
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	actionlib "github.com/GDVFox/gostreaming/lib/go-actionlib"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeadLetterRoutes(t *testing.T) {
+	routes, err := newOutputRoutes([]string{"", RouteDeadLetter, RouteRoundRobin}, 4)
+	assert.NoError(t, err)
+	assert.Equal(t, &outputRoute{mode: RouteBroadcast}, routes[0])
+	assert.Equal(t, &outputRoute{mode: RouteDeadLetter, position: 0, size: 1}, routes[1])
+	assert.Equal(t, &outputRoute{mode: RouteBroadcast}, routes[3])
+
+	item := testRoutedItem(t, 1, "")
+	deadLetter := testRoutedItem(t, 2, "")
+	deadLetter.Header.Flags |= forwardLogDeadLetterFlag
+	for i, route := range routes {
+		assert.Equal(t, i != 1, route.accepts(item), "route %d", i)
+		assert.Equal(t, i == 1, route.accepts(deadLetter), "route %d", i)
+	}
+}
+
+func TestForwardLogDeadLetter(t *testing.T) {
+	l := newTestLog(t)
+	assert.NoError(t, l.Write(0, 1, 1, nil, []byte("data"), true))
+	assert.NoError(t, l.WriteDeadLetter(0, 2, 2, nil, []byte("rejected"), true))
+
+	items, err := l.NewIterator().NextBatch(context.Background(), 10, 1<<20, nil)
+	assert.NoError(t, err)
+	if assert.Len(t, items, 2) {
+		assert.Zero(t, items[0].Header.Flags&forwardLogDeadLetterFlag)
+		assert.NotZero(t, items[1].Header.Flags&forwardLogDeadLetterFlag)
+		assert.Zero(t, items[1].Header.Flags&forwardLogPartialFlag)
+	}
+
+	// Отклоненные сообщения подтверждают входные так же, как обычные выходы.
+	inputMax, err := l.Trim(2)
+	assert.NoError(t, err)
+	assert.Equal(t, map[uint16]uint64{0: 2}, inputMax)
+}
+
+func TestWithDeadLetterHeaders(t *testing.T) {
+	source := &actionlib.Envelope{Key: []byte("key"), Headers: map[string]string{"h": "v"}}
+	encoded, err := actionlib.EncodeMetadata(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	withHeaders, err := WithDeadLetterHeaders(encoded, "scheme_a", "bad message", 3)
+	assert.NoError(t, err)
+	e := &actionlib.Envelope{}
+	assert.NoError(t, actionlib.DecodeMetadata(withHeaders, e))
+	assert.Equal(t, source.Key, e.Key)
+	assert.Equal(t, map[string]string{
+		"h":                     "v",
+		DeadLetterNodeHeader:    "scheme_a",
+		DeadLetterReasonHeader:  "bad message",
+		DeadLetterCrashesHeader: "3",
+	}, e.Headers)
+
+	withHeaders, err = WithDeadLetterHeaders(nil, "scheme_a", "bad message", 0)
+	assert.NoError(t, err)
+	e = &actionlib.Envelope{}
+	assert.NoError(t, actionlib.DecodeMetadata(withHeaders, e))
+	assert.NotContains(t, e.Headers, DeadLetterCrashesHeader)
+
+	_, err = WithDeadLetterHeaders(nil, "scheme_a", strings.Repeat("x", MaxMetadataLength), 0)
+	assert.ErrorIs(t, err, ErrMetadataTooLong)
+}
+
+func TestNewDetachedMessage(t *testing.T) {
+	msg := NewDetachedMessage([]byte{metadataVersion}, []byte("data"))
+	assert.True(t, msg.Detached)
+	assert.EqualValues(t, 4, msg.Header.MessageLength)
+	assert.Equal(t, []byte("data"), msg.Data)
+	assert.Empty(t, msg.Upstream)
+}
@@ -0,0 +1,359 @@
+package upstreambackup
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+// outputReservation число номеров выходных сообщений, которые резервируются в копии одной записью.
+const outputReservation = 1 << 16
+
+// Ключи хранилища доставленных сообщений.
+const (
+	deliveredKeyPrefix = "delivered/"
+	inputKeyPrefix     = "input/"
+	nextInputKey       = "next_input"
+	// nextOutputKey хранится только в копии, локально нумерацию сохраняет forward log.
+	nextOutputKey = "next_output"
+)
+
+// DeliveryStore хранит для каждого вышестоящего узла номер сообщения, до которого
+// включительно все его сообщения обработаны, и используется в режиме exactly-once.
+// После перезапуска вышестоящий узел повторно отправляет неподтвержденные сообщения,
+// уже обработанные из них отбрасываются, а не передаются действию второй раз.
+//
+// Номера входов выдаются хранилищем и не повторяются между перезапусками,
+// а имя узла каждого входа сохраняется до получения первого сообщения по нему.
+// Поэтому, если runtime завершился между записью выхода в forward log и отметкой
+// о доставке, граница доставки восстанавливается по записям forward log, см. Recover.
+//
+// Если задана копия, то границы подтвержденных сообщений записываются в нее вместе
+// с состоянием, а номера выходных сообщений резервируются в ней заранее. Поэтому после
+// запуска на другой машине без локальных данных подтвержденные сообщения не обрабатываются
+// повторно, а нумерация выходных сообщений продолжается с зарезервированного номера.
+type DeliveryStore struct {
+	lock sync.Mutex
+
+	db *leveldb.DB
+	// replica копия границ вне машины, nil если копия не используется.
+	replica StateReplica
+
+	// nextInput номер, который получит следующий вход. После 65535 нумерация
+	// начинается заново, к этому моменту записи старых входов уже удалены из forward log.
+	nextInput uint16
+	inputs    map[uint16]string
+	// delivered граница сохраненных обработанных сообщений каждого узла.
+	delivered map[string]uint64
+	// received граница сообщений каждого узла, переданных действию в текущем запуске.
+	// Она нужна, если узел переподключился раньше, чем закончилась обработка
+	// сообщений, полученных по прежнему соединению.
+	received map[string]uint64
+	// replicated границы, записанные в копию.
+	replicated map[string]uint64
+	// nextOutput номер, с которого продолжается нумерация выходных сообщений по данным копии.
+	nextOutput uint64
+	// reservedOutput номер, до которого номера выходных сообщений зарезервированы в копии.
+	reservedOutput uint64
+}
+
+// DeliveryMarks границы доставки, которые хранятся в копии состояния.
+type DeliveryMarks struct {
+	// Delivered граница подтвержденных сообщений каждого вышестоящего узла.
+	Delivered map[string]uint64
+	// NextOutput номер, до которого зарезервированы номера выходных сообщений, 0 если не изменился.
+	NextOutput uint64
+}
+
+// NewDeliveryStore открывает хранилище в deliveryDir. Как и состояние действия,
+// данные хранилища не удаляются при закрытии.
+// Если задана replica, то к локальным границам добавляются границы из копии, так как
+// локальное хранилище могло отсутствовать, если действие до этого работало на другой машине.
+func NewDeliveryStore(deliveryDir string, replica StateReplica) (*DeliveryStore, error) {
+	db, err := leveldb.OpenFile(deliveryDir, nil)
+	if err != nil {
+		return nil, fmt.Errorf("can not open underlying db: %w", err)
+	}
+
+	s := &DeliveryStore{
+		db:         db,
+		replica:    replica,
+		inputs:     make(map[uint16]string),
+		delivered:  make(map[string]uint64),
+		received:   make(map[string]uint64),
+		replicated: make(map[string]uint64),
+	}
+	if err := s.load(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if replica != nil {
+		if err := s.restore(); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *DeliveryStore) load() error {
+	iter := s.db.NewIterator(nil, nil)
+	defer iter.Release()
+
+	for iter.Next() {
+		key, value := string(iter.Key()), iter.Value()
+		switch {
+		case key == nextInputKey && len(value) == 2:
+			s.nextInput = binary.BigEndian.Uint16(value)
+		case strings.HasPrefix(key, deliveredKeyPrefix) && len(value) == 8:
+			s.delivered[strings.TrimPrefix(key, deliveredKeyPrefix)] = binary.BigEndian.Uint64(value)
+		case strings.HasPrefix(key, inputKeyPrefix) && len(key) == len(inputKeyPrefix)+2:
+			inputID := binary.BigEndian.Uint16([]byte(key[len(inputKeyPrefix):]))
+			s.inputs[inputID] = string(value)
+		default:
+			return fmt.Errorf("unexpected delivery key %q", key)
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return fmt.Errorf("can not load deliveries: %w", err)
+	}
+	return nil
+}
+
+// restore добавляет к локальным границам границы из копии. Локальные границы могут быть больше,
+// так как отметки о доставке делаются до подтверждения сообщений, а в копию попадают после.
+func (s *DeliveryStore) restore() error {
+	marks, err := s.replica.LoadDelivery()
+	if err != nil {
+		return fmt.Errorf("can not load delivery replica: %w", err)
+	}
+
+	batch := new(leveldb.Batch)
+	for name, msgID := range marks.Delivered {
+		s.replicated[name] = msgID
+		if delivered, ok := s.delivered[name]; !ok || msgID > delivered {
+			s.delivered[name] = msgID
+			batch.Put(deliveredKey(name), uint64Bytes(msgID))
+		}
+	}
+	if err := s.db.Write(batch, &opt.WriteOptions{Sync: true}); err != nil {
+		return fmt.Errorf("can not restore deliveries: %w", err)
+	}
+	s.nextOutput = marks.NextOutput
+	s.reservedOutput = marks.NextOutput
+	return nil
+}
+
+// Register выдает номер входа для нового соединения с узлом name.
+func (s *DeliveryStore) Register(name string) (uint16, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	inputID := s.nextInput
+	batch := new(leveldb.Batch)
+	batch.Put(inputKey(inputID), []byte(name))
+	batch.Put([]byte(nextInputKey), uint16Bytes(inputID+1))
+	if err := s.db.Write(batch, &opt.WriteOptions{Sync: true}); err != nil {
+		return 0, fmt.Errorf("can not register input: %w", err)
+	}
+
+	s.nextInput++
+	s.inputs[inputID] = name
+	return inputID, nil
+}
+
+// Recover переносит в хранилище границы restored, полученные из записей forward log,
+// оставшихся после предыдущего запуска, и удаляет имена входов предыдущих запусков.
+// Recover должен вызываться до регистрации первого входа.
+func (s *DeliveryStore) Recover(restored map[uint16]uint64) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	batch := new(leveldb.Batch)
+	for inputID, msgID := range restored {
+		name, ok := s.inputs[inputID]
+		if !ok {
+			continue
+		}
+		if delivered, ok := s.delivered[name]; !ok || msgID > delivered {
+			s.delivered[name] = msgID
+			batch.Put(deliveredKey(name), uint64Bytes(msgID))
+		}
+	}
+	// Границы записей прежних входов уже перенесены, а новые записи forward log
+	// будут ссылаться только на новые входы.
+	for inputID := range s.inputs {
+		batch.Delete(inputKey(inputID))
+	}
+	if err := s.db.Write(batch, &opt.WriteOptions{Sync: true}); err != nil {
+		return fmt.Errorf("can not recover deliveries: %w", err)
+	}
+	s.inputs = make(map[uint16]string)
+	return nil
+}
+
+// MarkDelivered отмечает, что обработаны все сообщения входа inputID до msgID включительно.
+// Отметки не сбрасываются на диск сразу, как и записи forward log, после отказа
+// потерянные отметки восстанавливаются по forward log. Сообщения без записей в логе,
+// например, в конечных узлах, в этом случае передаются действию повторно
+// и отбрасываются им по заголовкам доставки, см. WithDeliveryHeaders.
+func (s *DeliveryStore) MarkDelivered(inputID uint16, msgID uint64) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	name, ok := s.inputs[inputID]
+	if !ok {
+		return nil
+	}
+	if delivered, ok := s.delivered[name]; ok && msgID <= delivered {
+		return nil
+	}
+	if err := s.db.Put(deliveredKey(name), uint64Bytes(msgID), nil); err != nil {
+		return fmt.Errorf("can not mark delivered: %w", err)
+	}
+	s.delivered[name] = msgID
+	return nil
+}
+
+// Received отмечает, что сообщение msgID узла name передано действию.
+func (s *DeliveryStore) Received(name string, msgID uint64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if received, ok := s.received[name]; !ok || msgID > received {
+		s.received[name] = msgID
+	}
+}
+
+// Replayed проверяет, было ли сообщение msgID узла name уже получено.
+// delivered выставляется, если обработка сообщения завершена и сохранена,
+// такое сообщение можно сразу подтвердить.
+func (s *DeliveryStore) Replayed(name string, msgID uint64) (replayed bool, delivered bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if last, ok := s.delivered[name]; ok && msgID <= last {
+		return true, true
+	}
+	if last, ok := s.received[name]; ok && msgID <= last {
+		return true, false
+	}
+	return false, false
+}
+
+// NextOutput возвращает номер, не меньше которого должно получить первое выходное сообщение,
+// чтобы нумерация продолжалась после запуска на другой машине.
+func (s *DeliveryStore) NextOutput() uint64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.nextOutput
+}
+
+// ReserveOutput резервирует в копии номер выходного сообщения msgID. Номера резервируются
+// по outputReservation за раз, поэтому копия изменяется редко. Нижестоящие узлы отбрасывают
+// сообщения с уже полученными номерами, поэтому после запуска на другой машине нумерация
+// продолжается с зарезервированного номера, а не начинается заново.
+func (s *DeliveryStore) ReserveOutput(msgID uint64) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.replica == nil || msgID < s.reservedOutput {
+		return nil
+	}
+	reserved := msgID + outputReservation
+	if err := s.replica.Apply(nil, &DeliveryMarks{NextOutput: reserved}); err != nil {
+		return fmt.Errorf("can not reserve output numbers: %w", err)
+	}
+	s.reservedOutput = reserved
+	return nil
+}
+
+// Committed возвращает границы сообщений, подтвержденных ack, которые ещё не записаны в копию,
+// или nil, если копия не используется или записывать нечего.
+// Границы записываются в копию вместе с состоянием, после чего вызывается Replicated.
+func (s *DeliveryStore) Committed(ack UpstreamAck) *DeliveryMarks {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.replica == nil {
+		return nil
+	}
+	delivered := make(map[string]uint64)
+	for inputID, msgID := range ack {
+		name, ok := s.inputs[inputID]
+		if !ok {
+			continue
+		}
+		if replicated, ok := s.replicated[name]; ok && msgID <= replicated {
+			continue
+		}
+		if current, ok := delivered[name]; !ok || msgID > current {
+			delivered[name] = msgID
+		}
+	}
+	if len(delivered) == 0 {
+		return nil
+	}
+	return &DeliveryMarks{Delivered: delivered}
+}
+
+// Replicated отмечает, что границы marks записаны в копию.
+func (s *DeliveryStore) Replicated(marks *DeliveryMarks) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for name, msgID := range marks.Delivered {
+		if replicated, ok := s.replicated[name]; !ok || msgID > replicated {
+			s.replicated[name] = msgID
+		}
+	}
+}
+
+// Replicate записывает в копию границы marks без изменений состояния.
+// Используется, если состояние для действия не используется.
+func (s *DeliveryStore) Replicate(marks *DeliveryMarks) error {
+	if err := s.replica.Apply(nil, marks); err != nil {
+		return fmt.Errorf("can not replicate deliveries: %w", err)
+	}
+	s.Replicated(marks)
+	return nil
+}
+
+// InputName возвращает имя узла, которому был выдан номер входа inputID.
+func (s *DeliveryStore) InputName(inputID uint16) (string, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	name, ok := s.inputs[inputID]
+	return name, ok
+}
+
+// Close закрывает хранилище.
+func (s *DeliveryStore) Close() error {
+	return s.db.Close()
+}
+
+func deliveredKey(name string) []byte {
+	return []byte(deliveredKeyPrefix + name)
+}
+
+func inputKey(inputID uint16) []byte {
+	return append([]byte(inputKeyPrefix), uint16Bytes(inputID)...)
+}
+
+func uint16Bytes(v uint16) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, v)
+	return b
+}
+
+func uint64Bytes(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
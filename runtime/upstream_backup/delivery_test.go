@@ -0,0 +1,354 @@
+package upstreambackup
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	actionlib "github.com/GDVFox/gostreaming/lib/go-actionlib"
+	"github.com/stretchr/testify/assert"
+)
+
+func openTestDeliveryStore(t *testing.T, dir string, replica StateReplica) *DeliveryStore {
+	s, err := NewDeliveryStore(dir, replica)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestDeliveryStoreReopen(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestDeliveryStore(t, dir, nil)
+
+	first, err := s.Register("a")
+	assert.NoError(t, err)
+	second, err := s.Register("a")
+	assert.NoError(t, err)
+	assert.NotEqual(t, first, second)
+
+	assert.NoError(t, s.MarkDelivered(first, 3))
+	assert.NoError(t, s.MarkDelivered(second, 2))
+	s.Received("a", 5)
+
+	replayed, delivered := s.Replayed("a", 3)
+	assert.True(t, replayed)
+	assert.True(t, delivered)
+	replayed, delivered = s.Replayed("a", 5)
+	assert.True(t, replayed)
+	assert.False(t, delivered)
+	replayed, _ = s.Replayed("a", 6)
+	assert.False(t, replayed)
+	replayed, _ = s.Replayed("b", 0)
+	assert.False(t, replayed)
+	assert.NoError(t, s.Close())
+
+	// После перезапуска известны только сохраненные границы, а номера входов не повторяются.
+	s = openTestDeliveryStore(t, dir, nil)
+	defer s.Close()
+	assert.NoError(t, s.Recover(nil))
+
+	replayed, delivered = s.Replayed("a", 3)
+	assert.True(t, replayed)
+	assert.True(t, delivered)
+	replayed, _ = s.Replayed("a", 4)
+	assert.False(t, replayed)
+
+	third, err := s.Register("a")
+	assert.NoError(t, err)
+	assert.NotEqual(t, first, third)
+	assert.NotEqual(t, second, third)
+}
+
+func TestDeliveryStoreRecover(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestDeliveryStore(t, filepath.Join(dir, "delivery"), nil)
+	l, err := NewForwardLog(filepath.Join(dir, "log"), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inputID, err := s.Register("a")
+	assert.NoError(t, err)
+	assert.NoError(t, l.Write(inputID, 1, 0, nil, []byte("data"), true))
+	assert.NoError(t, s.MarkDelivered(inputID, 1))
+	// Отказ между записью в лог и отметкой о доставке.
+	assert.NoError(t, l.Write(inputID, 2, 1, nil, []byte("data"), true))
+	// Выход не последний, поэтому сообщение 3 ещё не обработано.
+	assert.NoError(t, l.Write(inputID, 3, 2, nil, []byte("data"), false))
+	assert.NoError(t, l.Close())
+	assert.NoError(t, s.Close())
+
+	s = openTestDeliveryStore(t, filepath.Join(dir, "delivery"), nil)
+	defer s.Close()
+	l, err = NewForwardLog(filepath.Join(dir, "log"), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	assert.NoError(t, s.Recover(l.RestoredInputs()))
+
+	replayed, delivered := s.Replayed("a", 2)
+	assert.True(t, replayed)
+	assert.True(t, delivered)
+	replayed, _ = s.Replayed("a", 3)
+	assert.False(t, replayed)
+}
+
+func TestWithDeliveryHeaders(t *testing.T) {
+	source := &actionlib.Envelope{Key: []byte("key"), Headers: map[string]string{"h": "v"}}
+	encoded, err := actionlib.EncodeMetadata(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, metadata := range [][]byte{nil, encoded} {
+		withHeaders, err := WithDeliveryHeaders(metadata, "scheme_a", 1<<40)
+		assert.NoError(t, err)
+
+		e := &actionlib.Envelope{}
+		assert.NoError(t, actionlib.DecodeMetadata(withHeaders, e))
+		d, err := actionlib.DeliveryOf(e)
+		assert.NoError(t, err)
+		assert.Equal(t, actionlib.Delivery{Upstream: "scheme_a", MessageID: 1 << 40}, d)
+		if metadata != nil {
+			assert.Equal(t, source.Key, e.Key)
+			assert.Equal(t, "v", e.Headers["h"])
+		}
+	}
+
+	_, err = WithDeliveryHeaders([]byte{2, 0}, "scheme_a", 1)
+	assert.ErrorIs(t, err, ErrBadMetadata)
+}
+
+// testUpstream вышестоящий узел, который отправляет сообщения DefaultReceiver.
+type testUpstream struct {
+	conn     net.Conn
+	protocol linkProtocol
+}
+
+func dialTestUpstream(t *testing.T, addr, name string) *testUpstream {
+	var conn net.Conn
+	var err error
+	// Receiver начинает слушать адрес асинхронно.
+	for i := 0; i < 100; i++ {
+		if conn, err = net.Dial("tcp", addr); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hello := &helloMessage{Name: []byte(name), NameLength: uint32(len(name))}
+	hello.helloVersionHeader = helloVersionHeader{
+		MinVersion:   minProtocolVersion,
+		MaxVersion:   maxProtocolVersion,
+		Capabilities: capabilityMetadata,
+	}
+	reply := &helloReplyMessage{}
+	if err := hello.writeOut(conn); err != nil {
+		t.Fatal(err)
+	}
+	if err := reply.readIn(conn); err != nil {
+		t.Fatal(err)
+	}
+	return &testUpstream{conn: conn, protocol: linkProtocol{Version: reply.Version, Capabilities: reply.Capabilities}}
+}
+
+func (u *testUpstream) send(t *testing.T, from, to uint64) {
+	for id := from; id < to; id++ {
+		msg := &dataMessage{Header: dataMessageHeader{MessageID: id, MessageLength: 4}, Data: []byte("data")}
+		if err := msg.writeOut(u.conn, u.protocol); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func (u *testUpstream) readAck(t *testing.T) uint64 {
+	u.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var ack ackMessage
+	if err := ack.readIn(u.conn, u.protocol); err != nil {
+		t.Fatal(err)
+	}
+	return uint64(ack)
+}
+
+// runTestReceiver запускает DefaultReceiver в режиме exactly-once, остановка имитирует отказ runtime.
+// replica копия границ доставки, может быть nil.
+func runTestReceiver(t *testing.T, deliveryDir string, replica StateReplica) (*DefaultReceiver, *DeliveryStore, string, func()) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	logger, err := newTestLogger()
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := openTestDeliveryStore(t, deliveryDir, replica)
+	assert.NoError(t, store.Recover(nil))
+	receiver := NewDefaultReceiver(addr, []string{"upstream"}, nil, store, logger)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		receiver.Run(ctx)
+	}()
+	return receiver, store, addr, func() {
+		cancel()
+		<-done
+		store.Close()
+	}
+}
+
+func receiveTestMessages(t *testing.T, r *DefaultReceiver, count int) []*UpstreamMessage {
+	msgs := make([]*UpstreamMessage, 0, count)
+	for len(msgs) < count {
+		select {
+		case msg := <-r.Messages():
+			msgs = append(msgs, msg)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("got %d messages of %d", len(msgs), count)
+		}
+	}
+	return msgs
+}
+
+func assertNoTestMessages(t *testing.T, r *DefaultReceiver) {
+	select {
+	case msg := <-r.Messages():
+		t.Fatalf("got unexpected message %d", msg.Header.MessageID)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestExactlyOnceReplay(t *testing.T) {
+	deliveryDir := t.TempDir()
+	receiver, store, addr, stop := runTestReceiver(t, deliveryDir, nil)
+
+	upstream := dialTestUpstream(t, addr, "upstream")
+	upstream.send(t, 1, 6)
+	msgs := receiveTestMessages(t, receiver, 5)
+	// Обработаны только первые три сообщения, остальные ещё у действия.
+	assert.NoError(t, store.MarkDelivered(msgs[2].InputID, 3))
+
+	// Переподключение: вышестоящий узел отправляет все неподтвержденные сообщения заново.
+	upstream.conn.Close()
+	upstream = dialTestUpstream(t, addr, "upstream")
+	upstream.send(t, 1, 7)
+	msgs = receiveTestMessages(t, receiver, 1)
+	assert.EqualValues(t, 6, msgs[0].Header.MessageID)
+	assert.Equal(t, "upstream", msgs[0].Upstream)
+	for id := uint64(1); id <= 3; id++ {
+		assert.Equal(t, id, upstream.readAck(t))
+	}
+	assertNoTestMessages(t, receiver)
+
+	// Отказ runtime до завершения обработки сообщений 4-6.
+	upstream.conn.Close()
+	stop()
+
+	receiver, _, addr, stop = runTestReceiver(t, deliveryDir, nil)
+	defer stop()
+	upstream = dialTestUpstream(t, addr, "upstream")
+	defer upstream.conn.Close()
+	upstream.send(t, 1, 7)
+	msgs = receiveTestMessages(t, receiver, 3)
+	for i, msg := range msgs {
+		assert.EqualValues(t, 4+i, msg.Header.MessageID)
+	}
+	assertNoTestMessages(t, receiver)
+}
+
+func TestExactlyOnceRelocation(t *testing.T) {
+	replica := &memoryReplica{}
+	state, err := NewStateStore(t.TempDir(), replica)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer state.Close()
+
+	receiver, store, addr, stop := runTestReceiver(t, t.TempDir(), replica)
+	upstream := dialTestUpstream(t, addr, "upstream")
+	upstream.send(t, 1, 6)
+	msgs := receiveTestMessages(t, receiver, 5)
+	inputID := msgs[0].InputID
+
+	// Сообщения 1-3 обработаны и подтверждены вместе с изменениями состояния,
+	// сообщение 4 обработано, но не подтверждено, сообщение 5 ещё у действия.
+	for _, msg := range msgs[:4] {
+		input := StateInput{InputID: inputID, MessageID: msg.Header.MessageID}
+		assert.NoError(t, state.Put(input, []byte("count"), []byte{byte(msg.Header.MessageID)}))
+		assert.NoError(t, store.MarkDelivered(inputID, msg.Header.MessageID))
+	}
+	ack := UpstreamAck{inputID: 3}
+	marks := store.Committed(ack)
+	assert.Equal(t, &DeliveryMarks{Delivered: map[string]uint64{"upstream": 3}}, marks)
+	assert.NoError(t, state.Commit(ack, marks))
+	store.Replicated(marks)
+	assert.Nil(t, store.Committed(ack))
+
+	// Отказ машины: подтверждение не дошло до вышестоящего узла, а локальные данные потеряны.
+	upstream.conn.Close()
+	stop()
+
+	// На другой машине каталог отметок пуст, но подтвержденные сообщения известны из копии.
+	receiver, _, addr, stop = runTestReceiver(t, t.TempDir(), replica)
+	defer stop()
+	upstream = dialTestUpstream(t, addr, "upstream")
+	defer upstream.conn.Close()
+	upstream.send(t, 1, 7)
+	msgs = receiveTestMessages(t, receiver, 3)
+	for i, msg := range msgs {
+		assert.EqualValues(t, 4+i, msg.Header.MessageID)
+	}
+	for id := uint64(1); id <= 3; id++ {
+		assert.Equal(t, id, upstream.readAck(t))
+	}
+	assertNoTestMessages(t, receiver)
+}
+
+func TestDeliveryStoreReserveOutput(t *testing.T) {
+	replica := &memoryReplica{}
+	s := openTestDeliveryStore(t, t.TempDir(), replica)
+
+	// Номера резервируются заранее, поэтому копия изменяется только при исчерпании резерва.
+	assert.NoError(t, s.ReserveOutput(0))
+	assert.EqualValues(t, outputReservation, replica.nextOutput)
+	assert.NoError(t, s.ReserveOutput(outputReservation-1))
+	assert.EqualValues(t, outputReservation, replica.nextOutput)
+	assert.NoError(t, s.ReserveOutput(outputReservation))
+	assert.EqualValues(t, 2*outputReservation, replica.nextOutput)
+	assert.NoError(t, s.Close())
+
+	// На другой машине нумерация продолжается после всех номеров, которые могли быть использованы.
+	s = openTestDeliveryStore(t, t.TempDir(), replica)
+	defer s.Close()
+	assert.EqualValues(t, 2*outputReservation, s.NextOutput())
+
+	logger, err := newTestLogger()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &DefaultForwarderConfig{
+		ACKPeriod:     time.Second,
+		ForwardLogDir: t.TempDir(),
+		Storage:       StorageConfig{Backend: StorageMemory},
+		Delivery:      s,
+	}
+	f, err := NewDefaultForwarder("test", []string{"downstream"}, cfg, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.forwardLog.Close()
+	assert.EqualValues(t, 2*outputReservation, f.messageIndex)
+	assert.NoError(t, f.ForwardDetached(nil, []byte("data")))
+	assert.EqualValues(t, 3*outputReservation, replica.nextOutput)
+}
@@ -1,10 +1,18 @@
 package upstreambackup
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
 	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/GDVFox/ctxio"
 	"github.com/GDVFox/gostreaming/util"
@@ -17,6 +25,13 @@ var (
 	ErrConnectionClosed = errors.New("can not write to closed connection")
 )
 
+// Ограничения пакета сообщений, которые читаются из лога и отправляются одной записью в соединение.
+const (
+	transmitBatchItems = 1024
+	transmitBatchBytes = 1 << 20
+	transmitBufferSize = 64 << 10
+)
+
 type downstreamAck struct {
 	ackMessage
 	DownstreamIndex uint16
@@ -27,7 +42,19 @@ type DownstreamForwarder struct {
 	writeCtx context.Context
 
 	iter *LogBufferIterator
-	acks chan *downstreamAck
+	// route выбирает записи лога, которые передаются получателю, nil означает все записи.
+	route   *outputRoute
+	tracker *routeTracker
+	// reportMutex упорядочивает передачу границ из цикла отправки и цикла подтверждений.
+	reportMutex sync.Mutex
+	window      *inFlightWindow
+	acks        chan *downstreamAck
+	compression *CompressionConfig
+	tlsConfig   *tls.Config
+	// protocol параметры протокола, на которые согласился получатель.
+	protocol linkProtocol
+	// lastSent номер последнего отправленного сообщения.
+	lastSent uint64
 
 	downstreamIndex uint16
 	name            string
@@ -36,15 +63,28 @@ type DownstreamForwarder struct {
 }
 
 // NewDownstreamForwarder создает новый объект DownstreamForwarder.
-func NewDownstreamForwarder(downstreamIndex uint16, name string, addr string, iter *LogBufferIterator, l *util.Logger) *DownstreamForwarder {
+// maxInFlight ограничивает число отправленных, но не подтвержденных сообщений, 0 отключает ограничение.
+// route может быть nil, если получатель получает все записи лога,
+// compression — если сообщения не сжимаются, tlsConfig — если соединение не защищено.
+func NewDownstreamForwarder(downstreamIndex uint16, name string, addr string, iter *LogBufferIterator, route *outputRoute,
+	maxInFlight int, compression *CompressionConfig, tlsConfig *tls.Config, l *util.Logger) *DownstreamForwarder {
+	var tracker *routeTracker
+	if route != nil {
+		tracker = &routeTracker{}
+	}
 	return &DownstreamForwarder{
 		downstreamIndex: downstreamIndex,
 		name:            name,
 		addr:            addr,
 
-		iter:   iter,
-		acks:   make(chan *downstreamAck),
-		logger: l.WithName("downstream_forwarder " + addr),
+		iter:        iter,
+		route:       route,
+		tracker:     tracker,
+		window:      newInFlightWindow(maxInFlight),
+		compression: compression,
+		tlsConfig:   tlsConfig,
+		acks:        make(chan *downstreamAck),
+		logger:      l.WithName("downstream_forwarder " + addr),
 	}
 }
 
@@ -57,9 +97,15 @@ func (f *DownstreamForwarder) Run(ctx context.Context) error {
 	if err != nil {
 		return fmt.Errorf("can not dial tcp: %w", err)
 	}
+	if f.tlsConfig != nil {
+		conn = tls.Client(conn, f.tlsConfig)
+	}
 	defer conn.Close()
 	tcpConn := connutil.NewDefaultConnection(conn)
 
+	if _, err := handshake(ctx, conn); err != nil {
+		return err
+	}
 	if err := f.sayHello(ctx, tcpConn); err != nil {
 		return fmt.Errorf("can not say hello: %w", err)
 	}
@@ -79,14 +125,48 @@ func (f *DownstreamForwarder) Run(ctx context.Context) error {
 func (f *DownstreamForwarder) sayHello(ctx context.Context, conn *connutil.Connection) error {
 	connWriter := ctxio.NewContextWriter(ctx, conn)
 	defer connWriter.Free()
+	connReader := ctxio.NewContextReader(ctx, conn)
+	defer connReader.Free()
+
+	offer, err := f.compression.offer()
+	if err != nil {
+		return err
+	}
 
 	hello := &helloMessage{}
+	hello.MinVersion = minProtocolVersion
+	hello.MaxVersion = maxProtocolVersion
+	hello.Capabilities = supportedCapabilities
+	hello.Compression = offer
 	hello.Name = []byte(f.name)
 	hello.NameLength = uint32(len(hello.Name))
 	if err := hello.writeOut(connWriter); err != nil {
 		return fmt.Errorf("can not send hello message: %w", err)
 	}
 
+	// Получатель, который поддерживает только protocolVersion1, не ответит на hello.
+	if err := conn.SetReadDeadline(time.Now().Add(helloReplyTimeout)); err != nil {
+		return fmt.Errorf("can not set hello reply deadline: %w", err)
+	}
+	reply := &helloReplyMessage{}
+	if err := reply.readIn(connReader); err != nil {
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return ErrNoHelloReply
+		}
+		return fmt.Errorf("can not read hello reply: %w", err)
+	}
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return fmt.Errorf("can not reset hello reply deadline: %w", err)
+	}
+
+	f.protocol, err = acceptReply(hello, reply)
+	if err != nil {
+		return err
+	}
+	f.logger.Infof("using protocol %s", f.protocol)
+	if !f.protocol.has(capabilityMetadata) {
+		f.logger.Warnf("downstream does not support metadata, messages will be sent without it")
+	}
 	return nil
 }
 
@@ -98,9 +178,21 @@ func (f *DownstreamForwarder) receivingLoop(ctx context.Context, conn *connutil.
 
 	for {
 		ack := &downstreamAck{DownstreamIndex: f.downstreamIndex}
-		if err := ack.ackMessage.readIn(connReader); err != nil {
+		if err := ack.ackMessage.readIn(connReader, f.protocol); err != nil {
 			return err
 		}
+		// До protocolVersion3 получатель подтверждает только младшие 32 бита номера.
+		if !f.protocol.wideIDs() {
+			ack.ackMessage = ackMessage(widenMessageID(uint32(ack.ackMessage), atomic.LoadUint64(&f.lastSent)))
+		}
+		f.window.Acked(uint64(ack.ackMessage))
+		if f.tracker != nil {
+			f.tracker.Acked(uint64(ack.ackMessage))
+			if err := f.reportBorder(ctx); err != nil {
+				return nil
+			}
+			continue
+		}
 
 		select {
 		case <-ctx.Done():
@@ -115,25 +207,177 @@ func (f *DownstreamForwarder) transmitingLoop(ctx context.Context, conn *connuti
 
 	connWriter := ctxio.NewContextWriter(ctx, conn)
 	defer connWriter.Close()
+	// Сообщения пакета накапливаются в буфере, поэтому пакет уходит в соединение
+	// одной или несколькими крупными записями, а не записью на каждое поле сообщения.
+	writer := bufio.NewWriterSize(connWriter, transmitBufferSize)
+	// При сжатии пакет сначала собирается целиком, а затем передается одним кадром.
+	var batch bytes.Buffer
+	var batchWriter io.Writer = writer
+	var frames *frameWriter
+	if f.protocol.Compression != compressionNone {
+		frames = newFrameWriter(writer, f.compression)
+		batchWriter = &batch
+	}
 
+	items := make([]*forwardLogItem, 0, transmitBatchItems)
 	for {
-		fLogItem := forwardLogItems.Get()
-		if err := f.iter.Next(ctx, fLogItem); err != nil {
-			forwardLogItems.Put(fLogItem)
-			return fmt.Errorf("can not get next item: %w", err)
+		maxItems, err := f.window.Available(ctx)
+		if err != nil {
+			return fmt.Errorf("can not wait for in-flight window: %w", err)
+		}
+		if maxItems > transmitBatchItems {
+			maxItems = transmitBatchItems
+		}
+
+		items, err = f.iter.NextBatch(ctx, maxItems, transmitBatchBytes, items[:0])
+		if err == nil {
+			err = f.writeItems(batchWriter, items)
+		}
+		if err == nil && frames != nil {
+			err = frames.WriteFrame(batch.Bytes())
+			batch.Reset()
+		}
+		for i, item := range items {
+			forwardLogItems.Put(item)
+			items[i] = nil
+		}
+		if err != nil {
+			return err
 		}
 
-		msg := &dataMessage{
-			Header: dataMessageHeader{
-				MessageID:     fLogItem.Header.OutputMessageID,
-				MessageLength: fLogItem.Header.MessageLength,
-			},
-			Data: fLogItem.Data,
+		if err := writer.Flush(); err != nil {
+			return fmt.Errorf("can not flush messages: %w", err)
+		}
+		// Записи, которые не предназначены получателю, сдвигают границу подтверждения без
+		// ответа от него. Иначе получатель, которому долго не достается сообщений, не позволил бы обрезать лог.
+		if f.tracker != nil {
+			if err := f.reportBorder(ctx); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// reportBorder передает границу подтверждения получателя с маршрутом, если она сдвинулась.
+func (f *DownstreamForwarder) reportBorder(ctx context.Context) error {
+	f.reportMutex.Lock()
+	defer f.reportMutex.Unlock()
+
+	border, ok := f.tracker.Next()
+	if !ok {
+		return nil
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case f.acks <- &downstreamAck{ackMessage: ackMessage(border), DownstreamIndex: f.downstreamIndex}:
+	}
+	return nil
+}
+
+func (f *DownstreamForwarder) writeItems(w io.Writer, items []*forwardLogItem) error {
+	msg := &dataMessage{}
+	for _, item := range items {
+		if f.route != nil && !f.route.accepts(item) {
+			f.tracker.Handled(item.Header.OutputMessageID)
+			continue
+		}
+		msg.Header = dataMessageHeader{
+			MessageID:     item.Header.OutputMessageID,
+			MessageLength: item.Header.MessageLength,
+		}
+		msg.Metadata = item.Metadata
+		// Получатель, который не читает метаданные, получает только данные сообщения.
+		if !f.protocol.has(capabilityMetadata) {
+			msg.Metadata = nil
 		}
-		forwardLogItems.Put(fLogItem)
+		msg.Data = item.Data
 
-		if err := msg.writeOut(connWriter); err != nil {
+		if err := msg.writeOut(w, f.protocol); err != nil {
 			return fmt.Errorf("can not send message %d: %w", msg.Header.MessageID, err)
 		}
+		f.window.Sent(msg.Header.MessageID)
+		if f.tracker != nil {
+			// Запись считается обработанной только после отметки об отправке,
+			// иначе граница могла бы пройти через неподтвержденное сообщение.
+			f.tracker.Sent(msg.Header.MessageID)
+			f.tracker.Handled(msg.Header.MessageID)
+		}
+		atomic.StoreUint64(&f.lastSent, msg.Header.MessageID)
+	}
+	return nil
+}
+
+// inFlightWindow ограничивает число сообщений, отправленных получателю, но ещё не подтвержденных им.
+type inFlightWindow struct {
+	lock  sync.Mutex
+	limit int
+	// inFlight идентификаторы неподтвержденных сообщений в порядке отправки.
+	inFlight []uint64
+	// acked закрывается и заменяется новым каналом после каждого подтверждения.
+	acked chan struct{}
+}
+
+func newInFlightWindow(limit int) *inFlightWindow {
+	return &inFlightWindow{
+		limit: limit,
+		acked: make(chan struct{}),
+	}
+}
+
+// Available блокируется, пока окно заполнено, и возвращает число сообщений, которые можно отправить.
+func (w *inFlightWindow) Available(ctx context.Context) (int, error) {
+	if w.limit <= 0 {
+		return transmitBatchItems, nil
+	}
+
+	for {
+		w.lock.Lock()
+		available, acked := w.limit-len(w.inFlight), w.acked
+		w.lock.Unlock()
+		if available > 0 {
+			return available, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-acked:
+		}
+	}
+}
+
+// Sent отмечает отправку сообщения id.
+func (w *inFlightWindow) Sent(id uint64) {
+	if w.limit <= 0 {
+		return
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.inFlight = append(w.inFlight, id)
+}
+
+// Acked отмечает подтверждение всех сообщений вплоть до id.
+func (w *inFlightWindow) Acked(id uint64) {
+	if w.limit <= 0 {
+		return
 	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	n := 0
+	for n < len(w.inFlight) && w.inFlight[n] <= id {
+		n++
+	}
+	if n == 0 {
+		return
+	}
+	w.inFlight = append(w.inFlight[:0], w.inFlight[n:]...)
+
+	close(w.acked)
+	w.acked = make(chan struct{})
 }
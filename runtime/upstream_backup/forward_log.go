@@ -1,53 +1,381 @@
 package upstreambackup
 
 import (
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
 )
 
+// Политики переполнения forward log.
+const (
+	// OverflowBlock приостанавливает запись, пока получатели не подтвердят старые сообщения.
+	// Действие при этом блокируется на записи в стандартный поток вывода.
+	OverflowBlock = "block"
+	// OverflowDropOldest удаляет самые старые сообщения, даже если их ещё не получили все получатели.
+	// Входные сообщения удаленных записей подтверждаются, поэтому удаленные сообщения теряются.
+	OverflowDropOldest = "drop_oldest"
+	// OverflowFail завершает работу runtime с ошибкой.
+	OverflowFail = "fail"
+)
+
+// Возможные ошибки ограничения forward log.
+var (
+	ErrForwardLogFull        = errors.New("forward log is full")
+	ErrForwardLogClosed      = errors.New("forward log is closed")
+	ErrUnknownOverflowPolicy = errors.New("unknown forward log overflow policy")
+)
+
+// ForwardLogLimits ограничения размера forward log.
+type ForwardLogLimits struct {
+	// MaxItems и MaxBytes максимальное число записей и суммарная длина их данных и метаданных,
+	// 0 отключает ограничение.
+	MaxItems uint64
+	MaxBytes uint64
+	// Overflow политика переполнения, пустое значение означает OverflowBlock.
+	Overflow string
+}
+
+// ForwardLogStats состояние forward log и число срабатываний политики переполнения.
+type ForwardLogStats struct {
+	Items uint64
+	Bytes uint64
+	// Blocked число записей, которые ожидали освобождения места.
+	Blocked uint64
+	// Dropped и DroppedBytes число и суммарная длина сообщений, удаленных из-за переполнения.
+	Dropped      uint64
+	DroppedBytes uint64
+}
+
+// sequenceMetaKey служебная запись с номером, который получит следующее выходное сообщение.
+// Обновляется при удалении записей, чтобы нумерация продолжалась после перезапуска,
+// даже если все записи были удалены из лога.
+const sequenceMetaKey = "sequence"
+
 // ForwardLog лог для записи сообщений с целью обеспечения отказоустойчивости.
+// Записи лога сохраняются между перезапусками runtime, поэтому после перезапуска
+// сообщения, которые не были подтверждены всеми получателями, отправляются повторно.
 type ForwardLog struct {
-	buffer *logBuffer
+	buffer logStorage
+
+	// nextOutput номер следующего выходного сообщения на момент открытия лога.
+	nextOutput uint64
+	// restoredTail ключ, начиная с которого идут записи текущего запуска.
+	// Записи до него остались от предыдущего запуска: номера входных сообщений в них
+	// относятся к прежним соединениям с вышестоящими узлами, поэтому их нельзя подтверждать.
+	restoredTail uint64
+	// restoredInputs границы подтверждения входных сообщений в записях предыдущего запуска.
+	restoredInputs map[uint16]uint64
+
+	// Количество и суммарная длина сообщений, удаленных из лога за все время работы.
+	trimmedMessages uint64
+	trimmedBytes    uint64
+	// Количество и суммарная длина сообщений, записанных в лог за все время работы,
+	// включая оставшиеся после предыдущего запуска.
+	writtenMessages uint64
+	writtenBytes    uint64
+	// trimmed закрывается и заменяется новым каналом после удаления сообщений из лога.
+	trimmedLock sync.Mutex
+	trimmed     chan struct{}
+
+	limits ForwardLogLimits
+	// bytes суммарная длина данных и метаданных записей лога.
+	bytes uint64
+	// trimMutex не позволяет одновременно удалять записи при подтверждении и при переполнении.
+	trimMutex sync.Mutex
+	// droppedInputs границы подтверждения входных сообщений удаленных при переполнении записей.
+	droppedInputs map[uint16]uint64
+	blocked       uint64
+	dropped       uint64
+	droppedBytes  uint64
+
+	done chan struct{}
 }
 
-// NewForwardLog создает новый ForwardLog.
-func NewForwardLog(forwardLogDir string) (*ForwardLog, error) {
-	buff, err := newLogBuffer(forwardLogDir)
+// NewForwardLog создает новый ForwardLog в хранилище, выбранном в storage.
+// storage может быть nil, тогда используется StorageLevelDB.
+// limits может быть nil, тогда размер лога не ограничен.
+func NewForwardLog(forwardLogDir string, storage *StorageConfig, limits *ForwardLogLimits) (*ForwardLog, error) {
+	l := &ForwardLog{
+		trimmed:        make(chan struct{}),
+		droppedInputs:  make(map[uint16]uint64),
+		restoredInputs: make(map[uint16]uint64),
+		done:           make(chan struct{}),
+	}
+	if limits != nil {
+		l.limits = *limits
+	}
+	switch l.limits.Overflow {
+	case "":
+		l.limits.Overflow = OverflowBlock
+	case OverflowBlock, OverflowDropOldest, OverflowFail:
+	default:
+		return nil, fmt.Errorf("%s: %w", l.limits.Overflow, ErrUnknownOverflowPolicy)
+	}
+
+	buff, err := openLogStorage(forwardLogDir, storage)
 	if err != nil {
 		return nil, err
 	}
+	l.buffer = buff
+	l.restoredTail, _ = buff.Tail()
+	if l.nextOutput, err = l.loadNextOutput(); err != nil {
+		buff.Close()
+		return nil, err
+	}
+	if l.bytes, err = l.loadBytes(); err != nil {
+		buff.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// loadBytes возвращает суммарную длину записей, оставшихся после предыдущего запуска,
+// и запоминает границы подтверждения входных сообщений в них.
+func (l *ForwardLog) loadBytes() (uint64, error) {
+	bytes := uint64(0)
+	from, to := l.buffer.Front(), l.restoredTail
+	items := make([]*forwardLogItem, 0, 1024)
+	for from < to {
+		var err error
+		items, from, err = l.buffer.ReadRange(from, to, cap(items), math.MaxInt, items[:0])
+		for _, item := range items {
+			bytes += itemBytes(item)
+			l.writtenMessages++
+			l.writtenBytes += uint64(item.Header.MessageLength)
+			if item.Header.Flags&forwardLogPartialFlag == 0 {
+				l.restoredInputs[item.Header.InputID] = item.Header.InputMessageID
+			}
+			forwardLogItems.Put(item)
+		}
+		if err != nil {
+			return 0, fmt.Errorf("can not read restored items: %w", err)
+		}
+	}
+	return bytes, nil
+}
+
+// loadNextOutput возвращает номер, с которого продолжается нумерация выходных сообщений.
+func (l *ForwardLog) loadNextOutput() (uint64, error) {
+	var next uint64
+	sequence, err := l.buffer.GetMeta(sequenceMetaKey)
+	if err != nil {
+		return 0, err
+	}
+	if len(sequence) == 8 {
+		next = binary.BigEndian.Uint64(sequence)
+	}
+
+	if l.buffer.Size() == 0 {
+		return next, nil
+	}
+	fLogItem := forwardLogItems.Get()
+	defer forwardLogItems.Put(fLogItem)
 
-	return &ForwardLog{buffer: buff}, nil
+	if err := l.buffer.LoadLast(fLogItem); err != nil {
+		return 0, fmt.Errorf("can not read back buffer header: %w", err)
+	}
+	if fLogItem.Header.OutputMessageID >= next {
+		next = fLogItem.Header.OutputMessageID + 1
+	}
+	return next, nil
+}
+
+// NextOutput возвращает номер, который должно получить первое выходное сообщение после открытия лога.
+func (l *ForwardLog) NextOutput() uint64 {
+	return l.nextOutput
+}
+
+// RestoredInputs возвращает для каждого входа границу подтверждения входных сообщений,
+// обработка которых завершилась до перезапуска, по записям предыдущего запуска.
+// Номера входов в них относятся к прежним соединениям.
+func (l *ForwardLog) RestoredInputs() map[uint16]uint64 {
+	return l.restoredInputs
 }
 
 // NewIterator возвращает итератор, который позволяет двигаться по ForwardLog с первой записи в прямом направлении.
 func (l *ForwardLog) NewIterator() *LogBufferIterator {
-	return l.buffer.NewIterator()
+	return NewLogBufferIterator(l.buffer)
+}
+
+// Write записывает в лог выходное сообщение outputMsgID, после подтверждения которого
+// можно подтвердить входные сообщения inputID до inputMsgID включительно.
+// isLast равен false, если запись не подтверждает входные сообщения, например,
+// если из входного сообщения будут получены ещё выходные сообщения.
+// metadata содержит закодированные метаданные сообщения и может быть пустым.
+// Если запись превысит ограничения лога, то применяется политика переполнения.
+func (l *ForwardLog) Write(inputID uint16, inputMsgID, outputMsgID uint64, metadata, data []byte, isLast bool) error {
+	flags := uint16(0)
+	if !isLast {
+		flags |= forwardLogPartialFlag
+	}
+	return l.write(inputID, inputMsgID, outputMsgID, metadata, data, flags)
+}
+
+// WriteDeadLetter записывает в лог входное сообщение, которое действие не смогло обработать.
+// Запись передается только получателям с режимом RouteDeadLetter, в остальном она
+// не отличается от записи Write.
+func (l *ForwardLog) WriteDeadLetter(inputID uint16, inputMsgID, outputMsgID uint64, metadata, data []byte, isLast bool) error {
+	flags := forwardLogDeadLetterFlag
+	if !isLast {
+		flags |= forwardLogPartialFlag
+	}
+	return l.write(inputID, inputMsgID, outputMsgID, metadata, data, flags)
 }
 
-func (l *ForwardLog) Write(inputID uint16, inputMsgID, outputMsgID uint32, data []byte) error {
+func (l *ForwardLog) write(inputID uint16, inputMsgID, outputMsgID uint64, metadata, data []byte, flags uint16) error {
+	size := uint64(len(metadata) + len(data))
+	if err := l.reserve(size); err != nil {
+		return err
+	}
+
 	fLogItem := forwardLogItems.Get()
 	defer forwardLogItems.Put(fLogItem)
 
+	fLogItem.Header.Flags = flags
 	fLogItem.Header.InputID = inputID
 	fLogItem.Header.InputMessageID = inputMsgID
 	fLogItem.Header.OutputMessageID = outputMsgID
 	fLogItem.Header.MessageLength = uint32(len(data))
+	fLogItem.Metadata = metadata
 	fLogItem.Data = data
 
 	if err := l.buffer.Append(fLogItem); err != nil {
 		return fmt.Errorf("can not write forward log item: %w", err)
 	}
+	atomic.AddUint64(&l.bytes, size)
+	atomic.AddUint64(&l.writtenMessages, 1)
+	atomic.AddUint64(&l.writtenBytes, uint64(len(data)))
+	return nil
+}
+
+// overflowed возвращает true, если запись длиной size превысит ограничения лога.
+// В пустой лог запись добавляется всегда, иначе слишком длинное сообщение никогда не будет записано.
+func (l *ForwardLog) overflowed(size uint64) bool {
+	items := uint64(l.buffer.Size())
+	if items == 0 {
+		return false
+	}
+	return (l.limits.MaxItems != 0 && items+1 > l.limits.MaxItems) ||
+		(l.limits.MaxBytes != 0 && atomic.LoadUint64(&l.bytes)+size > l.limits.MaxBytes)
+}
+
+// reserve освобождает место для записи длиной size согласно политике переполнения.
+func (l *ForwardLog) reserve(size uint64) error {
+	if !l.overflowed(size) {
+		return nil
+	}
+
+	switch l.limits.Overflow {
+	case OverflowFail:
+		return fmt.Errorf("%d items, %d bytes: %w", l.buffer.Size(), atomic.LoadUint64(&l.bytes), ErrForwardLogFull)
+	case OverflowDropOldest:
+		return l.dropOldest(size)
+	}
+
+	atomic.AddUint64(&l.blocked, 1)
+	for {
+		// Канал нужно получить до проверки, чтобы не пропустить удаление между ними.
+		trimmed := l.TrimNotify()
+		if !l.overflowed(size) {
+			return nil
+		}
+		select {
+		case <-l.done:
+			return ErrForwardLogClosed
+		case <-trimmed:
+		}
+	}
+}
+
+// dropOldest удаляет самые старые записи, пока запись длиной size превышает ограничения лога.
+func (l *ForwardLog) dropOldest(size uint64) error {
+	l.trimMutex.Lock()
+	defer l.trimMutex.Unlock()
+	defer l.notifyTrimmed()
+
+	// Номера удаленных сообщений уже могли получить нижестоящие узлы, поэтому
+	// после перезапуска нумерация должна продолжаться после них, даже если лог пуст.
+	dropped, lastDropped := false, uint64(0)
+	defer func() {
+		if dropped {
+			l.saveSequence(lastDropped + 1)
+		}
+	}()
+
+	for l.overflowed(size) {
+		fLogItem := forwardLogItems.Get()
+		restored := l.buffer.Front() < l.restoredTail
+
+		if err := l.buffer.LoadFirst(fLogItem); err != nil {
+			forwardLogItems.Put(fLogItem)
+			return fmt.Errorf("can not read front buffer header: %w", err)
+		}
+		if err := l.buffer.TrimFirst(); err != nil {
+			forwardLogItems.Put(fLogItem)
+			return fmt.Errorf("can not drop item: %w", err)
+		}
+		dropped, lastDropped = true, fLogItem.Header.OutputMessageID
+		l.removed(fLogItem)
+		atomic.AddUint64(&l.dropped, 1)
+		atomic.AddUint64(&l.droppedBytes, itemBytes(fLogItem))
+
+		// Удаленное сообщение уже не будет доставлено, поэтому его входное сообщение подтверждается,
+		// иначе вышестоящие узлы продолжат хранить и повторно отправлять его.
+		if fLogItem.Header.Flags&forwardLogPartialFlag == 0 && !restored {
+			l.droppedInputs[fLogItem.Header.InputID] = fLogItem.Header.InputMessageID
+		}
+		forwardLogItems.Put(fLogItem)
+	}
 	return nil
 }
 
+// TakeDropped возвращает границы подтверждения входных сообщений записей,
+// удаленных при переполнении с предыдущего вызова.
+func (l *ForwardLog) TakeDropped() map[uint16]uint64 {
+	l.trimMutex.Lock()
+	defer l.trimMutex.Unlock()
+
+	dropped := l.droppedInputs
+	l.droppedInputs = make(map[uint16]uint64)
+	return dropped
+}
+
+// removed учитывает удаление записи item из лога.
+func (l *ForwardLog) removed(item *forwardLogItem) {
+	atomic.AddUint64(&l.trimmedMessages, 1)
+	atomic.AddUint64(&l.trimmedBytes, uint64(item.Header.MessageLength))
+	atomic.AddUint64(&l.bytes, ^(itemBytes(item) - 1))
+}
+
+func itemBytes(item *forwardLogItem) uint64 {
+	return uint64(len(item.Metadata) + len(item.Data))
+}
+
 // Trim отрезает от лога все сообщения, у которых output_id <= idBorder.
 // Может обрезать сообщения одновременно с записью, так как никогда не будет обрабатывать
 // одно и то же сообщение из-за того, что отправка происходит после записи в лог,
 // а значит если мы получили подтверждение на это сообщение, то оно уже было отправлено.
-func (l *ForwardLog) Trim(idBorder uint32) (map[uint16]uint32, error) {
-	inputMaxs := make(map[uint16]uint32)
+// Записи, оставшиеся от предыдущего запуска, удаляются без подтверждения входных сообщений:
+// вышестоящие узлы отправят эти сообщения повторно.
+func (l *ForwardLog) Trim(idBorder uint64) (map[uint16]uint64, error) {
+	l.trimMutex.Lock()
+	defer l.trimMutex.Unlock()
+
+	inputMaxs := make(map[uint16]uint64)
+	trimmed := false
+	defer func() {
+		if trimmed {
+			l.saveSequence(idBorder + 1)
+			l.notifyTrimmed()
+		}
+	}()
+
 	for l.buffer.Size() != 0 {
 		fLogItem := forwardLogItems.Get()
+		restored := l.buffer.Front() < l.restoredTail
 
 		if err := l.buffer.LoadFirst(fLogItem); err != nil {
 			forwardLogItems.Put(fLogItem)
@@ -63,6 +391,15 @@ func (l *ForwardLog) Trim(idBorder uint32) (map[uint16]uint32, error) {
 			forwardLogItems.Put(fLogItem)
 			return nil, fmt.Errorf("can not trim buffer: %w", err)
 		}
+		trimmed = true
+		l.removed(fLogItem)
+
+		// Входное сообщение подтверждается только вместе с последним своим выходом,
+		// иначе после отказа оставшиеся выходы будут потеряны.
+		if fLogItem.Header.Flags&forwardLogPartialFlag != 0 || restored {
+			forwardLogItems.Put(fLogItem)
+			continue
+		}
 
 		// Последовательность строго возрастающая, поэтому можно переприсваивать.
 		// Но проверку на корректность буффера полезно сделать для дебага.
@@ -80,8 +417,55 @@ func (l *ForwardLog) Trim(idBorder uint32) (map[uint16]uint32, error) {
 	return inputMaxs, nil
 }
 
+// saveSequence сохраняет номер, не меньше которого получит следующее выходное сообщение.
+// Ошибка не прерывает работу: номер будет восстановлен по записям лога, если они остались.
+func (l *ForwardLog) saveSequence(next uint64) {
+	value := make([]byte, 8)
+	binary.BigEndian.PutUint64(value, next)
+	l.buffer.PutMeta(sequenceMetaKey, value)
+}
+
+// Trimmed возвращает количество и суммарную длину сообщений, удаленных из лога за все время работы.
+func (l *ForwardLog) Trimmed() (messages uint64, bytes uint64) {
+	return atomic.LoadUint64(&l.trimmedMessages), atomic.LoadUint64(&l.trimmedBytes)
+}
+
+// Written возвращает количество и суммарную длину сообщений, записанных в лог за все время работы,
+// включая оставшиеся после предыдущего запуска. Разность с Trimmed — сообщения, которые ещё в логе.
+func (l *ForwardLog) Written() (messages uint64, bytes uint64) {
+	return atomic.LoadUint64(&l.writtenMessages), atomic.LoadUint64(&l.writtenBytes)
+}
+
+// TrimNotify возвращает канал, который будет закрыт после следующего удаления сообщений из лога.
+// Канал нужно получить до проверки Trimmed, чтобы не пропустить удаление между ними.
+func (l *ForwardLog) TrimNotify() <-chan struct{} {
+	l.trimmedLock.Lock()
+	defer l.trimmedLock.Unlock()
+
+	return l.trimmed
+}
+
+func (l *ForwardLog) notifyTrimmed() {
+	l.trimmedLock.Lock()
+	defer l.trimmedLock.Unlock()
+
+	close(l.trimmed)
+	l.trimmed = make(chan struct{})
+}
+
+// Stats возвращает текущий размер лога и число срабатываний политики переполнения.
+func (l *ForwardLog) Stats() ForwardLogStats {
+	return ForwardLogStats{
+		Items:        uint64(l.buffer.Size()),
+		Bytes:        atomic.LoadUint64(&l.bytes),
+		Blocked:      atomic.LoadUint64(&l.blocked),
+		Dropped:      atomic.LoadUint64(&l.dropped),
+		DroppedBytes: atomic.LoadUint64(&l.droppedBytes),
+	}
+}
+
 // GetOldestOutput возвращает самый старый output_message_id, который хранится в логе.
-func (l *ForwardLog) GetOldestOutput() (uint32, error) {
+func (l *ForwardLog) GetOldestOutput() (uint64, error) {
 	if l.buffer.Size() == 0 {
 		return 0, nil
 	}
@@ -96,6 +480,8 @@ func (l *ForwardLog) GetOldestOutput() (uint32, error) {
 }
 
 // Close закрывает ForwardLog и очищает занимаемые ресурсы.
+// Ожидающие освобождения места записи завершаются с ErrForwardLogClosed.
 func (l *ForwardLog) Close() error {
+	close(l.done)
 	return l.buffer.Close()
 }
@@ -2,6 +2,7 @@ package upstreambackup
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"strconv"
@@ -19,7 +20,7 @@ var (
 )
 
 // UpstreamAck отображение upstream_id в содержание ACK сообщения.
-type UpstreamAck map[uint16]uint32
+type UpstreamAck map[uint16]uint64
 
 func (a UpstreamAck) String() string {
 	var b strings.Builder
@@ -27,7 +28,7 @@ func (a UpstreamAck) String() string {
 		b.WriteString("upstream_")
 		b.WriteString(strconv.Itoa(int(upstream)))
 		b.WriteByte('=')
-		b.WriteString(strconv.Itoa(int(ack)))
+		b.WriteString(strconv.FormatUint(ack, 10))
 	}
 	return b.String()
 }
@@ -42,27 +43,51 @@ type workingDownstream struct {
 type DefaultForwarderConfig struct {
 	ACKPeriod     time.Duration
 	ForwardLogDir string
+	// Compression параметры сжатия сообщений, передаваемых нижестоящим узлам.
+	Compression CompressionConfig
+	// MaxInFlight максимальное число отправленных, но не подтвержденных сообщений
+	// для каждого получателя, 0 отключает ограничение.
+	MaxInFlight int
+	// TLS включает взаимную TLS аутентификацию с нижестоящими узлами, может быть nil.
+	TLS *tls.Config
+	// Storage хранилище forward log.
+	Storage StorageConfig
+	// LogLimits ограничения размера forward log и политика его переполнения.
+	LogLimits ForwardLogLimits
+	// Delivery отмечает обработанные входные сообщения и резервирует номера выходных
+	// в режиме exactly-once, может быть nil.
+	Delivery *DeliveryStore
+	// Routing режимы передачи сообщений получателям в порядке outs, по умолчанию RouteBroadcast.
+	Routing []string
 }
 
 // DefaultForwarder предает сообщения дальше по потоку,
 // при этом обеспечивая отказоустойчивость по схеме upstream_backup.
 type DefaultForwarder struct {
-	// После того, как uint32 закончится, снова начнется нумерация с 0.
-	// Ничего из-за этого не случится, так как все записывается в порядке очереди
-	// и, кроме того, в системе не будут существовать 4294967295 одновременно.
-	messageIndex uint32
+	// Нумерация продолжается после перезапуска с номера, сохраненного в forward log,
+	// поэтому получатели не примут новые сообщения за уже подтвержденные.
+	messageIndex uint64
+	// forwardMutex упорядочивает выходные сообщения нескольких процессов действия.
+	forwardMutex sync.Mutex
 	name         string
+	maxInFlight  int
+	compression  *CompressionConfig
+	tlsConfig    *tls.Config
 
 	forwardLog *ForwardLog
+	delivery   *DeliveryStore
+	// routes маршруты получателей по их индексам, nil маршрут означает RouteBroadcast.
+	routes []*outputRoute
 
 	inputMaxMutex sync.Mutex
 	inputMax      UpstreamAck
+	completions   *inputCompletions
 
 	ctx          context.Context
 	downstreamWG sync.WaitGroup
 
 	downstreamsAcksLock sync.RWMutex
-	downstreamsAcks     map[uint16]uint32
+	downstreamsAcks     map[uint16]uint64
 
 	downstreamsInWorkMutex sync.Mutex
 	downstreamsInWork      map[uint16]*workingDownstream
@@ -72,13 +97,20 @@ type DefaultForwarder struct {
 
 	upstreamAcks chan UpstreamAck
 	ackTicker    *time.Ticker
+	// reportedDropped число удаленных при переполнении сообщений, о которых уже сообщено в логе.
+	reportedDropped uint64
 
 	logger *util.Logger
 }
 
 // NewDefaultForwarder создает новый объект DefaultForwarder.
 func NewDefaultForwarder(name string, outs []string, cfg *DefaultForwarderConfig, l *util.Logger) (*DefaultForwarder, error) {
-	forwardLog, err := NewForwardLog(cfg.ForwardLogDir)
+	routes, err := newOutputRoutes(cfg.Routing, len(outs))
+	if err != nil {
+		return nil, err
+	}
+
+	forwardLog, err := NewForwardLog(cfg.ForwardLogDir, &cfg.Storage, &cfg.LogLimits)
 	if err != nil {
 		return nil, err
 	}
@@ -88,12 +120,24 @@ func NewDefaultForwarder(name string, outs []string, cfg *DefaultForwarderConfig
 		downstreamsIndexes[out] = uint16(i)
 	}
 
+	// После запуска на другой машине forward log пуст, и нумерация продолжается с номера из копии.
+	messageIndex := forwardLog.NextOutput()
+	if cfg.Delivery != nil && cfg.Delivery.NextOutput() > messageIndex {
+		messageIndex = cfg.Delivery.NextOutput()
+	}
+
 	return &DefaultForwarder{
-		messageIndex:       0,
+		messageIndex:       messageIndex,
 		name:               name,
+		maxInFlight:        cfg.MaxInFlight,
+		compression:        &cfg.Compression,
+		tlsConfig:          cfg.TLS,
 		forwardLog:         forwardLog,
-		inputMax:           make(map[uint16]uint32),
-		downstreamsAcks:    make(map[uint16]uint32),
+		delivery:           cfg.Delivery,
+		routes:             routes,
+		inputMax:           make(map[uint16]uint64),
+		completions:        newInputCompletions(),
+		downstreamsAcks:    make(map[uint16]uint64),
 		downstreamsInWork:  make(map[uint16]*workingDownstream),
 		downstreamsIndexes: downstreamsIndexes,
 		upstreamAcks:       make(chan UpstreamAck),
@@ -159,10 +203,45 @@ func (f *DefaultForwarder) ChangeOut(oldOut, newOut string) error {
 }
 
 // GetOldestOutput возвращает самый старый output_message_id, который хранится в логе.
-func (f *DefaultForwarder) GetOldestOutput() (uint32, error) {
+func (f *DefaultForwarder) GetOldestOutput() (uint64, error) {
 	return f.forwardLog.GetOldestOutput()
 }
 
+// RestoredInputs возвращает границы подтверждения входных сообщений,
+// выходы которых остались в forward log после предыдущего запуска.
+func (f *DefaultForwarder) RestoredInputs() map[uint16]uint64 {
+	return f.forwardLog.RestoredInputs()
+}
+
+// HasDownstreams возвращает true, если есть узлы, которым передаются сообщения.
+func (f *DefaultForwarder) HasDownstreams() bool {
+	f.downstreamsIndexesMutex.Lock()
+	defer f.downstreamsIndexesMutex.Unlock()
+
+	return len(f.downstreamsIndexes) != 0
+}
+
+// Trimmed возвращает количество и суммарную длину сообщений, удаленных из forward log за все время работы.
+func (f *DefaultForwarder) Trimmed() (messages uint64, bytes uint64) {
+	return f.forwardLog.Trimmed()
+}
+
+// Written возвращает количество и суммарную длину сообщений, записанных в forward log за все время работы.
+func (f *DefaultForwarder) Written() (messages uint64, bytes uint64) {
+	return f.forwardLog.Written()
+}
+
+// TrimNotify возвращает канал, который будет закрыт после следующего удаления сообщений из forward log.
+// Канал нужно получить до проверки Trimmed, чтобы не пропустить удаление между ними.
+func (f *DefaultForwarder) TrimNotify() <-chan struct{} {
+	return f.forwardLog.TrimNotify()
+}
+
+// ForwardLogStats возвращает размер forward log и число срабатываний политики переполнения.
+func (f *DefaultForwarder) ForwardLogStats() ForwardLogStats {
+	return f.forwardLog.Stats()
+}
+
 func (f *DefaultForwarder) runDownstream(ctx context.Context, downstreamIndex uint16, addr string) {
 	downstreamCtx, downstreamStop := context.WithCancel(ctx)
 	defer downstreamStop()
@@ -176,7 +255,7 @@ func (f *DefaultForwarder) runDownstream(ctx context.Context, downstreamIndex ui
 	}
 
 	wd := &workingDownstream{
-		downstream:     NewDownstreamForwarder(downstreamIndex, f.name, addr, f.forwardLog.NewIterator(), f.logger),
+		downstream:     NewDownstreamForwarder(downstreamIndex, f.name, addr, f.forwardLog.NewIterator(), f.routes[downstreamIndex], f.maxInFlight, f.compression, f.tlsConfig, f.logger),
 		stopDownstream: downstreamStop,
 		done:           make(chan struct{}),
 	}
@@ -208,29 +287,101 @@ func (f *DefaultForwarder) runDownstream(ctx context.Context, downstreamIndex ui
 }
 
 // Forward отправляет сообщение дальше с гарантиями доставки.
-func (f *DefaultForwarder) Forward(inputID uint16, inputMsgID uint32, data []byte) error {
+// isLast должен быть false, если для входного сообщения inputMsgID ожидаются ещё выходные сообщения.
+// metadata содержит закодированные метаданные сообщения и может быть пустым.
+func (f *DefaultForwarder) Forward(inputID uint16, inputMsgID uint64, metadata, data []byte, isLast bool) error {
+	return f.forward(inputID, inputMsgID, metadata, data, isLast, false)
+}
+
+// ForwardDeadLetter передает входное сообщение inputMsgID, которое действие не смогло обработать,
+// получателям с режимом RouteDeadLetter и завершает его обработку так же, как последний выход Forward.
+// metadata должен содержать заголовки из WithDeadLetterHeaders.
+func (f *DefaultForwarder) ForwardDeadLetter(inputID uint16, inputMsgID uint64, metadata, data []byte) error {
+	return f.forward(inputID, inputMsgID, metadata, data, true, true)
+}
+
+// ForwardDetachedDeadLetter передает получателям с режимом RouteDeadLetter сообщение,
+// не полученное ни из одного входного, см. ForwardDetached.
+func (f *DefaultForwarder) ForwardDetachedDeadLetter(metadata, data []byte) error {
+	return f.forward(0, 0, metadata, data, false, true)
+}
+
+// HasDeadLetterRoute возвращает true, если есть получатель с режимом RouteDeadLetter.
+func (f *DefaultForwarder) HasDeadLetterRoute() bool {
+	for _, route := range f.routes {
+		if route != nil && route.mode == RouteDeadLetter {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *DefaultForwarder) forward(inputID uint16, inputMsgID uint64, metadata, data []byte, isLast, isDeadLetter bool) error {
+	f.forwardMutex.Lock()
+	defer f.forwardMutex.Unlock()
+
 	// Всегда увеличиваем счетчик, пропуски в случае ошибок не должны ни на что влиять
 	defer func() { f.messageIndex++ }()
 
+	// Входное сообщение считается обработанным только после последнего выхода,
+	// а подтверждать его можно только вместе со всеми сообщениями, переданными действию раньше.
+	// Поэтому в лог записывается граница подтверждения, а не номер самого сообщения.
+	ackMsgID, canAck := inputMsgID, false
+	if isLast {
+		ackMsgID, canAck = f.completions.Complete(inputID, inputMsgID)
+	}
+
 	// Если далее по схеме передавать сообщение некому,
 	// то и от логирования в буфер нет смысла.
 	// Кроме того по протоколу не передаются далее и пустые сообщения,
 	// они лишь служат маркером для перадачи подтверждений выше по потоку.
 	if len(f.downstreamsIndexes) != 0 && len(data) != 0 {
-		if err := f.forwardLog.Write(inputID, inputMsgID, f.messageIndex, data); err != nil {
+		if f.delivery != nil {
+			if err := f.delivery.ReserveOutput(f.messageIndex); err != nil {
+				return err
+			}
+		}
+		write := f.forwardLog.Write
+		if isDeadLetter {
+			write = f.forwardLog.WriteDeadLetter
+		}
+		if err := write(inputID, ackMsgID, f.messageIndex, metadata, data, canAck); err != nil {
 			return fmt.Errorf("can not write forward log: %w", err)
 		}
 	}
 
-	if err := f.updateInputMax(inputID, inputMsgID); err != nil {
-		return fmt.Errorf("can not update max: %w", err)
+	if canAck {
+		if err := f.updateInputMax(inputID, ackMsgID); err != nil {
+			return fmt.Errorf("can not update max: %w", err)
+		}
+		// Отметка делается после записи в лог, поэтому после отказа между ними
+		// граница доставки восстанавливается по логу.
+		if f.delivery != nil {
+			if err := f.delivery.MarkDelivered(inputID, ackMsgID); err != nil {
+				return fmt.Errorf("can not mark delivered: %w", err)
+			}
+		}
 	}
 
 	f.logger.Debugf("forward message %d (len %d) done", f.messageIndex, len(data))
 	return nil
 }
 
-func (f *DefaultForwarder) updateInputMax(inputID uint16, inputMsgID uint32) error {
+// Dispatched отмечает передачу входного сообщения действию. Если действие запущено
+// в нескольких процессах, то они могут ответить на сообщения не по порядку,
+// поэтому Forward подтверждает сообщение только после всех переданных до него.
+func (f *DefaultForwarder) Dispatched(inputID uint16, inputMsgID uint64) {
+	f.completions.Dispatched(inputID, inputMsgID)
+}
+
+// ForwardDetached передает выходное сообщение, не полученное ни из одного входного,
+// например, при срабатывании таймера в действии. Такое сообщение хранится в логе
+// до подтверждения, но не влияет на подтверждения вышестоящим узлам.
+func (f *DefaultForwarder) ForwardDetached(metadata, data []byte) error {
+	return f.Forward(0, 0, metadata, data, false)
+}
+
+func (f *DefaultForwarder) updateInputMax(inputID uint16, inputMsgID uint64) error {
 	f.inputMaxMutex.Lock()
 	defer f.inputMaxMutex.Unlock()
 
@@ -261,14 +412,14 @@ func (f *DefaultForwarder) handleAcks(ctx context.Context, acks chan *downstream
 
 			f.downstreamsAcksLock.Lock()
 			ackOutputMessageID, ok := f.downstreamsAcks[ack.DownstreamIndex]
-			if ok && ackOutputMessageID >= uint32(ack.ackMessage) {
+			if ok && ackOutputMessageID >= uint64(ack.ackMessage) {
 				f.logger.Errorf("new ack message from %d '%d' is less than saved '%d'",
 					ack.DownstreamIndex, ack.ackMessage, ackOutputMessageID)
 
 				f.downstreamsAcksLock.Unlock()
 				continue
 			}
-			f.downstreamsAcks[ack.DownstreamIndex] = uint32(ack.ackMessage)
+			f.downstreamsAcks[ack.DownstreamIndex] = uint64(ack.ackMessage)
 			f.downstreamsAcksLock.Unlock()
 		}
 	}
@@ -284,11 +435,11 @@ func (f *DefaultForwarder) trimLoop(ctx context.Context) error {
 
 			f.inputMaxMutex.Lock()
 			inputMax := f.inputMax
-			f.inputMax = make(map[uint16]uint32)
+			f.inputMax = make(map[uint16]uint64)
 			f.inputMaxMutex.Unlock()
 
 			if f.forwardLog.buffer.Size() != 0 {
-				var minAck uint32
+				var minAck uint64
 				var err error
 
 				// inputMax переприсваиваем input_max
@@ -298,6 +449,7 @@ func (f *DefaultForwarder) trimLoop(ctx context.Context) error {
 				}
 				f.logger.Debugf("trim forward log to %d done", minAck)
 			}
+			inputMax = f.mergeDropped(inputMax)
 
 			if len(inputMax) == 0 {
 				f.logger.Debugf("nothing to trim")
@@ -314,7 +466,31 @@ func (f *DefaultForwarder) trimLoop(ctx context.Context) error {
 	}
 }
 
-func (f *DefaultForwarder) trimForwardLog() (UpstreamAck, uint32, error) {
+// mergeDropped добавляет к inputMax подтверждения сообщений, удаленных из forward log при переполнении,
+// и сообщает в логе о потерянных с предыдущего вызова сообщениях.
+func (f *DefaultForwarder) mergeDropped(inputMax UpstreamAck) UpstreamAck {
+	if stats := f.forwardLog.Stats(); stats.Dropped != f.reportedDropped {
+		f.logger.Warnf("forward log overflow: dropped %d messages not delivered to all downstreams",
+			stats.Dropped-f.reportedDropped)
+		f.reportedDropped = stats.Dropped
+	}
+
+	dropped := f.forwardLog.TakeDropped()
+	if len(dropped) == 0 {
+		return inputMax
+	}
+	if inputMax == nil {
+		inputMax = make(UpstreamAck, len(dropped))
+	}
+	for inputID, msgID := range dropped {
+		if currentMax, ok := inputMax[inputID]; !ok || currentMax < msgID {
+			inputMax[inputID] = msgID
+		}
+	}
+	return inputMax
+}
+
+func (f *DefaultForwarder) trimForwardLog() (UpstreamAck, uint64, error) {
 	f.downstreamsAcksLock.RLock()
 	defer f.downstreamsAcksLock.RUnlock()
 
@@ -325,7 +501,7 @@ func (f *DefaultForwarder) trimForwardLog() (UpstreamAck, uint32, error) {
 	}
 
 	wasMin := false
-	minAck := uint32(0)
+	minAck := uint64(0)
 	for _, ack := range f.downstreamsAcks {
 		if !wasMin || minAck > ack {
 			wasMin = true
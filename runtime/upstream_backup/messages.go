@@ -2,19 +2,58 @@ package upstreambackup
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 )
 
+// helloMagic начинает hello сообщение, начиная с protocolVersion2. В protocolVersion1 на этом месте
+// передается длина имени, которая не может быть такой большой, поэтому получатель различает версии hello.
+const helloMagic uint32 = 0xFFFFFFFF
+
+// maxNameLength максимальная длина имени узла в hello сообщении.
+const maxNameLength = 1 << 16
+
+// ErrNameTooLong возвращается, если длина имени в hello больше maxNameLength.
+var ErrNameTooLong = errors.New("name is too long")
+
+// helloVersionHeader часть hello сообщения protocolVersion2 до имени отправителя.
+type helloVersionHeader struct {
+	// MinVersion и MaxVersion границы версий протокола, которые поддерживает отправитель.
+	MinVersion uint16
+	MaxVersion uint16
+	// Capabilities возможности протокола, которые поддерживает отправитель.
+	Capabilities uint32
+	// Compression маска алгоритмов сжатия, которые предлагает отправитель.
+	Compression uint8
+}
+
 type helloMessage struct {
+	helloVersionHeader
 	NameLength uint32
 	Name       []byte
 }
 
 func (m *helloMessage) readIn(r io.Reader) error {
-	if err := binary.Read(r, binary.BigEndian, &m.NameLength); err != nil {
+	var first uint32
+	if err := binary.Read(r, binary.BigEndian, &first); err != nil {
 		return fmt.Errorf("can not read hello message header: %w", err)
 	}
+	if first == helloMagic {
+		if err := binary.Read(r, binary.BigEndian, &m.helloVersionHeader); err != nil {
+			return fmt.Errorf("can not read hello message versions: %w", err)
+		}
+		if err := binary.Read(r, binary.BigEndian, &m.NameLength); err != nil {
+			return fmt.Errorf("can not read hello message header: %w", err)
+		}
+	} else {
+		m.helloVersionHeader = helloVersionHeader{MinVersion: protocolVersion1, MaxVersion: protocolVersion1}
+		m.NameLength = first
+	}
+
+	if m.NameLength > maxNameLength {
+		return fmt.Errorf("hello with name length %d: %w", m.NameLength, ErrNameTooLong)
+	}
 	m.Name = make([]byte, m.NameLength)
 	if err := binary.Read(r, binary.BigEndian, m.Name); err != nil {
 		return fmt.Errorf("can not read hello message data: %w", err)
@@ -23,6 +62,14 @@ func (m *helloMessage) readIn(r io.Reader) error {
 }
 
 func (m *helloMessage) writeOut(w io.Writer) error {
+	if m.MaxVersion > protocolVersion1 {
+		if err := binary.Write(w, binary.BigEndian, helloMagic); err != nil {
+			return fmt.Errorf("can not send hello message header: %w", err)
+		}
+		if err := binary.Write(w, binary.BigEndian, m.helloVersionHeader); err != nil {
+			return fmt.Errorf("can not send hello message versions: %w", err)
+		}
+	}
 	if err := binary.Write(w, binary.BigEndian, m.NameLength); err != nil {
 		return fmt.Errorf("can not send hello message header: %w", err)
 	}
@@ -32,7 +79,53 @@ func (m *helloMessage) writeOut(w io.Writer) error {
 	return nil
 }
 
+// helloReplyMessage ответ получателя на hello сообщение, начиная с protocolVersion2.
+type helloReplyMessage struct {
+	// Version выбранная версия протокола, 0 если общей версии нет.
+	Version uint16
+	// MinVersion и MaxVersion границы версий протокола, которые поддерживает получатель.
+	MinVersion uint16
+	MaxVersion uint16
+	// Capabilities общие возможности протокола.
+	Capabilities uint32
+	// Compression выбранный алгоритм сжатия.
+	Compression uint8
+}
+
+func (m *helloReplyMessage) readIn(r io.Reader) error {
+	if err := binary.Read(r, binary.BigEndian, m); err != nil {
+		return fmt.Errorf("can not read hello reply: %w", err)
+	}
+	return nil
+}
+
+func (m *helloReplyMessage) writeOut(w io.Writer) error {
+	if err := binary.Write(w, binary.BigEndian, m); err != nil {
+		return fmt.Errorf("can not send hello reply: %w", err)
+	}
+	return nil
+}
+
+const (
+	// dataMessageMetadataFlag выставляется, если перед данными сообщения передается блок метаданных.
+	dataMessageMetadataFlag uint16 = 0x1
+)
+
+// MaxMetadataLength максимальная длина блока метаданных сообщения.
+const MaxMetadataLength = 1 << 20
+
+// ErrMetadataTooLong возвращается, если длина блока метаданных больше MaxMetadataLength.
+var ErrMetadataTooLong = errors.New("metadata is too long")
+
 type dataMessageHeader struct {
+	MessageID     uint64
+	Reserved      uint16
+	Flags         uint16
+	MessageLength uint32
+}
+
+// narrowDataMessageHeader заголовок сообщения до protocolVersion3, в котором номер сообщения 32-битный.
+type narrowDataMessageHeader struct {
 	MessageID     uint32
 	Reserved      uint16
 	Flags         uint16
@@ -41,12 +134,36 @@ type dataMessageHeader struct {
 
 type dataMessage struct {
 	Header dataMessageHeader
-	Data   []byte
+	// Metadata закодированные actionlib метаданные сообщения: ключ, время события и заголовки.
+	// Runtime передает их без изменений.
+	Metadata []byte
+	Data     []byte
 }
 
-func (m *dataMessage) readIn(r io.Reader) error {
-	if err := binary.Read(r, binary.BigEndian, &m.Header); err != nil {
-		return fmt.Errorf("can not read data message header: %w", err)
+func (m *dataMessage) readIn(r io.Reader, p linkProtocol) error {
+	if p.wideIDs() {
+		if err := binary.Read(r, binary.BigEndian, &m.Header); err != nil {
+			return fmt.Errorf("can not read data message header: %w", err)
+		}
+	} else {
+		header := narrowDataMessageHeader{}
+		if err := binary.Read(r, binary.BigEndian, &header); err != nil {
+			return fmt.Errorf("can not read data message header: %w", err)
+		}
+		m.Header = dataMessageHeader{
+			MessageID:     uint64(header.MessageID),
+			Reserved:      header.Reserved,
+			Flags:         header.Flags,
+			MessageLength: header.MessageLength,
+		}
+	}
+	m.Metadata = nil
+	if m.Header.Flags&dataMessageMetadataFlag != 0 {
+		metadata, err := readMetadata(r)
+		if err != nil {
+			return fmt.Errorf("can not read data message metadata: %w", err)
+		}
+		m.Metadata = metadata
 	}
 	m.Data = make([]byte, m.Header.MessageLength)
 	if err := binary.Read(r, binary.BigEndian, m.Data); err != nil {
@@ -55,10 +172,30 @@ func (m *dataMessage) readIn(r io.Reader) error {
 	return nil
 }
 
-func (m *dataMessage) writeOut(w io.Writer) error {
-	if err := binary.Write(w, binary.BigEndian, m.Header); err != nil {
+func (m *dataMessage) writeOut(w io.Writer, p linkProtocol) error {
+	m.Header.Flags &^= dataMessageMetadataFlag
+	if len(m.Metadata) != 0 {
+		m.Header.Flags |= dataMessageMetadataFlag
+	}
+
+	var header interface{} = m.Header
+	if !p.wideIDs() {
+		// Подтверждение получателя тоже 32-битное, старшие биты восстанавливает отправитель.
+		header = narrowDataMessageHeader{
+			MessageID:     uint32(m.Header.MessageID),
+			Reserved:      m.Header.Reserved,
+			Flags:         m.Header.Flags,
+			MessageLength: m.Header.MessageLength,
+		}
+	}
+	if err := binary.Write(w, binary.BigEndian, header); err != nil {
 		return fmt.Errorf("can not send data message header: %w", err)
 	}
+	if len(m.Metadata) != 0 {
+		if err := writeMetadata(w, m.Metadata); err != nil {
+			return fmt.Errorf("can not send data message metadata: %w", err)
+		}
+	}
 
 	if err := binary.Write(w, binary.BigEndian, m.Data); err != nil {
 		return fmt.Errorf("can not send data message data: %w", err)
@@ -66,39 +203,73 @@ func (m *dataMessage) writeOut(w io.Writer) error {
 	return nil
 }
 
-type ackMessage uint32
+// ackMessage номер подтверждаемого сообщения, до protocolVersion3 передается 32-битным.
+type ackMessage uint64
 
-func (m *ackMessage) readIn(r io.Reader) error {
-	if err := binary.Read(r, binary.BigEndian, m); err != nil {
+func (m *ackMessage) readIn(r io.Reader, p linkProtocol) error {
+	if p.wideIDs() {
+		if err := binary.Read(r, binary.BigEndian, m); err != nil {
+			return fmt.Errorf("can not read ack message data: %w", err)
+		}
+		return nil
+	}
+
+	var ack uint32
+	if err := binary.Read(r, binary.BigEndian, &ack); err != nil {
 		return fmt.Errorf("can not read ack message data: %w", err)
 	}
+	*m = ackMessage(ack)
 	return nil
 }
 
-func (m *ackMessage) writeOut(w io.Writer) error {
-	if err := binary.Write(w, binary.BigEndian, *m); err != nil {
+func (m *ackMessage) writeOut(w io.Writer, p linkProtocol) error {
+	var ack interface{} = uint64(*m)
+	if !p.wideIDs() {
+		ack = uint32(*m)
+	}
+	if err := binary.Write(w, binary.BigEndian, ack); err != nil {
 		return fmt.Errorf("can not send ack message data: %w", err)
 	}
 	return nil
 }
 
+const (
+	// forwardLogPartialFlag выставляется для записи, которая не является
+	// последним выходным сообщением для своего входного сообщения.
+	forwardLogPartialFlag uint16 = 0x1
+	// forwardLogMetadataFlag выставляется, если перед данными записи хранится блок метаданных.
+	forwardLogMetadataFlag uint16 = 0x2
+	// forwardLogDeadLetterFlag выставляется для входного сообщения, которое действие не смогло обработать,
+	// такие записи передаются только получателям с режимом RouteDeadLetter.
+	forwardLogDeadLetterFlag uint16 = 0x4
+)
+
 type forwardLogHeader struct {
 	InputID         uint16
 	Flags           uint16
-	InputMessageID  uint32
-	OutputMessageID uint32
+	InputMessageID  uint64
+	OutputMessageID uint64
 	MessageLength   uint32
 }
 
 type forwardLogItem struct {
-	Header forwardLogHeader
-	Data   []byte
+	Header   forwardLogHeader
+	Metadata []byte
+	Data     []byte
 }
 
 func (m *forwardLogItem) readIn(r io.Reader) error {
 	if err := binary.Read(r, binary.BigEndian, &m.Header); err != nil {
 		return fmt.Errorf("can not read forward log item header: %w", err)
 	}
+	m.Metadata = nil
+	if m.Header.Flags&forwardLogMetadataFlag != 0 {
+		metadata, err := readMetadata(r)
+		if err != nil {
+			return fmt.Errorf("can not read forward log item metadata: %w", err)
+		}
+		m.Metadata = metadata
+	}
 	m.Data = make([]byte, m.Header.MessageLength)
 	if err := binary.Read(r, binary.BigEndian, m.Data); err != nil {
 		return fmt.Errorf("can not read forward log item data: %w", err)
@@ -107,12 +278,44 @@ func (m *forwardLogItem) readIn(r io.Reader) error {
 }
 
 func (m *forwardLogItem) writeOut(w io.Writer) error {
+	m.Header.Flags &^= forwardLogMetadataFlag
+	if len(m.Metadata) != 0 {
+		m.Header.Flags |= forwardLogMetadataFlag
+	}
 	if err := binary.Write(w, binary.BigEndian, m.Header); err != nil {
 		return fmt.Errorf("can not write forward log item header: %w", err)
 	}
+	if len(m.Metadata) != 0 {
+		if err := writeMetadata(w, m.Metadata); err != nil {
+			return fmt.Errorf("can not write forward log item metadata: %w", err)
+		}
+	}
 
 	if err := binary.Write(w, binary.BigEndian, m.Data); err != nil {
 		return fmt.Errorf("can not write forward log item header: %w", err)
 	}
 	return nil
 }
+
+func readMetadata(r io.Reader) ([]byte, error) {
+	var metadataLength uint32
+	if err := binary.Read(r, binary.BigEndian, &metadataLength); err != nil {
+		return nil, err
+	}
+	if metadataLength > MaxMetadataLength {
+		return nil, ErrMetadataTooLong
+	}
+
+	metadata := make([]byte, metadataLength)
+	if err := binary.Read(r, binary.BigEndian, metadata); err != nil {
+		return nil, err
+	}
+	return metadata, nil
+}
+
+func writeMetadata(w io.Writer, metadata []byte) error {
+	if err := binary.Write(w, binary.BigEndian, uint32(len(metadata))); err != nil {
+		return err
+	}
+	return binary.Write(w, binary.BigEndian, metadata)
+}
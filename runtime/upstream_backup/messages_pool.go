@@ -26,6 +26,7 @@ func (p *forwardLogItemsPool) Put(o *forwardLogItem) {
 	o.Header.InputMessageID = 0
 	o.Header.OutputMessageID = 0
 	o.Header.MessageLength = 0
+	o.Metadata = nil
 	o.Data = nil
 
 	p.p.Put(o)
@@ -0,0 +1,119 @@
+package upstreambackup
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"strconv"
+)
+
+// Заголовки, которые runtime в режиме exactly-once добавляет к метаданным входных сообщений,
+// чтобы действие могло отбросить повторно полученное сообщение.
+// Пара из имени вышестоящего узла и номера сообщения не меняется при повторной отправке.
+const (
+	DeliveryUpstreamHeader  = "gostreaming-upstream"
+	DeliveryMessageIDHeader = "gostreaming-message-id"
+)
+
+// Заголовки, которые runtime добавляет к метаданным сообщения, отклоненного действием,
+// перед передачей узлу для недоставленных сообщений.
+const (
+	DeadLetterNodeHeader    = "gostreaming-dead-letter-node"
+	DeadLetterReasonHeader  = "gostreaming-dead-letter-reason"
+	DeadLetterCrashesHeader = "gostreaming-dead-letter-crashes"
+)
+
+// metadataVersion версия формата блока метаданных, формат описан в actionlib.
+const metadataVersion uint8 = 1
+
+// ErrBadMetadata возвращается, если блок метаданных не удается разобрать.
+var ErrBadMetadata = errors.New("bad metadata")
+
+// emptyMetadata блок метаданных без ключа, времени и заголовков.
+var emptyMetadata = []byte{metadataVersion, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+
+// WithDeliveryHeaders возвращает копию блока метаданных metadata с добавленными
+// заголовками доставки сообщения messageID от узла upstream. metadata может быть пустым.
+// Заголовки дописываются в конец блока, поэтому при совпадении имен действие
+// получит значения, добавленные этим узлом.
+func WithDeliveryHeaders(metadata []byte, upstream string, messageID uint64) ([]byte, error) {
+	return withHeaders(metadata,
+		DeliveryUpstreamHeader, upstream,
+		DeliveryMessageIDHeader, strconv.FormatUint(messageID, 10))
+}
+
+// WithDeadLetterHeaders возвращает копию блока метаданных metadata с добавленными
+// заголовками отклоненного сообщения: именем узла node, причиной reason и числом
+// отказов действия на сообщении crashes, если оно больше 0. metadata может быть пустым.
+func WithDeadLetterHeaders(metadata []byte, node, reason string, crashes int) ([]byte, error) {
+	headers := []string{DeadLetterNodeHeader, node, DeadLetterReasonHeader, reason}
+	if crashes > 0 {
+		headers = append(headers, DeadLetterCrashesHeader, strconv.Itoa(crashes))
+	}
+	return withHeaders(metadata, headers...)
+}
+
+// withHeaders дописывает в конец блока метаданных заголовки из пар имя-значение.
+func withHeaders(metadata []byte, pairs ...string) ([]byte, error) {
+	if len(metadata) == 0 {
+		metadata = emptyMetadata
+	}
+	countOffset, err := metadataHeadersOffset(metadata)
+	if err != nil {
+		return nil, err
+	}
+	count := int(binary.BigEndian.Uint16(metadata[countOffset:]))
+	if count+len(pairs)/2 > math.MaxUint16 {
+		return nil, ErrMetadataTooLong
+	}
+
+	size := len(metadata)
+	for _, s := range pairs {
+		if len(s) > math.MaxUint16 {
+			return nil, ErrMetadataTooLong
+		}
+		size += 2 + len(s)
+	}
+	if size > MaxMetadataLength {
+		return nil, ErrMetadataTooLong
+	}
+
+	result := make([]byte, 0, size)
+	result = append(result, metadata...)
+	binary.BigEndian.PutUint16(result[countOffset:], uint16(count+len(pairs)/2))
+	for _, s := range pairs {
+		result = appendShortString(result, s)
+	}
+	return result, nil
+}
+
+// metadataHeadersOffset возвращает смещение числа заголовков в блоке метаданных:
+// блок начинается с версии, ключа с uint16 длиной и int64 времени события.
+func metadataHeadersOffset(metadata []byte) (int, error) {
+	if len(metadata) < 3 || metadata[0] != metadataVersion {
+		return 0, ErrBadMetadata
+	}
+	offset := 3 + int(binary.BigEndian.Uint16(metadata[1:])) + 8
+	if len(metadata) < offset+2 {
+		return 0, ErrBadMetadata
+	}
+	return offset, nil
+}
+
+func appendShortString(b []byte, s string) []byte {
+	b = append(b, byte(len(s)>>8), byte(len(s)))
+	return append(b, s...)
+}
+
+// metadataKey возвращает ключ сообщения из блока метаданных или nil, если ключа нет
+// или блок не удается разобрать.
+func metadataKey(metadata []byte) []byte {
+	if len(metadata) < 3 || metadata[0] != metadataVersion {
+		return nil
+	}
+	end := 3 + int(binary.BigEndian.Uint16(metadata[1:]))
+	if len(metadata) < end {
+		return nil
+	}
+	return metadata[3:end]
+}
@@ -0,0 +1,129 @@
+package upstreambackup
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// Версии протокола обмена сообщениями между runtime.
+const (
+	// protocolVersion1 исходный протокол: hello содержит только имя отправителя,
+	// получатель на него не отвечает, сообщения передаются без метаданных и сжатия.
+	protocolVersion1 uint16 = 1
+	// protocolVersion2 hello содержит версии и возможности отправителя,
+	// а получатель отвечает на него выбранной версией и общими возможностями.
+	protocolVersion2 uint16 = 2
+	// protocolVersion3 номера сообщений и подтверждений 64-битные.
+	protocolVersion3 uint16 = 3
+
+	// minProtocolVersion и maxProtocolVersion границы версий, которые поддерживает runtime.
+	minProtocolVersion = protocolVersion1
+	maxProtocolVersion = protocolVersion3
+)
+
+// Возможности протокола, о которых договариваются стороны соединения.
+const (
+	// capabilityMetadata сообщения могут содержать блок метаданных.
+	capabilityMetadata uint32 = 1 << 0
+	// capabilityCompression пакеты сообщений передаются кадрами, которые могут быть сжаты.
+	capabilityCompression uint32 = 1 << 1
+
+	supportedCapabilities = capabilityMetadata | capabilityCompression
+)
+
+// helloReplyTimeout время ожидания ответа на hello. Получатель с protocolVersion1
+// не отвечает на hello, поэтому без ограничения отправитель ждал бы ответа бесконечно.
+const helloReplyTimeout = 10 * time.Second
+
+// Возможные ошибки согласования протокола.
+var (
+	ErrIncompatibleVersion = errors.New("incompatible protocol version")
+	ErrNoHelloReply        = errors.New("no reply to hello, downstream may support only protocol version 1")
+	ErrBadCapabilities     = errors.New("downstream chose not offered capabilities")
+)
+
+// linkProtocol параметры протокола, о которых договорились стороны соединения.
+type linkProtocol struct {
+	Version      uint16
+	Capabilities uint32
+	Compression  uint8
+}
+
+// legacyProtocol параметры соединения с узлом, который поддерживает только protocolVersion1.
+var legacyProtocol = linkProtocol{Version: protocolVersion1}
+
+func (p linkProtocol) has(capability uint32) bool {
+	return p.Capabilities&capability != 0
+}
+
+// wideIDs возвращает true, если номера сообщений передаются 64-битными.
+func (p linkProtocol) wideIDs() bool {
+	return p.Version >= protocolVersion3
+}
+
+// widenMessageID восстанавливает 64-битный номер сообщения по его младшим 32 битам,
+// выбирая ближайший номер, не больший last — номера последнего отправленного сообщения.
+func widenMessageID(id uint32, last uint64) uint64 {
+	wide := last&^math.MaxUint32 | uint64(id)
+	if wide > last && wide > math.MaxUint32 {
+		wide -= 1 << 32
+	}
+	return wide
+}
+
+func (p linkProtocol) String() string {
+	capabilities := make([]string, 0, 2)
+	if p.has(capabilityMetadata) {
+		capabilities = append(capabilities, "metadata")
+	}
+	if p.has(capabilityCompression) {
+		capabilities = append(capabilities, "compression")
+	}
+	return fmt.Sprintf("version %d, capabilities [%s], compression %s",
+		p.Version, strings.Join(capabilities, ","), compressionName(p.Compression))
+}
+
+// negotiateProtocol выбирает наибольшую версию и возможности, которые поддерживают обе стороны.
+func negotiateProtocol(hello *helloMessage) (linkProtocol, error) {
+	version := hello.MaxVersion
+	if version > maxProtocolVersion {
+		version = maxProtocolVersion
+	}
+	if version < hello.MinVersion || version < minProtocolVersion {
+		return linkProtocol{}, fmt.Errorf("upstream supports versions [%d, %d], receiver supports [%d, %d]: %w",
+			hello.MinVersion, hello.MaxVersion, minProtocolVersion, maxProtocolVersion, ErrIncompatibleVersion)
+	}
+
+	protocol := linkProtocol{
+		Version:      version,
+		Capabilities: hello.Capabilities & supportedCapabilities,
+	}
+	if protocol.has(capabilityCompression) {
+		protocol.Compression = chooseCompression(hello.Compression)
+	}
+	return protocol, nil
+}
+
+// acceptReply проверяет ответ получателя на hello и возвращает параметры соединения.
+func acceptReply(hello *helloMessage, reply *helloReplyMessage) (linkProtocol, error) {
+	if reply.Version == 0 || reply.Version < hello.MinVersion || reply.Version > hello.MaxVersion {
+		return linkProtocol{}, fmt.Errorf("downstream supports versions [%d, %d], forwarder supports [%d, %d]: %w",
+			reply.MinVersion, reply.MaxVersion, hello.MinVersion, hello.MaxVersion, ErrIncompatibleVersion)
+	}
+	if reply.Capabilities&^hello.Capabilities != 0 {
+		return linkProtocol{}, fmt.Errorf("capabilities %#x: %w", reply.Capabilities, ErrBadCapabilities)
+	}
+	if reply.Compression != compressionNone &&
+		(reply.Compression != hello.Compression || reply.Capabilities&capabilityCompression == 0) {
+		return linkProtocol{}, fmt.Errorf("downstream chose not offered compression %d: %w", reply.Compression, ErrUnknownCompression)
+	}
+
+	return linkProtocol{
+		Version:      reply.Version,
+		Capabilities: reply.Capabilities,
+		Compression:  reply.Compression,
+	}, nil
+}
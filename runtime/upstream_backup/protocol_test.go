@@ -0,0 +1,192 @@
+package upstreambackup
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/GDVFox/gostreaming/util/connutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHelloLegacyRoundtrip(t *testing.T) {
+	// hello protocolVersion1 содержит только длину имени и имя.
+	var buf bytes.Buffer
+	legacy := &helloMessage{NameLength: 8, Name: []byte("upstream")}
+	legacy.MaxVersion = protocolVersion1
+	assert.NoError(t, legacy.writeOut(&buf))
+	assert.Equal(t, 4+8, buf.Len())
+
+	hello := &helloMessage{}
+	assert.NoError(t, hello.readIn(&buf))
+	assert.Equal(t, "upstream", string(hello.Name))
+	assert.Equal(t, protocolVersion1, hello.MinVersion)
+	assert.Equal(t, protocolVersion1, hello.MaxVersion)
+}
+
+func TestHelloRoundtrip(t *testing.T) {
+	var buf bytes.Buffer
+	sent := &helloMessage{NameLength: 8, Name: []byte("upstream")}
+	sent.helloVersionHeader = helloVersionHeader{
+		MinVersion:   protocolVersion1,
+		MaxVersion:   protocolVersion2,
+		Capabilities: supportedCapabilities,
+		Compression:  compressionZstd,
+	}
+	assert.NoError(t, sent.writeOut(&buf))
+
+	hello := &helloMessage{}
+	assert.NoError(t, hello.readIn(&buf))
+	assert.Equal(t, sent, hello)
+}
+
+func TestHelloNameTooLong(t *testing.T) {
+	var buf bytes.Buffer
+	hello := &helloMessage{NameLength: maxNameLength + 1}
+	hello.MaxVersion = protocolVersion1
+	assert.NoError(t, hello.writeOut(&buf))
+
+	assert.ErrorIs(t, (&helloMessage{}).readIn(&buf), ErrNameTooLong)
+}
+
+func TestNegotiateProtocol(t *testing.T) {
+	hello := &helloMessage{}
+	hello.helloVersionHeader = helloVersionHeader{
+		MinVersion: protocolVersion1,
+		// Отправитель новее получателя.
+		MaxVersion:   maxProtocolVersion + 3,
+		Capabilities: capabilityMetadata | 1<<20,
+		Compression:  compressionZstd,
+	}
+	protocol, err := negotiateProtocol(hello)
+	assert.NoError(t, err)
+	assert.Equal(t, linkProtocol{Version: maxProtocolVersion, Capabilities: capabilityMetadata}, protocol)
+
+	// Сжатие выбирается, только если отправитель поддерживает кадры.
+	hello.Capabilities = supportedCapabilities
+	protocol, err = negotiateProtocol(hello)
+	assert.NoError(t, err)
+	assert.Equal(t, compressionZstd, protocol.Compression)
+
+	hello.MinVersion = maxProtocolVersion + 1
+	_, err = negotiateProtocol(hello)
+	assert.ErrorIs(t, err, ErrIncompatibleVersion)
+}
+
+func TestAcceptReply(t *testing.T) {
+	hello := &helloMessage{}
+	hello.helloVersionHeader = helloVersionHeader{
+		MinVersion:   minProtocolVersion,
+		MaxVersion:   maxProtocolVersion,
+		Capabilities: capabilityMetadata,
+		Compression:  compressionZstd,
+	}
+
+	protocol, err := acceptReply(hello, &helloReplyMessage{Version: protocolVersion2, Capabilities: capabilityMetadata})
+	assert.NoError(t, err)
+	assert.Equal(t, linkProtocol{Version: protocolVersion2, Capabilities: capabilityMetadata}, protocol)
+
+	_, err = acceptReply(hello, &helloReplyMessage{Version: 0, MinVersion: 5, MaxVersion: 6})
+	assert.ErrorIs(t, err, ErrIncompatibleVersion)
+
+	_, err = acceptReply(hello, &helloReplyMessage{Version: protocolVersion2, Capabilities: capabilityCompression})
+	assert.ErrorIs(t, err, ErrBadCapabilities)
+
+	// Сжатие без возможности передавать кадры.
+	_, err = acceptReply(hello, &helloReplyMessage{Version: protocolVersion2, Compression: compressionZstd})
+	assert.ErrorIs(t, err, ErrUnknownCompression)
+}
+
+func TestListenHelloLegacy(t *testing.T) {
+	logger, err := newTestLogger()
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver := NewDefaultReceiver("", []string{"upstream"}, nil, nil, logger)
+
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+	go func() {
+		hello := &helloMessage{NameLength: 8, Name: []byte("upstream")}
+		hello.MaxVersion = protocolVersion1
+		hello.writeOut(clientConn)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	name, protocol, err := receiver.listenHello(ctx, connutil.NewDefaultConnection(serverConn))
+	assert.NoError(t, err)
+	assert.Equal(t, "upstream", name)
+	assert.Equal(t, legacyProtocol, protocol)
+}
+
+func TestSayHelloIncompatible(t *testing.T) {
+	logger, err := newTestLogger()
+	if err != nil {
+		t.Fatal(err)
+	}
+	forwarder := NewDownstreamForwarder(0, "upstream", "", nil, nil, 0, nil, nil, logger)
+
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+	go func() {
+		hello := &helloMessage{}
+		if err := hello.readIn(serverConn); err != nil {
+			return
+		}
+		reply := &helloReplyMessage{MinVersion: maxProtocolVersion + 1, MaxVersion: maxProtocolVersion + 2}
+		reply.writeOut(serverConn)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err = forwarder.sayHello(ctx, connutil.NewDefaultConnection(clientConn))
+	assert.ErrorIs(t, err, ErrIncompatibleVersion)
+}
+
+func TestWidenMessageID(t *testing.T) {
+	assert.EqualValues(t, 5, widenMessageID(5, 10))
+	assert.EqualValues(t, 1<<32+5, widenMessageID(5, 1<<32+10))
+	// Подтверждение отстает от отправленных сообщений на переходе через границу 32 бит.
+	assert.EqualValues(t, 1<<32-2, widenMessageID(1<<32-2, 1<<32+3))
+	assert.EqualValues(t, 3<<32+7, widenMessageID(7, 3<<32+7))
+}
+
+func TestDataMessageIDWidth(t *testing.T) {
+	sent := &dataMessage{
+		Header: dataMessageHeader{MessageID: 1<<32 + 3, MessageLength: 4},
+		Data:   []byte("data"),
+	}
+	for _, protocol := range []linkProtocol{legacyProtocol, testProtocol} {
+		var buf bytes.Buffer
+		assert.NoError(t, sent.writeOut(&buf, protocol))
+
+		msg := &dataMessage{}
+		assert.NoError(t, msg.readIn(&buf, protocol))
+		assert.Equal(t, sent.Data, msg.Data)
+		if protocol.wideIDs() {
+			assert.EqualValues(t, 1<<32+3, msg.Header.MessageID)
+		} else {
+			assert.EqualValues(t, 3, msg.Header.MessageID)
+		}
+	}
+}
+
+func TestAckMessageWidth(t *testing.T) {
+	var buf bytes.Buffer
+	ack := ackMessage(1<<32 + 3)
+	assert.NoError(t, ack.writeOut(&buf, legacyProtocol))
+	assert.Equal(t, 4, buf.Len())
+	assert.NoError(t, ack.readIn(&buf, legacyProtocol))
+	assert.EqualValues(t, 3, ack)
+
+	ack = ackMessage(1<<32 + 3)
+	assert.NoError(t, ack.writeOut(&buf, testProtocol))
+	assert.Equal(t, 8, buf.Len())
+	assert.NoError(t, ack.readIn(&buf, testProtocol))
+	assert.EqualValues(t, 1<<32+3, ack)
+}
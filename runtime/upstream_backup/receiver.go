@@ -2,6 +2,7 @@ package upstreambackup
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"net"
@@ -21,6 +22,8 @@ var (
 type workingUpstream struct {
 	upstream     *UpstreamReceiver
 	stopUpstream context.CancelFunc
+	// done закрывается, когда сообщения узла больше не передаются в DefaultReceiver.
+	done chan struct{}
 }
 
 // DefaultReceiver получает сообщения от вышестоящих узлов.
@@ -36,12 +39,18 @@ type DefaultReceiver struct {
 	upstreamInWorkIndexes map[uint16]string
 
 	upstreamNames map[string]struct{}
+	// tlsConfig включает взаимную TLS аутентификацию вышестоящих узлов, может быть nil.
+	tlsConfig *tls.Config
+	// delivery включает режим exactly-once, может быть nil.
+	delivery *DeliveryStore
 
 	logger *util.Logger
 }
 
 // NewDefaultReceiver возвращает новый объект DefaultReceiver.
-func NewDefaultReceiver(addr string, inNames []string, l *util.Logger) *DefaultReceiver {
+// Если tlsConfig не nil, то имя вышестоящего узла берется из его сертификата.
+// Если delivery не nil, то номера входов выдаются им, а повторно полученные сообщения отбрасываются.
+func NewDefaultReceiver(addr string, inNames []string, tlsConfig *tls.Config, delivery *DeliveryStore, l *util.Logger) *DefaultReceiver {
 	upstreamNames := make(map[string]struct{})
 	for _, in := range inNames {
 		upstreamNames[in] = struct{}{}
@@ -55,6 +64,8 @@ func NewDefaultReceiver(addr string, inNames []string, l *util.Logger) *DefaultR
 		upstreamNames:         upstreamNames,
 		upstreamInWork:        make(map[string]*workingUpstream),
 		upstreamInWorkIndexes: make(map[uint16]string),
+		tlsConfig:             tlsConfig,
+		delivery:              delivery,
 		logger:                l.WithName("default_receiver"),
 	}
 }
@@ -71,6 +82,9 @@ func (r *DefaultReceiver) Run(ctx context.Context) error {
 	if err != nil {
 		return fmt.Errorf("can not listen tcp: %w", err)
 	}
+	if r.tlsConfig != nil {
+		listener = tls.NewListener(listener, r.tlsConfig)
+	}
 
 	receiverWG.Add(1)
 	go func() {
@@ -130,12 +144,20 @@ func (r *DefaultReceiver) runUpstream(ctx context.Context, upstreamIndex uint16,
 	upstreamCtx, upstreamStop := context.WithCancel(ctx)
 	defer upstreamStop()
 
-	upstreamName, err := r.listenHello(upstreamCtx, tcpConn)
+	upstreamName, protocol, err := r.listenHello(upstreamCtx, tcpConn)
 	if err != nil {
 		r.logger.Errorf("read hello message failed: %s", err)
 		return
 	}
-	r.logger.Infof("got hello message from %s: %s", tcpConn.Conn.RemoteAddr(), upstreamName)
+	r.logger.Infof("got hello message from %s: %s, protocol %s",
+		tcpConn.Conn.RemoteAddr(), upstreamName, protocol)
+
+	if r.delivery != nil {
+		if upstreamIndex, err = r.delivery.Register(upstreamName); err != nil {
+			r.logger.Errorf("can not register upstream %s: %s", upstreamName, err)
+			return
+		}
+	}
 
 	r.upstreamInWorkMutex.Lock()
 	// Здесь мы можем попасть на уже завершенный upstream,
@@ -146,12 +168,20 @@ func (r *DefaultReceiver) runUpstream(ctx context.Context, upstreamIndex uint16,
 		delete(r.upstreamInWorkIndexes, workingUpstream.upstream.upstreamIndex)
 
 		r.logger.Debugf("send stop signal to previous upstream %s", upstreamName)
+		// Повторные сообщения определяются по сообщениям, уже переданным из прежнего соединения,
+		// поэтому новое соединение начинает работу только после его остановки.
+		if r.delivery != nil {
+			<-workingUpstream.done
+		}
 	}
 
-	upstream := NewUpstreamReceiver(upstreamIndex, upstreamName, tcpConn, r.logger)
+	upstream := NewUpstreamReceiver(upstreamIndex, upstreamName, protocol, tcpConn, r.delivery, r.logger)
+	done := make(chan struct{})
+	defer close(done)
 	r.upstreamInWork[upstreamName] = &workingUpstream{
 		upstream:     upstream,
 		stopUpstream: upstreamStop,
+		done:         done,
 	}
 	r.upstreamInWorkIndexes[upstreamIndex] = upstreamName
 	r.upstreamInWorkMutex.Unlock()
@@ -175,6 +205,9 @@ func (r *DefaultReceiver) runUpstream(ctx context.Context, upstreamIndex uint16,
 			case <-upstreamCtx.Done():
 				return
 			case r.messages <- message:
+				if r.delivery != nil {
+					r.delivery.Received(upstream.name, message.Header.MessageID)
+				}
 			}
 		}
 	}()
@@ -182,21 +215,53 @@ func (r *DefaultReceiver) runUpstream(ctx context.Context, upstreamIndex uint16,
 	wg.Wait()
 }
 
-func (r *DefaultReceiver) listenHello(ctx context.Context, tcpConn *connutil.Connection) (string, error) {
+// listenHello читает hello сообщение и отвечает на него выбранными версией протокола,
+// возможностями и алгоритмом сжатия. Отправителю, который поддерживает только protocolVersion1, ответ не передается.
+func (r *DefaultReceiver) listenHello(ctx context.Context, tcpConn *connutil.Connection) (string, linkProtocol, error) {
 	connReader := ctxio.NewContextReader(ctx, tcpConn)
 	defer connReader.Free()
+	connWriter := ctxio.NewContextWriter(ctx, tcpConn)
+	defer connWriter.Free()
+
+	peerName, err := handshake(ctx, tcpConn.Conn)
+	if err != nil {
+		return "", linkProtocol{}, err
+	}
 
 	hello := &helloMessage{}
 	if err := hello.readIn(connReader); err != nil {
-		return "", err
+		return "", linkProtocol{}, err
 	}
 
 	upstreamName := string(hello.Name)
+	// При TLS имя узла подтверждается сертификатом, а не только его собственным заявлением.
+	if r.tlsConfig != nil && upstreamName != peerName {
+		return "", linkProtocol{}, fmt.Errorf("hello from %s with certificate for %s: %w", upstreamName, peerName, ErrUpstreamNameMismatch)
+	}
 	if _, ok := r.upstreamNames[upstreamName]; !ok {
-		return "", fmt.Errorf("for %s: %w", upstreamName, ErrUpstreamUnknown)
+		return "", linkProtocol{}, fmt.Errorf("for %s: %w", upstreamName, ErrUpstreamUnknown)
 	}
 
-	return upstreamName, nil
+	if hello.MaxVersion == protocolVersion1 {
+		return upstreamName, legacyProtocol, nil
+	}
+
+	reply := &helloReplyMessage{MinVersion: minProtocolVersion, MaxVersion: maxProtocolVersion}
+	protocol, negotiateErr := negotiateProtocol(hello)
+	if negotiateErr == nil {
+		reply.Version = protocol.Version
+		reply.Capabilities = protocol.Capabilities
+		reply.Compression = protocol.Compression
+	}
+	// При несовместимых версиях отправитель получает ответ с нулевой версией,
+	// чтобы сообщить о причине разрыва соединения.
+	if err := reply.writeOut(connWriter); err != nil {
+		return "", linkProtocol{}, err
+	}
+	if negotiateErr != nil {
+		return "", linkProtocol{}, negotiateErr
+	}
+	return upstreamName, protocol, nil
 }
 
 // Messages возвращает канал с сообщениями.
@@ -216,19 +281,31 @@ func (r *DefaultReceiver) ackUpstreams(ack UpstreamAck) {
 	r.upstreamInWorkMutex.Lock()
 	defer r.upstreamInWorkMutex.Unlock()
 
-	ackWG := &sync.WaitGroup{}
+	// В режиме exactly-once номера сообщений узла не зависят от соединения, поэтому
+	// сообщения, полученные по прежнему соединению, подтверждаются по новому.
+	acks := make(map[string]uint64, len(ack))
 	for upstreamIndex, messageID := range ack {
 		upstreamName, ok := r.upstreamInWorkIndexes[upstreamIndex]
+		if !ok && r.delivery != nil {
+			upstreamName, ok = r.delivery.InputName(upstreamIndex)
+		}
 		if !ok {
 			continue
 		}
+		if current, ok := acks[upstreamName]; !ok || messageID > current {
+			acks[upstreamName] = messageID
+		}
+	}
+
+	ackWG := &sync.WaitGroup{}
+	for upstreamName, messageID := range acks {
 		upstream, ok := r.upstreamInWork[upstreamName]
 		if !ok {
 			continue
 		}
 
 		ackWG.Add(1)
-		go func(upstream *UpstreamReceiver, messageID uint32) {
+		go func(upstream *UpstreamReceiver, messageID uint64) {
 			defer ackWG.Done()
 
 			if err := upstream.Ack(messageID); err != nil {
@@ -0,0 +1,161 @@
+package upstreambackup
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sync"
+)
+
+// Режимы передачи сообщений нижестоящим узлам.
+const (
+	// RouteBroadcast получатель получает все сообщения.
+	RouteBroadcast = "broadcast"
+	// RouteRoundRobin сообщения распределяются по очереди между получателями с этим режимом.
+	RouteRoundRobin = "round_robin"
+	// RouteHash сообщения распределяются между получателями с этим режимом по ключу,
+	// поэтому сообщения с одним ключом всегда получает один узел.
+	RouteHash = "hash"
+	// RouteDeadLetter получатель получает только сообщения, которые действие не смогло обработать,
+	// остальные получатели их не получают.
+	RouteDeadLetter = "dead_letter"
+)
+
+// ErrUnknownRoute возвращается при неизвестном режиме передачи сообщений.
+var ErrUnknownRoute = errors.New("unknown routing mode")
+
+// outputRoute выбирает записи forward log, которые передаются получателю из группы
+// получателей с одним режимом. Выбор зависит только от записи, поэтому после
+// перезапуска или переподключения получатель получает те же записи.
+type outputRoute struct {
+	mode string
+	// position номер получателя в группе, size число получателей в группе.
+	position int
+	size     int
+}
+
+// newOutputRoutes возвращает маршруты получателей по их режимам routing,
+// nil маршрут означает, что получатель получает все сообщения.
+// routing может быть короче списка получателей, недостающие режимы означают RouteBroadcast.
+// Если есть получатель с режимом RouteDeadLetter, то маршрут есть у всех получателей,
+// так как остальные получатели должны пропускать его записи.
+func newOutputRoutes(routing []string, outs int) ([]*outputRoute, error) {
+	if len(routing) > outs {
+		return nil, fmt.Errorf("got %d routing modes for %d outs: %w", len(routing), outs, ErrUnknownRoute)
+	}
+
+	routes := make([]*outputRoute, outs)
+	groups := make(map[string][]*outputRoute)
+	for i, mode := range routing {
+		switch mode {
+		case "", RouteBroadcast:
+			continue
+		case RouteRoundRobin, RouteHash, RouteDeadLetter:
+		default:
+			return nil, fmt.Errorf("%s: %w", mode, ErrUnknownRoute)
+		}
+		routes[i] = &outputRoute{mode: mode, position: len(groups[mode])}
+		groups[mode] = append(groups[mode], routes[i])
+	}
+	if len(groups[RouteDeadLetter]) != 0 {
+		for i, route := range routes {
+			if route == nil {
+				routes[i] = &outputRoute{mode: RouteBroadcast}
+			}
+		}
+	}
+	for _, group := range groups {
+		for _, route := range group {
+			route.size = len(group)
+		}
+	}
+	return routes, nil
+}
+
+// accepts проверяет, передается ли запись получателю. Сообщения без ключа
+// в режиме RouteHash распределяются так же, как в RouteRoundRobin.
+// Отклоненные действием сообщения получают все получатели с режимом RouteDeadLetter.
+func (r *outputRoute) accepts(item *forwardLogItem) bool {
+	isDeadLetter := item.Header.Flags&forwardLogDeadLetterFlag != 0
+	if isDeadLetter != (r.mode == RouteDeadLetter) {
+		return false
+	}
+	switch r.mode {
+	case RouteBroadcast, RouteDeadLetter:
+		return true
+	case RouteHash:
+		if key := metadataKey(item.Metadata); len(key) != 0 {
+			h := fnv.New32a()
+			h.Write(key)
+			return int(h.Sum32()%uint32(r.size)) == r.position
+		}
+	}
+	return int(item.Header.OutputMessageID%uint64(r.size)) == r.position
+}
+
+// routeTracker вычисляет подтверждения получателя, которому передается только часть записей лога.
+// Получатель подтверждает только полученные им сообщения, а для обрезки лога нужна граница,
+// до которой каждая запись либо подтверждена, либо не предназначена получателю.
+type routeTracker struct {
+	lock sync.Mutex
+	// pending номера отправленных, но не подтвержденных сообщений в порядке отправки.
+	pending []uint64
+	// handled номер последней прочитанной из лога записи.
+	handled    uint64
+	hasHandled bool
+	// reported последняя переданная граница.
+	reported    uint64
+	hasReported bool
+}
+
+// Sent отмечает отправку сообщения id.
+func (t *routeTracker) Sent(id uint64) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.pending = append(t.pending, id)
+}
+
+// Handled отмечает, что прочитаны все записи лога до id включительно.
+func (t *routeTracker) Handled(id uint64) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.handled, t.hasHandled = id, true
+}
+
+// Acked отмечает подтверждение получателем всех сообщений вплоть до id.
+func (t *routeTracker) Acked(id uint64) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	n := 0
+	for n < len(t.pending) && t.pending[n] <= id {
+		n++
+	}
+	t.pending = append(t.pending[:0], t.pending[n:]...)
+}
+
+// Next возвращает новую границу, если она сдвинулась с последнего вызова.
+func (t *routeTracker) Next() (uint64, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if !t.hasHandled {
+		return 0, false
+	}
+	border := t.handled
+	if len(t.pending) != 0 {
+		// Номера выходных сообщений возрастают, поэтому все записи до первого
+		// неподтвержденного сообщения обработаны.
+		if t.pending[0] == 0 {
+			return 0, false
+		}
+		border = t.pending[0] - 1
+	}
+	if t.hasReported && border <= t.reported {
+		return 0, false
+	}
+	t.reported, t.hasReported = border, true
+	return border, true
+}
@@ -0,0 +1,142 @@
+package upstreambackup
+
+import (
+	"bytes"
+	"testing"
+
+	actionlib "github.com/GDVFox/gostreaming/lib/go-actionlib"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewOutputRoutes(t *testing.T) {
+	routes, err := newOutputRoutes([]string{RouteRoundRobin, "", RouteHash, RouteRoundRobin}, 5)
+	assert.NoError(t, err)
+	assert.Len(t, routes, 5)
+	assert.Nil(t, routes[1])
+	assert.Nil(t, routes[4])
+	assert.Equal(t, &outputRoute{mode: RouteRoundRobin, position: 0, size: 2}, routes[0])
+	assert.Equal(t, &outputRoute{mode: RouteHash, position: 0, size: 1}, routes[2])
+	assert.Equal(t, &outputRoute{mode: RouteRoundRobin, position: 1, size: 2}, routes[3])
+
+	_, err = newOutputRoutes([]string{"random"}, 1)
+	assert.ErrorIs(t, err, ErrUnknownRoute)
+	_, err = newOutputRoutes([]string{RouteHash, RouteHash}, 1)
+	assert.ErrorIs(t, err, ErrUnknownRoute)
+}
+
+func testRoutedItem(t *testing.T, id uint64, key string) *forwardLogItem {
+	item := &forwardLogItem{Data: []byte("data")}
+	item.Header.OutputMessageID = id
+	item.Header.MessageLength = 4
+	if key != "" {
+		metadata, err := actionlib.EncodeMetadata(&actionlib.Envelope{Key: []byte(key)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		item.Metadata = metadata
+	}
+	return item
+}
+
+func TestOutputRouteAccepts(t *testing.T) {
+	routes, err := newOutputRoutes([]string{RouteHash, RouteHash, RouteHash}, 3)
+	assert.NoError(t, err)
+
+	// Каждую запись получает ровно один получатель группы, записи с одним ключом — один и тот же.
+	owners := make(map[string]int)
+	for id := uint64(0); id < 100; id++ {
+		key := string(rune('a' + id%7))
+		accepted := -1
+		for i, route := range routes {
+			if route.accepts(testRoutedItem(t, id, key)) {
+				assert.Equal(t, -1, accepted)
+				accepted = i
+			}
+		}
+		if owner, ok := owners[key]; ok {
+			assert.Equal(t, owner, accepted)
+		}
+		owners[key] = accepted
+	}
+
+	// Записи без ключа распределяются по очереди.
+	for id := uint64(0); id < 6; id++ {
+		assert.True(t, routes[id%3].accepts(testRoutedItem(t, id, "")))
+	}
+}
+
+func TestRouteTracker(t *testing.T) {
+	tracker := &routeTracker{}
+	_, ok := tracker.Next()
+	assert.False(t, ok)
+
+	// Записи 1 и 2 предназначены другому получателю.
+	tracker.Handled(2)
+	border, ok := tracker.Next()
+	assert.True(t, ok)
+	assert.EqualValues(t, 2, border)
+
+	tracker.Sent(3)
+	tracker.Handled(3)
+	tracker.Handled(5)
+	tracker.Sent(6)
+	tracker.Handled(6)
+	_, ok = tracker.Next()
+	assert.False(t, ok)
+
+	// После подтверждения 3 граница доходит до записи перед неподтвержденным сообщением 6.
+	tracker.Acked(3)
+	border, ok = tracker.Next()
+	assert.True(t, ok)
+	assert.EqualValues(t, 5, border)
+
+	tracker.Handled(8)
+	tracker.Acked(6)
+	border, ok = tracker.Next()
+	assert.True(t, ok)
+	assert.EqualValues(t, 8, border)
+	_, ok = tracker.Next()
+	assert.False(t, ok)
+}
+
+func TestDownstreamRoutedItems(t *testing.T) {
+	logger, err := newTestLogger()
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes, err := newOutputRoutes([]string{RouteRoundRobin, RouteRoundRobin}, 2)
+	assert.NoError(t, err)
+
+	items := make([]*forwardLogItem, 0, 4)
+	for id := uint64(1); id <= 4; id++ {
+		items = append(items, testRoutedItem(t, id, ""))
+	}
+	for i, route := range routes {
+		forwarder := NewDownstreamForwarder(uint16(i), "upstream", "", nil, route, 0, nil, nil, logger)
+		forwarder.protocol = testProtocol
+
+		var buf bytes.Buffer
+		assert.NoError(t, forwarder.writeItems(&buf, items))
+
+		received := make([]uint64, 0, 2)
+		for buf.Len() != 0 {
+			msg := &dataMessage{}
+			assert.NoError(t, msg.readIn(&buf, testProtocol))
+			received = append(received, msg.Header.MessageID)
+		}
+		if i == 0 {
+			assert.Equal(t, []uint64{2, 4}, received)
+		} else {
+			assert.Equal(t, []uint64{1, 3}, received)
+		}
+
+		// Лог можно обрезать только до первого неподтвержденного сообщения получателя.
+		border, ok := forwarder.tracker.Next()
+		assert.True(t, ok)
+		assert.Equal(t, received[0]-1, border)
+		forwarder.tracker.Acked(received[1])
+		border, ok = forwarder.tracker.Next()
+		assert.True(t, ok)
+		assert.EqualValues(t, 4, border)
+	}
+}
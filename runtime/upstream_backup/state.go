@@ -0,0 +1,313 @@
+package upstreambackup
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+// Возможные ошибки состояния.
+var (
+	ErrStateKeyNotFound = errors.New("state key not found")
+)
+
+// StateInput входное сообщение, при обработке которого изменяется состояние.
+type StateInput struct {
+	InputID   uint16
+	MessageID uint64
+	// Immediate выставляется для изменений, не связанных с входным сообщением,
+	// например, при инициализации действия. Такие изменения применяются сразу.
+	Immediate bool
+}
+
+// StateChange подтвержденное изменение ключа состояния.
+type StateChange struct {
+	Key     []byte
+	Value   []byte
+	Deleted bool
+}
+
+// StateReplica копия подтвержденного состояния вне машины. Локальное хранилище
+// остается на машине, а действие после отказа может быть запущено на другой машине.
+// Вместе с состоянием в копии хранятся границы доставки режима exactly-once, см. DeliveryStore.
+type StateReplica interface {
+	// Load возвращает все ключи копии или nil, если в копию ещё ничего не записывалось.
+	Load() (map[string][]byte, error)
+	// LoadDelivery возвращает границы доставки, сохраненные в копии.
+	LoadDelivery() (*DeliveryMarks, error)
+	// Apply применяет к копии изменения состояния и границы доставки marks, marks может быть nil.
+	Apply(changes []StateChange, marks *DeliveryMarks) error
+}
+
+type stateWrite struct {
+	input   StateInput
+	key     string
+	value   []byte
+	deleted bool
+}
+
+// StateStore хранилище пар ключ-значение действия.
+// Изменения, сделанные при обработке входного сообщения, применяются только
+// после подтверждения этого сообщения вышестоящему узлу, т.е. вместе с обрезкой
+// forward log. Поэтому после перезапуска состояние соответствует подтвержденным сообщениям,
+// а неподтвержденные будут повторно отправлены и обработаны.
+type StateStore struct {
+	lock sync.Mutex
+
+	db *leveldb.DB
+	// replica копия состояния вне машины, nil если копия не используется.
+	replica StateReplica
+
+	// pending изменения неподтвержденных сообщений в порядке обработки.
+	pending []*stateWrite
+	// overlay последнее неподтвержденное изменение каждого ключа.
+	overlay map[string]*stateWrite
+}
+
+// NewStateStore открывает хранилище в stateDir. В отличие от forward log,
+// данные хранилища не удаляются при закрытии.
+// Если задана replica, то подтвержденные изменения записываются в нее до локального хранилища,
+// а при открытии локальное хранилище заменяется ее содержимым, так как оно могло устареть
+// или отсутствовать, если действие до этого работало на другой машине.
+func NewStateStore(stateDir string, replica StateReplica) (*StateStore, error) {
+	db, err := leveldb.OpenFile(stateDir, nil)
+	if err != nil {
+		return nil, fmt.Errorf("can not open underlying db: %w", err)
+	}
+
+	s := &StateStore{
+		db:      db,
+		replica: replica,
+		overlay: make(map[string]*stateWrite),
+	}
+	if replica != nil {
+		if err := s.restore(); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// restore приводит локальное хранилище к содержимому копии. Если копия пустая,
+// например, состояние хранилось только локально, то в нее записывается локальное хранилище.
+func (s *StateStore) restore() error {
+	replicated, err := s.replica.Load()
+	if err != nil {
+		return fmt.Errorf("can not load state replica: %w", err)
+	}
+
+	iter := s.db.NewIterator(nil, nil)
+	defer iter.Release()
+
+	if replicated == nil {
+		changes := make([]StateChange, 0)
+		for iter.Next() {
+			changes = append(changes, StateChange{
+				Key:   append([]byte(nil), iter.Key()...),
+				Value: append([]byte(nil), iter.Value()...),
+			})
+		}
+		if err := iter.Error(); err != nil {
+			return fmt.Errorf("can not read state: %w", err)
+		}
+		if err := s.replica.Apply(changes, nil); err != nil {
+			return fmt.Errorf("can not replicate state: %w", err)
+		}
+		return nil
+	}
+
+	batch := new(leveldb.Batch)
+	for iter.Next() {
+		if _, ok := replicated[string(iter.Key())]; !ok {
+			batch.Delete(append([]byte(nil), iter.Key()...))
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return fmt.Errorf("can not read state: %w", err)
+	}
+	for key, value := range replicated {
+		batch.Put([]byte(key), value)
+	}
+	if err := s.db.Write(batch, &opt.WriteOptions{Sync: true}); err != nil {
+		return fmt.Errorf("can not restore state: %w", err)
+	}
+	return nil
+}
+
+// Get возвращает значение ключа с учетом неподтвержденных изменений.
+func (s *StateStore) Get(key []byte) ([]byte, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if w, ok := s.overlay[string(key)]; ok {
+		if w.deleted {
+			return nil, ErrStateKeyNotFound
+		}
+		return w.value, nil
+	}
+
+	value, err := s.db.Get(key, nil)
+	if errors.Is(err, leveldb.ErrNotFound) {
+		return nil, ErrStateKeyNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can not read key: %w", err)
+	}
+	return value, nil
+}
+
+// Put сохраняет значение ключа, измененное при обработке input.
+func (s *StateStore) Put(input StateInput, key, value []byte) error {
+	return s.write(&stateWrite{input: input, key: string(key), value: value})
+}
+
+// Delete удаляет ключ при обработке input.
+func (s *StateStore) Delete(input StateInput, key []byte) error {
+	return s.write(&stateWrite{input: input, key: string(key), deleted: true})
+}
+
+func (s *StateStore) write(w *stateWrite) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if w.input.Immediate {
+		if err := s.replicate([]*stateWrite{w}, nil); err != nil {
+			return err
+		}
+		// Неподтвержденные изменения ключа старше, поэтому они больше не нужны.
+		s.dropPending(w.key)
+
+		batch := new(leveldb.Batch)
+		putToBatch(batch, w)
+		if err := s.db.Write(batch, &opt.WriteOptions{Sync: true}); err != nil {
+			return fmt.Errorf("can not write key: %w", err)
+		}
+		return nil
+	}
+
+	s.pending = append(s.pending, w)
+	s.overlay[w.key] = w
+	return nil
+}
+
+// Commit применяет изменения всех сообщений, подтвержденных ack.
+// Commit должен вызываться до отправки ack вышестоящему узлу.
+// marks границы доставки тех же сообщений, они записываются в копию вместе с изменениями,
+// иначе после отказа между записями сообщения будут обработаны повторно или потеряны.
+func (s *StateStore) Commit(ack UpstreamAck, marks *DeliveryMarks) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// Для каждого ключа достаточно применить последнее подтвержденное изменение,
+	// более ранние изменения этого ключа, в т.ч. неподтвержденные, им перекрываются.
+	lastCommitted := make(map[string]int)
+	for i, w := range s.pending {
+		if msgID, ok := ack[w.input.InputID]; ok && w.input.MessageID <= msgID {
+			lastCommitted[w.key] = i
+		}
+	}
+	if len(lastCommitted) == 0 && marks == nil {
+		return nil
+	}
+
+	batch := new(leveldb.Batch)
+	committed := make([]*stateWrite, 0, len(lastCommitted))
+	rest := make([]*stateWrite, 0, len(s.pending)-len(lastCommitted))
+	for i, w := range s.pending {
+		last, ok := lastCommitted[w.key]
+		if !ok || i > last {
+			rest = append(rest, w)
+			continue
+		}
+		if i == last {
+			putToBatch(batch, w)
+			committed = append(committed, w)
+		}
+	}
+
+	// Изменения должны попасть в копию до подтверждения сообщений, иначе после переноса
+	// действия на другую машину они будут потеряны, а сообщения не будут отправлены повторно.
+	if err := s.replicate(committed, marks); err != nil {
+		return err
+	}
+	if err := s.db.Write(batch, &opt.WriteOptions{Sync: true}); err != nil {
+		return fmt.Errorf("can not commit state: %w", err)
+	}
+	s.setPending(rest)
+	return nil
+}
+
+// Rollback отменяет неподтвержденные изменения, сделанные при обработке inputs.
+// Вызывается перед повторной передачей сообщений перезапущенному действию,
+// иначе при повторной обработке действие увидит собственные изменения.
+func (s *StateStore) Rollback(inputs []StateInput) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	rolledBack := make(map[StateInput]struct{}, len(inputs))
+	for _, input := range inputs {
+		rolledBack[input] = struct{}{}
+	}
+
+	rest := make([]*stateWrite, 0, len(s.pending))
+	for _, w := range s.pending {
+		if _, ok := rolledBack[w.input]; !ok {
+			rest = append(rest, w)
+		}
+	}
+	s.setPending(rest)
+}
+
+// Close закрывает хранилище, неподтвержденные изменения теряются.
+func (s *StateStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *StateStore) replicate(writes []*stateWrite, marks *DeliveryMarks) error {
+	if s.replica == nil {
+		return nil
+	}
+
+	changes := make([]StateChange, 0, len(writes))
+	for _, w := range writes {
+		changes = append(changes, StateChange{Key: []byte(w.key), Value: w.value, Deleted: w.deleted})
+	}
+	if err := s.replica.Apply(changes, marks); err != nil {
+		return fmt.Errorf("can not replicate state: %w", err)
+	}
+	return nil
+}
+
+func (s *StateStore) dropPending(key string) {
+	if _, ok := s.overlay[key]; !ok {
+		return
+	}
+
+	rest := make([]*stateWrite, 0, len(s.pending))
+	for _, w := range s.pending {
+		if w.key != key {
+			rest = append(rest, w)
+		}
+	}
+	s.setPending(rest)
+}
+
+func (s *StateStore) setPending(pending []*stateWrite) {
+	s.pending = pending
+	s.overlay = make(map[string]*stateWrite, len(pending))
+	for _, w := range pending {
+		s.overlay[w.key] = w
+	}
+}
+
+func putToBatch(batch *leveldb.Batch, w *stateWrite) {
+	if w.deleted {
+		batch.Delete([]byte(w.key))
+		return
+	}
+	batch.Put([]byte(w.key), w.value)
+}
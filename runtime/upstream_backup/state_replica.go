@@ -0,0 +1,171 @@
+package upstreambackup
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/GDVFox/gostreaming/util/storage"
+)
+
+const (
+	// maxReplicaOps ограничение на число изменений в одной транзакции etcd,
+	// по умолчанию etcd принимает не больше 128 операций.
+	maxReplicaOps = 64
+	// maxReplicaBatchSize ограничение на размер одной транзакции etcd,
+	// по умолчанию etcd принимает запросы не больше 1.5 МБ.
+	maxReplicaBatchSize = 1 << 20
+	// replicaMarker значение ключа-отметки о том, что копия уже записывалась.
+	replicaMarker = "1"
+	// deliveryReplicaPath путь границ доставки внутри копии. Ключи состояния записываются
+	// в hex и не содержат '/', поэтому не пересекаются с ключами под этим путем.
+	deliveryReplicaPath = "delivery/"
+)
+
+// ETCDStateReplica копия состояния действия в etcd. Каждый ключ состояния хранится
+// в отдельном ключе etcd с префиксом prefix, а сам prefix отмечает, что копия уже записывалась.
+// Границы доставки хранятся под prefix/delivery/: граница каждого вышестоящего узла по ключу
+// delivered/<имя узла в hex> и зарезервированный номер выходных сообщений по ключу next_output.
+type ETCDStateReplica struct {
+	cli    *storage.ETCDClient
+	prefix string
+}
+
+// NewETCDStateReplica создает копию состояния в etcd с ключами под prefix.
+func NewETCDStateReplica(cfg *storage.ETCDConfig, prefix string) (*ETCDStateReplica, error) {
+	cli, err := storage.NewETCDClient(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("can not create etcd client: %w", err)
+	}
+	return &ETCDStateReplica{
+		cli:    cli,
+		prefix: strings.TrimSuffix(prefix, "/"),
+	}, nil
+}
+
+// Load возвращает все ключи копии или nil, если в копию ещё ничего не записывалось.
+func (r *ETCDStateReplica) Load() (map[string][]byte, error) {
+	ctx := context.Background()
+	if _, err := r.cli.Get(ctx, r.prefix); err != nil {
+		if err == storage.ErrNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	values, err := r.cli.LoadPrefix(ctx, r.prefix+"/")
+	if err != nil {
+		return nil, err
+	}
+	state := make(map[string][]byte, len(values))
+	for etcdKey, value := range values {
+		if strings.HasPrefix(etcdKey, r.deliveryPrefix()) {
+			continue
+		}
+		key, err := hex.DecodeString(strings.TrimPrefix(etcdKey, r.prefix+"/"))
+		if err != nil {
+			return nil, fmt.Errorf("bad state key %s: %w", etcdKey, err)
+		}
+		state[string(key)] = value
+	}
+	return state, nil
+}
+
+// LoadDelivery возвращает границы доставки, сохраненные в копии.
+func (r *ETCDStateReplica) LoadDelivery() (*DeliveryMarks, error) {
+	values, err := r.cli.LoadPrefix(context.Background(), r.deliveryPrefix())
+	if err != nil {
+		return nil, err
+	}
+
+	marks := &DeliveryMarks{Delivered: make(map[string]uint64, len(values))}
+	for etcdKey, value := range values {
+		key := strings.TrimPrefix(etcdKey, r.deliveryPrefix())
+		if len(value) != 8 {
+			return nil, fmt.Errorf("bad delivery value %s", etcdKey)
+		}
+		switch {
+		case key == nextOutputKey:
+			marks.NextOutput = binary.BigEndian.Uint64(value)
+		case strings.HasPrefix(key, deliveredKeyPrefix):
+			name, err := hex.DecodeString(strings.TrimPrefix(key, deliveredKeyPrefix))
+			if err != nil {
+				return nil, fmt.Errorf("bad delivery key %s: %w", etcdKey, err)
+			}
+			marks.Delivered[string(name)] = binary.BigEndian.Uint64(value)
+		default:
+			return nil, fmt.Errorf("unexpected delivery key %s", etcdKey)
+		}
+	}
+	return marks, nil
+}
+
+// Apply применяет изменения к копии. Изменения разбиваются на несколько транзакций,
+// если не помещаются в одну. Каждая транзакция записывает последние значения ключей,
+// поэтому после ошибки изменения можно применить повторно.
+// Границы доставки записываются после изменений состояния, поэтому после ошибки
+// между транзакциями граница не опережает состояние.
+func (r *ETCDStateReplica) Apply(changes []StateChange, marks *DeliveryMarks) error {
+	ctx := context.Background()
+
+	values := map[string]string{r.prefix: replicaMarker}
+	deleted := make([]string, 0)
+	size := 0
+	flush := func() error {
+		if err := r.cli.Apply(ctx, values, deleted); err != nil {
+			return err
+		}
+		values = map[string]string{r.prefix: replicaMarker}
+		deleted = deleted[:0]
+		size = 0
+		return nil
+	}
+
+	add := func(etcdKey string, value []byte, isDeleted bool) error {
+		changeSize := len(etcdKey) + len(value)
+		if len(values)+len(deleted) > maxReplicaOps || (size != 0 && size+changeSize > maxReplicaBatchSize) {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		if isDeleted {
+			deleted = append(deleted, etcdKey)
+		} else {
+			values[etcdKey] = string(value)
+		}
+		size += changeSize
+		return nil
+	}
+
+	for _, change := range changes {
+		if err := add(r.prefix+"/"+hex.EncodeToString(change.Key), change.Value, change.Deleted); err != nil {
+			return err
+		}
+	}
+	if marks != nil {
+		for name, msgID := range marks.Delivered {
+			etcdKey := r.deliveryPrefix() + deliveredKeyPrefix + hex.EncodeToString([]byte(name))
+			if err := add(etcdKey, uint64Bytes(msgID), false); err != nil {
+				return err
+			}
+		}
+		if marks.NextOutput != 0 {
+			if err := add(r.deliveryPrefix()+nextOutputKey, uint64Bytes(marks.NextOutput), false); err != nil {
+				return err
+			}
+		}
+	}
+	return flush()
+}
+
+// deliveryPrefix префикс ключей границ доставки.
+func (r *ETCDStateReplica) deliveryPrefix() string {
+	return r.prefix + "/" + deliveryReplicaPath
+}
+
+// Close закрывает соединение с etcd.
+func (r *ETCDStateReplica) Close() error {
+	return r.cli.Close()
+}
@@ -0,0 +1,201 @@
+package upstreambackup
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStateStoreRollback(t *testing.T) {
+	s, err := NewStateStore(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	first := StateInput{InputID: 0, MessageID: 1}
+	second := StateInput{InputID: 0, MessageID: 2}
+	other := StateInput{InputID: 1, MessageID: 2}
+	assert.NoError(t, s.Put(first, []byte("a"), []byte("1")))
+	assert.NoError(t, s.Put(second, []byte("a"), []byte("2")))
+	assert.NoError(t, s.Put(other, []byte("b"), []byte("1")))
+
+	// После отмены изменений second ключ снова содержит значение, записанное при обработке first.
+	s.Rollback([]StateInput{second})
+	value, err := s.Get([]byte("a"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("1"), value)
+	value, err = s.Get([]byte("b"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("1"), value)
+
+	s.Rollback([]StateInput{first, other})
+	_, err = s.Get([]byte("a"))
+	assert.ErrorIs(t, err, ErrStateKeyNotFound)
+	_, err = s.Get([]byte("b"))
+	assert.ErrorIs(t, err, ErrStateKeyNotFound)
+
+	// Подтвержденные изменения не отменяются.
+	assert.NoError(t, s.Put(first, []byte("a"), []byte("1")))
+	assert.NoError(t, s.Commit(UpstreamAck{0: 1}, nil))
+	s.Rollback([]StateInput{first})
+	value, err = s.Get([]byte("a"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("1"), value)
+}
+
+// memoryReplica копия состояния в памяти, имитирующая хранилище вне машины.
+type memoryReplica struct {
+	state      map[string][]byte
+	delivered  map[string]uint64
+	nextOutput uint64
+	applyErr   error
+}
+
+func (r *memoryReplica) Load() (map[string][]byte, error) {
+	return r.state, nil
+}
+
+func (r *memoryReplica) LoadDelivery() (*DeliveryMarks, error) {
+	marks := &DeliveryMarks{Delivered: make(map[string]uint64), NextOutput: r.nextOutput}
+	for name, msgID := range r.delivered {
+		marks.Delivered[name] = msgID
+	}
+	return marks, nil
+}
+
+func (r *memoryReplica) Apply(changes []StateChange, marks *DeliveryMarks) error {
+	if r.applyErr != nil {
+		return r.applyErr
+	}
+	if marks != nil {
+		if r.delivered == nil {
+			r.delivered = make(map[string]uint64)
+		}
+		for name, msgID := range marks.Delivered {
+			r.delivered[name] = msgID
+		}
+		if marks.NextOutput != 0 {
+			r.nextOutput = marks.NextOutput
+		}
+	}
+	if r.state == nil {
+		r.state = make(map[string][]byte)
+	}
+	for _, change := range changes {
+		if change.Deleted {
+			delete(r.state, string(change.Key))
+			continue
+		}
+		r.state[string(change.Key)] = change.Value
+	}
+	return nil
+}
+
+func TestStateStoreReplica(t *testing.T) {
+	replica := &memoryReplica{}
+	s, err := NewStateStore(t.TempDir(), replica)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.NoError(t, s.Put(StateInput{Immediate: true}, []byte("init"), []byte("1")))
+	assert.NoError(t, s.Put(StateInput{InputID: 0, MessageID: 1}, []byte("a"), []byte("1")))
+	assert.NoError(t, s.Put(StateInput{InputID: 0, MessageID: 2}, []byte("a"), []byte("2")))
+	assert.NoError(t, s.Put(StateInput{InputID: 0, MessageID: 3}, []byte("b"), []byte("3")))
+	assert.NoError(t, s.Delete(StateInput{InputID: 0, MessageID: 3}, []byte("init")))
+
+	// В копию попадают только подтвержденные изменения.
+	assert.NoError(t, s.Commit(UpstreamAck{0: 2}, nil))
+	assert.Equal(t, map[string][]byte{"init": []byte("1"), "a": []byte("2")}, replica.state)
+
+	assert.NoError(t, s.Commit(UpstreamAck{0: 3}, nil))
+	assert.Equal(t, map[string][]byte{"a": []byte("2"), "b": []byte("3")}, replica.state)
+	assert.NoError(t, s.Close())
+
+	// Действие перенесено на другую машину, где локального хранилища нет.
+	moved, err := NewStateStore(t.TempDir(), replica)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer moved.Close()
+
+	value, err := moved.Get([]byte("a"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("2"), value)
+	value, err = moved.Get([]byte("b"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("3"), value)
+	_, err = moved.Get([]byte("init"))
+	assert.ErrorIs(t, err, ErrStateKeyNotFound)
+}
+
+func TestStateStoreReplicaReplacesStaleState(t *testing.T) {
+	dir := t.TempDir()
+	local, err := NewStateStore(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, local.Put(StateInput{Immediate: true}, []byte("a"), []byte("old")))
+	assert.NoError(t, local.Put(StateInput{Immediate: true}, []byte("stale"), []byte("old")))
+	assert.NoError(t, local.Close())
+
+	// Пока действие работало на другой машине, копия изменилась.
+	replica := &memoryReplica{state: map[string][]byte{"a": []byte("new")}}
+	s, err := NewStateStore(dir, replica)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	value, err := s.Get([]byte("a"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("new"), value)
+	_, err = s.Get([]byte("stale"))
+	assert.ErrorIs(t, err, ErrStateKeyNotFound)
+}
+
+func TestStateStoreReplicaUploadsLocalState(t *testing.T) {
+	dir := t.TempDir()
+	local, err := NewStateStore(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, local.Put(StateInput{Immediate: true}, []byte("a"), []byte("1")))
+	assert.NoError(t, local.Close())
+
+	// Копия ещё не записывалась, поэтому в нее переносится локальное состояние.
+	replica := &memoryReplica{}
+	s, err := NewStateStore(dir, replica)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	assert.Equal(t, map[string][]byte{"a": []byte("1")}, replica.state)
+}
+
+func TestStateStoreReplicaFailure(t *testing.T) {
+	replica := &memoryReplica{}
+	s, err := NewStateStore(t.TempDir(), replica)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	input := StateInput{InputID: 0, MessageID: 1}
+	assert.NoError(t, s.Put(input, []byte("a"), []byte("1")))
+
+	// Без записи в копию изменения не подтверждаются и остаются неподтвержденными.
+	replica.applyErr = errors.New("etcd unavailable")
+	assert.ErrorIs(t, s.Commit(UpstreamAck{0: 1}, nil), replica.applyErr)
+	s.Rollback([]StateInput{input})
+	_, err = s.Get([]byte("a"))
+	assert.ErrorIs(t, err, ErrStateKeyNotFound)
+
+	replica.applyErr = nil
+	assert.NoError(t, s.Put(input, []byte("a"), []byte("1")))
+	assert.NoError(t, s.Commit(UpstreamAck{0: 1}, nil))
+	assert.Equal(t, map[string][]byte{"a": []byte("1")}, replica.state)
+}
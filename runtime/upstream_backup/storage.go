@@ -0,0 +1,93 @@
+package upstreambackup
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Хранилища записей forward log.
+const (
+	// StorageLevelDB хранит записи в LevelDB.
+	StorageLevelDB = "leveldb"
+	// StorageMemory хранит записи в памяти процесса. Записи теряются при перезапуске runtime,
+	// поэтому хранилище подходит только для пайплайнов, которым не нужна доставка после отказа.
+	StorageMemory = "memory"
+	// StorageFile хранит записи в сегментах файла, в которые данные только дописываются.
+	StorageFile = "file"
+)
+
+// Режимы сброса на диск записей StorageFile.
+const (
+	// SyncNone оставляет сброс данных на диск операционной системе.
+	SyncNone = "none"
+	// SyncSegment сбрасывает сегмент на диск при переходе к следующему сегменту и при закрытии.
+	SyncSegment = "segment"
+	// SyncAlways сбрасывает данные на диск после каждой записи.
+	SyncAlways = "always"
+)
+
+// Возможные ошибки выбора хранилища.
+var (
+	ErrUnknownStorage  = errors.New("unknown forward log storage")
+	ErrUnknownSyncMode = errors.New("unknown forward log sync mode")
+)
+
+// StorageConfig параметры хранилища forward log.
+type StorageConfig struct {
+	// Backend хранилище записей, пустое значение означает StorageLevelDB.
+	Backend string
+	// Sync режим сброса на диск для StorageFile, пустое значение означает SyncSegment.
+	Sync string
+	// SegmentSize длина сегмента StorageFile в байтах, 0 означает defaultSegmentSize.
+	SegmentSize int64
+}
+
+// logStorage хранилище записей forward log. Записи получают последовательные ключи
+// в порядке добавления и удаляются только с начала, поэтому всегда занимают
+// непрерывный диапазон ключей [Front, Tail). Дописывать записи может только одна горутина,
+// а читать — одновременно с ней.
+type logStorage interface {
+	// Append добавляет запись в конец хранилища.
+	Append(item *forwardLogItem) error
+	// Front возвращает ключ первой записи.
+	Front() uint64
+	// Tail возвращает ключ, который получит следующая запись, и канал,
+	// который будет закрыт после этой записи.
+	Tail() (uint64, <-chan struct{})
+	// Size возвращает число записей.
+	Size() int64
+	// ReadRange загружает записи с ключами из [from, to) в порядке возрастания, пока их не больше maxItems,
+	// а суммарная длина данных не больше maxBytes. Первая запись загружается всегда.
+	// Возвращает ключ, с которого нужно продолжить чтение.
+	// Записи берутся из forwardLogItems, после использования их нужно вернуть в пул.
+	ReadRange(from, to uint64, maxItems, maxBytes int, items []*forwardLogItem) ([]*forwardLogItem, uint64, error)
+	// LoadFirst и LoadLast загружают первую и последнюю записи, errBufferEmpty если записей нет.
+	LoadFirst(item *forwardLogItem) error
+	LoadLast(item *forwardLogItem) error
+	// TrimFirst удаляет первую запись, errBufferEmpty если записей нет.
+	TrimFirst() error
+	// GetMeta возвращает значение служебной записи name, nil если записи нет.
+	GetMeta(name string) ([]byte, error)
+	// PutMeta сохраняет значение служебной записи name.
+	PutMeta(name string, value []byte) error
+	// Close закрывает хранилище, не удаляя записи.
+	Close() error
+}
+
+// openLogStorage открывает хранилище, выбранное в cfg, в каталоге dir.
+// cfg может быть nil, тогда используется StorageLevelDB.
+func openLogStorage(dir string, cfg *StorageConfig) (logStorage, error) {
+	if cfg == nil {
+		cfg = &StorageConfig{}
+	}
+
+	switch cfg.Backend {
+	case "", StorageLevelDB:
+		return newLogBuffer(dir)
+	case StorageMemory:
+		return newMemoryStorage(), nil
+	case StorageFile:
+		return newFileStorage(dir, cfg)
+	}
+	return nil, fmt.Errorf("%s: %w", cfg.Backend, ErrUnknownStorage)
+}
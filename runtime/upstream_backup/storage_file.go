@@ -0,0 +1,492 @@
+package upstreambackup
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// defaultSegmentSize длина сегмента fileStorage по умолчанию.
+const defaultSegmentSize = 64 << 20
+
+const (
+	segmentExt   = ".log"
+	metaFileName = "meta.json"
+)
+
+// ErrCorruptedSegment возвращается, если запись в сегменте, после которого есть другие сегменты, повреждена.
+var ErrCorruptedSegment = errors.New("forward log segment is corrupted")
+
+// fileRecordHeader заголовок записи в сегменте.
+type fileRecordHeader struct {
+	Length   uint32
+	Checksum uint32
+}
+
+const fileRecordHeaderSize = 8
+
+// fileSegment файл с записями, ключи которых начинаются со start.
+type fileSegment struct {
+	start uint64
+	// offsets смещения записей в файле.
+	offsets []int64
+	size    int64
+	file    *os.File
+}
+
+func (s *fileSegment) end() uint64 {
+	return s.start + uint64(len(s.offsets))
+}
+
+// fileMeta служебные данные fileStorage, которые сохраняются в metaFileName.
+type fileMeta struct {
+	// Front ключ первой записи, записи до него удалены, но могут оставаться в первом сегменте.
+	Front  uint64            `json:"front"`
+	Values map[string][]byte `json:"values"`
+}
+
+// fileStorage хранилище записей forward log в файлах-сегментах, в которые данные только дописываются.
+// Когда сегмент достигает segmentSize, записи продолжаются в новом сегменте, а сегмент,
+// все записи которого удалены, удаляется целиком. Ключ первой записи сохраняется вместе
+// со служебными записями, поэтому после отказа удаленные записи могут быть прочитаны повторно.
+// При открытии все записи проверяются по контрольной сумме, а недописанная запись в конце
+// последнего сегмента отбрасывается.
+type fileStorage struct {
+	lock sync.Mutex
+
+	dir         string
+	syncMode    string
+	segmentSize int64
+
+	// segments сегменты в порядке возрастания ключей, запись ведется в последний.
+	segments []*fileSegment
+	front    uint64
+	tail     uint64
+	values   map[string][]byte
+
+	// appended закрывается и заменяется новым каналом после каждой записи.
+	appended chan struct{}
+}
+
+func newFileStorage(dir string, cfg *StorageConfig) (*fileStorage, error) {
+	s := &fileStorage{
+		dir:         dir,
+		syncMode:    cfg.Sync,
+		segmentSize: cfg.SegmentSize,
+		values:      make(map[string][]byte),
+		appended:    make(chan struct{}),
+	}
+	switch s.syncMode {
+	case "":
+		s.syncMode = SyncSegment
+	case SyncNone, SyncSegment, SyncAlways:
+	default:
+		return nil, fmt.Errorf("%s: %w", s.syncMode, ErrUnknownSyncMode)
+	}
+	if s.segmentSize <= 0 {
+		s.segmentSize = defaultSegmentSize
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("can not create forward log dir: %w", err)
+	}
+	if err := s.open(); err != nil {
+		s.closeSegments()
+		return nil, err
+	}
+	return s, nil
+}
+
+// open загружает служебные данные и сегменты, оставшиеся после предыдущего запуска.
+func (s *fileStorage) open() error {
+	meta := &fileMeta{}
+	data, err := ioutil.ReadFile(filepath.Join(s.dir, metaFileName))
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return fmt.Errorf("can not read meta: %w", err)
+	default:
+		if err := json.Unmarshal(data, meta); err != nil {
+			return fmt.Errorf("can not decode meta: %w", err)
+		}
+	}
+	if meta.Values != nil {
+		s.values = meta.Values
+	}
+
+	starts, err := s.listSegments()
+	if err != nil {
+		return err
+	}
+	for i, start := range starts {
+		segment, err := s.loadSegment(start, i == len(starts)-1)
+		if err != nil {
+			return err
+		}
+		if len(s.segments) != 0 && s.segments[len(s.segments)-1].end() != start {
+			segment.file.Close()
+			return fmt.Errorf("segment %d does not continue previous segment: %w", start, ErrCorruptedSegment)
+		}
+		s.segments = append(s.segments, segment)
+	}
+
+	if len(s.segments) == 0 {
+		if err := s.createSegment(meta.Front); err != nil {
+			return err
+		}
+	}
+	s.tail = s.segments[len(s.segments)-1].end()
+	s.front = meta.Front
+	if first := s.segments[0].start; s.front < first {
+		s.front = first
+	}
+	if s.front > s.tail {
+		s.front = s.tail
+	}
+	return s.removeTrimmedSegments()
+}
+
+// listSegments возвращает ключи начала сегментов в каталоге в порядке возрастания.
+func (s *fileStorage) listSegments() ([]uint64, error) {
+	entries, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("can not list segments: %w", err)
+	}
+
+	starts := make([]uint64, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), segmentExt) {
+			continue
+		}
+		start, err := strconv.ParseUint(strings.TrimSuffix(entry.Name(), segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		starts = append(starts, start)
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i] < starts[j] })
+	return starts, nil
+}
+
+// loadSegment открывает сегмент и проверяет его записи. Недописанная или поврежденная запись
+// отбрасывается вместе со всеми следующими, только если сегмент последний.
+func (s *fileStorage) loadSegment(start uint64, last bool) (*fileSegment, error) {
+	file, err := os.OpenFile(s.segmentPath(start), os.O_RDWR, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("can not open segment %d: %w", start, err)
+	}
+	segment := &fileSegment{start: start, file: file}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("can not stat segment %d: %w", start, err)
+	}
+
+	reader := bufio.NewReader(file)
+	header := fileRecordHeader{}
+	payload := make([]byte, 0)
+	for {
+		err := binary.Read(reader, binary.BigEndian, &header)
+		if err == nil && segment.size+fileRecordHeaderSize+int64(header.Length) > info.Size() {
+			err = io.ErrUnexpectedEOF
+		}
+		if err == nil {
+			if cap(payload) < int(header.Length) {
+				payload = make([]byte, header.Length)
+			}
+			payload = payload[:header.Length]
+			_, err = io.ReadFull(reader, payload)
+		}
+		if err == nil && crc32.ChecksumIEEE(payload) != header.Checksum {
+			err = fmt.Errorf("record %d checksum mismatch", segment.end())
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			if !last {
+				file.Close()
+				return nil, fmt.Errorf("segment %d: %s: %w", start, err, ErrCorruptedSegment)
+			}
+			if err := file.Truncate(segment.size); err != nil {
+				file.Close()
+				return nil, fmt.Errorf("can not truncate segment %d: %w", start, err)
+			}
+			break
+		}
+
+		segment.offsets = append(segment.offsets, segment.size)
+		segment.size += fileRecordHeaderSize + int64(header.Length)
+	}
+	return segment, nil
+}
+
+func (s *fileStorage) createSegment(start uint64) error {
+	file, err := os.OpenFile(s.segmentPath(start), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("can not create segment %d: %w", start, err)
+	}
+	s.segments = append(s.segments, &fileSegment{start: start, file: file})
+	return nil
+}
+
+func (s *fileStorage) segmentPath(start uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", start, segmentExt))
+}
+
+func (s *fileStorage) Append(item *forwardLogItem) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	record := &bytes.Buffer{}
+	record.Write(make([]byte, fileRecordHeaderSize))
+	if err := item.writeOut(record); err != nil {
+		return fmt.Errorf("can not encode item: %w", err)
+	}
+	data := record.Bytes()
+	payload := data[fileRecordHeaderSize:]
+	binary.BigEndian.PutUint32(data, uint32(len(payload)))
+	binary.BigEndian.PutUint32(data[4:], crc32.ChecksumIEEE(payload))
+
+	segment := s.segments[len(s.segments)-1]
+	if segment.size >= s.segmentSize {
+		if err := s.rollSegment(); err != nil {
+			return err
+		}
+		segment = s.segments[len(s.segments)-1]
+	}
+
+	if _, err := segment.file.WriteAt(data, segment.size); err != nil {
+		// Частично записанная запись будет перезаписана следующей.
+		return fmt.Errorf("can not save item: %w", err)
+	}
+	if s.syncMode == SyncAlways {
+		if err := segment.file.Sync(); err != nil {
+			return fmt.Errorf("can not sync segment: %w", err)
+		}
+	}
+	segment.offsets = append(segment.offsets, segment.size)
+	segment.size += int64(len(data))
+	s.tail++
+
+	close(s.appended)
+	s.appended = make(chan struct{})
+	return nil
+}
+
+// rollSegment завершает запись в текущий сегмент и начинает новый.
+func (s *fileStorage) rollSegment() error {
+	if s.syncMode != SyncNone {
+		if err := s.segments[len(s.segments)-1].file.Sync(); err != nil {
+			return fmt.Errorf("can not sync segment: %w", err)
+		}
+	}
+	return s.createSegment(s.tail)
+}
+
+func (s *fileStorage) Front() uint64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.front
+}
+
+func (s *fileStorage) Tail() (uint64, <-chan struct{}) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.tail, s.appended
+}
+
+func (s *fileStorage) Size() int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return int64(s.tail - s.front)
+}
+
+func (s *fileStorage) ReadRange(from, to uint64, maxItems, maxBytes int, items []*forwardLogItem) ([]*forwardLogItem, uint64, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// Записи до front удалены, а после tail ещё не записаны.
+	if from < s.front {
+		from = s.front
+	}
+	if to > s.tail {
+		to = s.tail
+	}
+
+	next := from
+	bytesRead := 0
+	for ; next < to && len(items) < maxItems; next++ {
+		item := forwardLogItems.Get()
+		if err := s.load(next, item); err != nil {
+			forwardLogItems.Put(item)
+			return items, next, err
+		}
+
+		bytesRead += len(item.Metadata) + len(item.Data)
+		if len(items) != 0 && bytesRead > maxBytes {
+			forwardLogItems.Put(item)
+			break
+		}
+		items = append(items, item)
+	}
+	return items, next, nil
+}
+
+func (s *fileStorage) LoadFirst(item *forwardLogItem) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.tail == s.front {
+		return errBufferEmpty
+	}
+	return s.load(s.front, item)
+}
+
+func (s *fileStorage) LoadLast(item *forwardLogItem) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.tail == s.front {
+		return errBufferEmpty
+	}
+	return s.load(s.tail-1, item)
+}
+
+// load читает запись с ключом key, который должен находиться в [front, tail).
+func (s *fileStorage) load(key uint64, item *forwardLogItem) error {
+	i := sort.Search(len(s.segments), func(i int) bool { return s.segments[i].start > key }) - 1
+	segment := s.segments[i]
+
+	index := key - segment.start
+	offset := segment.offsets[index]
+	end := segment.size
+	if index+1 < uint64(len(segment.offsets)) {
+		end = segment.offsets[index+1]
+	}
+
+	data := make([]byte, end-offset)
+	if _, err := segment.file.ReadAt(data, offset); err != nil {
+		return fmt.Errorf("can not read item %d: %w", key, err)
+	}
+	payload := data[fileRecordHeaderSize:]
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(data[4:]) {
+		return fmt.Errorf("item %d checksum mismatch: %w", key, ErrCorruptedSegment)
+	}
+	if err := item.readIn(bytes.NewReader(payload)); err != nil {
+		return fmt.Errorf("can not decode item: %w", err)
+	}
+	return nil
+}
+
+func (s *fileStorage) TrimFirst() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.tail == s.front {
+		return errBufferEmpty
+	}
+	s.front++
+	return s.removeTrimmedSegments()
+}
+
+// removeTrimmedSegments удаляет сегменты, все записи которых удалены. Последний сегмент
+// не удаляется, так как в него продолжается запись.
+func (s *fileStorage) removeTrimmedSegments() error {
+	for len(s.segments) > 1 && s.segments[0].end() <= s.front {
+		segment := s.segments[0]
+		segment.file.Close()
+		if err := os.Remove(s.segmentPath(segment.start)); err != nil {
+			return fmt.Errorf("can not remove segment %d: %w", segment.start, err)
+		}
+		s.segments = s.segments[1:]
+	}
+	return nil
+}
+
+func (s *fileStorage) GetMeta(name string) ([]byte, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.values[name], nil
+}
+
+// PutMeta сохраняет значение служебной записи name вместе с ключом первой записи.
+func (s *fileStorage) PutMeta(name string, value []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.values[name] = append([]byte{}, value...)
+	return s.saveMeta()
+}
+
+// saveMeta атомарно заменяет файл служебных данных.
+func (s *fileStorage) saveMeta() error {
+	data, err := json.Marshal(&fileMeta{Front: s.front, Values: s.values})
+	if err != nil {
+		return fmt.Errorf("can not encode meta: %w", err)
+	}
+
+	tmpPath := filepath.Join(s.dir, metaFileName+".tmp")
+	file, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("can not create meta: %w", err)
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return fmt.Errorf("can not write meta: %w", err)
+	}
+	if s.syncMode != SyncNone {
+		if err := file.Sync(); err != nil {
+			file.Close()
+			return fmt.Errorf("can not sync meta: %w", err)
+		}
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("can not close meta: %w", err)
+	}
+	if err := os.Rename(tmpPath, filepath.Join(s.dir, metaFileName)); err != nil {
+		return fmt.Errorf("can not replace meta: %w", err)
+	}
+	return nil
+}
+
+// Close сохраняет ключ первой записи и закрывает сегменты.
+func (s *fileStorage) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if len(s.segments) == 0 {
+		return nil
+	}
+	err := s.saveMeta()
+	if s.syncMode != SyncNone {
+		if syncErr := s.segments[len(s.segments)-1].file.Sync(); err == nil && syncErr != nil {
+			err = fmt.Errorf("can not sync segment: %w", syncErr)
+		}
+	}
+	s.closeSegments()
+	return err
+}
+
+func (s *fileStorage) closeSegments() {
+	for _, segment := range s.segments {
+		segment.file.Close()
+	}
+	s.segments = nil
+}
@@ -0,0 +1,179 @@
+package upstreambackup
+
+import (
+	"sync"
+)
+
+// memoryStorageInitialSize начальная емкость кольцевого буфера memoryStorage.
+const memoryStorageInitialSize = 1024
+
+// memoryStorage хранилище записей forward log в памяти процесса.
+// Записи хранятся в кольцевом буфере, который увеличивается вдвое при заполнении,
+// поэтому размер хранилища ограничивают только ForwardLogLimits.
+type memoryStorage struct {
+	lock sync.Mutex
+
+	// items кольцевой буфер, запись с ключом front находится в items[head].
+	items []forwardLogItem
+	head  int
+	front uint64
+	tail  uint64
+
+	meta map[string][]byte
+
+	// appended закрывается и заменяется новым каналом после каждой записи.
+	appended chan struct{}
+}
+
+func newMemoryStorage() *memoryStorage {
+	return &memoryStorage{
+		items:    make([]forwardLogItem, memoryStorageInitialSize),
+		meta:     make(map[string][]byte),
+		appended: make(chan struct{}),
+	}
+}
+
+func (s *memoryStorage) Append(item *forwardLogItem) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	size := int(s.tail - s.front)
+	if size == len(s.items) {
+		s.grow()
+	}
+
+	// Данные копируются, так как item и его данные после записи могут быть переиспользованы.
+	payload := make([]byte, len(item.Metadata)+len(item.Data))
+	copy(payload, item.Metadata)
+	copy(payload[len(item.Metadata):], item.Data)
+
+	stored := &s.items[(s.head+size)%len(s.items)]
+	stored.Header = item.Header
+	stored.Metadata = nil
+	if len(item.Metadata) != 0 {
+		stored.Metadata = payload[:len(item.Metadata):len(item.Metadata)]
+	}
+	stored.Data = payload[len(item.Metadata):]
+	s.tail++
+
+	close(s.appended)
+	s.appended = make(chan struct{})
+	return nil
+}
+
+// grow увеличивает кольцевой буфер вдвое, перенося записи в начало нового буфера.
+func (s *memoryStorage) grow() {
+	items := make([]forwardLogItem, 2*len(s.items))
+	n := copy(items, s.items[s.head:])
+	copy(items[n:], s.items[:s.head])
+	s.items = items
+	s.head = 0
+}
+
+func (s *memoryStorage) Front() uint64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.front
+}
+
+func (s *memoryStorage) Tail() (uint64, <-chan struct{}) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.tail, s.appended
+}
+
+func (s *memoryStorage) Size() int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return int64(s.tail - s.front)
+}
+
+func (s *memoryStorage) ReadRange(from, to uint64, maxItems, maxBytes int, items []*forwardLogItem) ([]*forwardLogItem, uint64, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// Записи до front удалены, а после tail ещё не записаны.
+	if from < s.front {
+		from = s.front
+	}
+	if to > s.tail {
+		to = s.tail
+	}
+
+	next := from
+	bytesRead := 0
+	for ; next < to && len(items) < maxItems; next++ {
+		stored := s.at(next)
+		bytesRead += len(stored.Metadata) + len(stored.Data)
+		if len(items) != 0 && bytesRead > maxBytes {
+			break
+		}
+
+		item := forwardLogItems.Get()
+		*item = *stored
+		items = append(items, item)
+	}
+	return items, next, nil
+}
+
+func (s *memoryStorage) LoadFirst(item *forwardLogItem) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.tail == s.front {
+		return errBufferEmpty
+	}
+	*item = *s.at(s.front)
+	return nil
+}
+
+func (s *memoryStorage) LoadLast(item *forwardLogItem) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.tail == s.front {
+		return errBufferEmpty
+	}
+	*item = *s.at(s.tail - 1)
+	return nil
+}
+
+func (s *memoryStorage) TrimFirst() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.tail == s.front {
+		return errBufferEmpty
+	}
+	// Данные удаленной записи больше не нужны хранилищу.
+	s.items[s.head] = forwardLogItem{}
+	s.head = (s.head + 1) % len(s.items)
+	s.front++
+	return nil
+}
+
+func (s *memoryStorage) at(key uint64) *forwardLogItem {
+	return &s.items[(s.head+int(key-s.front))%len(s.items)]
+}
+
+func (s *memoryStorage) GetMeta(name string) ([]byte, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.meta[name], nil
+}
+
+func (s *memoryStorage) PutMeta(name string, value []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.meta[name] = append([]byte{}, value...)
+	return nil
+}
+
+func (s *memoryStorage) Close() error {
+	return nil
+}
@@ -0,0 +1,324 @@
+package upstreambackup
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testStorageBackend struct {
+	name    string
+	config  *StorageConfig
+	durable bool
+}
+
+// testStorageBackends хранилища, для которых выполняются общие тесты.
+// Сегменты StorageFile маленькие, чтобы записи занимали несколько сегментов.
+var testStorageBackends = []testStorageBackend{
+	{name: StorageLevelDB, config: &StorageConfig{Backend: StorageLevelDB}, durable: true},
+	{name: StorageMemory, config: &StorageConfig{Backend: StorageMemory}},
+	{name: StorageFile, config: &StorageConfig{Backend: StorageFile, SegmentSize: 128}, durable: true},
+	{name: StorageFile + "_always", config: &StorageConfig{Backend: StorageFile, Sync: SyncAlways}, durable: true},
+}
+
+func openTestStorage(t *testing.T, dir string, cfg *StorageConfig) logStorage {
+	s, err := openLogStorage(dir, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func newTestStorageItem(id uint64) *forwardLogItem {
+	item := &forwardLogItem{Data: []byte("data-" + strconv.FormatUint(id, 10))}
+	item.Header.InputID = uint16(id % 3)
+	item.Header.InputMessageID = id
+	item.Header.OutputMessageID = id
+	item.Header.MessageLength = uint32(len(item.Data))
+	if id%2 == 0 {
+		item.Metadata = []byte("meta")
+	}
+	return item
+}
+
+func appendTestItems(t *testing.T, s logStorage, from, to uint64) {
+	for id := from; id < to; id++ {
+		if err := s.Append(newTestStorageItem(id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func assertTestItem(t *testing.T, id uint64, item *forwardLogItem) {
+	expected := newTestStorageItem(id)
+	assert.Equal(t, expected.Header.OutputMessageID, item.Header.OutputMessageID)
+	assert.Equal(t, expected.Header.InputID, item.Header.InputID)
+	assert.Equal(t, expected.Metadata, item.Metadata)
+	assert.Equal(t, expected.Data, item.Data)
+}
+
+func readAllTestItems(t *testing.T, s logStorage) []*forwardLogItem {
+	tail, _ := s.Tail()
+	items, next, err := s.ReadRange(0, tail, math.MaxInt, math.MaxInt, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, tail, next)
+	return items
+}
+
+func TestStorageConformance(t *testing.T) {
+	for _, backend := range testStorageBackends {
+		backend := backend
+		t.Run(backend.name, func(t *testing.T) {
+			t.Run("Empty", func(t *testing.T) {
+				s := openTestStorage(t, t.TempDir(), backend.config)
+				defer s.Close()
+
+				tail, _ := s.Tail()
+				assert.EqualValues(t, 0, s.Size())
+				assert.Equal(t, tail, s.Front())
+				assert.ErrorIs(t, s.LoadFirst(&forwardLogItem{}), errBufferEmpty)
+				assert.ErrorIs(t, s.LoadLast(&forwardLogItem{}), errBufferEmpty)
+				assert.ErrorIs(t, s.TrimFirst(), errBufferEmpty)
+			})
+
+			t.Run("AppendRead", func(t *testing.T) {
+				s := openTestStorage(t, t.TempDir(), backend.config)
+				defer s.Close()
+
+				appendTestItems(t, s, 0, 10)
+				assert.EqualValues(t, 10, s.Size())
+
+				items := readAllTestItems(t, s)
+				assert.Len(t, items, 10)
+				for i, item := range items {
+					assertTestItem(t, uint64(i), item)
+				}
+			})
+
+			t.Run("ReadRangeLimits", func(t *testing.T) {
+				s := openTestStorage(t, t.TempDir(), backend.config)
+				defer s.Close()
+
+				appendTestItems(t, s, 0, 10)
+				front := s.Front()
+				tail, _ := s.Tail()
+
+				items, next, err := s.ReadRange(front, tail, 3, math.MaxInt, nil)
+				assert.NoError(t, err)
+				assert.Len(t, items, 3)
+				assert.Equal(t, front+3, next)
+
+				// Первая запись загружается, даже если она длиннее maxBytes.
+				items, next, err = s.ReadRange(next, tail, 10, 1, nil)
+				assert.NoError(t, err)
+				assert.Len(t, items, 1)
+				assertTestItem(t, 3, items[0])
+				assert.Equal(t, front+4, next)
+			})
+
+			t.Run("Trim", func(t *testing.T) {
+				s := openTestStorage(t, t.TempDir(), backend.config)
+				defer s.Close()
+
+				appendTestItems(t, s, 0, 10)
+				front := s.Front()
+				for i := 0; i < 4; i++ {
+					assert.NoError(t, s.TrimFirst())
+				}
+				assert.Equal(t, front+4, s.Front())
+				assert.EqualValues(t, 6, s.Size())
+
+				item := &forwardLogItem{}
+				assert.NoError(t, s.LoadFirst(item))
+				assertTestItem(t, 4, item)
+				assert.NoError(t, s.LoadLast(item))
+				assertTestItem(t, 9, item)
+
+				// Удаленные записи не читаются.
+				items := readAllTestItems(t, s)
+				assert.Len(t, items, 6)
+				assertTestItem(t, 4, items[0])
+			})
+
+			t.Run("TailNotify", func(t *testing.T) {
+				s := openTestStorage(t, t.TempDir(), backend.config)
+				defer s.Close()
+
+				tail, appended := s.Tail()
+				select {
+				case <-appended:
+					t.Fatal("notified before append")
+				default:
+				}
+				appendTestItems(t, s, 0, 1)
+				<-appended
+
+				newTail, _ := s.Tail()
+				assert.Equal(t, tail+1, newTail)
+			})
+
+			t.Run("CopiesItems", func(t *testing.T) {
+				s := openTestStorage(t, t.TempDir(), backend.config)
+				defer s.Close()
+
+				// После записи данные принадлежат вызывающему и могут быть изменены.
+				item := newTestStorageItem(0)
+				assert.NoError(t, s.Append(item))
+				item.Data[0] = 'x'
+				item.Metadata[0] = 'x'
+
+				loaded := &forwardLogItem{}
+				assert.NoError(t, s.LoadFirst(loaded))
+				assertTestItem(t, 0, loaded)
+			})
+
+			t.Run("Meta", func(t *testing.T) {
+				s := openTestStorage(t, t.TempDir(), backend.config)
+				defer s.Close()
+
+				value, err := s.GetMeta("sequence")
+				assert.NoError(t, err)
+				assert.Nil(t, value)
+
+				assert.NoError(t, s.PutMeta("sequence", []byte{1, 2}))
+				value, err = s.GetMeta("sequence")
+				assert.NoError(t, err)
+				assert.Equal(t, []byte{1, 2}, value)
+
+				// Служебные записи не читаются как записи лога.
+				assert.EqualValues(t, 0, s.Size())
+			})
+
+			if !backend.durable {
+				return
+			}
+			t.Run("Reopen", func(t *testing.T) {
+				dir := t.TempDir()
+				s := openTestStorage(t, dir, backend.config)
+				appendTestItems(t, s, 0, 10)
+				for i := 0; i < 3; i++ {
+					assert.NoError(t, s.TrimFirst())
+				}
+				assert.NoError(t, s.PutMeta("sequence", []byte{3}))
+				assert.NoError(t, s.Close())
+
+				s = openTestStorage(t, dir, backend.config)
+				defer s.Close()
+				assert.EqualValues(t, 7, s.Size())
+				items := readAllTestItems(t, s)
+				assert.Len(t, items, 7)
+				assertTestItem(t, 3, items[0])
+
+				value, err := s.GetMeta("sequence")
+				assert.NoError(t, err)
+				assert.Equal(t, []byte{3}, value)
+
+				// Запись продолжается после оставшихся записей.
+				appendTestItems(t, s, 10, 12)
+				item := &forwardLogItem{}
+				assert.NoError(t, s.LoadLast(item))
+				assertTestItem(t, 11, item)
+			})
+		})
+	}
+}
+
+func TestForwardLogStorages(t *testing.T) {
+	for _, backend := range testStorageBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			l, err := NewForwardLog(t.TempDir(), backend.config, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+
+			writeTestLog(t, l, 1, 6, []byte("data"))
+			inputMax, err := l.Trim(3)
+			assert.NoError(t, err)
+			assert.Equal(t, map[uint16]uint64{0: 3}, inputMax)
+			assert.Equal(t, ForwardLogStats{Items: 2, Bytes: 8}, l.Stats())
+		})
+	}
+}
+
+func TestOpenLogStorageUnknown(t *testing.T) {
+	_, err := openLogStorage(t.TempDir(), &StorageConfig{Backend: "rocksdb"})
+	assert.ErrorIs(t, err, ErrUnknownStorage)
+
+	_, err = openLogStorage(t.TempDir(), &StorageConfig{Backend: StorageFile, Sync: "sometimes"})
+	assert.ErrorIs(t, err, ErrUnknownSyncMode)
+}
+
+func segmentFiles(t *testing.T, dir string) []string {
+	files, err := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestFileStorageSegments(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestStorage(t, dir, &StorageConfig{Backend: StorageFile, SegmentSize: 64})
+	defer s.Close()
+
+	appendTestItems(t, s, 0, 10)
+	segments := len(segmentFiles(t, dir))
+	assert.Greater(t, segments, 2)
+
+	// Сегменты удаляются, когда удалены все их записи, кроме последнего.
+	for s.Size() != 0 {
+		assert.NoError(t, s.TrimFirst())
+	}
+	assert.Len(t, segmentFiles(t, dir), 1)
+}
+
+func TestFileStorageTornTail(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &StorageConfig{Backend: StorageFile}
+	s := openTestStorage(t, dir, cfg)
+	appendTestItems(t, s, 0, 5)
+	assert.NoError(t, s.Close())
+
+	// Запись, которая не была дописана до отказа.
+	files := segmentFiles(t, dir)
+	file, err := os.OpenFile(files[len(files)-1], os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write([]byte{0, 0, 0, 100, 1, 2, 3, 4, 5})
+	file.Close()
+
+	s = openTestStorage(t, dir, cfg)
+	defer s.Close()
+	assert.EqualValues(t, 5, s.Size())
+
+	appendTestItems(t, s, 5, 6)
+	items := readAllTestItems(t, s)
+	assert.Len(t, items, 6)
+	assertTestItem(t, 5, items[5])
+}
+
+func TestFileStorageCorruptedSegment(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &StorageConfig{Backend: StorageFile, SegmentSize: 64}
+	s := openTestStorage(t, dir, cfg)
+	appendTestItems(t, s, 0, 10)
+	assert.NoError(t, s.Close())
+
+	// Поврежденная запись не в последнем сегменте не может быть отброшена.
+	files := segmentFiles(t, dir)
+	file, err := os.OpenFile(files[0], os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteAt([]byte("corrupted"), fileRecordHeaderSize)
+	file.Close()
+
+	_, err = openLogStorage(dir, cfg)
+	assert.ErrorIs(t, err, ErrCorruptedSegment)
+}
@@ -0,0 +1,88 @@
+package upstreambackup
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+)
+
+// Возможные ошибки аутентификации.
+var (
+	ErrBadCA                = errors.New("can not parse CA certificates")
+	ErrNoPeerCertificate    = errors.New("peer certificate is not presented")
+	ErrUpstreamNameMismatch = errors.New("upstream name does not match peer certificate")
+)
+
+// LoadTLSConfig загружает сертификат runtime и сертификаты доверенных центров сертификации.
+// Полученная конфигурация используется как получателем, так и отправителем: обе стороны
+// предъявляют сертификат и проверяют, что сертификат другой стороны подписан доверенным центром.
+func LoadTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("can not load certificate: %w", err)
+	}
+
+	caPEM, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("can not read CA file: %w", err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("%s: %w", caFile, ErrBadCA)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    roots,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+		// Нижестоящие узлы адресуются по ip, который не указан в их сертификатах,
+		// поэтому отправитель проверяет только цепочку сертификатов получателя.
+		InsecureSkipVerify: true,
+		VerifyConnection: func(state tls.ConnectionState) error {
+			if len(state.VerifiedChains) != 0 {
+				return nil
+			}
+			return verifyPeerChain(state, roots)
+		},
+	}, nil
+}
+
+func verifyPeerChain(state tls.ConnectionState, roots *x509.CertPool) error {
+	if len(state.PeerCertificates) == 0 {
+		return ErrNoPeerCertificate
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range state.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := state.PeerCertificates[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	return err
+}
+
+// handshake выполняет TLS рукопожатие, если соединение защищено, и возвращает
+// имя из сертификата другой стороны. Для незащищенного соединения возвращается пустое имя.
+func handshake(ctx context.Context, conn net.Conn) (string, error) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return "", nil
+	}
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return "", fmt.Errorf("tls handshake failed: %w", err)
+	}
+
+	peerCertificates := tlsConn.ConnectionState().PeerCertificates
+	if len(peerCertificates) == 0 {
+		return "", ErrNoPeerCertificate
+	}
+	return peerCertificates[0].Subject.CommonName, nil
+}
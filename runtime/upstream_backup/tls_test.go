@@ -0,0 +1,174 @@
+package upstreambackup
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/GDVFox/gostreaming/util/connutil"
+	"github.com/stretchr/testify/assert"
+)
+
+type testCA struct {
+	dir  string
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	file string
+}
+
+func newTestCA(t *testing.T) *testCA {
+	ca := &testCA{dir: t.TempDir()}
+	ca.cert, ca.key = ca.issue(t, "ca", nil, nil)
+	ca.file = ca.write(t, "ca", ca.cert, ca.key)
+	return ca
+}
+
+// issue выпускает сертификат с именем name, подписанный parent, или самоподписанный, если parent nil.
+func (ca *testCA) issue(t *testing.T, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func (ca *testCA) write(t *testing.T, name string, cert *x509.Certificate, key *ecdsa.PrivateKey) string {
+	certFile := filepath.Join(ca.dir, name+".crt")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(ca.dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile
+}
+
+// tlsConfig возвращает конфигурацию runtime с сертификатом для name, подписанным центром ca.
+func (ca *testCA) tlsConfig(t *testing.T, name string) *tls.Config {
+	cert, key := ca.issue(t, name, ca.cert, ca.key)
+	certFile := ca.write(t, name, cert, key)
+	cfg, err := LoadTLSConfig(certFile, filepath.Join(ca.dir, name+".key"), ca.file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+// sayTestHello выполняет рукопожатие и hello обмен со стороны вышестоящего узла name.
+func sayTestHello(ctx context.Context, conn net.Conn, name string) error {
+	if _, err := handshake(ctx, conn); err != nil {
+		return err
+	}
+	hello := &helloMessage{Name: []byte(name), NameLength: uint32(len(name))}
+	if err := hello.writeOut(conn); err != nil {
+		return err
+	}
+	reply := &helloReplyMessage{}
+	return reply.readIn(conn)
+}
+
+func testListenHello(t *testing.T, serverConfig, clientConfig *tls.Config, helloName string) (string, error) {
+	logger, err := newTestLogger()
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver := NewDefaultReceiver("", []string{"upstream", "other"}, serverConfig, nil, logger)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	go func() {
+		clientConn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			return
+		}
+		defer clientConn.Close()
+		sayTestHello(ctx, tls.Client(clientConn, clientConfig), helloName)
+	}()
+
+	serverConn, err := tls.NewListener(listener, serverConfig).Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverConn.Close()
+
+	name, _, err := receiver.listenHello(ctx, connutil.NewDefaultConnection(serverConn))
+	return name, err
+}
+
+func TestListenHelloTLS(t *testing.T) {
+	ca := newTestCA(t)
+	serverConfig := ca.tlsConfig(t, "downstream")
+
+	name, err := testListenHello(t, serverConfig, ca.tlsConfig(t, "upstream"), "upstream")
+	assert.NoError(t, err)
+	assert.Equal(t, "upstream", name)
+}
+
+func TestListenHelloTLSNameMismatch(t *testing.T) {
+	ca := newTestCA(t)
+	serverConfig := ca.tlsConfig(t, "downstream")
+
+	// Узел с сертификатом upstream не может представиться другим известным узлом.
+	_, err := testListenHello(t, serverConfig, ca.tlsConfig(t, "upstream"), "other")
+	assert.ErrorIs(t, err, ErrUpstreamNameMismatch)
+}
+
+func TestListenHelloTLSUntrustedCA(t *testing.T) {
+	ca := newTestCA(t)
+	serverConfig := ca.tlsConfig(t, "downstream")
+
+	_, err := testListenHello(t, serverConfig, newTestCA(t).tlsConfig(t, "upstream"), "upstream")
+	assert.Error(t, err)
+}
+
+func TestListenHelloTLSNoClientCertificate(t *testing.T) {
+	ca := newTestCA(t)
+	serverConfig := ca.tlsConfig(t, "downstream")
+
+	clientConfig := serverConfig.Clone()
+	clientConfig.Certificates = nil
+	_, err := testListenHello(t, serverConfig, clientConfig, "upstream")
+	assert.Error(t, err)
+}
@@ -2,9 +2,10 @@ package upstreambackup
 
 import (
 	"context"
-	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
+	"sync"
 
 	"github.com/GDVFox/ctxio"
 	"github.com/GDVFox/gostreaming/util"
@@ -22,6 +23,11 @@ var (
 type UpstreamMessage struct {
 	*dataMessage
 	InputID uint16
+	// Upstream имя узла, от которого получено сообщение.
+	Upstream string
+	// Detached выставляется для сообщения, не полученного ни от одного вышестоящего узла,
+	// его не нужно подтверждать, а выходы передаются как ForwardDetached.
+	Detached bool
 }
 
 // DummyUpstreamMessage пустое сообщение из upstream,
@@ -30,24 +36,47 @@ var DummyUpstreamMessage = &UpstreamMessage{
 	dataMessage: &dataMessage{},
 }
 
+// NewDetachedMessage возвращает сообщение с метаданными metadata и данными data,
+// не полученное ни от одного вышестоящего узла, например, повторно переданное
+// из очереди недоставленных сообщений.
+func NewDetachedMessage(metadata, data []byte) *UpstreamMessage {
+	msg := &UpstreamMessage{
+		dataMessage: &dataMessage{Metadata: metadata, Data: data},
+		Detached:    true,
+	}
+	msg.Header.MessageLength = uint32(len(data))
+	return msg
+}
+
 // UpstreamReceiver структура, для получения сообщений от узлов выше по потоку.
 type UpstreamReceiver struct {
 	upstreamIndex uint16
 	name          string
+	// protocol параметры протокола, выбранные при получении hello сообщения.
+	protocol linkProtocol
 
 	conn       *connutil.Connection
 	connWriter *ctxio.ContextWriter
+	// ackMutex упорядочивает запись подтверждений, которые передаются
+	// и при обрезке forward log, и при отбрасывании повторных сообщений.
+	ackMutex sync.Mutex
+	// delivery отбрасывает повторно полученные сообщения в режиме exactly-once, может быть nil.
+	delivery *DeliveryStore
 
 	output chan *UpstreamMessage
 	logger *util.Logger
 }
 
 // NewUpstreamReceiver создает новый UpstreamReceiver.
-func NewUpstreamReceiver(upstreamIndex uint16, name string, tcpConn *connutil.Connection, l *util.Logger) *UpstreamReceiver {
+// Если delivery не nil, то уже полученные сообщения не передаются дальше.
+func NewUpstreamReceiver(upstreamIndex uint16, name string, protocol linkProtocol, tcpConn *connutil.Connection,
+	delivery *DeliveryStore, l *util.Logger) *UpstreamReceiver {
 	return &UpstreamReceiver{
 		upstreamIndex: upstreamIndex,
 		name:          name,
+		protocol:      protocol,
 		conn:          tcpConn,
+		delivery:      delivery,
 		output:        make(chan *UpstreamMessage),
 		logger:        l.WithName("upstream_receiver " + name),
 	}
@@ -76,15 +105,29 @@ func (r *UpstreamReceiver) receivingLoop(ctx context.Context) error {
 	connReader := ctxio.NewContextReader(ctx, r.conn)
 	defer connReader.Close()
 
+	var reader io.Reader = connReader
+	if r.protocol.Compression != compressionNone {
+		reader = newFrameReader(connReader)
+	}
 	for {
 		msg := &UpstreamMessage{
 			dataMessage: &dataMessage{},
 			InputID:     r.upstreamIndex,
+			Upstream:    r.name,
 		}
 
-		if err := msg.dataMessage.readIn(connReader); err != nil {
+		if err := msg.dataMessage.readIn(reader, r.protocol); err != nil {
 			return fmt.Errorf("can not read message: %w", err)
 		}
+		if r.delivery != nil {
+			replayed, err := r.dropReplayed(msg.Header.MessageID)
+			if err != nil {
+				return err
+			}
+			if replayed {
+				continue
+			}
+		}
 
 		select {
 		case <-ctx.Done():
@@ -94,9 +137,31 @@ func (r *UpstreamReceiver) receivingLoop(ctx context.Context) error {
 	}
 }
 
+// dropReplayed проверяет, было ли сообщение msgID уже получено. Обработанное сообщение
+// сразу подтверждается, иначе вышестоящий узел, ограничивающий число неподтвержденных
+// сообщений, может остановиться на повторно отправленных. Сообщение, которое ещё
+// обрабатывается, будет подтверждено вместе со следующими.
+func (r *UpstreamReceiver) dropReplayed(msgID uint64) (bool, error) {
+	replayed, delivered := r.delivery.Replayed(r.name, msgID)
+	if !replayed {
+		return false, nil
+	}
+	r.logger.Debugf("drop replayed message %d (delivered: %t)", msgID, delivered)
+	if delivered {
+		if err := r.Ack(msgID); err != nil {
+			return true, err
+		}
+	}
+	return true, nil
+}
+
 // Ack передает ACK сообщение вверх по потку.
-func (r *UpstreamReceiver) Ack(ack uint32) error {
-	if err := binary.Write(r.connWriter, binary.BigEndian, ack); err != nil {
+func (r *UpstreamReceiver) Ack(ack uint64) error {
+	r.ackMutex.Lock()
+	defer r.ackMutex.Unlock()
+
+	msg := ackMessage(ack)
+	if err := msg.writeOut(r.connWriter, r.protocol); err != nil {
 		return fmt.Errorf("can not send ack %d: %w", ack, err)
 	}
 	return nil
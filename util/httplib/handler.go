@@ -30,7 +30,7 @@ type WSHandler func(w http.ResponseWriter, r *http.Request) error
 func CreateHandler(h Handler, l *util.Logger) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		token := uuid.New()
-		logger := &util.Logger{SugaredLogger: l.With(zap.String("request_id", token.String()))}
+		logger := l.WithFields(zap.String("request_id", token.String()))
 		logger.Debugf("got request %s, %s", r.Method, r.URL)
 
 		ctx := context.WithValue(r.Context(), RequestLogger, logger)
@@ -53,7 +53,7 @@ func CreateHandler(h Handler, l *util.Logger) http.HandlerFunc {
 func CreateWSHandler(h WSHandler, l *util.Logger) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		token := uuid.New()
-		logger := &util.Logger{SugaredLogger: l.With(zap.String("request_id", token.String()))}
+		logger := l.WithFields(zap.String("request_id", token.String()))
 		logger.Debugf("got request %s, %s", r.Method, r.URL)
 
 		ctx := context.WithValue(r.Context(), RequestLogger, logger)
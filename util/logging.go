@@ -27,6 +27,8 @@ func NewLoggingConfig() *LoggingConfig {
 // Logger структура, предназначенная для записи логов.
 type Logger struct {
 	*zap.SugaredLogger
+	// level общий для логгера и всех производных от него логгеров.
+	level zap.AtomicLevel
 }
 
 // NewLogger создает новый логгер
@@ -59,6 +61,7 @@ func NewLogger(cfg *LoggingConfig) (*Logger, error) {
 	core := zapcore.NewCore(zapcore.NewConsoleEncoder(encoderConfig), ws, lvl)
 	return &Logger{
 		SugaredLogger: zap.New(core).Sugar(),
+		level:         lvl,
 	}, nil
 }
 
@@ -66,5 +69,49 @@ func NewLogger(cfg *LoggingConfig) (*Logger, error) {
 func (l *Logger) WithName(name string) *Logger {
 	return &Logger{
 		SugaredLogger: l.SugaredLogger.Named(name),
+		level:         l.level,
 	}
 }
+
+// WithFields добавляет поля к каждой записи.
+func (l *Logger) WithFields(fields ...interface{}) *Logger {
+	return &Logger{
+		SugaredLogger: l.SugaredLogger.With(fields...),
+		level:         l.level,
+	}
+}
+
+// ErrLevelNotChangeable возвращается при изменении уровня логгера, созданного не через NewLogger.
+var ErrLevelNotChangeable = errors.New("logging level of the logger can not be changed")
+
+// SetLevel изменяет уровень логирования логгера и всех производных от него логгеров.
+func (l *Logger) SetLevel(level string) error {
+	if !l.hasLevel() {
+		return ErrLevelNotChangeable
+	}
+	if err := l.level.UnmarshalText([]byte(level)); err != nil {
+		return errors.Wrap(err, "can not set logging level")
+	}
+	return nil
+}
+
+// Level возвращает текущий уровень логирования.
+// Для логгера, созданного не через NewLogger, уровень определяется по его core.
+func (l *Logger) Level() string {
+	if l.hasLevel() {
+		return l.level.String()
+	}
+	core := l.SugaredLogger.Desugar().Core()
+	for level := zapcore.DebugLevel; level < zapcore.FatalLevel; level++ {
+		if core.Enabled(level) {
+			return level.String()
+		}
+	}
+	return zapcore.FatalLevel.String()
+}
+
+// hasLevel возвращает true, если уровень логгера можно изменить: у AtomicLevel
+// нулевого значения нет общего уровня и его методы завершаются паникой.
+func (l *Logger) hasLevel() bool {
+	return l.level != zap.AtomicLevel{}
+}
@@ -0,0 +1,34 @@
+package util
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestLoggerSetLevel(t *testing.T) {
+	l, err := NewLogger(&LoggingConfig{Logfile: "stdout", Level: "info"})
+	assert.NoError(t, err)
+	named := l.WithName("child").WithFields("key", "value")
+
+	// Уровень общий для логгера и производных от него логгеров.
+	assert.NoError(t, named.SetLevel("debug"))
+	assert.Equal(t, "debug", l.Level())
+	assert.True(t, l.Desugar().Core().Enabled(zapcore.DebugLevel))
+
+	assert.Error(t, l.SetLevel("verbose"))
+	assert.Equal(t, "debug", named.Level())
+}
+
+func TestLoggerSetLevelWithoutLevel(t *testing.T) {
+	core, _ := observer.New(zapcore.WarnLevel)
+	l := &Logger{SugaredLogger: zap.New(core).Sugar()}
+
+	// Логгер, созданный не через NewLogger, не может изменить уровень, но не завершается паникой.
+	assert.ErrorIs(t, l.SetLevel("debug"), ErrLevelNotChangeable)
+	assert.ErrorIs(t, l.WithName("child").SetLevel("debug"), ErrLevelNotChangeable)
+	assert.Equal(t, "warn", l.Level())
+}
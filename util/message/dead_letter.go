@@ -0,0 +1,35 @@
+package message
+
+import "time"
+
+// DeadLetter входное сообщение, которое действие не смогло обработать.
+// Runtime сохраняет его в файл, machine_node переносит в очередь недоставленных сообщений схемы.
+type DeadLetter struct {
+	ID         string `json:"id"`
+	SchemeName string `json:"scheme_name"`
+	ActionName string `json:"action_name"`
+	// Upstream и MessageID отправитель и номер сообщения, пустые для повторно переданных сообщений.
+	Upstream  string `json:"upstream,omitempty"`
+	MessageID uint64 `json:"message_id,omitempty"`
+	// Reason причина, с которой действие отклонило сообщение.
+	Reason string `json:"reason"`
+	// Crashes число отказов действия на сообщении, 0 если действие отклонило его само.
+	Crashes   int       `json:"crashes,omitempty"`
+	Metadata  []byte    `json:"metadata,omitempty"`
+	Data      []byte    `json:"data"`
+	CreatedAt time.Time `json:"created_at"`
+	// DataParts число частей, которыми данные сообщения хранятся в etcd отдельно от него.
+	DataParts int `json:"data_parts,omitempty"`
+	// Size исходная длина данных сообщения. Truncated выставляется, если в etcd сохранена
+	// только часть данных, такое сообщение нельзя передать повторно.
+	Size      int  `json:"size,omitempty"`
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// ReplayRequest запрос к machine_node для повторной передачи сообщения действию.
+type ReplayRequest struct {
+	SchemeName string `json:"scheme_name"`
+	ActionName string `json:"action_name"`
+	Metadata   []byte `json:"metadata,omitempty"`
+	Data       []byte `json:"data"`
+}
@@ -1,5 +1,7 @@
 package message
 
+import "github.com/GDVFox/gostreaming/util"
+
 // RunActionRequest запрос к machine_node для запуска действия.
 type RunActionRequest struct {
 	SchemeName    string            `json:"scheme_name"`
@@ -11,6 +13,42 @@ type RunActionRequest struct {
 	Args          []string          `json:"args"`
 	Env           map[string]string `json:"env"`
 	ConnWhitelist []string          `json:"conn_whitelist"`
+	Codec         string            `json:"codec"`
+	Metadata      bool              `json:"metadata"`
+	State         bool              `json:"state"`
+	Replicas      int               `json:"replicas"`
+
+	MaxPendingMessages int `json:"max_pending_messages"`
+	MaxPendingBytes    int `json:"max_pending_bytes"`
+	// Максимальное число входных сообщений в одном пакете, 0 отключает пакеты.
+	BatchSize int `json:"batch_size"`
+
+	Compression        string `json:"compression"`
+	CompressionLevel   int    `json:"compression_level"`
+	CompressionMinSize int    `json:"compression_min_size"`
+
+	ForwardLogMaxItems int    `json:"forward_log_max_items"`
+	ForwardLogMaxBytes int    `json:"forward_log_max_bytes"`
+	ForwardLogOverflow string `json:"forward_log_overflow"`
+	ForwardLogStorage  string `json:"forward_log_storage"`
+	ForwardLogSync     string `json:"forward_log_sync"`
+	// Режим exactly-once задается для всей схемы.
+	ExactlyOnce bool `json:"exactly_once"`
+	// Режимы передачи сообщений в порядке Out.
+	Routing []string `json:"routing"`
+	// Число отказов действия на одном сообщении до передачи его в очередь недоставленных сообщений.
+	MaxCrashes int `json:"max_crashes"`
+	// Число перезапусков отказавшего действия подряд и задержки между ними.
+	MaxRestarts       int           `json:"max_restarts"`
+	RestartBackoff    util.Duration `json:"restart_backoff"`
+	RestartMaxBackoff util.Duration `json:"restart_max_backoff"`
+
+	ReadyTimeout  util.Duration `json:"ready_timeout"`
+	ProbeInterval util.Duration `json:"probe_interval"`
+	ProbeTimeout  util.Duration `json:"probe_timeout"`
+
+	TickInterval    util.Duration `json:"tick_interval"`
+	ShutdownTimeout util.Duration `json:"shutdown_timeout"`
 }
 
 // StopActionRequest запрос к machine_node для остановки действия.
@@ -27,6 +65,27 @@ type ChangeOutRequest struct {
 	NewOut     string `json:"new_out"`
 }
 
+// RuntimeRequest запрос к machine_node для команды runtime без параметров: stats, pause или resume.
+type RuntimeRequest struct {
+	SchemeName string `json:"scheme_name"`
+	ActionName string `json:"action_name"`
+}
+
+// DrainRequest запрос на завершение runtime после обработки и доставки полученных сообщений.
+// Timeout время ожидания завершения, 0 означает значение по умолчанию machine_node.
+type DrainRequest struct {
+	SchemeName string        `json:"scheme_name"`
+	ActionName string        `json:"action_name"`
+	Timeout    util.Duration `json:"timeout"`
+}
+
+// LogLevelRequest запрос на изменение уровня логирования runtime.
+type LogLevelRequest struct {
+	SchemeName string `json:"scheme_name"`
+	ActionName string `json:"action_name"`
+	Level      string `json:"level"`
+}
+
 // RuntimeStatus состояние runtime
 type RuntimeStatus uint8
 
@@ -35,12 +94,98 @@ const (
 	RuntimeStatusOK RuntimeStatus = 0
 	// RuntimeStatusPending runtime пока считается рабочим, но не ответил на несколько последних ping.
 	RuntimeStatusPending RuntimeStatus = 1
+	// RuntimeStatusStarting действие запущено, но ещё не подтвердило готовность.
+	RuntimeStatusStarting RuntimeStatus = 2
+	// RuntimeStatusUnresponsive действие не отвечает на проверки работоспособности runtime.
+	RuntimeStatusUnresponsive RuntimeStatus = 3
 )
 
+// String возвращает название состояния.
+func (s RuntimeStatus) String() string {
+	switch s {
+	case RuntimeStatusOK:
+		return "ok"
+	case RuntimeStatusPending:
+		return "pending"
+	case RuntimeStatusStarting:
+		return "starting"
+	case RuntimeStatusUnresponsive:
+		return "unresponsive"
+	default:
+		return "unknown"
+	}
+}
+
 // RuntimeTelemetry набор информации о рантайме.
 type RuntimeTelemetry struct {
-	SchemeName   string        `json:"scheme_name"`
-	ActionName   string        `json:"action_name"`
-	Status       RuntimeStatus `json:"status"`
-	OldestOutput uint32        `json:"oldest_output"`
+	SchemeName   string                   `json:"scheme_name"`
+	ActionName   string                   `json:"action_name"`
+	Status       RuntimeStatus            `json:"status"`
+	OldestOutput uint64                   `json:"oldest_output"`
+	ForwardLog   ForwardLogTelemetry      `json:"forward_log"`
+	Metrics      map[string]*ActionMetric `json:"metrics,omitempty"`
+	// Crashes число отказов действия, после которых runtime перезапустил его, LastExit причина последнего.
+	Crashes  uint64 `json:"crashes"`
+	LastExit string `json:"last_exit,omitempty"`
+}
+
+// RuntimeStats подробная статистика runtime, которую он возвращает на команду stats.
+type RuntimeStats struct {
+	SchemeName      string        `json:"scheme_name"`
+	ActionName      string        `json:"action_name"`
+	Status          RuntimeStatus `json:"status"`
+	ProtocolVersion uint16        `json:"protocol_version"`
+	// Paused получение входных сообщений приостановлено, Draining runtime выполняет drain.
+	Paused   bool   `json:"paused"`
+	Draining bool   `json:"draining"`
+	LogLevel string `json:"log_level"`
+	// Received число полученных входных сообщений, InFlight число сообщений, на которые действие не ответило.
+	Received     uint64                   `json:"received"`
+	InFlight     int64                    `json:"in_flight"`
+	OldestOutput uint64                   `json:"oldest_output"`
+	ForwardLog   ForwardLogTelemetry      `json:"forward_log"`
+	Crashes      uint64                   `json:"crashes"`
+	LastExit     string                   `json:"last_exit,omitempty"`
+	Processes    []*ProcessStats          `json:"processes"`
+	Metrics      map[string]*ActionMetric `json:"metrics,omitempty"`
+}
+
+// ProcessStats статистика одного процесса действия.
+type ProcessStats struct {
+	Index           int           `json:"index"`
+	Status          RuntimeStatus `json:"status"`
+	ProtocolVersion uint16        `json:"protocol_version"`
+	Batching        bool          `json:"batching"`
+	// Queued число сообщений, переданных процессу, на которые он ещё не начал отвечать.
+	Queued int `json:"queued"`
+}
+
+// ForwardLogTelemetry размер forward log рантайма и число срабатываний политики переполнения.
+type ForwardLogTelemetry struct {
+	Items uint64 `json:"items"`
+	Bytes uint64 `json:"bytes"`
+	// Blocked число выходных сообщений, которые ожидали освобождения места в логе.
+	Blocked uint64 `json:"blocked"`
+	// Dropped и DroppedBytes число и длина сообщений, удаленных из лога до доставки.
+	Dropped      uint64 `json:"dropped"`
+	DroppedBytes uint64 `json:"dropped_bytes"`
+}
+
+// Типы пользовательских метрик действия.
+const (
+	MetricTypeCounter   = "counter"
+	MetricTypeGauge     = "gauge"
+	MetricTypeHistogram = "histogram"
+)
+
+// ActionMetric агрегированное значение пользовательской метрики действия.
+// Для counter Value содержит сумму, для gauge последнее значение,
+// для histogram заполнены Count, Sum, Min и Max.
+type ActionMetric struct {
+	Type  string  `json:"type"`
+	Value float64 `json:"value,omitempty"`
+	Count uint64  `json:"count,omitempty"`
+	Sum   float64 `json:"sum,omitempty"`
+	Min   float64 `json:"min,omitempty"`
+	Max   float64 `json:"max,omitempty"`
 }
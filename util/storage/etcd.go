@@ -134,6 +134,16 @@ func (c *ETCDClient) Put(ctx context.Context, key string, value string) error {
 	return nil
 }
 
+// Set записывает данные по ключу key, заменяя существующее значение.
+func (c *ETCDClient) Set(ctx context.Context, key string, value string) error {
+	return util.Retry(ctx, c.cfg.Retry, func() error {
+		requestCtx, requestCancel := context.WithTimeout(ctx, time.Duration(c.cfg.Timeout))
+		_, err := c.kv.Put(requestCtx, key, value)
+		requestCancel() // запрос выполнен, нужно очистить таймер.
+		return err
+	})
+}
+
 // Delete удалает данные по ключу key.
 func (c *ETCDClient) Delete(ctx context.Context, key string) error {
 	var resp *clientv3.TxnResponse
@@ -160,3 +170,57 @@ func (c *ETCDClient) Delete(ctx context.Context, key string) error {
 	}
 	return nil
 }
+
+// LoadPrefix получает все пары ключ-значение с префиксом prefix.
+func (c *ETCDClient) LoadPrefix(ctx context.Context, prefix string) (map[string][]byte, error) {
+	var resp *clientv3.GetResponse
+	err := util.Retry(ctx, c.cfg.Retry, func() error {
+		var err error
+		requestCtx, requestCancel := context.WithTimeout(ctx, time.Duration(c.cfg.Timeout))
+		resp, err = c.kv.Get(requestCtx, prefix, clientv3.WithPrefix())
+		requestCancel() // запрос выполнен, нужно очистить таймер.
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(map[string][]byte, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		values[string(kv.Key)] = kv.Value
+	}
+	return values, nil
+}
+
+// Apply атомарно записывает значения values и удаляет ключи deleted.
+func (c *ETCDClient) Apply(ctx context.Context, values map[string]string, deleted []string) error {
+	ops := make([]clientv3.Op, 0, len(values)+len(deleted))
+	for key, value := range values {
+		ops = append(ops, clientv3.OpPut(key, value))
+	}
+	for _, key := range deleted {
+		ops = append(ops, clientv3.OpDelete(key))
+	}
+
+	return util.Retry(ctx, c.cfg.Retry, func() error {
+		requestCtx, requestCancel := context.WithTimeout(ctx, time.Duration(c.cfg.Timeout))
+		_, err := c.kv.Txn(requestCtx).Then(ops...).Commit()
+		requestCancel() // запрос выполнен, нужно очистить таймер.
+		return err
+	})
+}
+
+// Close закрывает соединение с etcd.
+func (c *ETCDClient) Close() error {
+	return c.cli.Close()
+}
+
+// DeletePrefix удаляет все данные с префиксом prefix.
+func (c *ETCDClient) DeletePrefix(ctx context.Context, prefix string) error {
+	return util.Retry(ctx, c.cfg.Retry, func() error {
+		requestCtx, requestCancel := context.WithTimeout(ctx, time.Duration(c.cfg.Timeout))
+		_, err := c.kv.Delete(requestCtx, prefix, clientv3.WithPrefix())
+		requestCancel() // запрос выполнен, нужно очистить таймер.
+		return err
+	})
+}